@@ -0,0 +1,405 @@
+// package loads the configuration of both services from a YAML or TOML file, environment variables and flags
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-nauka/grpcauth"
+	"go-nauka/jwtauth"
+	"go-nauka/retention/policy"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// names of the services, selecting their defaults and the settings that are validated
+const (
+	LocationService = "location-service"
+	HistoryService  = "location-history-service"
+)
+
+// Duration is a time.Duration written as "5s" or "24h" in files, variables and flags
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	value, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+// Config holds every setting of both services, each field names the variable and flag overriding it
+// fields tagged secret are redacted when the config is printed
+type Config struct {
+	HTTP     HTTP     `yaml:"http" toml:"http"`
+	GRPC     GRPC     `yaml:"grpc" toml:"grpc"`
+	Database Database `yaml:"database" toml:"database"`
+	JWT      JWT      `yaml:"jwt" toml:"jwt"`
+	Location Location `yaml:"location" toml:"location"`
+	History  History  `yaml:"history" toml:"history"`
+	Tracing  Tracing  `yaml:"tracing" toml:"tracing"`
+	Logging  Logging  `yaml:"logging" toml:"logging"`
+	Shutdown Shutdown `yaml:"shutdown" toml:"shutdown"`
+
+	// set by --print-config, main prints the config and exits
+	PrintOnly bool `yaml:"-" toml:"-"`
+}
+
+// HTTP configures the REST api
+type HTTP struct {
+	Addr string `yaml:"addr" toml:"addr" env:"HTTP_ADDR" flag:"http-addr" usage:"address the REST api listens on"`
+}
+
+// GRPC configures the channel between the services, Addr is where the history service listens and Target what location-service dials
+type GRPC struct {
+	Addr           string   `yaml:"addr" toml:"addr" env:"GRPC_ADDR" flag:"grpc-addr" usage:"address the gRPC server listens on"`
+	Target         string   `yaml:"target" toml:"target" env:"GRPC_TARGET" flag:"grpc-target" usage:"address of the location history gRPC server"`
+	Timeout        Duration `yaml:"timeout" toml:"timeout" env:"GRPC_TIMEOUT" flag:"grpc-timeout" usage:"timeout of a gRPC call"`
+	TLSCert        string   `yaml:"tls_cert" toml:"tls_cert" env:"GRPC_TLS_CERT" flag:"grpc-tls-cert" usage:"certificate file of this service"`
+	TLSKey         string   `yaml:"tls_key" toml:"tls_key" env:"GRPC_TLS_KEY" flag:"grpc-tls-key" usage:"private key file of this service"`
+	TLSCA          string   `yaml:"tls_ca" toml:"tls_ca" env:"GRPC_TLS_CA" flag:"grpc-tls-ca" usage:"CA file the other service is verified with"`
+	TLSServerName  string   `yaml:"tls_server_name" toml:"tls_server_name" env:"GRPC_TLS_SERVER_NAME" flag:"grpc-tls-server-name" usage:"name expected in the server certificate"`
+	Token          string   `yaml:"token" toml:"token" env:"GRPC_SERVICE_TOKEN" flag:"grpc-token" usage:"service token sent with every call" secret:"true"`
+	AllowedClients []string `yaml:"allowed_clients" toml:"allowed_clients" env:"GRPC_ALLOWED_CLIENTS" flag:"grpc-allowed-clients" usage:"comma separated client certificate names the server accepts"`
+	OutboxSize     int      `yaml:"outbox_size" toml:"outbox_size" env:"GRPC_OUTBOX_SIZE" flag:"grpc-outbox-size" usage:"location updates kept while the history service is unavailable"`
+}
+
+// Database configures the MySQL connection
+type Database struct {
+	User     string `yaml:"user" toml:"user" env:"DBUSER" flag:"db-user" usage:"MySQL user"`
+	Password string `yaml:"password" toml:"password" env:"DBPASS" flag:"db-password" usage:"MySQL password" secret:"true"`
+	Addr     string `yaml:"addr" toml:"addr" env:"DB_ADDR" flag:"db-addr" usage:"MySQL address"`
+	Name     string `yaml:"name" toml:"name" env:"DB_NAME" flag:"db-name" usage:"MySQL database"`
+}
+
+// JWT configures the bearer tokens accepted by the REST api
+type JWT struct {
+	HS256Secret string `yaml:"hs256_secret" toml:"hs256_secret" env:"JWT_HS256_SECRET" flag:"jwt-hs256-secret" usage:"secret of HS256 tokens" secret:"true"`
+	JWKSFile    string `yaml:"jwks_file" toml:"jwks_file" env:"JWT_JWKS_FILE" flag:"jwt-jwks-file" usage:"JWKS file with the keys of RS256 tokens"`
+	Issuer      string `yaml:"issuer" toml:"issuer" env:"JWT_ISSUER" flag:"jwt-issuer" usage:"required iss claim"`
+	Audience    string `yaml:"audience" toml:"audience" env:"JWT_AUDIENCE" flag:"jwt-audience" usage:"required aud claim"`
+}
+
+// Location holds the settings only location-service uses
+type Location struct {
+	IdempotencyTTL    Duration `yaml:"idempotency_ttl" toml:"idempotency_ttl" env:"IDEMPOTENCY_TTL" flag:"idempotency-ttl" usage:"how long idempotency keys are remembered"`
+	AuditSecret       string   `yaml:"audit_secret" toml:"audit_secret" env:"DELETION_AUDIT_SECRET" flag:"audit-secret" usage:"key of the username hashes in the deletion audit" secret:"true"`
+	PrecisionSecret   string   `yaml:"precision_secret" toml:"precision_secret" env:"PRECISION_SECRET" flag:"precision-secret" usage:"key of the per user offsets of reduced precision positions" secret:"true"`
+	WriteRate         float64  `yaml:"write_rate" toml:"write_rate" env:"RATE_LIMIT_WRITE_RATE" flag:"write-rate" usage:"location writes a second per caller"`
+	WriteBurst        int      `yaml:"write_burst" toml:"write_burst" env:"RATE_LIMIT_WRITE_BURST" flag:"write-burst" usage:"location writes at once per caller"`
+	SearchRate        float64  `yaml:"search_rate" toml:"search_rate" env:"RATE_LIMIT_SEARCH_RATE" flag:"search-rate" usage:"searches a second per caller"`
+	SearchBurst       int      `yaml:"search_burst" toml:"search_burst" env:"RATE_LIMIT_SEARCH_BURST" flag:"search-burst" usage:"searches at once per caller"`
+	MinUpdateInterval Duration `yaml:"min_update_interval" toml:"min_update_interval" env:"MIN_UPDATE_INTERVAL" flag:"min-update-interval" usage:"updates of a user sooner than this are coalesced"`
+}
+
+// History holds the settings only location-history-service uses
+type History struct {
+	RetentionPolicy      string   `yaml:"retention_policy" toml:"retention_policy" env:"RETENTION_POLICY" flag:"retention-policy" usage:"retention tiers such as 30d=5m,365d=delete"`
+	RetentionToleranceKm float64  `yaml:"retention_tolerance_km" toml:"retention_tolerance_km" env:"RETENTION_TOLERANCE_KM" flag:"retention-tolerance-km" usage:"distance a compacted segment may lose"`
+	RetentionInterval    Duration `yaml:"retention_interval" toml:"retention_interval" env:"RETENTION_INTERVAL" flag:"retention-interval" usage:"how often the retention job runs"`
+
+	// RetentionPolicy parsed by Validate with the tolerance applied
+	Policy policy.Policy `yaml:"-" toml:"-"`
+}
+
+// Tracing configures where the OpenTelemetry spans of a service are exported
+type Tracing struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter" env:"TRACING_EXPORTER" flag:"tracing-exporter" usage:"where spans are exported: none, stdout, file or otlp"`
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint" env:"TRACING_OTLP_ENDPOINT" flag:"tracing-otlp-endpoint" usage:"OTLP gRPC collector URL, http:// for plaintext"`
+	File        string  `yaml:"file" toml:"file" env:"TRACING_FILE" flag:"tracing-file" usage:"file the file exporter appends spans to"`
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio" env:"TRACING_SAMPLE_RATIO" flag:"tracing-sample-ratio" usage:"share of new traces that are recorded"`
+}
+
+// Logging configures the structured logs of a service
+type Logging struct {
+	Level        string   `yaml:"level" toml:"level" env:"LOG_LEVEL" flag:"log-level" usage:"lowest level logged: debug, info, warn or error"`
+	Format       string   `yaml:"format" toml:"format" env:"LOG_FORMAT" flag:"log-format" usage:"json or text lines"`
+	Packages     []string `yaml:"packages" toml:"packages" env:"LOG_PACKAGE_LEVELS" flag:"log-package-levels" usage:"comma separated package levels such as grpc=debug,handlers=warn"`
+	Redact       []string `yaml:"redact" toml:"redact" env:"LOG_REDACT" flag:"log-redact" usage:"comma separated values hidden in logs: usernames, coordinates"`
+	RedactSecret string   `yaml:"redact_secret" toml:"redact_secret" env:"LOG_REDACT_SECRET" flag:"log-redact-secret" usage:"key of the username hashes in redacted logs" secret:"true"`
+}
+
+// Shutdown configures how a service stops on SIGINT or SIGTERM
+type Shutdown struct {
+	Delay   Duration `yaml:"delay" toml:"delay" env:"SHUTDOWN_DELAY" flag:"shutdown-delay" usage:"how long readiness fails before the servers stop accepting requests"`
+	Timeout Duration `yaml:"timeout" toml:"timeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"how long in-flight requests and queued location updates are waited for"`
+}
+
+// returns the defaults of a service, they match the addresses the services always used
+func Defaults(service string) *Config {
+	config := &Config{
+		HTTP: HTTP{Addr: "localhost:8080"},
+		GRPC: GRPC{
+			Addr:           ":50051",
+			Target:         "localhost:50051",
+			Timeout:        Duration(5 * time.Second),
+			AllowedClients: []string{"location-service"},
+			OutboxSize:     10000,
+		},
+		Database: Database{Addr: "127.0.0.1:3306", Name: "users"},
+		Location: Location{
+			IdempotencyTTL: Duration(24 * time.Hour),
+			WriteRate:      1,
+			WriteBurst:     30,
+			SearchRate:     2,
+			SearchBurst:    20,
+		},
+		History:  History{RetentionToleranceKm: 0.05, RetentionInterval: Duration(time.Hour)},
+		Tracing:  Tracing{Exporter: "none", Endpoint: "http://localhost:4317", SampleRatio: 1},
+		Logging:  Logging{Level: "info", Format: "json", Redact: []string{"usernames", "coordinates"}},
+		Shutdown: Shutdown{Timeout: Duration(10 * time.Second)},
+	}
+	if service == HistoryService {
+		config.HTTP.Addr = "localhost:8081"
+	}
+	return config
+}
+
+// registers the flags of every setting plus --config and --print-config on fs, parses args and returns the config
+// settings are taken from the defaults, the file named by --config or CONFIG_FILE (.yaml, .yml or .toml),
+// the environment and the flags, each overriding the ones before, the result is validated for the service
+func Load(service string, fs *flag.FlagSet, args []string) (*Config, error) {
+	config := Defaults(service)
+
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
+	printOnly := fs.Bool("print-config", false, "print the resolved config with secrets redacted and exit")
+	flags := map[string]string{}
+	for _, setting := range settings(config) {
+		name := setting.field.Tag.Get("flag")
+		fs.Func(name, setting.field.Tag.Get("usage")+" ($"+setting.field.Tag.Get("env")+")", func(value string) error {
+			flags[name] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *file != "" {
+		if err := config.loadFile(*file); err != nil {
+			return nil, err
+		}
+	}
+	for _, setting := range settings(config) {
+		if value, ok := os.LookupEnv(setting.field.Tag.Get("env")); ok {
+			if err := setting.set(value); err != nil {
+				return nil, fmt.Errorf("config: %s: %v", setting.field.Tag.Get("env"), err)
+			}
+		}
+	}
+	for _, setting := range settings(config) {
+		name := setting.field.Tag.Get("flag")
+		if value, ok := flags[name]; ok {
+			if err := setting.set(value); err != nil {
+				return nil, fmt.Errorf("config: -%s: %v", name, err)
+			}
+		}
+	}
+
+	config.PrintOnly = *printOnly
+	if err := config.Validate(service); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// decodes a YAML or TOML file over the config, unknown keys are an error so typos don't go unnoticed
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && err != io.EOF {
+			return fmt.Errorf("config: %s: %v", path, err)
+		}
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(c); err != nil {
+			return fmt.Errorf("config: %s: %v", path, err)
+		}
+	default:
+		return fmt.Errorf("config: unsupported file type %q", path)
+	}
+	return nil
+}
+
+// checks the settings the service uses and returns every problem found
+func (c *Config) Validate(service string) error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("config: "+format, args...))
+		}
+	}
+	validAddr := func(addr string) bool {
+		_, port, err := net.SplitHostPort(addr)
+		return err == nil && port != ""
+	}
+
+	check(validAddr(c.HTTP.Addr), "invalid http addr %q", c.HTTP.Addr)
+	check(validAddr(c.Database.Addr), "invalid database addr %q", c.Database.Addr)
+	check(c.Database.Name != "", "missing database name")
+	check(c.GRPC.Timeout > 0, "grpc timeout must be positive")
+	tlsFiles := 0
+	for _, file := range []string{c.GRPC.TLSCert, c.GRPC.TLSKey, c.GRPC.TLSCA} {
+		if file != "" {
+			tlsFiles++
+		}
+	}
+	check(tlsFiles == 0 || tlsFiles == 3, "grpc tls_cert, tls_key and tls_ca must be set together")
+	check(slices.Contains([]string{"none", "stdout", "file", "otlp"}, c.Tracing.Exporter), "unknown tracing exporter %q", c.Tracing.Exporter)
+	check(c.Tracing.Exporter != "file" || c.Tracing.File != "", "missing tracing file")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing sample ratio must be between 0 and 1")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Logging.Level)) == nil, "unknown log level %q", c.Logging.Level)
+	check(slices.Contains([]string{"json", "text"}, c.Logging.Format), "unknown log format %q", c.Logging.Format)
+	for _, override := range c.Logging.Packages {
+		pkg, text, found := strings.Cut(override, "=")
+		check(found && pkg != "" && level.UnmarshalText([]byte(text)) == nil, "invalid package log level %q", override)
+	}
+	for _, value := range c.Logging.Redact {
+		check(slices.Contains([]string{"usernames", "coordinates"}, value), "unknown log redaction %q", value)
+	}
+	check(c.Shutdown.Delay >= 0, "shutdown delay can't be negative")
+	check(c.Shutdown.Timeout > 0, "shutdown timeout must be positive")
+
+	switch service {
+	case LocationService:
+		check(c.GRPC.Target != "", "missing grpc target")
+		check(c.GRPC.OutboxSize >= 0, "grpc outbox size can't be negative")
+		check(c.Location.IdempotencyTTL > 0, "idempotency ttl must be positive")
+		check(c.Location.AuditSecret != "", "missing audit secret")
+		check(c.Location.PrecisionSecret != "", "missing precision secret")
+		check(c.Location.WriteRate > 0 && c.Location.WriteBurst > 0, "write rate and burst must be positive")
+		check(c.Location.SearchRate > 0 && c.Location.SearchBurst > 0, "search rate and burst must be positive")
+		check(c.Location.MinUpdateInterval >= 0, "min update interval can't be negative")
+	case HistoryService:
+		check(validAddr(c.GRPC.Addr), "invalid grpc addr %q", c.GRPC.Addr)
+		check(len(c.GRPC.AllowedClients) > 0 || tlsFiles == 0, "grpc allowed_clients can't be empty with TLS")
+		check(c.History.RetentionToleranceKm >= 0, "retention tolerance can't be negative")
+		retention, err := policy.Parse(c.History.RetentionPolicy)
+		check(err == nil, "invalid retention policy: %v", err)
+		retention.ToleranceKm = c.History.RetentionToleranceKm
+		c.History.Policy = retention
+		check(!retention.Enabled() || c.History.RetentionInterval > 0, "retention interval must be positive")
+	default:
+		check(false, "unknown service %q", service)
+	}
+	return errors.Join(errs...)
+}
+
+// writes the config as YAML with the secrets that are set replaced by "<redacted>"
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	redacted.GRPC.AllowedClients = append([]string(nil), c.GRPC.AllowedClients...)
+	for _, setting := range settings(&redacted) {
+		if setting.field.Tag.Get("secret") == "true" && setting.value.String() != "" {
+			setting.value.SetString("<redacted>")
+		}
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&redacted); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	return encoder.Close()
+}
+
+// returns the options of the gRPC channel credentials
+func (g GRPC) Auth() grpcauth.Config {
+	return grpcauth.Config{
+		CertFile:       g.TLSCert,
+		KeyFile:        g.TLSKey,
+		CAFile:         g.TLSCA,
+		ServerName:     g.TLSServerName,
+		Token:          g.Token,
+		AllowedClients: g.AllowedClients,
+	}
+}
+
+// returns the options of the bearer token verifier
+func (j JWT) Verifier() jwtauth.Config {
+	return jwtauth.Config{HMACSecret: []byte(j.HS256Secret), JWKSFile: j.JWKSFile, Issuer: j.Issuer, Audience: j.Audience}
+}
+
+// a leaf field of the config with its tags
+type setting struct {
+	field reflect.StructField
+	value reflect.Value
+}
+
+// returns the settings of the config in declaration order
+func settings(config *Config) []setting {
+	var found []setting
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.Type.Kind() == reflect.Struct {
+				walk(v.Field(i))
+			} else if field.Tag.Get("env") != "" {
+				found = append(found, setting{field: field, value: v.Field(i)})
+			}
+		}
+	}
+	walk(reflect.ValueOf(config).Elem())
+	return found
+}
+
+// parses a value given as text into the setting
+func (s setting) set(text string) error {
+	switch target := s.value.Addr().Interface().(type) {
+	case *Duration:
+		return target.UnmarshalText([]byte(text))
+	case *string:
+		*target = text
+	case *[]string:
+		*target = nil
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*target = append(*target, item)
+			}
+		}
+	case *int:
+		value, err := strconv.Atoi(text)
+		if err != nil {
+			return err
+		}
+		*target = value
+	case *float64:
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return err
+		}
+		*target = value
+	default:
+		return fmt.Errorf("unsupported setting type %v", s.field.Type)
+	}
+	return nil
+}
@@ -1,4 +1,4 @@
-DROP TABLE IF EXISTS location,location_history;
+DROP TABLE IF EXISTS location,location_history,idempotency_keys,user_deletion_audit,location_daily_stats,proximity_rules,proximity_rule_members,proximity_events,location_shares,user_groups,group_members,api_key_usernames,api_keys;
 CREATE TABLE location (
     name VARCHAR(16) PRIMARY KEY,
     latitude DOUBLE NOT NULL,
@@ -11,6 +11,114 @@ CREATE TABLE location_history (
     username VARCHAR(16) NOT NULL,
     latitude DOUBLE NOT NULL,
     longitude DOUBLE NOT NULL,
-    recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    recorded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    fix_id VARCHAR(64) NULL,
+    UNIQUE KEY uniq_username_fix_id (username, fix_id),
+    INDEX idx_username_recorded_at (username, recorded_at),
+    INDEX idx_recorded_at (recorded_at)
 );
 
+CREATE TABLE idempotency_keys (
+    name VARCHAR(16) NOT NULL,
+    idempotency_key VARCHAR(64) NOT NULL,
+    status_code INT NOT NULL,
+    response TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (name, idempotency_key)
+);
+
+CREATE TABLE user_deletion_audit (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    subject_hash CHAR(64) NOT NULL,
+    location_rows INT NOT NULL,
+    history_rows INT NOT NULL,
+    deleted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE location_daily_stats (
+    username VARCHAR(16) NOT NULL,
+    day DATE NOT NULL,
+    distance_km DOUBLE NOT NULL DEFAULT 0,
+    moving_seconds BIGINT NOT NULL DEFAULT 0,
+    point_count BIGINT NOT NULL DEFAULT 0,
+    min_latitude DOUBLE NOT NULL,
+    max_latitude DOUBLE NOT NULL,
+    min_longitude DOUBLE NOT NULL,
+    max_longitude DOUBLE NOT NULL,
+    first_fix_at DATETIME NOT NULL,
+    last_fix_at DATETIME NOT NULL,
+    last_latitude DOUBLE NOT NULL,
+    last_longitude DOUBLE NOT NULL,
+    PRIMARY KEY (username, day)
+);
+
+CREATE TABLE proximity_rules (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(64) NOT NULL,
+    threshold_km DOUBLE NOT NULL,
+    exit_km DOUBLE NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE proximity_rule_members (
+    rule_id INT NOT NULL,
+    username VARCHAR(16) NOT NULL,
+    accepted BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (rule_id, username),
+    INDEX idx_username (username)
+);
+
+CREATE TABLE proximity_events (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    rule_id INT NOT NULL,
+    event_type VARCHAR(16) NOT NULL,
+    user_a VARCHAR(16) NOT NULL,
+    user_b VARCHAR(16) NOT NULL,
+    distance_km DOUBLE NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_user_a (user_a),
+    INDEX idx_user_b (user_b)
+);
+
+CREATE TABLE location_shares (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    owner VARCHAR(16) NOT NULL,
+    grantee_type ENUM('everyone', 'user', 'group') NOT NULL,
+    grantee VARCHAR(64) NOT NULL DEFAULT '',
+    precision_m INT NOT NULL DEFAULT 0,
+    expires_at DATETIME NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_owner (owner),
+    INDEX idx_grantee (grantee_type, grantee)
+);
+
+CREATE TABLE user_groups (
+    name VARCHAR(64) PRIMARY KEY,
+    owner VARCHAR(16) NOT NULL
+);
+
+CREATE TABLE group_members (
+    group_name VARCHAR(64) NOT NULL,
+    username VARCHAR(16) NOT NULL,
+    PRIMARY KEY (group_name, username),
+    INDEX idx_username (username)
+);
+
+CREATE TABLE api_keys (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    prefix VARCHAR(16) NOT NULL,
+    name VARCHAR(64) NOT NULL DEFAULT '',
+    owner VARCHAR(16) NOT NULL,
+    scopes VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME NULL,
+    revoked_at DATETIME NULL,
+    INDEX idx_owner (owner)
+);
+
+CREATE TABLE api_key_usernames (
+    key_id INT NOT NULL,
+    username VARCHAR(16) NOT NULL,
+    PRIMARY KEY (key_id, username)
+);
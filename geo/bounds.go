@@ -0,0 +1,127 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Bounds is a latitude/longitude rectangle
+// a rectangle crossing the antimeridian has SouthWest.Lng greater than NorthEast.Lng
+type Bounds struct {
+	SouthWest LatLng `json:"south_west"`
+	NorthEast LatLng `json:"north_east"`
+}
+
+// returns the bounds covering the whole globe
+func World() Bounds {
+	return Bounds{SouthWest: LatLng{Lat: -90, Lng: -180}, NorthEast: LatLng{Lat: 90, Lng: 180}}
+}
+
+// reports whether the bounds cross the antimeridian
+func (b Bounds) CrossesAntimeridian() bool {
+	return b.SouthWest.Lng > b.NorthEast.Lng
+}
+
+// reports whether a point lies inside the bounds
+func (b Bounds) Contains(p LatLng) bool {
+	if p.Lat < b.SouthWest.Lat || p.Lat > b.NorthEast.Lat {
+		return false
+	}
+	if b.CrossesAntimeridian() {
+		return p.Lng >= b.SouthWest.Lng || p.Lng <= b.NorthEast.Lng
+	}
+	return p.Lng >= b.SouthWest.Lng && p.Lng <= b.NorthEast.Lng
+}
+
+// returns the smallest bounds containing every point within radiusKm of center on a spherical earth
+// a circle reaching a pole covers all longitudes
+func BoundsAround(center LatLng, radiusKm float64) Bounds {
+	angular := radiusKm / EarthRadiusKm
+	if angular >= math.Pi {
+		return World()
+	}
+
+	minLat := center.Lat - RadiansToDegrees(angular)
+	maxLat := center.Lat + RadiansToDegrees(angular)
+	if minLat <= -90 || maxLat >= 90 {
+		return Bounds{
+			SouthWest: LatLng{Lat: math.Max(minLat, -90), Lng: -180},
+			NorthEast: LatLng{Lat: math.Min(maxLat, 90), Lng: 180},
+		}
+	}
+
+	ratio := math.Sin(angular) / math.Cos(DegreesToRadians(center.Lat))
+	if ratio >= 1 {
+		return Bounds{SouthWest: LatLng{Lat: minLat, Lng: -180}, NorthEast: LatLng{Lat: maxLat, Lng: 180}}
+	}
+
+	dLng := RadiansToDegrees(math.Asin(ratio))
+	return Bounds{
+		SouthWest: LatLng{Lat: minLat, Lng: NormalizeLongitude(center.Lng - dLng)},
+		NorthEast: LatLng{Lat: maxLat, Lng: wrapEast(center.Lng + dLng)},
+	}
+}
+
+// returns the bounds widened by km on every side, bounds reaching a pole or going around the globe cover all longitudes
+func (b Bounds) Expand(km float64) Bounds {
+	dLat := RadiansToDegrees(km / EarthRadiusKm)
+	south, north := b.SouthWest.Lat-dLat, b.NorthEast.Lat+dLat
+	if south <= -90 || north >= 90 {
+		return Bounds{SouthWest: LatLng{Lat: math.Max(south, -90), Lng: -180}, NorthEast: LatLng{Lat: math.Min(north, 90), Lng: 180}}
+	}
+
+	// a degree of longitude is shortest at the edge closest to a pole
+	dLng := dLat / math.Cos(DegreesToRadians(math.Max(math.Abs(south), math.Abs(north))))
+	width := b.NorthEast.Lng - b.SouthWest.Lng
+	if b.CrossesAntimeridian() {
+		width += 360
+	}
+	if width+2*dLng >= 360 {
+		return Bounds{SouthWest: LatLng{Lat: south, Lng: -180}, NorthEast: LatLng{Lat: north, Lng: 180}}
+	}
+	return Bounds{
+		SouthWest: LatLng{Lat: south, Lng: NormalizeLongitude(b.SouthWest.Lng - dLng)},
+		NorthEast: LatLng{Lat: north, Lng: wrapEast(b.NorthEast.Lng + dLng)},
+	}
+}
+
+// wraps an eastern longitude into (-180, 180] so a bound ending exactly at the antimeridian stays 180
+func wrapEast(lng float64) float64 {
+	lng = NormalizeLongitude(lng)
+	if lng == -180 {
+		return 180
+	}
+	return lng
+}
+
+// parses a bounding box given as "west,south,east,north" in degrees
+// a west edge greater than the east edge describes a box crossing the antimeridian
+func ParseBounds(s string) (Bounds, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return Bounds{}, fmt.Errorf("geo: bounding box %q must be west,south,east,north", s)
+	}
+
+	var values [4]float64
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return Bounds{}, fmt.Errorf("geo: invalid bounding box value %q", part)
+		}
+		values[i] = value
+	}
+
+	b := Bounds{SouthWest: LatLng{Lat: values[1], Lng: values[0]}, NorthEast: LatLng{Lat: values[3], Lng: values[2]}}
+	if err := Validate(b.SouthWest.Lat, b.SouthWest.Lng); err != nil {
+		return Bounds{}, err
+	}
+	if err := Validate(b.NorthEast.Lat, b.NorthEast.Lng); err != nil {
+		return Bounds{}, err
+	}
+	if b.SouthWest.Lat > b.NorthEast.Lat {
+		return Bounds{}, fmt.Errorf("geo: south edge %v is north of %v", b.SouthWest.Lat, b.NorthEast.Lat)
+	}
+	return b, nil
+}
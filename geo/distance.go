@@ -0,0 +1,63 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+)
+
+// DistanceFunc calculates the distance in kilometers between two points
+type DistanceFunc func(a, b LatLng) float64
+
+// names of the distance methods that can be selected per request
+const (
+	MethodHaversine = "haversine"
+	MethodGeodesic  = "geodesic"
+)
+
+// returns the distance func for a method name, an empty name selects haversine
+func DistanceFuncFor(method string) (DistanceFunc, error) {
+	switch method {
+	case "", MethodHaversine:
+		return Haversine, nil
+	case MethodGeodesic, "vincenty", "wgs84":
+		return Geodesic, nil
+	}
+	return nil, fmt.Errorf("unknown distance method %q", method)
+}
+
+// calculates the great-circle distance between two points on a spherical earth
+func Haversine(a, b LatLng) float64 {
+	dLat := DegreesToRadians(b.Lat - a.Lat)
+	dLng := DegreesToRadians(b.Lng - a.Lng)
+
+	lat1 := DegreesToRadians(a.Lat)
+	lat2 := DegreesToRadians(b.Lat)
+
+	h := math.Pow(math.Sin(dLat/2), 2) +
+		math.Pow(math.Sin(dLng/2), 2)*math.Cos(lat1)*math.Cos(lat2)
+
+	return EarthRadiusKm * 2 * math.Asin(math.Sqrt(h))
+}
+
+// calculates the initial bearing in degrees [0, 360) of the great circle from a to b
+func Bearing(a, b LatLng) float64 {
+	lat1, lat2 := DegreesToRadians(a.Lat), DegreesToRadians(b.Lat)
+	dLng := DegreesToRadians(b.Lng - a.Lng)
+
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+
+	return math.Mod(RadiansToDegrees(math.Atan2(y, x))+360, 360)
+}
+
+// returns the point reached travelling distanceKm from start along the great circle with the given initial bearing
+func Destination(start LatLng, bearing, distanceKm float64) LatLng {
+	lat1, lng1 := DegreesToRadians(start.Lat), DegreesToRadians(start.Lng)
+	theta := DegreesToRadians(bearing)
+	delta := distanceKm / EarthRadiusKm
+
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(delta) + math.Cos(lat1)*math.Sin(delta)*math.Cos(theta))
+	lng2 := lng1 + math.Atan2(math.Sin(theta)*math.Sin(delta)*math.Cos(lat1), math.Cos(delta)-math.Sin(lat1)*math.Sin(lat2))
+
+	return Normalize(LatLng{Lat: RadiansToDegrees(lat2), Lng: RadiansToDegrees(lng2)})
+}
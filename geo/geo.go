@@ -0,0 +1,68 @@
+// package provides geographic types and calculations shared by both services
+package geo
+
+import (
+	"fmt"
+	"math"
+)
+
+// mean earth radius used by the spherical formulas
+const EarthRadiusKm = 6371.0
+
+// LatLng is a point given by latitude and longitude in degrees
+type LatLng struct {
+	Lat float64 `json:"latitude"`
+	Lng float64 `json:"longitude"`
+}
+
+// converts degrees to radians(used for calculations using trigonometry)
+func DegreesToRadians(deg float64) float64 {
+	return deg * (math.Pi / 180)
+}
+
+// converts radians to degrees
+func RadiansToDegrees(rad float64) float64 {
+	return rad * (180 / math.Pi)
+}
+
+// checks that latitude is within [-90, 90] and longitude within [-180, 180]
+func Validate(lat, lng float64) error {
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return fmt.Errorf("geo: latitude %v out of range [-90, 90]", lat)
+	}
+	if math.IsNaN(lng) || lng < -180 || lng > 180 {
+		return fmt.Errorf("geo: longitude %v out of range [-180, 180]", lng)
+	}
+	return nil
+}
+
+// validates a point and returns it normalized
+func NewLatLng(lat, lng float64) (LatLng, error) {
+	if err := Validate(lat, lng); err != nil {
+		return LatLng{}, err
+	}
+	return Normalize(LatLng{Lat: lat, Lng: lng}), nil
+}
+
+// wraps the longitude into [-180, 180), clamps the latitude to [-90, 90] and turns -0 into 0
+func Normalize(p LatLng) LatLng {
+	p.Lat = math.Max(-90, math.Min(90, p.Lat))
+	p.Lng = NormalizeLongitude(p.Lng)
+	if p.Lat == 0 {
+		p.Lat = 0
+	}
+	return p
+}
+
+// wraps a longitude in degrees into [-180, 180)
+func NormalizeLongitude(lng float64) float64 {
+	lng = math.Mod(lng+180, 360)
+	if lng < 0 {
+		lng += 360
+	}
+	lng -= 180
+	if lng == 0 {
+		lng = 0
+	}
+	return lng
+}
@@ -0,0 +1,519 @@
+package geo
+
+import "math"
+
+// WGS-84 ellipsoid
+const (
+	wgs84A = 6378137.0
+	wgs84F = 1 / 298.257223563
+	wgs84B = wgs84A * (1 - wgs84F)
+
+	// third flattening and second eccentricity squared
+	wgs84N   = wgs84F / (2 - wgs84F)
+	wgs84EP2 = wgs84F * (2 - wgs84F) / ((1 - wgs84F) * (1 - wgs84F))
+)
+
+// calculates the distance between two points on the WGS-84 ellipsoid
+// uses Vincenty's inverse formula and falls back to Karney's series solution for near-antipodal points
+// where Vincenty does not converge
+func Geodesic(a, b LatLng) float64 {
+	if meters, ok := vincentyInverse(a.Lat, a.Lng, b.Lat, b.Lng); ok {
+		return meters / 1000
+	}
+	return karneyInverse(a.Lat, a.Lng, b.Lat, b.Lng) / 1000
+}
+
+// Vincenty's inverse formula, returns the distance in meters and false if the iteration does not converge
+func vincentyInverse(lat1, lon1, lat2, lon2 float64) (float64, bool) {
+	L := DegreesToRadians(lon2 - lon1)
+	U1 := math.Atan((1 - wgs84F) * math.Tan(DegreesToRadians(lat1)))
+	U2 := math.Atan((1 - wgs84F) * math.Tan(DegreesToRadians(lat2)))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	var sinSigma, cosSigma, sigma, cosSqAlpha, cos2SigmaM float64
+
+	converged := false
+	for i := 0; i < 200; i++ {
+		sinLambda, cosLambda := math.Sincos(lambda)
+		sinSigma = math.Hypot(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda)
+		if sinSigma == 0 {
+			return 0, true
+		}
+		cosSigma = sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma = math.Atan2(sinSigma, cosSigma)
+
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha = 1 - sinAlpha*sinAlpha
+		cos2SigmaM = 0
+		if cosSqAlpha != 0 {
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+
+		C := wgs84F / 16 * cosSqAlpha * (4 + wgs84F*(4-3*cosSqAlpha))
+		prev := lambda
+		lambda = L + (1-C)*wgs84F*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+
+		if math.Abs(lambda) > math.Pi {
+			return 0, false
+		}
+		if math.Abs(lambda-prev) < 1e-12 {
+			converged = true
+			break
+		}
+	}
+	if !converged {
+		return 0, false
+	}
+
+	uSq := cosSqAlpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+	A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+	deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+		B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+
+	return wgs84B * A * (sigma - deltaSigma), true
+}
+
+// order of the series in Karney's solution, good to a few nanometers on the WGS-84 ellipsoid
+const karneyOrder = 6
+
+// tolerances and iteration limits of Karney's solution, as in GeographicLib
+var (
+	karneyTiny   = math.Sqrt(math.SmallestNonzeroFloat64)
+	karneyTol0   = 0x1p-52
+	karneyTol1   = 200 * karneyTol0
+	karneyTol2   = math.Sqrt(karneyTol0)
+	karneyTolb   = karneyTol0 * karneyTol2
+	karneyXThres = 1000 * karneyTol2
+	karneyEtol2  = 0.1 * karneyTol2 / math.Sqrt(math.Max(0.001, wgs84F)*math.Min(1, 1-wgs84F/2)/2)
+)
+
+const (
+	karneyMaxit1 = 20
+	karneyMaxit2 = karneyMaxit1 + 53 + 10
+)
+
+// coefficients of A3 and C3 as polynomials in eps, precomputed for the third flattening of WGS-84
+var karneyA3x, karneyC3x = karneyA3Coeffs(), karneyC3Coeffs()
+
+// solves the inverse problem with Karney's series solution ("Algorithms for geodesics", 2013)
+// the initial azimuth is found with Newton's method on the longitude difference, starting from the
+// astroid estimate for nearly antipodal points and falling back to bisection when a step leaves the bracket,
+// returns the distance in meters
+func karneyInverse(lat1, lon1, lat2, lon2 float64) float64 {
+	lon12 := math.Remainder(lon2-lon1, 360)
+	lon12 = angRound(math.Abs(lon12))
+	lam12 := DegreesToRadians(lon12)
+	var slam12, clam12 float64
+	if lon12 > 90 {
+		slam12, clam12 = math.Sincos(DegreesToRadians(180 - lon12))
+		clam12 = -clam12
+	} else {
+		slam12, clam12 = math.Sincos(lam12)
+	}
+
+	// put the point furthest from the equator first and in the southern hemisphere
+	lat1, lat2 = angRound(lat1), angRound(lat2)
+	if math.Abs(lat1) < math.Abs(lat2) {
+		lat1, lat2 = lat2, lat1
+	}
+	if !math.Signbit(lat1) {
+		lat1, lat2 = -lat1, -lat2
+	}
+
+	sbet1, cbet1 := reducedLatitude(lat1)
+	sbet2, cbet2 := reducedLatitude(lat2)
+	// keep the symmetries of points at the same or opposite latitudes exact
+	if cbet1 < -sbet1 {
+		if cbet2 == cbet1 {
+			sbet2 = math.Copysign(sbet1, sbet2)
+		}
+	} else if math.Abs(sbet2) == -sbet1 {
+		cbet2 = cbet1
+	}
+
+	dn1 := math.Sqrt(1 + wgs84EP2*sbet1*sbet1)
+	dn2 := math.Sqrt(1 + wgs84EP2*sbet2*sbet2)
+
+	if lat1 == -90 || slam12 == 0 {
+		// along a meridian, unless it is shorter to go around the pole as a general geodesic
+		ssig1, csig1 := sbet1, clam12*cbet1
+		ssig2, csig2 := sbet2, cbet2
+		sig12 := math.Atan2(math.Max(0, csig1*ssig2-ssig1*csig2), csig1*csig2+ssig1*ssig2)
+		s12, m12, _ := karneyLengths(wgs84N, sig12, ssig1, csig1, dn1, ssig2, csig2, dn2)
+		if sig12 < 1 || m12 >= 0 {
+			if sig12 < 3*karneyTiny || (sig12 < karneyTol0 && (s12 < 0 || m12 < 0)) {
+				return 0
+			}
+			return wgs84B * s12
+		}
+	}
+
+	// points on the equator closer than (1-f)*pi are joined along the equator
+	if sbet1 == 0 && lam12 <= math.Pi-wgs84F*math.Pi {
+		return wgs84A * lam12
+	}
+
+	salp1, calp1, sig12, dnm := karneyInverseStart(sbet1, cbet1, sbet2, cbet2, lam12, slam12, clam12)
+	if sig12 >= 0 {
+		return sig12 * wgs84B * dnm
+	}
+
+	var ssig1, csig1, ssig2, csig2, eps float64
+	salp1a, calp1a, salp1b, calp1b := karneyTiny, 1.0, karneyTiny, -1.0
+	for numit, tripn, tripb := 0, false, false; ; numit++ {
+		var v, dv float64
+		v, dv, sig12, ssig1, csig1, ssig2, csig2, eps = karneyLambda12(sbet1, cbet1, dn1, sbet2, cbet2, dn2, salp1, calp1, slam12, clam12, numit < karneyMaxit1)
+		tol := karneyTol0
+		if tripn {
+			tol *= 8
+		}
+		if tripb || !(math.Abs(v) >= tol) || numit == karneyMaxit2 {
+			break
+		}
+
+		// narrow the bracket of the azimuth
+		if v > 0 && (numit > karneyMaxit1 || calp1/salp1 > calp1b/salp1b) {
+			salp1b, calp1b = salp1, calp1
+		} else if v < 0 && (numit > karneyMaxit1 || calp1/salp1 < calp1a/salp1a) {
+			salp1a, calp1a = salp1, calp1
+		}
+
+		if numit < karneyMaxit1 && dv > 0 {
+			if dalp1 := -v / dv; math.Abs(dalp1) < math.Pi {
+				sdalp1, cdalp1 := math.Sincos(dalp1)
+				if nsalp1 := salp1*cdalp1 + calp1*sdalp1; nsalp1 > 0 {
+					salp1, calp1 = norm(nsalp1, calp1*cdalp1-salp1*sdalp1)
+					tripn = math.Abs(v) <= 16*karneyTol0
+					continue
+				}
+			}
+		}
+
+		// the newton step was not usable, bisect the bracket instead
+		salp1, calp1 = norm((salp1a+salp1b)/2, (calp1a+calp1b)/2)
+		tripn = false
+		tripb = math.Abs(salp1a-salp1)+(calp1a-calp1) < karneyTolb || math.Abs(salp1-salp1b)+(calp1-calp1b) < karneyTolb
+	}
+
+	s12, _, _ := karneyLengths(eps, sig12, ssig1, csig1, dn1, ssig2, csig2, dn2)
+	return wgs84B * s12
+}
+
+// returns a first guess of the azimuth at the first point, and the arc length and mean dn when the
+// line is short enough to solve right away (the arc length is negative otherwise)
+// nearly antipodal points are estimated by solving the astroid problem
+func karneyInverseStart(sbet1, cbet1, sbet2, cbet2, lam12, slam12, clam12 float64) (salp1, calp1, sig12, dnm float64) {
+	sig12 = -1
+	sbet12 := sbet2*cbet1 - cbet2*sbet1
+	cbet12 := cbet2*cbet1 + sbet2*sbet1
+	sbet12a := sbet2*cbet1 + cbet2*sbet1
+
+	shortline := cbet12 >= 0 && sbet12 < 0.5 && cbet2*lam12 < 0.5
+	somg12, comg12 := slam12, clam12
+	if shortline {
+		sbetm2 := (sbet1 + sbet2) * (sbet1 + sbet2)
+		sbetm2 /= sbetm2 + (cbet1+cbet2)*(cbet1+cbet2)
+		dnm = math.Sqrt(1 + wgs84EP2*sbetm2)
+		somg12, comg12 = math.Sincos(lam12 / ((1 - wgs84F) * dnm))
+	}
+
+	salp1 = cbet2 * somg12
+	if comg12 >= 0 {
+		calp1 = sbet12 + cbet2*sbet1*somg12*somg12/(1+comg12)
+	} else {
+		calp1 = sbet12a - cbet2*sbet1*somg12*somg12/(1-comg12)
+	}
+
+	ssig12 := math.Hypot(salp1, calp1)
+	csig12 := sbet1*sbet2 + cbet1*cbet2*comg12
+
+	switch {
+	case shortline && ssig12 < karneyEtol2:
+		sig12 = math.Atan2(ssig12, csig12)
+	case math.Abs(wgs84N) > 0.1 || csig12 >= 0 || ssig12 >= 6*math.Abs(wgs84N)*math.Pi*cbet1*cbet1:
+		// the spherical estimate is good enough
+	default:
+		// scale to coordinates where the antipode is at the origin and the singular point at x = -1, y = 0
+		lam12x := math.Atan2(-slam12, -clam12)
+		k2 := sbet1 * sbet1 * wgs84EP2
+		lamscale := wgs84F * cbet1 * karneyA3(k2/(2*(1+math.Sqrt(1+k2))+k2)) * math.Pi
+		betscale := lamscale * cbet1
+		x, y := lam12x/lamscale, sbet12a/betscale
+
+		if y > -karneyTol1 && x > -1-karneyXThres {
+			salp1 = math.Min(1, -x)
+			calp1 = -math.Sqrt(1 - salp1*salp1)
+		} else {
+			k := astroid(x, y)
+			omg12a := lamscale * (-x * k / (1 + k))
+			somg12, comg12 = math.Sincos(omg12a)
+			comg12 = -comg12
+			salp1 = cbet2 * somg12
+			calp1 = sbet12a - cbet2*sbet1*somg12*somg12/(1-comg12)
+		}
+	}
+
+	if !(salp1 <= 0) {
+		salp1, calp1 = norm(salp1, calp1)
+	} else {
+		salp1, calp1 = 1, 0
+	}
+	return salp1, calp1, sig12, dnm
+}
+
+// returns the positive root k of k^4 + 2k^3 - (x^2 + y^2 - 1)k^2 - 2y^2 k - y^2 = 0
+func astroid(x, y float64) float64 {
+	p, q := x*x, y*y
+	r := (p + q - 1) / 6
+	if q == 0 && r <= 0 {
+		return 0
+	}
+
+	S := p * q / 4
+	r2 := r * r
+	r3 := r * r2
+	disc := S * (S + 2*r3)
+	u := r
+	if disc >= 0 {
+		T3 := S + r3
+		if T3 < 0 {
+			T3 -= math.Sqrt(disc)
+		} else {
+			T3 += math.Sqrt(disc)
+		}
+		T := math.Cbrt(T3)
+		u += T
+		if T != 0 {
+			u += r2 / T
+		}
+	} else {
+		u += 2 * r * math.Cos(math.Atan2(math.Sqrt(-disc), -(S+r3))/3)
+	}
+
+	v := math.Sqrt(u*u + q)
+	uv := u + v
+	if u < 0 {
+		uv = q / (v - u)
+	}
+	w := (uv - q) / (2 * v)
+	return uv / (math.Sqrt(uv+w*w) + w)
+}
+
+// follows the geodesic leaving the first point with the given azimuth to the latitude of the second point
+// returns how far its longitude difference is off the target and the derivative of that by the azimuth
+// (when diffp is set), with the arc and the parameter the lengths of the line are computed from
+func karneyLambda12(sbet1, cbet1, dn1, sbet2, cbet2, dn2, salp1, calp1, slam120, clam120 float64, diffp bool) (lam12, dlam12, sig12, ssig1, csig1, ssig2, csig2, eps float64) {
+	if sbet1 == 0 && calp1 == 0 {
+		// break the degeneracy of the equatorial line
+		calp1 = -karneyTiny
+	}
+
+	salp0 := salp1 * cbet1
+	calp0 := math.Hypot(calp1, salp1*sbet1)
+
+	somg1, comg1 := salp0*sbet1, calp1*cbet1
+	ssig1, csig1 = norm(sbet1, comg1)
+
+	calp2 := math.Abs(calp1)
+	if cbet2 != cbet1 || math.Abs(sbet2) != -sbet1 {
+		d := (sbet1 - sbet2) * (sbet1 + sbet2)
+		if cbet1 < -sbet1 {
+			d = (cbet2 - cbet1) * (cbet1 + cbet2)
+		}
+		calp2 = math.Sqrt(calp1*cbet1*calp1*cbet1+d) / cbet2
+	}
+
+	somg2, comg2 := salp0*sbet2, calp2*cbet2
+	ssig2, csig2 = norm(sbet2, comg2)
+
+	sig12 = math.Atan2(math.Max(0, csig1*ssig2-ssig1*csig2), csig1*csig2+ssig1*ssig2)
+	somg12 := math.Max(0, comg1*somg2-somg1*comg2)
+	comg12 := comg1*comg2 + somg1*somg2
+	eta := math.Atan2(somg12*clam120-comg12*slam120, comg12*clam120+somg12*slam120)
+
+	k2 := calp0 * calp0 * wgs84EP2
+	eps = k2 / (2*(1+math.Sqrt(1+k2)) + k2)
+	c3 := karneyC3(eps)
+	b312 := sinCosSeries(ssig2, csig2, c3) - sinCosSeries(ssig1, csig1, c3)
+	lam12 = eta - wgs84F*karneyA3(eps)*salp0*(sig12+b312)
+
+	if diffp {
+		if calp2 == 0 {
+			dlam12 = -2 * (1 - wgs84F) * dn1 / sbet1
+		} else {
+			_, m12, _ := karneyLengths(eps, sig12, ssig1, csig1, dn1, ssig2, csig2, dn2)
+			dlam12 = m12 * (1 - wgs84F) / (calp2 * cbet2)
+		}
+	}
+	return lam12, dlam12, sig12, ssig1, csig1, ssig2, csig2, eps
+}
+
+// returns the distance, the reduced length and m0 of a geodesic arc, all scaled to the minor axis
+func karneyLengths(eps, sig12, ssig1, csig1, dn1, ssig2, csig2, dn2 float64) (s12b, m12b, m0 float64) {
+	A1m1, c1 := karneyA1m1(eps), karneyC1(eps)
+	A2m1, c2 := karneyA2m1(eps), karneyC2(eps)
+	m0 = A1m1 - A2m1
+	A1, A2 := 1+A1m1, 1+A2m1
+
+	B1 := sinCosSeries(ssig2, csig2, c1) - sinCosSeries(ssig1, csig1, c1)
+	B2 := sinCosSeries(ssig2, csig2, c2) - sinCosSeries(ssig1, csig1, c2)
+	s12b = A1 * (sig12 + B1)
+	J12 := m0*sig12 + (A1*B1 - A2*B2)
+	m12b = dn2*(csig1*ssig2) - dn1*(ssig1*csig2) - csig1*csig2*J12
+	return s12b, m12b, m0
+}
+
+// evaluates sum(c[k] * sin(2k * sigma)) for k from 1 with Clenshaw summation, c[0] is unused
+func sinCosSeries(sinx, cosx float64, c []float64) float64 {
+	n := len(c) - 1
+	ar := 2 * (cosx - sinx) * (cosx + sinx)
+	var y0, y1 float64
+	i := len(c)
+	if n&1 == 1 {
+		i--
+		y0 = c[i]
+	}
+	for n /= 2; n > 0; n-- {
+		i--
+		y1 = ar*y0 - y1 + c[i]
+		i--
+		y0 = ar*y1 - y0 + c[i]
+	}
+	return 2 * sinx * cosx * y0
+}
+
+// evaluates the polynomial with the coefficients p, highest power first
+func polyval(p []float64, x float64) float64 {
+	y := 0.0
+	for _, c := range p {
+		y = y*x + c
+	}
+	return y
+}
+
+// returns A1 - 1 of the series for the distance
+func karneyA1m1(eps float64) float64 {
+	eps2 := eps * eps
+	t := polyval([]float64{1, 4, 64, 0}, eps2) / 256
+	return (t + eps) / (1 - eps)
+}
+
+// returns the coefficients C1[1..6] of the series for the distance
+func karneyC1(eps float64) []float64 {
+	return seriesCoeffs(eps, [][]float64{
+		{-1, 6, -16, 32},
+		{-9, 64, -128, 2048},
+		{9, -16, 768},
+		{3, -5, 512},
+		{-7, 1280},
+		{-7, 2048},
+	})
+}
+
+// returns A2 - 1 of the series for the reduced length
+func karneyA2m1(eps float64) float64 {
+	eps2 := eps * eps
+	t := polyval([]float64{-11, -28, -192, 0}, eps2) / 256
+	return (t - eps) / (1 + eps)
+}
+
+// returns the coefficients C2[1..6] of the series for the reduced length
+func karneyC2(eps float64) []float64 {
+	return seriesCoeffs(eps, [][]float64{
+		{1, 2, 16, 32},
+		{35, 64, 384, 2048},
+		{15, 80, 768},
+		{7, 35, 512},
+		{63, 1280},
+		{77, 2048},
+	})
+}
+
+// returns the coefficients c[1..] of eps^l times a polynomial in eps^2 given with its denominator last
+func seriesCoeffs(eps float64, coeffs [][]float64) []float64 {
+	c := make([]float64, len(coeffs)+1)
+	eps2, d := eps*eps, eps
+	for l, coeff := range coeffs {
+		c[l+1] = d * polyval(coeff[:len(coeff)-1], eps2) / coeff[len(coeff)-1]
+		d *= eps
+	}
+	return c
+}
+
+// returns A3 of the series for the longitude
+func karneyA3(eps float64) float64 {
+	return polyval(karneyA3x, eps)
+}
+
+// returns the coefficients C3[1..5] of the series for the longitude
+func karneyC3(eps float64) []float64 {
+	c := make([]float64, karneyOrder)
+	mult, o := 1.0, 0
+	for l := 1; l < karneyOrder; l++ {
+		m := karneyOrder - l - 1
+		mult *= eps
+		c[l] = mult * polyval(karneyC3x[o:o+m+1], eps)
+		o += m + 1
+	}
+	return c
+}
+
+// returns the coefficients of A3 as a polynomial in eps, highest power first
+func karneyA3Coeffs() []float64 {
+	coeffs := [][]float64{
+		{-3, 128},
+		{-2, -3, 64},
+		{-1, -3, -1, 16},
+		{3, -1, -2, 8},
+		{1, -1, 2},
+		{1, 1},
+	}
+	x := make([]float64, len(coeffs))
+	for i, coeff := range coeffs {
+		x[i] = polyval(coeff[:len(coeff)-1], wgs84N) / coeff[len(coeff)-1]
+	}
+	return x
+}
+
+// returns the coefficients of C3[1..5] as polynomials in eps, highest power first
+func karneyC3Coeffs() []float64 {
+	coeffs := [][]float64{
+		{3, 128}, {2, 5, 128}, {-1, 3, 3, 64}, {-1, 0, 1, 8}, {-1, 1, 4},
+		{5, 256}, {1, 3, 128}, {-3, -2, 3, 64}, {1, -3, 2, 32},
+		{7, 512}, {-10, 9, 384}, {5, -9, 5, 192},
+		{7, 512}, {-14, 7, 512},
+		{21, 2560},
+	}
+	x := make([]float64, len(coeffs))
+	for i, coeff := range coeffs {
+		x[i] = polyval(coeff[:len(coeff)-1], wgs84N) / coeff[len(coeff)-1]
+	}
+	return x
+}
+
+// rounds angles this close to zero to zero, so points very near the equator are treated as on it
+func angRound(x float64) float64 {
+	const z = 1.0 / 16
+	y := math.Abs(x)
+	if w := z - y; w > 0 {
+		y = z - w
+	}
+	return math.Copysign(y, x)
+}
+
+// returns the sine and cosine of the reduced latitude of a geographic latitude in degrees
+// the cosine is kept positive so the poles don't divide by zero
+func reducedLatitude(lat float64) (float64, float64) {
+	sinPhi, cosPhi := math.Sincos(DegreesToRadians(lat))
+	sinB, cosB := norm((1-wgs84F)*sinPhi, cosPhi)
+	return sinB, math.Max(karneyTiny, cosB)
+}
+
+// scales a sine and cosine pair to unit length
+func norm(sinx, cosx float64) (float64, float64) {
+	r := math.Hypot(sinx, cosx)
+	return sinx / r, cosx / r
+}
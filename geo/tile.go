@@ -0,0 +1,91 @@
+package geo
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// latitude limit of the Web-Mercator projection, the map is square between -MaxMercatorLat and MaxMercatorLat
+	MaxMercatorLat = 85.05112877980659
+	// deepest zoom level accepted for tiles
+	MaxZoom = 22
+	// width and height of a tile in pixels
+	TileSize = 256
+)
+
+// Tile is a Web-Mercator (slippy map) tile, x grows eastwards and y southwards from the north-west corner
+type Tile struct {
+	Z int `json:"z"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// returns the tile, checking that the zoom is supported and x and y lie on the map
+func NewTile(z, x, y int) (Tile, error) {
+	if z < 0 || z > MaxZoom {
+		return Tile{}, fmt.Errorf("geo: zoom %d out of range [0, %d]", z, MaxZoom)
+	}
+	n := 1 << z
+	if x < 0 || x >= n || y < 0 || y >= n {
+		return Tile{}, fmt.Errorf("geo: tile %d/%d/%d does not exist", z, x, y)
+	}
+	return Tile{Z: z, X: x, Y: y}, nil
+}
+
+// projects a point to Web-Mercator world coordinates in [0, 1], latitudes beyond the projection are clamped
+func Mercator(p LatLng) (x, y float64) {
+	lat := DegreesToRadians(math.Max(-MaxMercatorLat, math.Min(MaxMercatorLat, p.Lat)))
+	x = (NormalizeLongitude(p.Lng) + 180) / 360
+	y = (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2
+	return x, y
+}
+
+// converts Web-Mercator world coordinates back to a point
+func InverseMercator(x, y float64) LatLng {
+	lat := math.Atan(math.Sinh(math.Pi * (1 - 2*y)))
+	return LatLng{Lat: RadiansToDegrees(lat), Lng: x*360 - 180}
+}
+
+// returns the tile containing a point at a zoom level
+func TileFor(p LatLng, z int) Tile {
+	x, y := Mercator(p)
+	n := float64(int(1) << z)
+	return Tile{Z: z, X: clampTile(x*n, z), Y: clampTile(y*n, z)}
+}
+
+func clampTile(v float64, z int) int {
+	return int(math.Max(0, math.Min(math.Floor(v), float64(int(1)<<z-1))))
+}
+
+// returns the latitude/longitude rectangle covered by the tile
+func (t Tile) Bounds() Bounds {
+	n := float64(int(1) << t.Z)
+	return Bounds{
+		SouthWest: InverseMercator(float64(t.X)/n, float64(t.Y+1)/n),
+		NorthEast: InverseMercator(float64(t.X+1)/n, float64(t.Y)/n),
+	}
+}
+
+// returns the center point of the tile
+func (t Tile) Center() LatLng {
+	n := float64(int(1) << t.Z)
+	return InverseMercator((float64(t.X)+0.5)/n, (float64(t.Y)+0.5)/n)
+}
+
+// returns the position of a point in pixels relative to the north-west corner of the tile
+// points across the antimeridian are wrapped to the side nearest to the tile
+func (t Tile) Pixel(p LatLng, size int) (float64, float64) {
+	x, y := Mercator(p)
+	n := float64(int(1) << t.Z)
+	px := (x*n - float64(t.X)) * float64(size)
+	py := (y*n - float64(t.Y)) * float64(size)
+
+	world := n * float64(size)
+	if offset := px - float64(size)/2; offset > world/2 {
+		px -= world
+	} else if offset < -world/2 {
+		px += world
+	}
+	return px, py
+}
@@ -0,0 +1,209 @@
+// package secures the internal gRPC channel between the services with mutual TLS and a service token
+package grpcauth
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// identity of callers authenticated by the service token instead of a certificate
+const TokenIdentity = "token"
+
+// method prefix of the grpc.health.v1 service, probes call it without the service token or an allowed certificate
+// with mutual TLS they still need a certificate signed by the CA to get through the handshake
+const healthMethods = "/grpc.health.v1.Health/"
+
+// Config holds the certificate, key and CA files of one side of the channel, filled from the grpc section of the service config
+// without certificate files the channel is plaintext and callers must present Token
+// AllowedClients lists the certificate common names or DNS names the server accepts
+// ServerName overrides the name the client expects in the server certificate
+type Config struct {
+	CertFile       string
+	KeyFile        string
+	CAFile         string
+	ServerName     string
+	Token          string
+	AllowedClients []string
+}
+
+// reports whether the channel uses mutual TLS
+func (c Config) TLSEnabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != ""
+}
+
+// loads the key pair and the CA pool, all three files are required once any is set
+func (c Config) load() (tls.Certificate, *x509.CertPool, error) {
+	if c.CertFile == "" || c.KeyFile == "" || c.CAFile == "" {
+		return tls.Certificate{}, nil, errors.New("grpcauth: certificate, key and CA files must all be set")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("grpcauth: %v", err)
+	}
+	ca, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("grpcauth: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return tls.Certificate{}, nil, fmt.Errorf("grpcauth: no certificates in %s", c.CAFile)
+	}
+	return cert, pool, nil
+}
+
+// returns the options of a server that requires client certificates signed by the CA, or the token on a plaintext channel,
+// and checks the caller identity on every unary and streaming call
+func ServerOptions(config Config) ([]grpc.ServerOption, error) {
+	creds := insecure.NewCredentials()
+	if config.TLSEnabled() {
+		cert, pool, err := config.load()
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		})
+	} else if config.Token == "" {
+		return nil, errors.New("grpcauth: neither TLS certificates nor a service token configured")
+	}
+
+	auth := &authorizer{token: config.Token, allowed: config.AllowedClients}
+	return []grpc.ServerOption{
+		grpc.Creds(creds),
+		grpc.ChainUnaryInterceptor(auth.unary),
+		grpc.ChainStreamInterceptor(auth.stream),
+	}, nil
+}
+
+// returns the options of a client presenting its certificate and verifying the server against the CA,
+// the token is sent with every call when set
+func DialOptions(config Config) ([]grpc.DialOption, error) {
+	creds := insecure.NewCredentials()
+	if config.TLSEnabled() {
+		cert, pool, err := config.load()
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			ServerName:   config.ServerName,
+			MinVersion:   tls.VersionTLS12,
+		})
+	} else if config.Token == "" {
+		return nil, errors.New("grpcauth: neither TLS certificates nor a service token configured")
+	}
+
+	options := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if config.Token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(tokenCredentials{token: config.Token, secure: config.TLSEnabled()}))
+	}
+	return options, nil
+}
+
+// sends the service token as "authorization: Bearer" metadata
+type tokenCredentials struct {
+	token  string
+	secure bool
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+// the token may only travel in plaintext when TLS is not configured at all
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return t.secure
+}
+
+// key of the caller identity in the context of a call
+type identityKey struct{}
+
+// returns the identity of the service making the call, empty outside of an authorized call
+func Identity(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+// checks the identity of the calling service
+type authorizer struct {
+	token   string
+	allowed []string
+}
+
+// returns the context of a call carrying the caller identity
+// a verified client certificate must name an allowed client, otherwise the metadata must carry the token
+func (a *authorizer) authorize(ctx context.Context) (context.Context, error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			cert := info.State.VerifiedChains[0][0]
+			for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+				if name != "" && slices.Contains(a.allowed, name) {
+					return context.WithValue(ctx, identityKey{}, name), nil
+				}
+			}
+			return nil, status.Errorf(codes.PermissionDenied, "client %q is not allowed", cert.Subject.CommonName)
+		}
+	}
+
+	if a.token != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			token, found := strings.CutPrefix(value, "Bearer ")
+			if found && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+				return context.WithValue(ctx, identityKey{}, TokenIdentity), nil
+			}
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "missing client certificate or service token")
+}
+
+func (a *authorizer) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, healthMethods) {
+		return handler(ctx, req)
+	}
+	ctx, err := a.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *authorizer) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if strings.HasPrefix(info.FullMethod, healthMethods) {
+		return handler(srv, ss)
+	}
+	ctx, err := a.authorize(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &identifiedStream{ServerStream: ss, ctx: ctx})
+}
+
+// server stream whose context carries the caller identity
+type identifiedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identifiedStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,221 @@
+// package reports the liveness and readiness of both services over REST and the standard grpc health service
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// every check passes
+	StatusOK = "ok"
+	// a non-critical check fails, the service still takes traffic
+	StatusDegraded = "degraded"
+	// a critical check fails or the service is shutting down
+	StatusFailing = "failing"
+)
+
+// CheckFunc checks a dependency, it returns a short description of its state and fails with an error
+type CheckFunc func(ctx context.Context) (string, error)
+
+type check struct {
+	name     string
+	critical bool
+	fn       CheckFunc
+}
+
+// Result is the outcome of a single check
+type Result struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Detail   string `json:"detail,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Report is the outcome of all checks of a service
+type Report struct {
+	Status       string            `json:"status"`
+	ShuttingDown bool              `json:"shutting_down,omitempty"`
+	Checks       map[string]Result `json:"checks"`
+}
+
+// reports whether the service should take traffic
+func (r Report) Ready() bool {
+	return r.Status != StatusFailing
+}
+
+// Checker runs the dependency checks of a service, each of them within Timeout
+// the service is ready unless a critical check fails or it is shutting down
+type Checker struct {
+	Timeout time.Duration
+
+	mu           sync.Mutex
+	checks       []check
+	servers      []*grpchealth.Server
+	shuttingDown atomic.Bool
+}
+
+// checker of the service, its checks are added by main
+var Default = &Checker{Timeout: 2 * time.Second}
+
+// adds a check, a failing critical check makes the service unready while others only degrade it
+func (h *Checker) Add(name string, critical bool, fn CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, check{name: name, critical: critical, fn: fn})
+}
+
+// runs all checks concurrently
+func (h *Checker) Check(ctx context.Context) Report {
+	h.mu.Lock()
+	checks := append([]check(nil), h.checks...)
+	h.mu.Unlock()
+
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			detail, err := check.fn(ctx)
+			results[i] = Result{Status: StatusOK, Critical: check.critical, Detail: detail}
+			if err != nil {
+				results[i].Status = StatusFailing
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusOK, ShuttingDown: h.shuttingDown.Load(), Checks: make(map[string]Result, len(checks))}
+	for i, check := range checks {
+		result := results[i]
+		report.Checks[check.name] = result
+		switch {
+		case result.Status == StatusOK:
+		case result.Critical:
+			report.Status = StatusFailing
+		case report.Status == StatusOK:
+			report.Status = StatusDegraded
+		}
+	}
+	if report.ShuttingDown {
+		report.Status = StatusFailing
+	}
+	return report
+}
+
+// reports whether Shutdown was called
+func (h *Checker) ShuttingDown() bool {
+	return h.shuttingDown.Load()
+}
+
+// makes the service unready from now on, called first on graceful shutdown so load balancers stop sending traffic
+func (h *Checker) Shutdown() {
+	h.shuttingDown.Store(true)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, server := range h.servers {
+		server.Shutdown()
+	}
+}
+
+// keeps the serving status of the grpc health server up to date, checking every interval
+// the overall status ("") and the named services are serving while the service is ready
+func (h *Checker) Serve(server *grpchealth.Server, interval time.Duration, services ...string) {
+	h.mu.Lock()
+	h.servers = append(h.servers, server)
+	h.mu.Unlock()
+
+	update := func() {
+		status := healthpb.HealthCheckResponse_NOT_SERVING
+		if h.Check(context.Background()).Ready() {
+			status = healthpb.HealthCheckResponse_SERVING
+		}
+		for _, service := range append([]string{""}, services...) {
+			server.SetServingStatus(service, status)
+		}
+	}
+
+	update()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if h.ShuttingDown() {
+				return
+			}
+			update()
+		}
+	}()
+}
+
+// GET /healthz - the process is alive and serving requests, dependencies are not checked
+func (h *Checker) Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": StatusOK})
+}
+
+// GET /readyz - runs the checks, responds 503 when the service should not take traffic
+func (h *Checker) Readiness(c *gin.Context) {
+	report := h.Check(c.Request.Context())
+	code := http.StatusOK
+	if !report.Ready() {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, report)
+}
+
+// Job records the runs of a background job started every Interval
+type Job struct {
+	Interval time.Duration
+	Now      func() time.Time
+
+	mu      sync.Mutex
+	lastRun time.Time
+	lastErr error
+}
+
+// records a finished run
+func (j *Job) Done(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.lastRun, j.lastErr = j.now(), err
+}
+
+// fails when the last run failed or no run finished for two intervals
+func (j *Job) Check(ctx context.Context) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.lastRun.IsZero() {
+		return "no run finished yet", nil
+	}
+	detail := "last run " + j.lastRun.Format(time.RFC3339)
+	if j.lastErr != nil {
+		return detail, fmt.Errorf("last run failed: %v", j.lastErr)
+	}
+	if j.Interval > 0 && j.now().Sub(j.lastRun) > 2*j.Interval {
+		return detail, fmt.Errorf("no run finished since %s", j.lastRun.Format(time.RFC3339))
+	}
+	return detail, nil
+}
+
+func (j *Job) now() time.Time {
+	if j.Now != nil {
+		return j.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,224 @@
+// package validates the bearer tokens of the REST APIs of both services
+package jwtauth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// scope allowing reads of every user's data
+	ScopeAdmin = "admin"
+	// key of the validated claims in the gin context
+	ClaimsKey = "claims"
+	// clock skew tolerated when checking exp and nbf
+	Leeway = 30 * time.Second
+)
+
+// Config selects the accepted keys, HS256 tokens are signed with HMACSecret and RS256 tokens with a key of the JWKS file
+// Issuer and Audience are only checked when set
+type Config struct {
+	HMACSecret []byte
+	JWKSFile   string
+	Issuer     string
+	Audience   string
+}
+
+// Claims are the registered claims and the space separated OAuth2 scopes of a token
+type Claims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope,omitempty"`
+}
+
+// reports whether the token was granted a scope
+func (c *Claims) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(c.Scope), scope)
+}
+
+// Verifier validates tokens against the configured keys
+type Verifier struct {
+	hmacSecret []byte
+	rsaKeys    map[string]*rsa.PublicKey
+	parser     *jwt.Parser
+}
+
+// verifier used by the middleware, set by main
+var Default *Verifier
+
+// returns a verifier for the config, loading the RSA keys of the JWKS file
+func NewVerifier(config Config) (*Verifier, error) {
+	v := &Verifier{hmacSecret: config.HMACSecret, rsaKeys: map[string]*rsa.PublicKey{}}
+
+	if config.JWKSFile != "" {
+		data, err := os.ReadFile(config.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwtauth: %v", err)
+		}
+		if v.rsaKeys, err = ParseJWKS(data); err != nil {
+			return nil, fmt.Errorf("jwtauth: %v", err)
+		}
+	}
+	if len(v.hmacSecret) == 0 && len(v.rsaKeys) == 0 {
+		return nil, errors.New("jwtauth: no HS256 secret or RS256 keys configured")
+	}
+
+	var methods []string
+	if len(v.hmacSecret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if len(v.rsaKeys) > 0 {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired(), jwt.WithLeeway(Leeway)}
+	if config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(config.Issuer))
+	}
+	if config.Audience != "" {
+		options = append(options, jwt.WithAudience(config.Audience))
+	}
+	v.parser = jwt.NewParser(options...)
+
+	return v, nil
+}
+
+// a key of a JSON Web Key Set, only RSA signing keys are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// returns the RSA public keys of a JSON Web Key Set by key id
+func ParseJWKS(data []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(key.N)
+		e, errE := base64.RawURLEncoding.DecodeString(key.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA key %q", key.Kid)
+		}
+		keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// returns the key a token was signed with, RS256 tokens name it by kid unless the set holds a single key
+func (v *Verifier) key(token *jwt.Token) (interface{}, error) {
+	if token.Method == jwt.SigningMethodHS256 {
+		return v.hmacSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := v.rsaKeys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(v.rsaKeys) == 1 {
+		for _, key := range v.rsaKeys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// validates a token and returns its claims, the subject is required
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return nil, fmt.Errorf("jwtauth: %v", err)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("jwtauth: token has no subject")
+	}
+	return claims, nil
+}
+
+// rejects requests without a valid "Authorization: Bearer" token with 401 and stores the claims in the context
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found || token == "" {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+		if Default == nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Authentication not configured"})
+			return
+		}
+
+		claims, err := Default.Verify(token)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		c.Set(ClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// returns the claims stored by the middleware, nil for requests that did not pass it
+func ClaimsOf(c *gin.Context) *Claims {
+	claims, _ := c.Get(ClaimsKey)
+	typed, _ := claims.(*Claims)
+	return typed
+}
+
+// returns the user the token was issued to, empty when there are no claims
+func Subject(c *gin.Context) string {
+	if claims := ClaimsOf(c); claims != nil {
+		return claims.Subject
+	}
+	return ""
+}
+
+// reports whether the caller was granted the admin scope
+func IsAdmin(c *gin.Context) bool {
+	claims := ClaimsOf(c)
+	return claims != nil && claims.HasScope(ScopeAdmin)
+}
+
+// rejects callers without the given scope with 403
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if claims := ClaimsOf(c); claims == nil || !claims.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
+
+// reports whether the caller may read the data of a user, which needs the admin scope for anyone but themselves
+// responds with 403 otherwise
+func CanRead(c *gin.Context, username string) bool {
+	if username == Subject(c) || IsAdmin(c) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to read this user"})
+	return false
+}
@@ -0,0 +1,261 @@
+// package derives speed, pace and acceleration metrics from a users location history
+package analytics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-nauka/geo"
+	"go-nauka/location-history-service/models"
+	"go-nauka/location-history-service/utils"
+)
+
+// transport mode hints inferred from segment speeds
+const (
+	ModeStationary = "stationary"
+	ModeWalking    = "walking"
+	ModeCycling    = "cycling"
+	ModeDriving    = "driving"
+)
+
+// Band is a speed range in km/h, a band with MaxKmh 0 has no upper limit
+type Band struct {
+	Name   string  `json:"name"`
+	MinKmh float64 `json:"min_kmh"`
+	MaxKmh float64 `json:"max_kmh,omitempty"`
+}
+
+// reports whether a speed falls into the band
+func (b Band) Contains(speedKmh float64) bool {
+	return speedKmh >= b.MinKmh && (b.MaxKmh == 0 || speedKmh < b.MaxKmh)
+}
+
+// Config holds the thresholds used to analyse a track
+// segments slower than MinMovingSpeedKmh or with a gap longer than MaxGap are not counted as moving,
+// moving segments up to WalkingMaxKmh are walking, up to CyclingMaxKmh cycling and faster ones driving
+type Config struct {
+	Bands             []Band
+	MinMovingSpeedKmh float64
+	MaxGap            time.Duration
+	WalkingMaxKmh     float64
+	CyclingMaxKmh     float64
+}
+
+// returns the default thresholds, the moving thresholds match the daily statistics
+func DefaultConfig() Config {
+	return Config{
+		Bands:             DefaultBands(),
+		MinMovingSpeedKmh: 1,
+		MaxGap:            10 * time.Minute,
+		WalkingMaxKmh:     7,
+		CyclingMaxKmh:     25,
+	}
+}
+
+// returns the default speed bands
+func DefaultBands() []Band {
+	bands, _ := ParseBands("1,7,25,60")
+	return bands
+}
+
+// parses ascending band edges in km/h such as "1,7,25,60" into bands "0-1", "1-7", ..., "60+"
+func ParseBands(spec string) ([]Band, error) {
+	var edges []float64
+	for _, part := range strings.Split(spec, ",") {
+		edge, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || edge <= 0 || math.IsInf(edge, 0) {
+			return nil, fmt.Errorf("parseBands: invalid edge %q", part)
+		}
+		if len(edges) > 0 && edge <= edges[len(edges)-1] {
+			return nil, fmt.Errorf("parseBands: edges must be ascending")
+		}
+		edges = append(edges, edge)
+	}
+
+	bands := []Band{}
+	min := 0.0
+	for _, edge := range edges {
+		bands = append(bands, Band{Name: formatEdge(min) + "-" + formatEdge(edge), MinKmh: min, MaxKmh: edge})
+		min = edge
+	}
+	return append(bands, Band{Name: formatEdge(min) + "+", MinKmh: min}), nil
+}
+
+func formatEdge(edge float64) string {
+	return strconv.FormatFloat(edge, 'f', -1, 64)
+}
+
+// Segment is the movement between two consecutive fixes
+// acceleration is the change of speed from the previous segment, pace is given for moving segments only
+type Segment struct {
+	From             string  `json:"from"`
+	To               string  `json:"to"`
+	DistanceKm       float64 `json:"distance_km"`
+	DurationSeconds  float64 `json:"duration_seconds"`
+	SpeedKmh         float64 `json:"speed_kmh"`
+	PaceMinPerKm     float64 `json:"pace_min_per_km,omitempty"`
+	AccelerationMps2 float64 `json:"acceleration_mps2"`
+	Moving           bool    `json:"moving"`
+	Mode             string  `json:"mode,omitempty"`
+}
+
+// BandTime is the time and distance spent in a speed band
+type BandTime struct {
+	Band       string  `json:"band"`
+	Seconds    float64 `json:"seconds"`
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// ModeHint is the time and distance that looks like a transport mode, Share is the fraction of moving time
+type ModeHint struct {
+	Mode       string  `json:"mode"`
+	Seconds    float64 `json:"seconds"`
+	DistanceKm float64 `json:"distance_km"`
+	Share      float64 `json:"share"`
+}
+
+// Summary is the speed analysis of a track
+// AvgSpeedKmh covers the whole time between the first and last fix, MovingSpeedKmh only the moving segments
+type Summary struct {
+	Points              int        `json:"points"`
+	DistanceKm          float64    `json:"distance_km"`
+	DurationSeconds     float64    `json:"duration_seconds"`
+	MovingSeconds       float64    `json:"moving_seconds"`
+	MaxSpeedKmh         float64    `json:"max_speed_kmh"`
+	AvgSpeedKmh         float64    `json:"avg_speed_kmh"`
+	MovingSpeedKmh      float64    `json:"moving_speed_kmh"`
+	MovingPaceMinPerKm  float64    `json:"moving_pace_min_per_km,omitempty"`
+	MaxAccelerationMps2 float64    `json:"max_acceleration_mps2"`
+	MaxDecelerationMps2 float64    `json:"max_deceleration_mps2"`
+	Mode                string     `json:"mode,omitempty"`
+	Bands               []BandTime `json:"bands"`
+	Modes               []ModeHint `json:"modes"`
+	Segments            []Segment  `json:"segments"`
+}
+
+// returns the transport mode hint for a moving speed
+func (c Config) ModeFor(speedKmh float64) string {
+	switch {
+	case speedKmh < c.MinMovingSpeedKmh:
+		return ModeStationary
+	case speedKmh <= c.WalkingMaxKmh:
+		return ModeWalking
+	case speedKmh <= c.CyclingMaxKmh:
+		return ModeCycling
+	}
+	return ModeDriving
+}
+
+// analyses a track ordered by recorded_at
+// a fix repeating the previous timestamp is skipped since no speed can be derived for it
+func Analyze(locations []models.LocationHistory, distance geo.DistanceFunc, config Config) (Summary, error) {
+	summary := Summary{Points: len(locations), Segments: []Segment{}, Modes: []ModeHint{}}
+
+	bands := make([]BandTime, len(config.Bands))
+	for i, band := range config.Bands {
+		bands[i].Band = band.Name
+	}
+	modes := map[string]*ModeHint{}
+
+	var prev *models.LocationHistory
+	var prevAt time.Time
+	var prevSegment *Segment
+	var movingKm float64
+
+	for i := range locations {
+		loc := &locations[i]
+		at, err := utils.ParseTimestamp(loc.RecordedAt)
+		if err != nil {
+			return Summary{}, fmt.Errorf("analyze: %v", err)
+		}
+		if prev == nil {
+			prev, prevAt = loc, at
+			continue
+		}
+
+		gap := at.Sub(prevAt)
+		if gap <= 0 {
+			continue
+		}
+
+		segment := Segment{
+			From:            prev.RecordedAt,
+			To:              loc.RecordedAt,
+			DistanceKm:      distance(utils.Position(*prev), utils.Position(*loc)),
+			DurationSeconds: gap.Seconds(),
+		}
+		segment.SpeedKmh = segment.DistanceKm / gap.Hours()
+		segment.Moving = gap <= config.MaxGap && segment.SpeedKmh >= config.MinMovingSpeedKmh
+
+		if prevSegment != nil && gap <= config.MaxGap && prevSegment.DurationSeconds <= config.MaxGap.Seconds() {
+			// speeds are averages over each segment so the change is spread between the segment midpoints
+			elapsed := (prevSegment.DurationSeconds + segment.DurationSeconds) / 2
+			segment.AccelerationMps2 = (segment.SpeedKmh - prevSegment.SpeedKmh) / 3.6 / elapsed
+			summary.MaxAccelerationMps2 = math.Max(summary.MaxAccelerationMps2, segment.AccelerationMps2)
+			summary.MaxDecelerationMps2 = math.Max(summary.MaxDecelerationMps2, -segment.AccelerationMps2)
+		}
+
+		summary.DistanceKm += segment.DistanceKm
+		summary.DurationSeconds += segment.DurationSeconds
+
+		if segment.Moving {
+			segment.PaceMinPerKm = 60 / segment.SpeedKmh
+			segment.Mode = config.ModeFor(segment.SpeedKmh)
+			summary.MovingSeconds += segment.DurationSeconds
+			summary.MaxSpeedKmh = math.Max(summary.MaxSpeedKmh, segment.SpeedKmh)
+			movingKm += segment.DistanceKm
+
+			hint, ok := modes[segment.Mode]
+			if !ok {
+				hint = &ModeHint{Mode: segment.Mode}
+				modes[segment.Mode] = hint
+			}
+			hint.Seconds += segment.DurationSeconds
+			hint.DistanceKm += segment.DistanceKm
+		}
+
+		// long gaps say nothing about the speed in between so they are left out of the bands
+		if gap <= config.MaxGap {
+			for j, band := range config.Bands {
+				if band.Contains(segment.SpeedKmh) {
+					bands[j].Seconds += segment.DurationSeconds
+					bands[j].DistanceKm += segment.DistanceKm
+					break
+				}
+			}
+		}
+
+		summary.Segments = append(summary.Segments, segment)
+		prevSegment = &segment
+		prev, prevAt = loc, at
+	}
+
+	if summary.DurationSeconds > 0 {
+		summary.AvgSpeedKmh = summary.DistanceKm / (summary.DurationSeconds / 3600)
+	}
+	if summary.MovingSeconds > 0 {
+		summary.MovingSpeedKmh = movingKm / (summary.MovingSeconds / 3600)
+		summary.MovingPaceMinPerKm = 60 / summary.MovingSpeedKmh
+	}
+
+	for _, hint := range modes {
+		hint.Share = hint.Seconds / summary.MovingSeconds
+		summary.Modes = append(summary.Modes, *hint)
+	}
+	sort.Slice(summary.Modes, func(i, j int) bool {
+		if summary.Modes[i].Seconds != summary.Modes[j].Seconds {
+			return summary.Modes[i].Seconds > summary.Modes[j].Seconds
+		}
+		return summary.Modes[i].Mode < summary.Modes[j].Mode
+	})
+	if len(summary.Modes) > 0 {
+		summary.Mode = summary.Modes[0].Mode
+	}
+
+	summary.Bands = bands
+	return summary, nil
+}
@@ -2,49 +2,129 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"os"
+	"strings"
+	"time"
 
+	"go-nauka/config"
 	"go-nauka/location-history-service/models"
+	"go-nauka/logging"
+	"go-nauka/metrics"
+	"go-nauka/tracing"
 
 	"github.com/go-sql-driver/mysql"
 )
 
 var DB *sql.DB
 
-// initalizes the database
-func InitDB() {
+// runs statements on the database or inside one of its transactions
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+var logger = logging.For("db")
+
+// safely closes the database connection
+func CloseDB() {
+	if DB != nil {
+		if err := DB.Close(); err != nil {
+			logger.Error("Error closing the database", "error", err)
+		} else {
+			logger.Info("Database connection closed")
+		}
+	}
+}
+
+// initalizes the database with the database section of the config
+func InitDB(settings config.Database) {
 	cfg := mysql.Config{
-		User:   os.Getenv("DBUSER"),
-		Passwd: os.Getenv("DBPASS"),
+		User:   settings.User,
+		Passwd: settings.Password,
 		Net:    "tcp",
-		Addr:   "127.0.0.1:3306",
-		DBName: "users",
+		Addr:   settings.Addr,
+		DBName: settings.Name,
 	}
 
 	var err error
 	DB, err = sql.Open("mysql", cfg.FormatDSN())
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "Failed to open the database", "error", err)
 	}
 
 	if err = DB.Ping(); err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "Failed to connect to the database", "addr", settings.Addr, "error", err)
 	}
-	fmt.Println("Connected to the location history database!")
+	logger.Info("Connected to the location history database", "addr", settings.Addr)
+}
+
+// pings the database for the readiness check
+func HealthCheck(ctx context.Context) (string, error) {
+	if err := DB.PingContext(ctx); err != nil {
+		return "", fmt.Errorf("healthCheck: %v", err)
+	}
+	return fmt.Sprintf("%d open connections", DB.Stats().OpenConnections), nil
 }
 
 // inserts a new location record into the location_history table
-func SaveLocation(username string, lat, lon float64, recordedAt string) error {
-	_, err := DB.Exec("INSERT INTO location_history (username, latitude, longitude, recorded_at) VALUES (?, ?, ?, ?)",
-		username, lat, lon, recordedAt)
-	return err
+// records repeating an already stored (username, fixID) pair are ignored, inserted reports whether a row was written
+func SaveLocation(ctx context.Context, q Querier, username string, lat, lon float64, recordedAt, fixID string) (bool, error) {
+	ctx, span := tracing.StartQuery(ctx, "SaveLocation")
+	defer span.End()
+	defer metrics.ObserveQuery("SaveLocation", time.Now())
+
+	result, err := q.ExecContext(ctx, "INSERT INTO location_history (username, latitude, longitude, recorded_at, fix_id) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id",
+		username, lat, lon, recordedAt, sql.NullString{String: fixID, Valid: fixID != ""})
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+// removes every location_history record of a user and returns how many rows were deleted
+func DeleteUserLocations(ctx context.Context, username string) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "DeleteUserLocations")
+	defer span.End()
+
+	result, err := DB.ExecContext(ctx, "DELETE FROM location_history WHERE username = ?", username)
+	if err != nil {
+		return 0, fmt.Errorf("DeleteUserLocations: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("DeleteUserLocations: %v", err)
+	}
+	return rowsAffected, nil
+}
+
+// locks every location_history record of a user until the transaction ends and returns how many there are
+// inserts of new records for the user wait for the lock as well
+func LockUserLocations(ctx context.Context, tx *sql.Tx, username string) (int, error) {
+	ctx, span := tracing.StartQuery(ctx, "LockUserLocations")
+	defer span.End()
+
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM location_history WHERE username = ? FOR UPDATE", username).Scan(&count); err != nil {
+		return 0, fmt.Errorf("LockUserLocations: %v", err)
+	}
+	return count, nil
 }
 
 // retrieves a users location history between two dates
-func GetUserLocations(username, startDate, endDate string) ([]models.LocationHistory, error) {
+func GetUserLocations(ctx context.Context, username, startDate, endDate string) ([]models.LocationHistory, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetUserLocations")
+	defer span.End()
+	defer metrics.ObserveQuery("GetUserLocations", time.Now())
+
 	query := `
 		SELECT id, username, latitude, longitude, recorded_at 
 		FROM location_history 
@@ -52,7 +132,7 @@ func GetUserLocations(username, startDate, endDate string) ([]models.LocationHis
 		ORDER BY recorded_at ASC
 	`
 
-	rows, err := DB.Query(query, username, startDate, endDate)
+	rows, err := DB.QueryContext(ctx, query, username, startDate, endDate)
 	if err != nil {
 		return nil, fmt.Errorf("GetUserLocations: %v", err)
 	}
@@ -70,3 +150,117 @@ func GetUserLocations(username, startDate, endDate string) ([]models.LocationHis
 
 	return history, nil
 }
+
+// lists the users having location records between start (inclusive) and end (exclusive)
+func GetUsersWithLocationsBetween(ctx context.Context, start, end string) ([]string, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetUsersWithLocationsBetween")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, "SELECT DISTINCT username FROM location_history WHERE recorded_at >= ? AND recorded_at < ?", start, end)
+	if err != nil {
+		return nil, fmt.Errorf("GetUsersWithLocationsBetween: %v", err)
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, fmt.Errorf("GetUsersWithLocationsBetween: %v", err)
+		}
+		users = append(users, username)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetUsersWithLocationsBetween: %v", err)
+	}
+	return users, nil
+}
+
+// retrieves up to limit records of a user recorded before end, ordered by time and continuing after the (afterAt, afterID) record
+func GetUserLocationsPage(ctx context.Context, q Querier, username, afterAt string, afterID int, end string, limit int) ([]models.LocationHistory, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetUserLocationsPage")
+	defer span.End()
+
+	query := `
+		SELECT id, username, latitude, longitude, recorded_at
+		FROM location_history
+		WHERE username = ? AND recorded_at < ? AND (recorded_at > ? OR (recorded_at = ? AND id > ?))
+		ORDER BY recorded_at ASC, id ASC
+		LIMIT ?
+	`
+
+	rows, err := q.QueryContext(ctx, query, username, end, afterAt, afterAt, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("GetUserLocationsPage: %v", err)
+	}
+	defer rows.Close()
+
+	var history []models.LocationHistory
+	for rows.Next() {
+		var loc models.LocationHistory
+		if err := rows.Scan(&loc.ID, &loc.Username, &loc.Latitude, &loc.Longitude, &loc.RecordedAt); err != nil {
+			return nil, fmt.Errorf("GetUserLocationsPage: %v", err)
+		}
+		history = append(history, loc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetUserLocationsPage: %v", err)
+	}
+	return history, nil
+}
+
+// removes the location records with the given ids and returns how many rows were deleted
+func DeleteLocationsByID(ctx context.Context, ids []int) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "DeleteLocationsByID")
+	defer span.End()
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	result, err := DB.ExecContext(ctx, "DELETE FROM location_history WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return 0, fmt.Errorf("DeleteLocationsByID: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("DeleteLocationsByID: %v", err)
+	}
+	return rowsAffected, nil
+}
+
+// counts the location records older than before
+func CountLocationsBefore(ctx context.Context, before string) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "CountLocationsBefore")
+	defer span.End()
+
+	var count int64
+	if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM location_history WHERE recorded_at < ?", before).Scan(&count); err != nil {
+		return 0, fmt.Errorf("CountLocationsBefore: %v", err)
+	}
+	return count, nil
+}
+
+// removes up to limit location records older than before and returns how many rows were deleted
+func DeleteLocationsBefore(ctx context.Context, before string, limit int) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "DeleteLocationsBefore")
+	defer span.End()
+
+	result, err := DB.ExecContext(ctx, "DELETE FROM location_history WHERE recorded_at < ? LIMIT ?", before, limit)
+	if err != nil {
+		return 0, fmt.Errorf("DeleteLocationsBefore: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("DeleteLocationsBefore: %v", err)
+	}
+	return rowsAffected, nil
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go-nauka/geo"
+	"go-nauka/tracing"
+)
+
+// calls fn for every recorded position inside bounds with recorded_at in [start, end)
+// rows are streamed so a large window is never held in memory, an empty usernames list includes every user
+func ForEachLocationIn(ctx context.Context, bounds geo.Bounds, start, end string, usernames []string, fn func(geo.LatLng)) error {
+	ctx, span := tracing.StartQuery(ctx, "ForEachLocationIn")
+	defer span.End()
+
+	query := "SELECT latitude, longitude FROM location_history WHERE recorded_at >= ? AND recorded_at < ? AND latitude BETWEEN ? AND ?"
+	if bounds.CrossesAntimeridian() {
+		query += " AND (longitude >= ? OR longitude <= ?)"
+	} else {
+		query += " AND longitude BETWEEN ? AND ?"
+	}
+	args := []interface{}{start, end, bounds.SouthWest.Lat, bounds.NorthEast.Lat, bounds.SouthWest.Lng, bounds.NorthEast.Lng}
+
+	if len(usernames) > 0 {
+		query += " AND username IN (?" + strings.Repeat(", ?", len(usernames)-1) + ")"
+		for _, username := range usernames {
+			args = append(args, username)
+		}
+	}
+
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("ForEachLocationIn: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p geo.LatLng
+		if err := rows.Scan(&p.Lat, &p.Lng); err != nil {
+			return fmt.Errorf("ForEachLocationIn: %v", err)
+		}
+		fn(p)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("ForEachLocationIn: %v", err)
+	}
+	return nil
+}
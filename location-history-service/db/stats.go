@@ -0,0 +1,207 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"go-nauka/location-history-service/models"
+	"go-nauka/tracing"
+)
+
+const dailyStatsColumns = `username, day, distance_km, moving_seconds, point_count,
+	min_latitude, max_latitude, min_longitude, max_longitude,
+	first_fix_at, last_fix_at, last_latitude, last_longitude`
+
+// scans a location_daily_stats row selected with dailyStatsColumns
+func scanDailyStats(scan func(dest ...interface{}) error) (models.DailyStats, error) {
+	var s models.DailyStats
+	err := scan(&s.Username, &s.Day, &s.DistanceKm, &s.MovingSeconds, &s.PointCount,
+		&s.MinLatitude, &s.MaxLatitude, &s.MinLongitude, &s.MaxLongitude,
+		&s.FirstFixAt, &s.LastFixAt, &s.LastLatitude, &s.LastLongitude)
+	return s, err
+}
+
+// retrieves the statistics of a user for a single day, returns nil if there are none
+func GetDailyStats(ctx context.Context, q Querier, username, day string) (*models.DailyStats, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetDailyStats")
+	defer span.End()
+
+	row := q.QueryRowContext(ctx, "SELECT "+dailyStatsColumns+" FROM location_daily_stats WHERE username = ? AND day = ?", username, day)
+
+	s, err := scanDailyStats(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetDailyStats: %v", err)
+	}
+	return &s, nil
+}
+
+// retrieves the most recent day of statistics of a user, returns nil if there are none
+func GetLatestDailyStats(ctx context.Context, q Querier, username string) (*models.DailyStats, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetLatestDailyStats")
+	defer span.End()
+
+	row := q.QueryRowContext(ctx, "SELECT "+dailyStatsColumns+" FROM location_daily_stats WHERE username = ? ORDER BY day DESC LIMIT 1", username)
+
+	s, err := scanDailyStats(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetLatestDailyStats: %v", err)
+	}
+	return &s, nil
+}
+
+// retrieves the daily statistics of a user between two days (inclusive) ordered by day
+func GetDailyStatsRange(ctx context.Context, username, startDay, endDay string) ([]models.DailyStats, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetDailyStatsRange")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, "SELECT "+dailyStatsColumns+" FROM location_daily_stats WHERE username = ? AND day BETWEEN ? AND ? ORDER BY day ASC",
+		username, startDay, endDay)
+	if err != nil {
+		return nil, fmt.Errorf("GetDailyStatsRange: %v", err)
+	}
+	defer rows.Close()
+
+	var days []models.DailyStats
+	for rows.Next() {
+		s, err := scanDailyStats(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("GetDailyStatsRange: %v", err)
+		}
+		days = append(days, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetDailyStatsRange: %v", err)
+	}
+	return days, nil
+}
+
+// inserts or replaces the statistics of a user for a single day
+func UpsertDailyStats(ctx context.Context, q Querier, s models.DailyStats) error {
+	ctx, span := tracing.StartQuery(ctx, "UpsertDailyStats")
+	defer span.End()
+
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO location_daily_stats (`+dailyStatsColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			distance_km = VALUES(distance_km), moving_seconds = VALUES(moving_seconds), point_count = VALUES(point_count),
+			min_latitude = VALUES(min_latitude), max_latitude = VALUES(max_latitude),
+			min_longitude = VALUES(min_longitude), max_longitude = VALUES(max_longitude),
+			first_fix_at = VALUES(first_fix_at), last_fix_at = VALUES(last_fix_at),
+			last_latitude = VALUES(last_latitude), last_longitude = VALUES(last_longitude)
+	`, s.Username, s.Day, s.DistanceKm, s.MovingSeconds, s.PointCount,
+		s.MinLatitude, s.MaxLatitude, s.MinLongitude, s.MaxLongitude,
+		s.FirstFixAt, s.LastFixAt, s.LastLatitude, s.LastLongitude)
+	if err != nil {
+		return fmt.Errorf("UpsertDailyStats: %v", err)
+	}
+	return nil
+}
+
+// removes all daily statistics of a user and returns how many days were deleted
+func DeleteDailyStats(ctx context.Context, q Querier, username string) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "DeleteDailyStats")
+	defer span.End()
+
+	result, err := q.ExecContext(ctx, "DELETE FROM location_daily_stats WHERE username = ?", username)
+	if err != nil {
+		return 0, fmt.Errorf("DeleteDailyStats: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("DeleteDailyStats: %v", err)
+	}
+	return rowsAffected, nil
+}
+
+// lists every user with recorded location history
+func GetUsernames(ctx context.Context) ([]string, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetUsernames")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, "SELECT DISTINCT username FROM location_history")
+	if err != nil {
+		return nil, fmt.Errorf("GetUsernames: %v", err)
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, fmt.Errorf("GetUsernames: %v", err)
+		}
+		users = append(users, username)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetUsernames: %v", err)
+	}
+	return users, nil
+}
+
+// condition selecting the rows of location_daily_stats (aliased d) of users the viewer may see, the viewer themselves
+// and users sharing their location with them through a share that has not expired, the viewer is passed three times
+// mirrors the sharing rules of the location service, which owns the location_shares table in the same database
+const visibleStats = `(d.username = ? OR EXISTS (
+		SELECT 1 FROM location_shares s
+		WHERE s.owner = d.username
+			AND (s.expires_at IS NULL OR s.expires_at > UTC_TIMESTAMP())
+			AND (s.grantee_type = 'everyone'
+				OR (s.grantee_type = 'user' AND s.grantee = ?)
+				OR (s.grantee_type = 'group' AND s.grantee IN (
+					SELECT m.group_name FROM group_members m JOIN user_groups g ON g.name = m.group_name
+					WHERE m.username = ? AND g.owner = s.owner)))))`
+
+// ranks users by the distance travelled between two days (inclusive) using the daily rollups
+// distances are compared in meters, ties are ordered by username
+// only users visible to the viewer are ranked, an empty viewer (an admin) ranks everyone
+func GetLeaderboard(ctx context.Context, viewer, startDay, endDay string, limit, offset int) ([]models.LeaderboardEntry, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetLeaderboard")
+	defer span.End()
+
+	where := "d.day BETWEEN ? AND ?"
+	args := []any{startDay, endDay}
+	if viewer != "" {
+		where += " AND " + visibleStats
+		args = append(args, viewer, viewer, viewer)
+	}
+
+	query := `
+		SELECT RANK() OVER (ORDER BY distance_km DESC) AS position, username, distance_km, moving_seconds
+		FROM (
+			SELECT d.username, ROUND(SUM(d.distance_km), 3) AS distance_km, SUM(d.moving_seconds) AS moving_seconds
+			FROM location_daily_stats d
+			WHERE ` + where + `
+			GROUP BY d.username
+		) totals
+		ORDER BY distance_km DESC, username ASC
+		LIMIT ? OFFSET ?
+	`
+
+	rows, err := DB.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf("GetLeaderboard: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []models.LeaderboardEntry{}
+	for rows.Next() {
+		var entry models.LeaderboardEntry
+		if err := rows.Scan(&entry.Rank, &entry.Username, &entry.DistanceKm, &entry.MovingSeconds); err != nil {
+			return nil, fmt.Errorf("GetLeaderboard: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetLeaderboard: %v", err)
+	}
+	return entries, nil
+}
@@ -19,7 +19,8 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	LocationHistoryService_RecordLocation_FullMethodName = "/location.LocationHistoryService/RecordLocation"
+	LocationHistoryService_RecordLocation_FullMethodName    = "/location.LocationHistoryService/RecordLocation"
+	LocationHistoryService_DeleteUserHistory_FullMethodName = "/location.LocationHistoryService/DeleteUserHistory"
 )
 
 // LocationHistoryServiceClient is the client API for LocationHistoryService service.
@@ -27,6 +28,7 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type LocationHistoryServiceClient interface {
 	RecordLocation(ctx context.Context, in *LocationRequest, opts ...grpc.CallOption) (*LocationResponse, error)
+	DeleteUserHistory(ctx context.Context, in *DeleteUserHistoryRequest, opts ...grpc.CallOption) (*DeleteUserHistoryResponse, error)
 }
 
 type locationHistoryServiceClient struct {
@@ -47,11 +49,22 @@ func (c *locationHistoryServiceClient) RecordLocation(ctx context.Context, in *L
 	return out, nil
 }
 
+func (c *locationHistoryServiceClient) DeleteUserHistory(ctx context.Context, in *DeleteUserHistoryRequest, opts ...grpc.CallOption) (*DeleteUserHistoryResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteUserHistoryResponse)
+	err := c.cc.Invoke(ctx, LocationHistoryService_DeleteUserHistory_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LocationHistoryServiceServer is the server API for LocationHistoryService service.
 // All implementations must embed UnimplementedLocationHistoryServiceServer
 // for forward compatibility.
 type LocationHistoryServiceServer interface {
 	RecordLocation(context.Context, *LocationRequest) (*LocationResponse, error)
+	DeleteUserHistory(context.Context, *DeleteUserHistoryRequest) (*DeleteUserHistoryResponse, error)
 	mustEmbedUnimplementedLocationHistoryServiceServer()
 }
 
@@ -65,6 +78,9 @@ type UnimplementedLocationHistoryServiceServer struct{}
 func (UnimplementedLocationHistoryServiceServer) RecordLocation(context.Context, *LocationRequest) (*LocationResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method RecordLocation not implemented")
 }
+func (UnimplementedLocationHistoryServiceServer) DeleteUserHistory(context.Context, *DeleteUserHistoryRequest) (*DeleteUserHistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUserHistory not implemented")
+}
 func (UnimplementedLocationHistoryServiceServer) mustEmbedUnimplementedLocationHistoryServiceServer() {
 }
 func (UnimplementedLocationHistoryServiceServer) testEmbeddedByValue() {}
@@ -105,6 +121,24 @@ func _LocationHistoryService_RecordLocation_Handler(srv interface{}, ctx context
 	return interceptor(ctx, in, info, handler)
 }
 
+func _LocationHistoryService_DeleteUserHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUserHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LocationHistoryServiceServer).DeleteUserHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LocationHistoryService_DeleteUserHistory_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LocationHistoryServiceServer).DeleteUserHistory(ctx, req.(*DeleteUserHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // LocationHistoryService_ServiceDesc is the grpc.ServiceDesc for LocationHistoryService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -116,6 +150,10 @@ var LocationHistoryService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "RecordLocation",
 			Handler:    _LocationHistoryService_RecordLocation_Handler,
 		},
+		{
+			MethodName: "DeleteUserHistory",
+			Handler:    _LocationHistoryService_DeleteUserHistory_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/location.proto",
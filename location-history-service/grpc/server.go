@@ -6,18 +6,57 @@ import (
 
 	"go-nauka/location-history-service/db"
 	pb "go-nauka/location-history-service/grpc/proto"
+	"go-nauka/location-history-service/stats"
+	"go-nauka/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// recorded locations by result, "duplicate" for repeated fix ids
+var recordedLocations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "location_history_records_total",
+	Help: "Locations received from location-service, by result.",
+}, []string{"result"})
+
+var logger = logging.For("grpc")
+
 // implements the LocationHistoryServiceServer interface for handling GRPC requests
 type Server struct {
 	pb.UnimplementedLocationHistoryServiceServer
 }
 
-// handles incoming GRPC requests to store user location data using SaveLocation func from db package
+// handles incoming GRPC requests to store user location data using Record func from stats package
+// a request repeating an already recorded fix id is acknowledged without storing it again
+// new records are added to the users daily statistics in the same transaction
 func (s *Server) RecordLocation(ctx context.Context, req *pb.LocationRequest) (*pb.LocationResponse, error) {
-	err := db.SaveLocation(req.Username, req.Latitude, req.Longitude, req.RecordedAt)
+	inserted, err := stats.Record(ctx, req.Username, req.Latitude, req.Longitude, req.RecordedAt, req.FixId)
 	if err != nil {
+		recordedLocations.WithLabelValues("failed").Inc()
+		logger.ErrorContext(ctx, "Failed to record location", "username", req.Username, "error", err)
 		return &pb.LocationResponse{Status: "Failed"}, err
 	}
+	if !inserted {
+		recordedLocations.WithLabelValues("duplicate").Inc()
+		logger.DebugContext(ctx, "Ignored duplicate location", "username", req.Username, "fix_id", req.FixId)
+		return &pb.LocationResponse{Status: "Duplicate"}, nil
+	}
+	recordedLocations.WithLabelValues("inserted").Inc()
+	logger.DebugContext(ctx, "Recorded location", "username", req.Username, "latitude", req.Latitude, "longitude", req.Longitude)
 	return &pb.LocationResponse{Status: "Success"}, nil
 }
+
+// handles incoming GRPC requests to erase a users whole location history and daily statistics
+func (s *Server) DeleteUserHistory(ctx context.Context, req *pb.DeleteUserHistoryRequest) (*pb.DeleteUserHistoryResponse, error) {
+	deletedRows, err := db.DeleteUserLocations(ctx, req.Username)
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to delete user history", "username", req.Username, "error", err)
+		return nil, err
+	}
+	if _, err := db.DeleteDailyStats(ctx, db.DB, req.Username); err != nil {
+		logger.ErrorContext(ctx, "Failed to delete daily stats", "username", req.Username, "error", err)
+		return nil, err
+	}
+	logger.InfoContext(ctx, "Deleted user history", "username", req.Username, "records", deletedRows)
+	return &pb.DeleteUserHistoryResponse{DeletedRows: deletedRows}, nil
+}
@@ -3,32 +3,330 @@ package handlers
 
 import (
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"go-nauka/geo"
+	"go-nauka/jwtauth"
+	"go-nauka/location-history-service/analytics"
 	"go-nauka/location-history-service/db"
+	"go-nauka/location-history-service/heatmap"
+	"go-nauka/location-history-service/retention"
+	"go-nauka/location-history-service/stats"
 	"go-nauka/location-history-service/utils"
+	"go-nauka/logging"
 
 	"github.com/gin-gonic/gin"
 )
 
+var logger = logging.For("handlers")
+
 // handles GET requests for calculating the total distance traveled by the user
+// method selects the distance formula, haversine (default) or the WGS-84 geodesic
+// username defaults to the caller, other users need the admin scope
 func CalculateDistance(c *gin.Context) {
-	username := c.Query("username")
+	username := c.DefaultQuery("username", jwtauth.Subject(c))
+	if !jwtauth.CanRead(c, username) {
+		return
+	}
 	startDate := c.DefaultQuery("start", time.Now().Add(-24*time.Hour).Format(time.RFC3339))
 	endDate := c.DefaultQuery("end", time.Now().Format(time.RFC3339))
+	method := c.DefaultQuery("method", geo.MethodHaversine)
+
+	distance, err := geo.DistanceFuncFor(method)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid distance method"})
+		return
+	}
 
-	locations, err := db.GetUserLocations(username, startDate, endDate)
+	locations, err := db.GetUserLocations(c.Request.Context(), username, startDate, endDate)
 	if err != nil {
-		log.Printf("Error fetching user locations: %v", err)
+		logger.ErrorContext(c.Request.Context(), "Error fetching user locations", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch locations"})
 		return
 	}
 
-	totalDistance := utils.CalculateTotalDistance(locations)
+	totalDistance := utils.CalculateTotalDistance(locations, distance)
 	c.JSON(http.StatusOK, gin.H{
 		"username":      username,
+		"method":        method,
 		"totalDistance": fmt.Sprintf("%.2f km", totalDistance),
 	})
 }
+
+// handles GET requests for the speed analysis of a users track
+// bands sets the speed band edges in km/h (e.g. "1,7,25,60"), method selects the distance formula
+// username defaults to the caller, other users need the admin scope
+func SpeedAnalytics(c *gin.Context) {
+	username := c.DefaultQuery("username", jwtauth.Subject(c))
+	startDate := c.DefaultQuery("start", time.Now().Add(-24*time.Hour).Format(time.RFC3339))
+	endDate := c.DefaultQuery("end", time.Now().Format(time.RFC3339))
+	method := c.DefaultQuery("method", geo.MethodHaversine)
+
+	if username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing username"})
+		return
+	}
+	if !jwtauth.CanRead(c, username) {
+		return
+	}
+
+	distance, err := geo.DistanceFuncFor(method)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid distance method"})
+		return
+	}
+
+	config := analytics.DefaultConfig()
+	if spec := c.Query("bands"); spec != "" {
+		config.Bands, err = analytics.ParseBands(spec)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid speed bands"})
+			return
+		}
+	}
+
+	locations, err := db.GetUserLocations(c.Request.Context(), username, startDate, endDate)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Error fetching user locations", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch locations"})
+		return
+	}
+
+	summary, err := analytics.Analyze(locations, distance, config)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Error analysing user locations", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not analyse locations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"username": username,
+		"method":   method,
+		"speed":    summary,
+	})
+}
+
+// handles GET requests for a dry run of the retention policy
+// reports how many records each tier would compact and how many would be deleted without changing anything
+func RetentionReport(c *gin.Context) {
+	report, err := retention.Run(c.Request.Context(), retention.Current, time.Now(), true)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Error running retention dry run", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not build retention report"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// handles GET requests for a users activity statistics read from the daily rollups
+// granularity groups the days by day, week or month, start and end are days in YYYY-MM-DD format
+// username defaults to the caller, other users need the admin scope
+func UserStats(c *gin.Context) {
+	username := c.DefaultQuery("username", jwtauth.Subject(c))
+	granularity := c.DefaultQuery("granularity", stats.Day)
+	startDay := c.DefaultQuery("start", time.Now().AddDate(0, 0, -30).UTC().Format(stats.DayLayout))
+	endDay := c.DefaultQuery("end", time.Now().UTC().Format(stats.DayLayout))
+
+	if username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing username"})
+		return
+	}
+	if !jwtauth.CanRead(c, username) {
+		return
+	}
+	if granularity != stats.Day && granularity != stats.Week && granularity != stats.Month {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid granularity"})
+		return
+	}
+
+	days, err := db.GetDailyStatsRange(c.Request.Context(), username, startDay, endDay)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Error fetching daily stats", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch stats"})
+		return
+	}
+
+	buckets, err := stats.Aggregate(days, granularity)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Error aggregating daily stats", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not aggregate stats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"username":    username,
+		"granularity": granularity,
+		"stats":       buckets,
+	})
+}
+
+// largest page size accepted by the leaderboard
+const maxLeaderboardLimit = 100
+
+// handles GET requests for ranking users by distance travelled between two days
+// supports pagination with limit and page, has_more tells whether another page exists
+// callers only see themselves and the users sharing their location with them, admins see everyone
+func Leaderboard(c *gin.Context) {
+	startDay := c.DefaultQuery("start", time.Now().AddDate(0, 0, -7).UTC().Format(stats.DayLayout))
+	endDay := c.DefaultQuery("end", time.Now().UTC().Format(stats.DayLayout))
+
+	start, err := time.Parse(stats.DayLayout, startDay)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start date"})
+		return
+	}
+	end, err := time.Parse(stats.DayLayout, endDay)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end date"})
+		return
+	}
+	if end.Before(start) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "End date must not be before start date"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit < 1 {
+		limit = 10
+	}
+	if limit > maxLeaderboardLimit {
+		limit = maxLeaderboardLimit
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	viewer := jwtauth.Subject(c)
+	if jwtauth.IsAdmin(c) {
+		viewer = ""
+	}
+
+	entries, err := db.GetLeaderboard(c.Request.Context(), viewer, startDay, endDay, limit+1, (page-1)*limit)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Error fetching leaderboard", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch leaderboard"})
+		return
+	}
+
+	hasMore := len(entries) > limit
+	if hasMore {
+		entries = entries[:limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"start":    startDay,
+		"end":      endDay,
+		"page":     page,
+		"limit":    limit,
+		"has_more": hasMore,
+		"entries":  entries,
+	})
+}
+
+// builds the heatmap query from the start, end and users parameters, the window defaults to the last 30 days
+// without the admin scope users defaults to the caller and may not name anyone else, responds with 403 and returns false then
+func heatmapQuery(c *gin.Context) (heatmap.Query, bool) {
+	q := heatmap.Query{
+		Start: c.DefaultQuery("start", time.Now().AddDate(0, 0, -30).Format(time.RFC3339)),
+		End:   c.DefaultQuery("end", time.Now().Format(time.RFC3339)),
+	}
+	for _, username := range strings.Split(c.Query("users"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			q.Usernames = append(q.Usernames, username)
+		}
+	}
+
+	if !jwtauth.IsAdmin(c) {
+		if len(q.Usernames) == 0 {
+			q.Usernames = []string{jwtauth.Subject(c)}
+		}
+		for _, username := range q.Usernames {
+			if !jwtauth.CanRead(c, username) {
+				return q, false
+			}
+		}
+	}
+	return q, true
+}
+
+// handles GET requests for the number of recorded positions per Web-Mercator tile at a zoom level
+// bbox limits the grid to "west,south,east,north", users to a comma separated list of usernames
+func HeatmapGrid(c *gin.Context) {
+	zoom, err := strconv.Atoi(c.DefaultQuery("zoom", "10"))
+	if err != nil || zoom < 0 || zoom > geo.MaxZoom {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid zoom"})
+		return
+	}
+
+	bounds := geo.World()
+	if bbox := c.Query("bbox"); bbox != "" {
+		bounds, err = geo.ParseBounds(bbox)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bbox"})
+			return
+		}
+	}
+
+	q, ok := heatmapQuery(c)
+	if !ok {
+		return
+	}
+	cells, err := heatmap.Grid(c.Request.Context(), zoom, bounds, q)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Error building heatmap grid", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not build heatmap"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"zoom":  zoom,
+		"start": q.Start,
+		"end":   q.End,
+		"cells": cells,
+	})
+}
+
+// handles GET requests for a rendered heatmap tile at /history/heatmap/{z}/{x}/{y}.png
+// radius sets the blur radius in pixels and saturation how many overlapping points reach full colour
+func HeatmapTile(c *gin.Context) {
+	y, isPNG := strings.CutSuffix(c.Param("y"), ".png")
+	z, errZ := strconv.Atoi(c.Param("z"))
+	x, errX := strconv.Atoi(c.Param("x"))
+	row, errY := strconv.Atoi(y)
+	if !isPNG || errZ != nil || errX != nil || errY != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tile"})
+		return
+	}
+	tile, err := geo.NewTile(z, x, row)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tile"})
+		return
+	}
+
+	style := heatmap.DefaultStyle()
+	if radius, err := strconv.Atoi(c.Query("radius")); err == nil && radius >= 1 && radius <= heatmap.MaxRadius {
+		style.Radius = radius
+	}
+	if saturation, err := strconv.ParseFloat(c.Query("saturation"), 64); err == nil && saturation > 0 {
+		style.Saturation = saturation
+	}
+
+	q, ok := heatmapQuery(c)
+	if !ok {
+		return
+	}
+	image, err := heatmap.Render(c.Request.Context(), tile, q, style)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Error rendering heatmap tile", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not render heatmap"})
+		return
+	}
+
+	c.Data(http.StatusOK, "image/png", image)
+}
@@ -0,0 +1,54 @@
+// package aggregates location history into Web-Mercator grids and renders heatmap tiles
+package heatmap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"go-nauka/geo"
+	"go-nauka/location-history-service/db"
+)
+
+// Query selects the recorded positions aggregated into a heatmap
+// records are taken from [Start, End), an empty Usernames list includes every user
+type Query struct {
+	Start     string
+	End       string
+	Usernames []string
+}
+
+// Cell is the number of recorded positions inside a tile of the grid
+type Cell struct {
+	X      int        `json:"x"`
+	Y      int        `json:"y"`
+	Count  int64      `json:"count"`
+	Center geo.LatLng `json:"center"`
+}
+
+// counts the recorded positions inside bounds per tile at the given zoom
+// cells are ordered by count, the busiest first
+func Grid(ctx context.Context, zoom int, bounds geo.Bounds, q Query) ([]Cell, error) {
+	counts := map[geo.Tile]int64{}
+	err := db.ForEachLocationIn(ctx, bounds, q.Start, q.End, q.Usernames, func(p geo.LatLng) {
+		counts[geo.TileFor(p, zoom)]++
+	})
+	if err != nil {
+		return nil, fmt.Errorf("heatmap: %v", err)
+	}
+
+	cells := make([]Cell, 0, len(counts))
+	for tile, count := range counts {
+		cells = append(cells, Cell{X: tile.X, Y: tile.Y, Count: count, Center: tile.Center()})
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Count != cells[j].Count {
+			return cells[i].Count > cells[j].Count
+		}
+		if cells[i].Y != cells[j].Y {
+			return cells[i].Y < cells[j].Y
+		}
+		return cells[i].X < cells[j].X
+	})
+	return cells, nil
+}
@@ -0,0 +1,177 @@
+package heatmap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+
+	"go-nauka/geo"
+	"go-nauka/location-history-service/db"
+)
+
+const (
+	// default blur radius of a point in pixels
+	DefaultRadius = 8
+	MaxRadius     = 64
+	// default number of overlapping points rendered at about two thirds of the full colour
+	DefaultSaturation = 5.0
+)
+
+// Style controls how points are drawn on a tile
+// the scale does not depend on the tile content so neighbouring tiles match at their edges
+type Style struct {
+	Radius     int
+	Saturation float64
+}
+
+// returns the default style
+func DefaultStyle() Style {
+	return Style{Radius: DefaultRadius, Saturation: DefaultSaturation}
+}
+
+// Canvas accumulates points of a tile and of a margin around it as wide as the blur radius,
+// so points just outside the tile still blur into it
+type Canvas struct {
+	tile   geo.Tile
+	radius int
+	width  int
+	counts []float64
+}
+
+// returns an empty canvas for a tile
+func NewCanvas(tile geo.Tile, radius int) *Canvas {
+	width := geo.TileSize + 2*radius
+	return &Canvas{tile: tile, radius: radius, width: width, counts: make([]float64, width*width)}
+}
+
+// adds a point, points outside the tile and its margin are ignored
+func (c *Canvas) Add(p geo.LatLng) {
+	px, py := c.tile.Pixel(p, geo.TileSize)
+	x := int(math.Floor(px)) + c.radius
+	y := int(math.Floor(py)) + c.radius
+	if x < 0 || y < 0 || x >= c.width || y >= c.width {
+		return
+	}
+	c.counts[y*c.width+x]++
+}
+
+// returns the bounds of the tile together with its margin
+func (c *Canvas) Bounds() geo.Bounds {
+	n := float64(int(1) << c.tile.Z)
+	margin := float64(c.radius) / geo.TileSize
+
+	west, east := (float64(c.tile.X)-margin)/n, (float64(c.tile.X+1)+margin)/n
+	north, south := (float64(c.tile.Y)-margin)/n, (float64(c.tile.Y+1)+margin)/n
+
+	bounds := geo.Bounds{
+		SouthWest: geo.InverseMercator(west, math.Min(south, 1)),
+		NorthEast: geo.InverseMercator(east, math.Max(north, 0)),
+	}
+	// the projection ends at about 85 degrees, points beyond it are drawn on the edge tiles
+	if north <= 0 {
+		bounds.NorthEast.Lat = 90
+	}
+	if south >= 1 {
+		bounds.SouthWest.Lat = -90
+	}
+
+	if east-west >= 1 {
+		bounds.SouthWest.Lng, bounds.NorthEast.Lng = -180, 180
+		return bounds
+	}
+	if bounds.SouthWest.Lng < -180 {
+		bounds.SouthWest.Lng += 360
+	}
+	if bounds.NorthEast.Lng > 180 {
+		bounds.NorthEast.Lng -= 360
+	}
+	return bounds
+}
+
+// blurs the points with a gaussian kernel and colours the tile
+func (c *Canvas) Image(saturation float64) *image.NRGBA {
+	kernel := gaussianKernel(c.radius)
+
+	// horizontal pass over every row of the canvas, only the columns of the tile are needed
+	rows := make([]float64, c.width*geo.TileSize)
+	for y := 0; y < c.width; y++ {
+		for x := 0; x < geo.TileSize; x++ {
+			var sum float64
+			for k, weight := range kernel {
+				sum += c.counts[y*c.width+x+k] * weight
+			}
+			rows[y*geo.TileSize+x] = sum
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, geo.TileSize, geo.TileSize))
+	for y := 0; y < geo.TileSize; y++ {
+		for x := 0; x < geo.TileSize; x++ {
+			var density float64
+			for k, weight := range kernel {
+				density += rows[(y+k)*geo.TileSize+x] * weight
+			}
+			if density > 0 {
+				img.SetNRGBA(x, y, ramp(1-math.Exp(-density/saturation)))
+			}
+		}
+	}
+	return img
+}
+
+// returns a gaussian kernel of 2*radius+1 weights with a peak of 1 so a lone point has a density of 1 at its center
+func gaussianKernel(radius int) []float64 {
+	kernel := make([]float64, 2*radius+1)
+	sigma := math.Max(float64(radius)/2, 0.5)
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+	}
+	return kernel
+}
+
+// colour stops of the heatmap from cold to hot
+var stops = []color.NRGBA{
+	{0, 0, 255, 0},
+	{0, 255, 255, 0},
+	{0, 255, 0, 0},
+	{255, 255, 0, 0},
+	{255, 0, 0, 0},
+}
+
+// maps an intensity in [0, 1] to a colour, faint areas are more transparent
+func ramp(t float64) color.NRGBA {
+	t = math.Max(0, math.Min(1, t))
+	pos := t * float64(len(stops)-1)
+	i := int(math.Min(math.Floor(pos), float64(len(stops)-2)))
+	f := pos - float64(i)
+
+	lerp := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + (float64(b)-float64(a))*f))
+	}
+	from, to := stops[i], stops[i+1]
+	return color.NRGBA{
+		R: lerp(from.R, to.R),
+		G: lerp(from.G, to.G),
+		B: lerp(from.B, to.B),
+		A: uint8(math.Round(255 * math.Min(1, math.Sqrt(t)*1.2))),
+	}
+}
+
+// renders the heatmap tile of the selected records as a PNG
+func Render(ctx context.Context, tile geo.Tile, q Query, style Style) ([]byte, error) {
+	canvas := NewCanvas(tile, style.Radius)
+	if err := db.ForEachLocationIn(ctx, canvas.Bounds(), q.Start, q.End, q.Usernames, canvas.Add); err != nil {
+		return nil, fmt.Errorf("heatmap: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas.Image(style.Saturation)); err != nil {
+		return nil, fmt.Errorf("heatmap: %v", err)
+	}
+	return buf.Bytes(), nil
+}
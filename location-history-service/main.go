@@ -2,46 +2,212 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"go-nauka/config"
+	"go-nauka/grpcauth"
+	"go-nauka/health"
+	"go-nauka/jwtauth"
 	"go-nauka/location-history-service/db"
 	"go-nauka/location-history-service/grpc"
+	"go-nauka/location-history-service/retention"
 	"go-nauka/location-history-service/routes"
+	"go-nauka/location-history-service/stats"
+	"go-nauka/logging"
+	"go-nauka/metrics"
+	"go-nauka/tracing"
 
 	pb "go-nauka/location-history-service/grpc/proto"
 
 	gr "google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/gin-gonic/gin"
 )
 
-// initalizes the database connection and starts GRPC and REST servers
+var logger = logging.For("main")
+
+// loads the config, initalizes the database connection and starts GRPC and REST servers until SIGINT or SIGTERM
+// with -rebuild-stats it only recomputes the daily statistics from the location history and exits,
+// with --print-config it only prints the resolved config
 func main() {
-	db.InitDB()
+	rebuildStats := flag.Bool("rebuild-stats", false, "rebuild daily statistics from location history and exit")
+	rebuildUser := flag.String("rebuild-user", "", "limit -rebuild-stats to a single user")
+	cfg, err := config.Load(config.HistoryService, flag.CommandLine, os.Args[1:])
+	if err != nil {
+		logging.Fatal(logger, "Failed to load the config", "error", err)
+	}
+	if cfg.PrintOnly {
+		if err := cfg.Print(os.Stdout); err != nil {
+			logging.Fatal(logger, "Failed to print the config", "error", err)
+		}
+		return
+	}
 
-	go startGRPCServer()
+	if err := logging.Setup(config.HistoryService, cfg.Logging, os.Stdout); err != nil {
+		logging.Fatal(logger, "Failed to set up logging", "error", err)
+	}
+	gin.SetMode(gin.ReleaseMode)
 
-	startRESTServer()
+	shutdownTracing, err := tracing.Setup(config.HistoryService, cfg.Tracing)
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up tracing", "error", err)
+	}
+
+	db.InitDB(cfg.Database)
+
+	if *rebuildStats {
+		rebuild(*rebuildUser)
+		shutdownTracing(context.Background())
+		db.CloseDB()
+		return
+	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	health.Default.Add("mysql", true, db.HealthCheck)
+	startRetention(cfg.History)
+
+	grpcServer := startGRPCServer(cfg.GRPC)
+	restServer := startRESTServer(cfg)
+
+	<-ctx.Done()
+	// a second signal kills the process right away
+	stop()
+	gracefulShutdown(cfg.Shutdown, restServer, grpcServer, shutdownTracing)
 }
 
-// starts the GRPC server on port 50051
-func startGRPCServer() {
-	listener, err := net.Listen("tcp", ":50051")
+// recomputes the daily statistics of one user, or of all users when username is empty
+func rebuild(username string) {
+	var err error
+	if username != "" {
+		err = stats.Rebuild(context.Background(), username)
+	} else {
+		err = stats.RebuildAll(context.Background())
+	}
 	if err != nil {
-		log.Fatalf("Failed to listen on port 50051: %v", err)
+		logging.Fatal(logger, "Failed to rebuild daily stats", "username", username, "error", err)
+	}
+	logger.Info("Daily stats rebuilt", "username", username)
+}
+
+// starts the background job applying the retention policy parsed from the config (e.g. "30d=5m,365d=delete")
+// the tolerance and interval tune the allowed distance loss per segment and how often the job runs
+func startRetention(settings config.History) {
+	retention.Current = settings.Policy
+	if !settings.Policy.Enabled() {
+		logger.Info("No retention policy configured, location history is kept forever")
+		return
 	}
 
-	grpcServer := gr.NewServer()
+	interval := time.Duration(settings.RetentionInterval)
+	retention.Start(interval)
+	health.Default.Add("retention", false, retention.Status.Check)
+	logger.Info("Retention job running", "interval", interval.String())
+}
+
+// starts the GRPC server on the address of the grpc config in the background
+// clients authenticate with a certificate signed by the configured CA or with the service token
+// the grpc.health.v1 service reports the readiness checks of the service and answers probes without the token
+func startGRPCServer(settings config.GRPC) *gr.Server {
+	options, err := grpcauth.ServerOptions(settings.Auth())
+	if err != nil {
+		logging.Fatal(logger, "Failed to configure gRPC credentials", "error", err)
+	}
+
+	listener, err := net.Listen("tcp", settings.Addr)
+	if err != nil {
+		logging.Fatal(logger, "Failed to listen", "addr", settings.Addr, "error", err)
+	}
+
+	// calls are traced, given the request id of the caller and counted before they are authenticated, so rejected ones show up too
+	options = append([]gr.ServerOption{
+		gr.ChainUnaryInterceptor(tracing.UnaryServerInterceptor, logging.UnaryServerInterceptor, metrics.UnaryServerInterceptor),
+		gr.ChainStreamInterceptor(tracing.StreamServerInterceptor, logging.StreamServerInterceptor, metrics.StreamServerInterceptor),
+	}, options...)
+	grpcServer := gr.NewServer(options...)
 	pb.RegisterLocationHistoryServiceServer(grpcServer, &grpc.Server{})
 
-	log.Println("gRPC server running on port 50051...")
-	if err := grpcServer.Serve(listener); err != nil {
-		log.Fatalf("Failed to start gRPC server: %v", err)
+	healthServer := grpchealth.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	health.Default.Serve(healthServer, 10*time.Second, pb.LocationHistoryService_ServiceDesc.ServiceName)
+
+	go func() {
+		logger.Info("gRPC server running", "addr", settings.Addr)
+		if err := grpcServer.Serve(listener); err != nil {
+			logging.Fatal(logger, "Failed to start gRPC server", "error", err)
+		}
+	}()
+	return grpcServer
+}
+
+// starts the REST server on the http address in the background, localhost:8081 by default (8080 used by location-service microservice)
+// the bearer tokens are checked with the HS256 secret or the keys of the JWKS file of the jwt config
+func startRESTServer(cfg *config.Config) *http.Server {
+	verifier, err := jwtauth.NewVerifier(cfg.JWT.Verifier())
+	if err != nil {
+		logging.Fatal(logger, "Failed to create the token verifier", "error", err)
+	}
+	jwtauth.Default = verifier
+
+	server := &http.Server{
+		Addr:    cfg.HTTP.Addr,
+		Handler: routes.SetupRouter(),
 	}
+	go func() {
+		logger.Info("REST server running", "addr", cfg.HTTP.Addr)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal(logger, "Failed to start REST server", "error", err)
+		}
+	}()
+	return server
 }
 
-// starts the REST server on localhost port 8081 (8080 used by location-service microservice)
-func startRESTServer() {
-	router := routes.SetupRouter()
-	router.Run("localhost:8081")
+// stops the service in order so no location sent by location-service is lost
+// readiness fails first, also in the grpc health service, and the servers keep accepting calls for the shutdown delay,
+// then in-flight REST requests and gRPC calls are drained, the retention job stopped,
+// the spans flushed and the database closed, all within the shutdown timeout
+func gracefulShutdown(settings config.Shutdown, restServer *http.Server, grpcServer *gr.Server, shutdownTracing func(context.Context) error) {
+	logger.Info("Shutting down server", "delay", time.Duration(settings.Delay).String(), "timeout", time.Duration(settings.Timeout).String())
+	health.Default.Shutdown()
+	time.Sleep(time.Duration(settings.Delay))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(settings.Timeout))
+	defer cancel()
+
+	if err := restServer.Shutdown(ctx); err != nil {
+		logger.Error("Failed to drain REST requests, closing their connections", "error", err)
+		restServer.Close()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logger.Error("Failed to drain gRPC calls, cancelling them", "error", ctx.Err())
+		grpcServer.Stop()
+	}
+
+	retention.Stop()
+
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("Failed to flush spans", "error", err)
+	}
+
+	db.CloseDB()
+	logger.Info("Server exited gracefully")
 }
@@ -9,3 +9,43 @@ type LocationHistory struct {
 	Longitude  float64 `json:"longitude"`
 	RecordedAt string  `json:"recorded_at"`
 }
+
+// DailyStats is the pre-aggregated activity of a user on a single day (UTC)
+// the last fix position is kept so the next update can add the distance of the new segment
+type DailyStats struct {
+	Username      string  `json:"username"`
+	Day           string  `json:"day"`
+	DistanceKm    float64 `json:"distance_km"`
+	MovingSeconds int64   `json:"moving_seconds"`
+	PointCount    int64   `json:"point_count"`
+	MinLatitude   float64 `json:"min_latitude"`
+	MaxLatitude   float64 `json:"max_latitude"`
+	MinLongitude  float64 `json:"min_longitude"`
+	MaxLongitude  float64 `json:"max_longitude"`
+	FirstFixAt    string  `json:"first_fix_at"`
+	LastFixAt     string  `json:"last_fix_at"`
+	LastLatitude  float64 `json:"last_latitude"`
+	LastLongitude float64 `json:"last_longitude"`
+}
+
+// StatsBucket aggregates daily statistics over a day, week or month starting at Period
+type StatsBucket struct {
+	Period        string  `json:"period"`
+	DistanceKm    float64 `json:"distance_km"`
+	MovingSeconds int64   `json:"moving_seconds"`
+	PointCount    int64   `json:"point_count"`
+	MinLatitude   float64 `json:"min_latitude"`
+	MaxLatitude   float64 `json:"max_latitude"`
+	MinLongitude  float64 `json:"min_longitude"`
+	MaxLongitude  float64 `json:"max_longitude"`
+	FirstFixAt    string  `json:"first_fix_at"`
+	LastFixAt     string  `json:"last_fix_at"`
+}
+
+// LeaderboardEntry is a users position in the distance ranking, users with equal distance share a rank
+type LeaderboardEntry struct {
+	Rank          int     `json:"rank"`
+	Username      string  `json:"username"`
+	DistanceKm    float64 `json:"distance_km"`
+	MovingSeconds int64   `json:"moving_seconds"`
+}
@@ -0,0 +1,59 @@
+package retention
+
+import (
+	"time"
+
+	"go-nauka/geo"
+	"go-nauka/location-history-service/models"
+	"go-nauka/location-history-service/utils"
+)
+
+// picks the points of a time ordered batch that can be removed when keeping one point per interval
+// anchor is the last point kept before the batch (nil for the first batch)
+// a removed point is restored when dropping it would shorten the track by more than toleranceKm,
+// the last point of the batch is always kept so later batches never depend on already deleted rows
+// returns the ids of the points to remove
+func Downsample(points []models.LocationHistory, anchor *models.LocationHistory, interval time.Duration, toleranceKm float64) []int {
+	keep := make([]bool, len(points))
+
+	var anchorAt time.Time
+	if anchor != nil {
+		anchorAt, _ = utils.ParseTimestamp(anchor.RecordedAt)
+	}
+	pathKm := 0.0
+
+	for i := range points {
+		recordedAt, err := utils.ParseTimestamp(points[i].RecordedAt)
+		if anchor == nil || err != nil {
+			keep[i] = true
+			anchor, anchorAt, pathKm = &points[i], recordedAt, 0
+			continue
+		}
+
+		prev := anchor
+		if i > 0 {
+			prev = &points[i-1]
+		}
+		pathKm += geo.Haversine(utils.Position(*prev), utils.Position(points[i]))
+
+		direct := geo.Haversine(utils.Position(*anchor), utils.Position(points[i]))
+		if pathKm-direct > toleranceKm && i > 0 && !keep[i-1] {
+			keep[i-1] = true
+			anchor, pathKm = &points[i-1], geo.Haversine(utils.Position(points[i-1]), utils.Position(points[i]))
+			anchorAt, _ = utils.ParseTimestamp(points[i-1].RecordedAt)
+		}
+
+		if recordedAt.Sub(anchorAt) >= interval || i == len(points)-1 {
+			keep[i] = true
+			anchor, anchorAt, pathKm = &points[i], recordedAt, 0
+		}
+	}
+
+	var remove []int
+	for i, kept := range keep {
+		if !kept {
+			remove = append(remove, points[i].ID)
+		}
+	}
+	return remove
+}
@@ -0,0 +1,205 @@
+// package implements retention policies that downsample and delete old location history
+package retention
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go-nauka/health"
+	"go-nauka/location-history-service/db"
+	"go-nauka/location-history-service/models"
+	"go-nauka/logging"
+	"go-nauka/retention/policy"
+)
+
+// the policy applied by the background job and reported by the dry-run endpoint
+var Current = policy.Policy{ToleranceKm: policy.DefaultToleranceKm, BatchSize: policy.DefaultBatchSize}
+
+var logger = logging.For("retention")
+
+// TierReport describes what a single tier compacted
+type TierReport struct {
+	OlderThan string `json:"older_than"`
+	Interval  string `json:"interval"`
+	Users     int    `json:"users"`
+	Scanned   int64  `json:"scanned"`
+	Removed   int64  `json:"removed"`
+}
+
+// Report describes the outcome of a retention run, in a dry run nothing is removed
+type Report struct {
+	DryRun    bool         `json:"dry_run"`
+	StartedAt string       `json:"started_at"`
+	Tiers     []TierReport `json:"tiers"`
+	Deleted   int64        `json:"deleted"`
+}
+
+// returns the number of rows removed by downsampling across all tiers
+func (r Report) Compacted() int64 {
+	var total int64
+	for _, tier := range r.Tiers {
+		total += tier.Removed
+	}
+	return total
+}
+
+// outcome of the background runs for the readiness check
+var Status = &health.Job{}
+
+var (
+	lastMu     sync.Mutex
+	lastReport *Report
+	lastErr    error
+
+	// cancels the runs of the background job, set by Start
+	stopRuns context.CancelFunc
+	running  sync.WaitGroup
+)
+
+// applies the policy to location history as of now, with dryRun only counting the rows that would be removed
+func Run(ctx context.Context, p policy.Policy, now time.Time, dryRun bool) (Report, error) {
+	report := Report{DryRun: dryRun, StartedAt: now.Format(time.RFC3339), Tiers: []TierReport{}}
+
+	batchSize := p.BatchSize
+	if batchSize <= 0 {
+		batchSize = policy.DefaultBatchSize
+	}
+
+	for i, tier := range p.Tiers {
+		start := time.Unix(1, 0)
+		if i+1 < len(p.Tiers) {
+			start = now.Add(-p.Tiers[i+1].After)
+		} else if p.DeleteAfter > 0 {
+			start = now.Add(-p.DeleteAfter)
+		}
+
+		tierReport, err := compactTier(ctx, tier, start, now.Add(-tier.After), p.ToleranceKm, batchSize, dryRun)
+		if err != nil {
+			return report, fmt.Errorf("retention: %v", err)
+		}
+		report.Tiers = append(report.Tiers, tierReport)
+	}
+
+	if p.DeleteAfter > 0 {
+		cutoff := now.Add(-p.DeleteAfter).Format(time.RFC3339)
+		if dryRun {
+			count, err := db.CountLocationsBefore(ctx, cutoff)
+			if err != nil {
+				return report, fmt.Errorf("retention: %v", err)
+			}
+			report.Deleted = count
+		} else {
+			for {
+				deleted, err := db.DeleteLocationsBefore(ctx, cutoff, batchSize)
+				if err != nil {
+					return report, fmt.Errorf("retention: %v", err)
+				}
+				report.Deleted += deleted
+				if deleted < int64(batchSize) {
+					break
+				}
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// downsamples every users records between start and end to the tiers interval
+func compactTier(ctx context.Context, tier policy.Tier, start, end time.Time, toleranceKm float64, batchSize int, dryRun bool) (TierReport, error) {
+	tierReport := TierReport{OlderThan: tier.After.String(), Interval: tier.Interval.String()}
+	startAt, endAt := start.Format(time.RFC3339), end.Format(time.RFC3339)
+
+	users, err := db.GetUsersWithLocationsBetween(ctx, startAt, endAt)
+	if err != nil {
+		return tierReport, err
+	}
+	tierReport.Users = len(users)
+
+	for _, username := range users {
+		afterAt, afterID := startAt, 0
+		var anchor *models.LocationHistory
+
+		for {
+			page, err := db.GetUserLocationsPage(ctx, db.DB, username, afterAt, afterID, endAt, batchSize)
+			if err != nil {
+				return tierReport, err
+			}
+			if len(page) == 0 {
+				break
+			}
+
+			remove := Downsample(page, anchor, tier.Interval, toleranceKm)
+			tierReport.Scanned += int64(len(page))
+			tierReport.Removed += int64(len(remove))
+
+			if !dryRun && len(remove) > 0 {
+				if _, err := db.DeleteLocationsByID(ctx, remove); err != nil {
+					return tierReport, err
+				}
+			}
+
+			last := page[len(page)-1]
+			anchor, afterAt, afterID = &last, last.RecordedAt, last.ID
+			if len(page) < batchSize {
+				break
+			}
+		}
+	}
+
+	return tierReport, nil
+}
+
+// runs the current policy every interval until Stop is called
+func Start(interval time.Duration) {
+	Status.Interval = interval
+	ctx, cancel := context.WithCancel(context.Background())
+	stopRuns = cancel
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			report, err := Run(ctx, Current, time.Now(), false)
+			if ctx.Err() != nil {
+				logger.Warn("Retention run interrupted by shutdown", "error", err)
+				return
+			}
+
+			lastMu.Lock()
+			lastReport, lastErr = &report, err
+			lastMu.Unlock()
+			Status.Done(err)
+
+			if err != nil {
+				logger.Error("Retention run failed", "error", err)
+				continue
+			}
+			logger.Info("Retention run finished", "compacted", report.Compacted(), "deleted", report.Deleted)
+		}
+	}()
+}
+
+// stops the background job, a run in progress is cancelled and waited for so the database can be closed after
+func Stop() {
+	if stopRuns != nil {
+		stopRuns()
+	}
+	running.Wait()
+}
+
+// returns the report and error of the most recent background run, nil if none has finished yet
+func LastRun() (*Report, error) {
+	lastMu.Lock()
+	defer lastMu.Unlock()
+	return lastReport, lastErr
+}
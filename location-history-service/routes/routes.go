@@ -2,14 +2,31 @@
 package routes
 
 import (
+	"go-nauka/health"
+	"go-nauka/jwtauth"
 	"go-nauka/location-history-service/handlers"
+	"go-nauka/logging"
+	"go-nauka/metrics"
+	"go-nauka/tracing"
 
 	"github.com/gin-gonic/gin"
 )
 
 // initalizes the router and defines HTTP routes for the server
+// every route but the /healthz and /readyz probes and /metrics needs a bearer token, the history of other users than the tokens subject can only be read with the admin scope
 func SetupRouter() *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	router.Use(logging.Middleware(), gin.Recovery(), tracing.Middleware(), metrics.Middleware())
+	router.GET("/healthz", health.Default.Liveness)
+	router.GET("/readyz", health.Default.Readiness)
+	router.GET("/metrics", metrics.Handler())
+	router.Use(jwtauth.Middleware())
 	router.GET("/history/distance", handlers.CalculateDistance)
+	router.GET("/history/speed", handlers.SpeedAnalytics)
+	router.GET("/history/retention/report", jwtauth.RequireScope(jwtauth.ScopeAdmin), handlers.RetentionReport)
+	router.GET("/history/stats", handlers.UserStats)
+	router.GET("/history/leaderboard", handlers.Leaderboard)
+	router.GET("/history/heatmap", handlers.HeatmapGrid)
+	router.GET("/history/heatmap/:z/:x/:y", handlers.HeatmapTile)
 	return router
 }
@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"go-nauka/location-history-service/models"
+)
+
+// supported granularities of GET /history/stats
+const (
+	Day   = "day"
+	Week  = "week"
+	Month = "month"
+)
+
+// returns the first day of the period a day belongs to, weeks start on monday
+func periodStart(day time.Time, granularity string) (time.Time, error) {
+	switch granularity {
+	case Day:
+		return day, nil
+	case Week:
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset), nil
+	case Month:
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	return time.Time{}, fmt.Errorf("stats: unsupported granularity %q", granularity)
+}
+
+// combines daily rollups ordered by day into day, week or month buckets
+func Aggregate(days []models.DailyStats, granularity string) ([]models.StatsBucket, error) {
+	buckets := []models.StatsBucket{}
+
+	for _, d := range days {
+		day, err := time.Parse(DayLayout, d.Day)
+		if err != nil {
+			return nil, fmt.Errorf("stats: %v", err)
+		}
+		start, err := periodStart(day, granularity)
+		if err != nil {
+			return nil, err
+		}
+		period := start.Format(DayLayout)
+
+		if len(buckets) == 0 || buckets[len(buckets)-1].Period != period {
+			buckets = append(buckets, models.StatsBucket{
+				Period:       period,
+				MinLatitude:  d.MinLatitude,
+				MaxLatitude:  d.MaxLatitude,
+				MinLongitude: d.MinLongitude,
+				MaxLongitude: d.MaxLongitude,
+				FirstFixAt:   d.FirstFixAt,
+				LastFixAt:    d.LastFixAt,
+			})
+		}
+
+		b := &buckets[len(buckets)-1]
+		b.DistanceKm += d.DistanceKm
+		b.MovingSeconds += d.MovingSeconds
+		b.PointCount += d.PointCount
+		b.MinLatitude = math.Min(b.MinLatitude, d.MinLatitude)
+		b.MaxLatitude = math.Max(b.MaxLatitude, d.MaxLatitude)
+		b.MinLongitude = math.Min(b.MinLongitude, d.MinLongitude)
+		b.MaxLongitude = math.Max(b.MaxLongitude, d.MaxLongitude)
+		if d.FirstFixAt < b.FirstFixAt {
+			b.FirstFixAt = d.FirstFixAt
+		}
+		if d.LastFixAt > b.LastFixAt {
+			b.LastFixAt = d.LastFixAt
+		}
+	}
+
+	return buckets, nil
+}
@@ -0,0 +1,260 @@
+// package maintains per-user daily activity rollups of the location history
+package stats
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"go-nauka/geo"
+	"go-nauka/location-history-service/db"
+	"go-nauka/location-history-service/models"
+	"go-nauka/location-history-service/utils"
+)
+
+const (
+	// layout of days and fix times stored in location_daily_stats
+	DayLayout = "2006-01-02"
+	FixLayout = "2006-01-02 15:04:05"
+
+	// segments slower than this are not counted as moving time
+	MinMovingSpeedKmh = 1.0
+	// segments with a longer gap between fixes are not counted as moving time
+	MaxMovingGap = 10 * time.Minute
+
+	rebuildBatchSize = 1000
+)
+
+var (
+	locksMu sync.Mutex
+	locks   = map[string]*userLock{}
+)
+
+// serializes rollup updates of one user so concurrent fixes do not overwrite each other
+type userLock struct {
+	sync.Mutex
+	holders int
+}
+
+// locks the rollups of a user in this process and returns the func releasing them
+func lockUser(username string) func() {
+	locksMu.Lock()
+	l := locks[username]
+	if l == nil {
+		l = &userLock{}
+		locks[username] = l
+	}
+	l.holders++
+	locksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		locksMu.Lock()
+		if l.holders--; l.holders == 0 {
+			delete(locks, username)
+		}
+		locksMu.Unlock()
+	}
+}
+
+// Fix is a single recorded position of a user
+type Fix struct {
+	Latitude   float64
+	Longitude  float64
+	RecordedAt time.Time
+}
+
+// returns the last fix stored in a days rollup
+func LastFix(s models.DailyStats) (Fix, error) {
+	recordedAt, err := utils.ParseTimestamp(s.LastFixAt)
+	if err != nil {
+		return Fix{}, err
+	}
+	return Fix{Latitude: s.LastLatitude, Longitude: s.LastLongitude, RecordedAt: recordedAt}, nil
+}
+
+// adds a fix to the rollup of its day, prev is the users previous fix or nil for the first one
+// the distance of the segment from prev is attributed to the day of the new fix,
+// fixes arriving out of order only update the counts and bounding box
+func Apply(rollup *models.DailyStats, prev *Fix, fix Fix) {
+	at := fix.RecordedAt.UTC().Format(FixLayout)
+
+	if rollup.PointCount == 0 {
+		rollup.MinLatitude, rollup.MaxLatitude = fix.Latitude, fix.Latitude
+		rollup.MinLongitude, rollup.MaxLongitude = fix.Longitude, fix.Longitude
+		rollup.FirstFixAt, rollup.LastFixAt = at, at
+		rollup.LastLatitude, rollup.LastLongitude = fix.Latitude, fix.Longitude
+	}
+	rollup.PointCount++
+
+	rollup.MinLatitude = math.Min(rollup.MinLatitude, fix.Latitude)
+	rollup.MaxLatitude = math.Max(rollup.MaxLatitude, fix.Latitude)
+	rollup.MinLongitude = math.Min(rollup.MinLongitude, fix.Longitude)
+	rollup.MaxLongitude = math.Max(rollup.MaxLongitude, fix.Longitude)
+
+	if at < rollup.FirstFixAt {
+		rollup.FirstFixAt = at
+	}
+
+	if prev != nil && !fix.RecordedAt.Before(prev.RecordedAt) {
+		distance := geo.Haversine(geo.LatLng{Lat: prev.Latitude, Lng: prev.Longitude}, geo.LatLng{Lat: fix.Latitude, Lng: fix.Longitude})
+		rollup.DistanceKm += distance
+
+		gap := fix.RecordedAt.Sub(prev.RecordedAt)
+		if gap > 0 && gap <= MaxMovingGap && distance/gap.Hours() >= MinMovingSpeedKmh {
+			rollup.MovingSeconds += int64(gap.Seconds())
+		}
+	}
+
+	if at >= rollup.LastFixAt {
+		rollup.LastFixAt = at
+		rollup.LastLatitude, rollup.LastLongitude = fix.Latitude, fix.Longitude
+	}
+}
+
+// stores a fix in the location history and adds it to the users daily rollup in one transaction
+// inserted is false and nothing changes when the fix id was already recorded,
+// the history insert waits for a concurrent Rebuild of the user so the fix is counted exactly once
+func Record(ctx context.Context, username string, latitude, longitude float64, recordedAt, fixID string) (bool, error) {
+	at, err := utils.ParseTimestamp(recordedAt)
+	if err != nil {
+		return false, fmt.Errorf("stats: %v", err)
+	}
+	fix := Fix{Latitude: latitude, Longitude: longitude, RecordedAt: at}
+	day := at.UTC().Format(DayLayout)
+
+	unlock := lockUser(username)
+	defer unlock()
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("stats: %v", err)
+	}
+	defer tx.Rollback()
+
+	inserted, err := db.SaveLocation(ctx, tx, username, latitude, longitude, recordedAt, fixID)
+	if err != nil {
+		return false, fmt.Errorf("stats: %v", err)
+	}
+	if !inserted {
+		return false, nil
+	}
+
+	latest, err := db.GetLatestDailyStats(ctx, tx, username)
+	if err != nil {
+		return false, fmt.Errorf("stats: %v", err)
+	}
+
+	var prev *Fix
+	if latest != nil {
+		last, err := LastFix(*latest)
+		if err != nil {
+			return false, fmt.Errorf("stats: %v", err)
+		}
+		prev = &last
+	}
+
+	rollup := models.DailyStats{Username: username, Day: day}
+	if latest != nil && latest.Day == day {
+		rollup = *latest
+	} else if existing, err := db.GetDailyStats(ctx, tx, username, day); err != nil {
+		return false, fmt.Errorf("stats: %v", err)
+	} else if existing != nil {
+		rollup = *existing
+	}
+
+	Apply(&rollup, prev, fix)
+
+	if err := db.UpsertDailyStats(ctx, tx, rollup); err != nil {
+		return false, fmt.Errorf("stats: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("stats: %v", err)
+	}
+	return true, nil
+}
+
+// recomputes the daily rollups of a user from the stored location history
+// runs in one transaction holding the users history records, so fixes recorded meanwhile
+// by a running server wait for it instead of being lost when the old rollups are replaced
+func Rebuild(ctx context.Context, username string) error {
+	unlock := lockUser(username)
+	defer unlock()
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("stats: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := db.LockUserLocations(ctx, tx, username); err != nil {
+		return fmt.Errorf("stats: %v", err)
+	}
+
+	days := map[string]*models.DailyStats{}
+	var order []string
+	var prev *Fix
+
+	afterAt, afterID := time.Unix(1, 0).UTC().Format(FixLayout), 0
+	end := time.Now().Add(24 * time.Hour).UTC().Format(FixLayout)
+
+	for {
+		page, err := db.GetUserLocationsPage(ctx, tx, username, afterAt, afterID, end, rebuildBatchSize)
+		if err != nil {
+			return fmt.Errorf("stats: %v", err)
+		}
+
+		for _, loc := range page {
+			at, err := utils.ParseTimestamp(loc.RecordedAt)
+			if err != nil {
+				return fmt.Errorf("stats: %v", err)
+			}
+			fix := Fix{Latitude: loc.Latitude, Longitude: loc.Longitude, RecordedAt: at}
+
+			day := at.UTC().Format(DayLayout)
+			if days[day] == nil {
+				days[day] = &models.DailyStats{Username: username, Day: day}
+				order = append(order, day)
+			}
+			Apply(days[day], prev, fix)
+			prev = &fix
+		}
+
+		if len(page) < rebuildBatchSize {
+			break
+		}
+		last := page[len(page)-1]
+		afterAt, afterID = last.RecordedAt, last.ID
+	}
+
+	if _, err := db.DeleteDailyStats(ctx, tx, username); err != nil {
+		return fmt.Errorf("stats: %v", err)
+	}
+	for _, day := range order {
+		if err := db.UpsertDailyStats(ctx, tx, *days[day]); err != nil {
+			return fmt.Errorf("stats: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("stats: %v", err)
+	}
+	return nil
+}
+
+// recomputes the daily rollups of every user with location history
+func RebuildAll(ctx context.Context) error {
+	users, err := db.GetUsernames(ctx)
+	if err != nil {
+		return fmt.Errorf("stats: %v", err)
+	}
+
+	for _, username := range users {
+		if err := Rebuild(ctx, username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// package conatins unit an integration tests for the app
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-nauka/geo"
+	"go-nauka/location-history-service/analytics"
+	"go-nauka/location-history-service/handlers"
+	"go-nauka/location-history-service/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// builds a track moving north along a meridian, each step is given in km and covered in a minute
+func northboundTrack(steps ...float64) []models.LocationHistory {
+	start := geo.LatLng{Lat: 52.0, Lng: 21.0}
+	track := []models.LocationHistory{{ID: 1, Username: "john_doe", Latitude: start.Lat, Longitude: start.Lng, RecordedAt: "2024-01-16 10:00:00"}}
+	position := start
+	for i, step := range steps {
+		position = geo.Destination(position, 0, step)
+		track = append(track, models.LocationHistory{
+			ID:         i + 2,
+			Username:   "john_doe",
+			Latitude:   position.Lat,
+			Longitude:  position.Lng,
+			RecordedAt: fmt.Sprintf("2024-01-16 10:%02d:00", i+1),
+		})
+	}
+	return track
+}
+
+// tests speeds, bands and mode hints of a walk followed by a drive with a stop in between
+func TestAnalyzeSpeed(t *testing.T) {
+	// 0.1 km/min is 6 km/h walking, 0 km/min is parked, 1 km/min is 60 km/h driving
+	track := northboundTrack(0.1, 0.1, 0, 1, 1)
+
+	summary, err := analytics.Analyze(track, geo.Haversine, analytics.DefaultConfig())
+	assert.NoError(t, err)
+
+	assert.Equal(t, 6, summary.Points)
+	assert.Len(t, summary.Segments, 5)
+	assert.InDelta(t, 2.2, summary.DistanceKm, 1e-6)
+	assert.Equal(t, 300.0, summary.DurationSeconds)
+	assert.Equal(t, 240.0, summary.MovingSeconds)
+	assert.InDelta(t, 60, summary.MaxSpeedKmh, 1e-6)
+	assert.InDelta(t, 26.4, summary.AvgSpeedKmh, 1e-6)
+	assert.InDelta(t, 33, summary.MovingSpeedKmh, 1e-6)
+	assert.InDelta(t, 10, summary.Segments[0].PaceMinPerKm, 1e-6)
+
+	assert.False(t, summary.Segments[2].Moving)
+	assert.InDelta(t, -6/3.6/60, summary.Segments[2].AccelerationMps2, 1e-9)
+	assert.InDelta(t, 60/3.6/60, summary.MaxAccelerationMps2, 1e-9)
+	assert.InDelta(t, 6/3.6/60, summary.MaxDecelerationMps2, 1e-9)
+
+	assert.Equal(t, analytics.ModeWalking, summary.Segments[0].Mode)
+	assert.Equal(t, analytics.ModeDriving, summary.Segments[4].Mode)
+	assert.Len(t, summary.Modes, 2)
+	assert.Equal(t, 0.5, summary.Modes[0].Share)
+	assert.Equal(t, analytics.ModeDriving, summary.Mode)
+
+	seconds := map[string]float64{}
+	for _, band := range summary.Bands {
+		seconds[band.Band] = band.Seconds
+	}
+	assert.Equal(t, map[string]float64{"0-1": 60, "1-7": 120, "7-25": 0, "25-60": 0, "60+": 120}, seconds)
+}
+
+// tests that long gaps and repeated timestamps are not counted as movement
+func TestAnalyzeSpeedGaps(t *testing.T) {
+	track := []models.LocationHistory{
+		{Latitude: 52.0, Longitude: 21.0, RecordedAt: "2024-01-16 10:00:00"},
+		{Latitude: 52.0, Longitude: 21.1, RecordedAt: "2024-01-16 10:00:00"},
+		{Latitude: 52.1, Longitude: 21.0, RecordedAt: "2024-01-16 11:00:00"},
+	}
+
+	summary, err := analytics.Analyze(track, geo.Haversine, analytics.DefaultConfig())
+	assert.NoError(t, err)
+	assert.Len(t, summary.Segments, 1)
+	assert.False(t, summary.Segments[0].Moving)
+	assert.Equal(t, 0.0, summary.MovingSeconds)
+	assert.Empty(t, summary.Modes)
+	for _, band := range summary.Bands {
+		assert.Equal(t, 0.0, band.Seconds)
+	}
+
+	_, err = analytics.Analyze([]models.LocationHistory{{RecordedAt: "yesterday"}}, geo.Haversine, analytics.DefaultConfig())
+	assert.Error(t, err)
+}
+
+// tests parsing of speed band edges
+func TestParseBands(t *testing.T) {
+	bands, err := analytics.ParseBands("5, 20")
+	assert.NoError(t, err)
+	assert.Equal(t, []analytics.Band{
+		{Name: "0-5", MinKmh: 0, MaxKmh: 5},
+		{Name: "5-20", MinKmh: 5, MaxKmh: 20},
+		{Name: "20+", MinKmh: 20},
+	}, bands)
+
+	for _, spec := range []string{"", "5,x", "20,5", "0,5"} {
+		_, err := analytics.ParseBands(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+// tests the GET /history/speed endpoint
+func TestSpeedAnalyticsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	router := gin.Default()
+	router.Use(asCaller("john_doe", ""))
+	router.GET("/history/speed", handlers.SpeedAnalytics)
+
+	rows := sqlmock.NewRows([]string{"id", "username", "latitude", "longitude", "recorded_at"})
+	for _, loc := range northboundTrack(0.1, 1) {
+		rows.AddRow(loc.ID, loc.Username, loc.Latitude, loc.Longitude, loc.RecordedAt)
+	}
+	mock.ExpectQuery("SELECT id, username, latitude, longitude, recorded_at FROM location_history").
+		WithArgs("john_doe", "2024-01-16T00:00:00Z", "2024-01-17T00:00:00Z").
+		WillReturnRows(rows)
+
+	req, _ := http.NewRequest("GET", "/history/speed?username=john_doe&start=2024-01-16T00:00:00Z&end=2024-01-17T00:00:00Z&bands=10", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Username string            `json:"username"`
+		Speed    analytics.Summary `json:"speed"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "john_doe", response.Username)
+	assert.Len(t, response.Speed.Segments, 2)
+	assert.InDelta(t, 60, response.Speed.MaxSpeedKmh, 1e-6)
+	assert.Len(t, response.Speed.Bands, 2)
+	assert.Equal(t, 60.0, response.Speed.Bands[0].Seconds)
+
+	for _, query := range []string{"username=john_doe&bands=abc", "username=john_doe&method=flat"} {
+		req, _ := http.NewRequest("GET", "/history/speed?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
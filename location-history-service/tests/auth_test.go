@@ -0,0 +1,115 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-nauka/jwtauth"
+	"go-nauka/location-history-service/handlers"
+	"go-nauka/location-history-service/routes"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// secret of the locally minted test tokens
+var testSecret = []byte("test-secret")
+
+// adds an HS256 bearer token for a subject with the given space separated scopes to a request
+// the verifier used by the middleware is set to accept it
+func authorize(req *http.Request, subject, scope string) {
+	if jwtauth.Default == nil {
+		jwtauth.Default, _ = jwtauth.NewVerifier(jwtauth.Config{HMACSecret: testSecret})
+	}
+	claims := jwtauth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: subject, ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		Scope:            scope,
+	}
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testSecret)
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+// returns middleware making every request come from the subject with the given scopes without a token
+func asCaller(subject, scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(jwtauth.ClaimsKey, &jwtauth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: subject}, Scope: scope})
+	}
+}
+
+// tests that the history of other users and the retention report need the admin scope
+func TestHistoryAuthorization(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	router := routes.SetupRouter()
+
+	tests := []struct {
+		name           string
+		path           string
+		subject        string
+		scope          string
+		expectedStatus int
+	}{
+		{name: "Anonymous", path: "/history/distance?username=john_doe", expectedStatus: http.StatusUnauthorized},
+		{name: "Other User", path: "/history/distance?username=jane_doe", subject: "john_doe", expectedStatus: http.StatusForbidden},
+		{name: "Other Users Stats", path: "/history/stats?username=jane_doe", subject: "john_doe", expectedStatus: http.StatusForbidden},
+		{name: "Other Users Heatmap", path: "/history/heatmap?users=john_doe,jane_doe", subject: "john_doe", expectedStatus: http.StatusForbidden},
+		{name: "Retention Report", path: "/history/retention/report", subject: "john_doe", scope: "read", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tt.path, nil)
+			if tt.subject != "" {
+				authorize(req, tt.subject, tt.scope)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+
+	// without a username the caller reads their own history
+	mock.ExpectQuery("SELECT id, username, latitude, longitude, recorded_at FROM location_history").
+		WithArgs("john_doe", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "latitude", "longitude", "recorded_at"}))
+
+	req, _ := http.NewRequest("GET", "/history/distance", nil)
+	authorize(req, "john_doe", "")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests that a heatmap without users only covers the callers own history
+func TestHeatmapDefaultsToCaller(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	router := gin.Default()
+	router.Use(asCaller("john_doe", ""))
+	router.GET("/history/heatmap", handlers.HeatmapGrid)
+
+	mock.ExpectQuery("AND username IN \\(\\?\\)").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), -90.0, 90.0, -180.0, 180.0, "john_doe").
+		WillReturnRows(sqlmock.NewRows([]string{"latitude", "longitude"}))
+
+	req, _ := http.NewRequest("GET", "/history/heatmap?zoom=3", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
@@ -2,6 +2,8 @@
 package tests
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 
 	DB "go-nauka/location-history-service/db"
@@ -35,8 +37,11 @@ func TestSaveLocation(t *testing.T) {
 		latitude   float64
 		longitude  float64
 		recordedAt string
+		fixID      string
+		mockResult sql.Result
 		mockError  error
 		wantErr    bool
+		inserted   bool
 	}{
 		{
 			name:       "Successful Insert",
@@ -44,8 +49,34 @@ func TestSaveLocation(t *testing.T) {
 			latitude:   40.7128,
 			longitude:  -74.0060,
 			recordedAt: "2024-01-16T10:00:00Z",
+			mockResult: sqlmock.NewResult(1, 1),
 			mockError:  nil,
 			wantErr:    false,
+			inserted:   true,
+		},
+		{
+			name:       "Successful Insert With Fix ID",
+			username:   "john_doe",
+			latitude:   40.7128,
+			longitude:  -74.0060,
+			recordedAt: "2024-01-16T10:00:00Z",
+			fixID:      "fix-1",
+			mockResult: sqlmock.NewResult(2, 1),
+			mockError:  nil,
+			wantErr:    false,
+			inserted:   true,
+		},
+		{
+			name:       "Duplicate Fix ID Ignored",
+			username:   "john_doe",
+			latitude:   40.7128,
+			longitude:  -74.0060,
+			recordedAt: "2024-01-16T10:00:00Z",
+			fixID:      "fix-1",
+			mockResult: sqlmock.NewResult(0, 0),
+			mockError:  nil,
+			wantErr:    false,
+			inserted:   false,
 		},
 		{
 			name:       "Failed Insert (DB Error)",
@@ -53,6 +84,7 @@ func TestSaveLocation(t *testing.T) {
 			latitude:   34.0522,
 			longitude:  -118.2437,
 			recordedAt: "2024-01-16T11:00:00Z",
+			mockResult: sqlmock.NewResult(1, 1),
 			mockError:  errors.New("insert error"),
 			wantErr:    true,
 		},
@@ -61,16 +93,20 @@ func TestSaveLocation(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mock.ExpectExec("INSERT INTO location_history").
-				WithArgs(tt.username, tt.latitude, tt.longitude, tt.recordedAt).
-				WillReturnResult(sqlmock.NewResult(1, 1)).
+				WithArgs(tt.username, tt.latitude, tt.longitude, tt.recordedAt, sql.NullString{String: tt.fixID, Valid: tt.fixID != ""}).
+				WillReturnResult(tt.mockResult).
 				WillReturnError(tt.mockError)
 
-			err := DB.SaveLocation(tt.username, tt.latitude, tt.longitude, tt.recordedAt)
+			inserted, err := DB.SaveLocation(context.Background(), DB.DB, tt.username, tt.latitude, tt.longitude, tt.recordedAt, tt.fixID)
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Expected error: %v, got: %v", tt.wantErr, err)
 			}
 
+			if inserted != tt.inserted {
+				t.Errorf("Expected inserted: %v, got: %v", tt.inserted, inserted)
+			}
+
 			if err := mock.ExpectationsWereMet(); err != nil {
 				t.Errorf("Unfulfilled DB expectations: %v", err)
 			}
@@ -127,7 +163,7 @@ func TestGetUserLocations(t *testing.T) {
 					WillReturnError(errors.New("query error"))
 			}
 
-			history, err := DB.GetUserLocations(username, startDate, endDate)
+			history, err := DB.GetUserLocations(context.Background(), username, startDate, endDate)
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Expected error: %v, got: %v", tt.wantErr, err)
@@ -143,3 +179,26 @@ func TestGetUserLocations(t *testing.T) {
 		})
 	}
 }
+
+// tests the DeleteUserLocations func
+func TestDeleteUserLocations(t *testing.T) {
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectExec("DELETE FROM location_history WHERE username = ?").
+		WithArgs("john_doe").
+		WillReturnResult(sqlmock.NewResult(0, 4))
+
+	deleted, err := DB.DeleteUserLocations(context.Background(), "john_doe")
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if deleted != 4 {
+		t.Errorf("Expected 4 deleted records, got %d", deleted)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
@@ -2,7 +2,7 @@
 package tests
 
 import (
-	"go-nauka/location-history-service/utils"
+	"go-nauka/geo"
 	"math"
 	"testing"
 )
@@ -12,7 +12,7 @@ func almostEqual(a, b, tolerance float64) bool {
 	return math.Abs(a-b) <= tolerance
 }
 
-// tests the HaversineDistance func
+// tests the Haversine func used for history distances
 func TestHaversineDistance(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -50,7 +50,7 @@ func TestHaversineDistance(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := utils.HaversineDistance(tt.lat1, tt.lon1, tt.lat2, tt.lon2)
+			result := geo.Haversine(geo.LatLng{Lat: tt.lat1, Lng: tt.lon1}, geo.LatLng{Lat: tt.lat2, Lng: tt.lon2})
 			if !almostEqual(result, tt.expected, 1.0) {
 				t.Errorf("Expected %.2f km, but got %.2f km", tt.expected, result)
 			}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 
+	"go-nauka/jwtauth"
 	"go-nauka/location-history-service/handlers"
 	"net/http"
 	"net/http/httptest"
@@ -22,6 +23,7 @@ func TestCalculateDistance(t *testing.T) {
 	defer cleanup()
 
 	router := gin.Default()
+	router.Use(asCaller("operator", jwtauth.ScopeAdmin))
 	router.GET("/history/distance", handlers.CalculateDistance)
 
 	tests := []struct {
@@ -0,0 +1,130 @@
+// package conatins unit an integration tests for the app
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-nauka/geo"
+	"go-nauka/jwtauth"
+	"go-nauka/location-history-service/handlers"
+	"go-nauka/location-history-service/heatmap"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// tests counting positions per tile for the JSON heatmap
+func TestHeatmapGrid(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	router := gin.Default()
+	router.Use(asCaller("operator", jwtauth.ScopeAdmin))
+	router.GET("/history/heatmap", handlers.HeatmapGrid)
+
+	mock.ExpectQuery("SELECT latitude, longitude FROM location_history WHERE recorded_at >= \\? AND recorded_at < \\? AND latitude BETWEEN \\? AND \\? AND longitude BETWEEN \\? AND \\? AND username IN \\(\\?, \\?\\)").
+		WithArgs("2024-01-16T00:00:00Z", "2024-01-17T00:00:00Z", 50.0, 55.0, 20.0, 22.0, "john_doe", "jane_doe").
+		WillReturnRows(sqlmock.NewRows([]string{"latitude", "longitude"}).
+			AddRow(52.2297, 21.0122).
+			AddRow(52.2298, 21.0123).
+			AddRow(52.4064, 21.9250))
+
+	req, _ := http.NewRequest("GET", "/history/heatmap?zoom=10&bbox=20,50,22,55&users=john_doe,jane_doe&start=2024-01-16T00:00:00Z&end=2024-01-17T00:00:00Z", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Zoom  int            `json:"zoom"`
+		Cells []heatmap.Cell `json:"cells"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 10, response.Zoom)
+	assert.Len(t, response.Cells, 2)
+	assert.Equal(t, heatmap.Cell{X: 571, Y: 337, Count: 2, Center: geo.Tile{Z: 10, X: 571, Y: 337}.Center()}, response.Cells[0])
+	assert.Equal(t, int64(1), response.Cells[1].Count)
+
+	for _, query := range []string{"zoom=23", "zoom=x", "bbox=1,2,3"} {
+		req, _ := http.NewRequest("GET", "/history/heatmap?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests that a rendered tile is hot around the recorded positions and transparent elsewhere
+func TestHeatmapTile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	router := gin.Default()
+	router.Use(asCaller("operator", jwtauth.ScopeAdmin))
+	router.GET("/history/heatmap/:z/:x/:y", handlers.HeatmapTile)
+
+	tile := geo.Tile{Z: 10, X: 571, Y: 337}
+	point := tile.Center()
+	bounds := heatmap.NewCanvas(tile, 4).Bounds()
+
+	rows := sqlmock.NewRows([]string{"latitude", "longitude"})
+	for i := 0; i < 10; i++ {
+		rows.AddRow(point.Lat, point.Lng)
+	}
+	mock.ExpectQuery("SELECT latitude, longitude FROM location_history").
+		WithArgs("2024-01-16T00:00:00Z", "2024-01-17T00:00:00Z", bounds.SouthWest.Lat, bounds.NorthEast.Lat, bounds.SouthWest.Lng, bounds.NorthEast.Lng).
+		WillReturnRows(rows)
+
+	req, _ := http.NewRequest("GET", "/history/heatmap/10/571/337.png?radius=4&start=2024-01-16T00:00:00Z&end=2024-01-17T00:00:00Z", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+
+	img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, geo.TileSize, img.Bounds().Dx())
+
+	r, g, b, a := img.At(128, 128).RGBA()
+	assert.Equal(t, uint32(0xffff), a)
+	assert.True(t, r > g && r > b, "expected a hot pixel at the center")
+
+	_, _, _, a = img.At(10, 10).RGBA()
+	assert.Equal(t, uint32(0), a)
+
+	for _, path := range []string{"/history/heatmap/10/571/337", "/history/heatmap/10/1024/0.png", "/history/heatmap/a/0/0.png"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests that the margin of a tile on the antimeridian wraps around to the other side
+func TestHeatmapCanvasBounds(t *testing.T) {
+	bounds := heatmap.NewCanvas(geo.Tile{Z: 3, X: 0, Y: 0}, 8).Bounds()
+	assert.True(t, bounds.CrossesAntimeridian())
+	assert.Equal(t, 90.0, bounds.NorthEast.Lat)
+	assert.True(t, bounds.Contains(geo.LatLng{Lat: 80, Lng: 179.5}))
+
+	canvas := heatmap.NewCanvas(geo.Tile{Z: 3, X: 0, Y: 0}, 8)
+	canvas.Add(geo.LatLng{Lat: 80, Lng: 179.9})
+	_, _, _, a := canvas.Image(heatmap.DefaultSaturation).At(0, 230).RGBA()
+	assert.NotZero(t, a)
+}
@@ -0,0 +1,119 @@
+// package conatins unit an integration tests for the app
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-nauka/location-history-service/models"
+	"go-nauka/location-history-service/retention"
+	"go-nauka/retention/policy"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// tests that Downsample keeps one point per interval and the points needed to preserve distance
+func TestDownsample(t *testing.T) {
+	t.Run("One Point Per Interval", func(t *testing.T) {
+		var points []models.LocationHistory
+		for i := 0; i < 11; i++ {
+			points = append(points, models.LocationHistory{
+				ID:         i + 1,
+				Latitude:   52.0 + float64(i)*0.0001,
+				Longitude:  21.0,
+				RecordedAt: time.Date(2024, 1, 16, 10, i, 0, 0, time.UTC).Format(time.RFC3339),
+			})
+		}
+
+		remove := retention.Downsample(points, nil, 5*time.Minute, 0.05)
+		assert.Equal(t, []int{2, 3, 4, 5, 7, 8, 9, 10}, remove)
+	})
+
+	t.Run("Corner Is Kept", func(t *testing.T) {
+		points := []models.LocationHistory{
+			{ID: 1, Latitude: 52.0, Longitude: 21.0, RecordedAt: "2024-01-16 10:00:00"},
+			{ID: 2, Latitude: 52.0, Longitude: 21.01, RecordedAt: "2024-01-16 10:01:00"},
+			{ID: 3, Latitude: 52.0, Longitude: 21.02, RecordedAt: "2024-01-16 10:02:00"},
+			{ID: 4, Latitude: 52.01, Longitude: 21.02, RecordedAt: "2024-01-16 10:03:00"},
+			{ID: 5, Latitude: 52.02, Longitude: 21.02, RecordedAt: "2024-01-16 10:04:00"},
+		}
+
+		remove := retention.Downsample(points, nil, time.Hour, 0.05)
+		assert.Equal(t, []int{2, 4}, remove)
+	})
+
+	t.Run("Continues From Anchor", func(t *testing.T) {
+		anchor := models.LocationHistory{ID: 1, Latitude: 52.0, Longitude: 21.0, RecordedAt: "2024-01-16 10:00:00"}
+		points := []models.LocationHistory{
+			{ID: 2, Latitude: 52.0, Longitude: 21.0, RecordedAt: "2024-01-16 10:01:00"},
+			{ID: 3, Latitude: 52.0, Longitude: 21.0, RecordedAt: "2024-01-16 10:02:00"},
+		}
+
+		remove := retention.Downsample(points, &anchor, 5*time.Minute, 0.05)
+		assert.Equal(t, []int{2}, remove)
+	})
+}
+
+// tests that a dry run reports compaction and deletion without removing rows
+func TestRetentionDryRun(t *testing.T) {
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	hourly := policy.Policy{
+		Tiers:       []policy.Tier{{After: 24 * time.Hour, Interval: time.Hour}},
+		DeleteAfter: 30 * 24 * time.Hour,
+		ToleranceKm: 0.05,
+		BatchSize:   100,
+	}
+	start := now.Add(-30 * 24 * time.Hour).Format(time.RFC3339)
+	end := now.Add(-24 * time.Hour).Format(time.RFC3339)
+
+	mock.ExpectQuery("SELECT DISTINCT username FROM location_history").
+		WithArgs(start, end).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("john_doe"))
+	mock.ExpectQuery("SELECT id, username, latitude, longitude, recorded_at FROM location_history").
+		WithArgs("john_doe", end, start, start, 0, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "latitude", "longitude", "recorded_at"}).
+			AddRow(1, "john_doe", 52.0, 21.0, "2024-02-10 10:00:00").
+			AddRow(2, "john_doe", 52.0, 21.0, "2024-02-10 10:10:00").
+			AddRow(3, "john_doe", 52.0, 21.0, "2024-02-10 10:20:00"))
+	mock.ExpectQuery("SELECT COUNT").
+		WithArgs(start).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(7))
+
+	report, err := retention.Run(context.Background(), hourly, now, true)
+	assert.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, int64(3), report.Tiers[0].Scanned)
+	assert.Equal(t, int64(1), report.Tiers[0].Removed)
+	assert.Equal(t, int64(7), report.Deleted)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests that Stop cancels a background run in progress and waits for it, without recording it as a finished run
+func TestRetentionStop(t *testing.T) {
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	current := retention.Current
+	retention.Current = policy.Policy{DeleteAfter: 24 * time.Hour, BatchSize: 100}
+	defer func() { retention.Current = current }()
+
+	mock.ExpectExec("DELETE FROM location_history").WillDelayFor(time.Minute).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	retention.Start(10 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	started := time.Now()
+	retention.Stop()
+	assert.Less(t, time.Since(started), 5*time.Second)
+
+	report, err := retention.LastRun()
+	assert.Nil(t, report)
+	assert.NoError(t, err)
+}
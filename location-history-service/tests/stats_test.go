@@ -0,0 +1,278 @@
+// package conatins unit an integration tests for the app
+package tests
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-nauka/jwtauth"
+	"go-nauka/location-history-service/handlers"
+	"go-nauka/location-history-service/models"
+	"go-nauka/location-history-service/stats"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// tests that Apply accumulates distance, moving time, counts and bounding box
+func TestApplyDailyStats(t *testing.T) {
+	start := time.Date(2024, 1, 16, 10, 0, 0, 0, time.UTC)
+	rollup := models.DailyStats{Username: "john_doe", Day: "2024-01-16"}
+
+	first := stats.Fix{Latitude: 35.12314, Longitude: 27.64532, RecordedAt: start}
+	second := stats.Fix{Latitude: 35.13314, Longitude: 27.64532, RecordedAt: start.Add(5 * time.Minute)}
+	parked := stats.Fix{Latitude: 35.13314, Longitude: 27.64532, RecordedAt: start.Add(30 * time.Minute)}
+
+	stats.Apply(&rollup, nil, first)
+	stats.Apply(&rollup, &first, second)
+	stats.Apply(&rollup, &second, parked)
+
+	assert.Equal(t, int64(3), rollup.PointCount)
+	assert.InDelta(t, 1.11, rollup.DistanceKm, 0.01)
+	assert.Equal(t, int64(300), rollup.MovingSeconds)
+	assert.Equal(t, 35.12314, rollup.MinLatitude)
+	assert.Equal(t, 35.13314, rollup.MaxLatitude)
+	assert.Equal(t, "2024-01-16 10:00:00", rollup.FirstFixAt)
+	assert.Equal(t, "2024-01-16 10:30:00", rollup.LastFixAt)
+
+	late := stats.Fix{Latitude: 36.0, Longitude: 27.0, RecordedAt: start.Add(-time.Hour)}
+	stats.Apply(&rollup, &parked, late)
+
+	assert.Equal(t, int64(4), rollup.PointCount)
+	assert.InDelta(t, 1.11, rollup.DistanceKm, 0.01)
+	assert.Equal(t, "2024-01-16 09:00:00", rollup.FirstFixAt)
+	assert.Equal(t, "2024-01-16 10:30:00", rollup.LastFixAt)
+}
+
+// tests that Aggregate groups days into weeks and months
+func TestAggregateStats(t *testing.T) {
+	days := []models.DailyStats{
+		{Day: "2024-01-30", DistanceKm: 1, PointCount: 2, MinLatitude: 1, MaxLatitude: 2, FirstFixAt: "2024-01-30 08:00:00", LastFixAt: "2024-01-30 09:00:00"},
+		{Day: "2024-02-01", DistanceKm: 2, PointCount: 3, MinLatitude: 0, MaxLatitude: 3, FirstFixAt: "2024-02-01 08:00:00", LastFixAt: "2024-02-01 09:00:00"},
+		{Day: "2024-02-05", DistanceKm: 4, PointCount: 5, MinLatitude: 1, MaxLatitude: 1, FirstFixAt: "2024-02-05 08:00:00", LastFixAt: "2024-02-05 09:00:00"},
+	}
+
+	weeks, err := stats.Aggregate(days, stats.Week)
+	assert.NoError(t, err)
+	assert.Len(t, weeks, 2)
+	assert.Equal(t, "2024-01-29", weeks[0].Period)
+	assert.Equal(t, 3.0, weeks[0].DistanceKm)
+	assert.Equal(t, int64(5), weeks[0].PointCount)
+	assert.Equal(t, 0.0, weeks[0].MinLatitude)
+	assert.Equal(t, "2024-02-01 09:00:00", weeks[0].LastFixAt)
+
+	months, err := stats.Aggregate(days, stats.Month)
+	assert.NoError(t, err)
+	assert.Len(t, months, 2)
+	assert.Equal(t, "2024-02-01", months[1].Period)
+	assert.Equal(t, 6.0, months[1].DistanceKm)
+
+	_, err = stats.Aggregate(days, "year")
+	assert.Error(t, err)
+}
+
+// columns of location_daily_stats rows returned by the mocked queries
+var dailyStatsColumns = []string{"username", "day", "distance_km", "moving_seconds", "point_count",
+	"min_latitude", "max_latitude", "min_longitude", "max_longitude",
+	"first_fix_at", "last_fix_at", "last_latitude", "last_longitude"}
+
+// tests that Record stores the fix and updates its days rollup in one transaction
+func TestRecordDailyStats(t *testing.T) {
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		name     string
+		fixID    string
+		inserted bool
+	}{
+		{name: "New Fix", fixID: "fix-1", inserted: true},
+		{name: "Duplicate Fix", fixID: "fix-1", inserted: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock.ExpectBegin()
+			if !tt.inserted {
+				mock.ExpectExec("INSERT INTO location_history").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+			} else {
+				mock.ExpectExec("INSERT INTO location_history").
+					WithArgs("john_doe", 41.5, -73.5, "2024-01-16T10:00:00Z", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery("SELECT (.+) FROM location_daily_stats WHERE username = \\? ORDER BY day DESC").
+					WithArgs("john_doe").
+					WillReturnRows(sqlmock.NewRows(dailyStatsColumns).
+						AddRow("john_doe", "2024-01-15", 0.0, 0, 1, 40.7128, 40.7128, -74.0060, -74.0060, "2024-01-15 23:00:00", "2024-01-15 23:00:00", 40.7128, -74.0060))
+				mock.ExpectQuery("SELECT (.+) FROM location_daily_stats WHERE username = \\? AND day = \\?").
+					WithArgs("john_doe", "2024-01-16").
+					WillReturnRows(sqlmock.NewRows(dailyStatsColumns))
+				mock.ExpectExec("INSERT INTO location_daily_stats").
+					WithArgs("john_doe", "2024-01-16", sqlmock.AnyArg(), int64(0), 1, 41.5, 41.5, -73.5, -73.5,
+						"2024-01-16 10:00:00", "2024-01-16 10:00:00", 41.5, -73.5).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+
+			inserted, err := stats.Record(context.Background(), "john_doe", 41.5, -73.5, "2024-01-16T10:00:00Z", tt.fixID)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.inserted, inserted)
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled DB expectations: %v", err)
+			}
+		})
+	}
+}
+
+// tests that Rebuild locks the users history before replacing the rollups in the same transaction
+func TestRebuildDailyStats(t *testing.T) {
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM location_history WHERE username = \\? FOR UPDATE").
+		WithArgs("john_doe").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	mock.ExpectQuery("SELECT id, username, latitude, longitude, recorded_at FROM location_history").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "latitude", "longitude", "recorded_at"}).
+			AddRow(1, "john_doe", 40.7128, -74.0060, "2024-01-15 23:00:00").
+			AddRow(2, "john_doe", 41.5, -73.5, "2024-01-16 10:00:00"))
+	mock.ExpectExec("DELETE FROM location_daily_stats WHERE username = ?").
+		WithArgs("john_doe").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO location_daily_stats").
+		WithArgs("john_doe", "2024-01-15", 0.0, int64(0), 1, 40.7128, 40.7128, -74.0060, -74.0060,
+			"2024-01-15 23:00:00", "2024-01-15 23:00:00", 40.7128, -74.0060).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO location_daily_stats").
+		WithArgs("john_doe", "2024-01-16", sqlmock.AnyArg(), int64(0), 1, 41.5, 41.5, -73.5, -73.5,
+			"2024-01-16 10:00:00", "2024-01-16 10:00:00", 41.5, -73.5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, stats.Rebuild(context.Background(), "john_doe"))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests the UserStats handler
+func TestUserStats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	router := gin.Default()
+	router.Use(asCaller("john_doe", ""))
+	router.GET("/history/stats", handlers.UserStats)
+
+	mock.ExpectQuery("SELECT (.+) FROM location_daily_stats WHERE username = \\? AND day BETWEEN").
+		WithArgs("john_doe", "2024-01-01", "2024-01-31").
+		WillReturnRows(sqlmock.NewRows(dailyStatsColumns).
+			AddRow("john_doe", "2024-01-16", 4.5, 600, 10, 35.1, 35.2, 27.6, 27.7, "2024-01-16 08:00:00", "2024-01-16 18:00:00", 35.2, 27.7).
+			AddRow("john_doe", "2024-01-17", 1.5, 300, 4, 35.0, 35.1, 27.5, 27.6, "2024-01-17 08:00:00", "2024-01-17 09:00:00", 35.1, 27.6))
+
+	req, _ := http.NewRequest("GET", "/history/stats?username=john_doe&granularity=month&start=2024-01-01&end=2024-01-31", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Username string               `json:"username"`
+		Stats    []models.StatsBucket `json:"stats"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Stats, 1)
+	assert.Equal(t, 6.0, response.Stats[0].DistanceKm)
+	assert.Equal(t, int64(900), response.Stats[0].MovingSeconds)
+	assert.Equal(t, 35.0, response.Stats[0].MinLatitude)
+
+	req, _ = http.NewRequest("GET", "/history/stats?username=john_doe&granularity=year", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests that the Leaderboard handler ranks the users visible to the caller, everyone for admins, and rejects invalid dates
+func TestLeaderboard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		name           string
+		scope          string
+		query          string
+		args           []driver.Value
+		expectedStatus int
+	}{
+		{
+			name:           "Visible To Caller",
+			query:          "start=2024-01-01&end=2024-01-31&limit=2&page=2",
+			args:           []driver.Value{"2024-01-01", "2024-01-31", "john_doe", "john_doe", "john_doe", 3, 2},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Admin Sees Everyone",
+			scope:          jwtauth.ScopeAdmin,
+			query:          "start=2024-01-01&end=2024-01-31&limit=2&page=2",
+			args:           []driver.Value{"2024-01-01", "2024-01-31", 3, 2},
+			expectedStatus: http.StatusOK,
+		},
+		{name: "Malformed Start", query: "start=2024-13-01&end=2024-01-31", expectedStatus: http.StatusBadRequest},
+		{name: "Malformed End", query: "start=2024-01-01&end=yesterday", expectedStatus: http.StatusBadRequest},
+		{name: "End Before Start", query: "start=2024-01-31&end=2024-01-01", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.Default()
+			router.Use(asCaller("john_doe", tt.scope))
+			router.GET("/history/leaderboard", handlers.Leaderboard)
+
+			if tt.args != nil {
+				mock.ExpectQuery("SELECT RANK\\(\\) OVER").
+					WithArgs(tt.args...).
+					WillReturnRows(sqlmock.NewRows([]string{"position", "username", "distance_km", "moving_seconds"}).
+						AddRow(3, "alice", 12.5, 3600).
+						AddRow(3, "bob", 12.5, 3000).
+						AddRow(5, "carol", 3.2, 900))
+			}
+
+			req, _ := http.NewRequest("GET", "/history/leaderboard?"+tt.query, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus == http.StatusOK {
+				var response struct {
+					HasMore bool                      `json:"has_more"`
+					Entries []models.LeaderboardEntry `json:"entries"`
+				}
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+				assert.True(t, response.HasMore)
+				assert.Equal(t, []models.LeaderboardEntry{
+					{Rank: 3, Username: "alice", DistanceKm: 12.5, MovingSeconds: 3600},
+					{Rank: 3, Username: "bob", DistanceKm: 12.5, MovingSeconds: 3000},
+				}, response.Entries)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled DB expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// layouts recorded_at values can have, RFC3339 when sent over grpc and the mysql format when read back from the database
+var timestampLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// parses a recorded_at timestamp in any of the supported layouts
+func ParseTimestamp(value string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("parseTimestamp: unsupported timestamp %q", value)
+}
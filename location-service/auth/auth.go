@@ -0,0 +1,47 @@
+// package identifies the user calling the REST api by bearer token or API key
+package auth
+
+import (
+	"net/http"
+	"slices"
+
+	"go-nauka/jwtauth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// returns the user the bearer token was issued to, empty for requests without validated claims
+func Caller(c *gin.Context) string {
+	return jwtauth.Subject(c)
+}
+
+// returns the calling user or responds with 401 when the request is anonymous
+func RequireCaller(c *gin.Context) (string, bool) {
+	caller := Caller(c)
+	if caller == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return "", false
+	}
+	return caller, true
+}
+
+// reports whether the caller may act as a user, a device may only act as the user its token was issued to
+// and an API key as one of its usernames, responds with 403 otherwise
+func RequireSelf(c *gin.Context, name string) bool {
+	caller, ok := RequireCaller(c)
+	if !ok {
+		return false
+	}
+	if key := APIKeyOf(c); key != nil {
+		if !slices.Contains(key.Usernames, name) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key not allowed for this user"})
+			return false
+		}
+		return true
+	}
+	if caller != name {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Token subject does not match the user"})
+		return false
+	}
+	return true
+}
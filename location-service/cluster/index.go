@@ -0,0 +1,402 @@
+// package keeps a hierarchical grid of the current user positions for clustered map markers
+package cluster
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"go-nauka/geo"
+	"go-nauka/location-service/models"
+	"go-nauka/location-service/precision"
+)
+
+const (
+	// points are clustered up to this zoom level, deeper zooms return every user on its own
+	MaxZoom = 16
+	// size of a cell in pixels of a 256 pixel tile, a power of two so each cell splits into four cells at the next zoom
+	CellPixels = 64
+	// maximum number of member names returned with a cluster
+	SampleSize = 5
+	// farthest a View moves a user, users stored this far outside the requested bounds may be seen inside them
+	viewShiftKm = precision.MaxMeters / 1000.0
+)
+
+// Cluster is a group of users in the same grid cell, Center is the mean of their positions
+type Cluster struct {
+	Center geo.LatLng `json:"center"`
+	Count  int        `json:"count"`
+	Sample []string   `json:"sample"`
+}
+
+// a grid cell, sums of the projected positions give the centroid without visiting the members
+// public counts the members every viewer sees at their stored position,
+// removed counts the removals since the sums were last recomputed from the members
+type cell struct {
+	sumX    float64
+	sumY    float64
+	members map[string]struct{}
+	public  int
+	removed int
+}
+
+// a user position projected to Web-Mercator world coordinates
+type point struct {
+	position geo.LatLng
+	x, y     float64
+	public   bool
+}
+
+// Index holds one grid per zoom level, a moving user is removed from the cells of its old position and added to the new ones
+type Index struct {
+	mu     sync.RWMutex
+	points map[string]point
+	public map[string]struct{}
+	levels [MaxZoom + 1]map[[2]int]*cell
+}
+
+// index of the current locations used by the handlers
+var Default = NewIndex()
+
+// returns an empty index
+func NewIndex() *Index {
+	idx := &Index{points: map[string]point{}, public: map[string]struct{}{}}
+	for z := range idx.levels {
+		idx.levels[z] = map[[2]int]*cell{}
+	}
+	return idx
+}
+
+// replaces the content of the index with the given locations, the users marked public are kept
+func (idx *Index) Load(locations []models.Location) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.points = map[string]point{}
+	for z := range idx.levels {
+		idx.levels[z] = map[[2]int]*cell{}
+	}
+	for _, loc := range locations {
+		idx.add(loc.Name, loc.Position())
+	}
+}
+
+// moves a user to a new position, adding the user when it is not indexed yet
+func (idx *Index) Update(name string, position geo.LatLng) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(name)
+	idx.add(name, position)
+}
+
+// removes a user from the index and forgets whether they are public
+func (idx *Index) Remove(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.remove(name)
+	delete(idx.public, name)
+}
+
+// marks whether every viewer sees a user at the stored position, views are not asked about public users
+// and cells of only public users are returned as they are, so only users sharing their exact position with
+// everyone for good may be marked
+func (idx *Index) SetPublic(name string, public bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.public[name]; ok == public {
+		return
+	}
+	if public {
+		idx.public[name] = struct{}{}
+	} else {
+		delete(idx.public, name)
+	}
+	if p, ok := idx.points[name]; ok {
+		idx.remove(name)
+		idx.add(name, p.position)
+	}
+}
+
+// returns the number of indexed users
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return len(idx.points)
+}
+
+// returns the key of the cell containing a projected point at a zoom level
+func cellKey(x, y float64, z int) [2]int {
+	cells := float64(int(1)<<z) * geo.TileSize / CellPixels
+	return [2]int{int(math.Min(math.Floor(x*cells), cells-1)), int(math.Min(math.Floor(y*cells), cells-1))}
+}
+
+// returns the column of the cell containing a longitude at a zoom level, 180 falls into the last column
+func cellColumn(lng float64, z int) int {
+	cells := float64(int(1)<<z) * geo.TileSize / CellPixels
+	return int(math.Min(math.Floor((lng+180)/360*cells), cells-1))
+}
+
+// returns the ranges of cell columns and the range of cell rows a zoom level covers the bounds with,
+// bounds crossing the antimeridian take two ranges of columns
+func cellRanges(b geo.Bounds, z int) ([][2]int, [2]int) {
+	_, north := geo.Mercator(geo.LatLng{Lat: b.NorthEast.Lat})
+	_, south := geo.Mercator(geo.LatLng{Lat: b.SouthWest.Lat})
+	rows := [2]int{cellKey(0, north, z)[1], cellKey(0, south, z)[1]}
+
+	west, east := cellColumn(b.SouthWest.Lng, z), cellColumn(b.NorthEast.Lng, z)
+	if b.CrossesAntimeridian() {
+		return [][2]int{{west, cellColumn(180, z)}, {0, east}}, rows
+	}
+	return [][2]int{{west, east}}, rows
+}
+
+func (idx *Index) add(name string, position geo.LatLng) {
+	x, y := geo.Mercator(position)
+	_, public := idx.public[name]
+	idx.points[name] = point{position: position, x: x, y: y, public: public}
+
+	for z, level := range idx.levels {
+		key := cellKey(x, y, z)
+		c, ok := level[key]
+		if !ok {
+			c = &cell{members: map[string]struct{}{}}
+			level[key] = c
+		}
+		c.add(name, idx.points[name])
+	}
+}
+
+func (idx *Index) remove(name string) {
+	p, ok := idx.points[name]
+	if !ok {
+		return
+	}
+	delete(idx.points, name)
+
+	for z, level := range idx.levels {
+		key := cellKey(p.x, p.y, z)
+		c := level[key]
+		c.remove(name, p)
+		if len(c.members) == 0 {
+			delete(level, key)
+			continue
+		}
+		// the float sums drift with every removal, they are recomputed once a cell has seen as many removals as members
+		if c.removed++; c.removed >= len(c.members) {
+			c.recompute(idx.points)
+		}
+	}
+}
+
+// View returns where a viewer sees a user, or false when the user is hidden from them
+// it may move a user by at most precision.MaxMeters
+type View func(name string, position geo.LatLng) (geo.LatLng, bool)
+
+// returns the clusters at a zoom level whose center lies inside bounds, the largest first
+// a nil view shows every user at their exact position
+// above MaxZoom every user is returned as a cluster of one
+func (idx *Index) Clusters(bounds geo.Bounds, zoom int, view View) []Cluster {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	clusters := []Cluster{}
+	add := func(center geo.LatLng, members map[string]struct{}) {
+		if bounds.Contains(center) {
+			clusters = append(clusters, Cluster{Center: center, Count: len(members), Sample: sample(members)})
+		}
+	}
+
+	// users stored outside the bounds may be seen inside them
+	region := bounds
+	if view != nil {
+		region = bounds.Expand(viewShiftKm)
+	}
+
+	if zoom > MaxZoom {
+		for _, c := range idx.cellsFor(MaxZoom, region, nil) {
+			for name := range c.members {
+				p := idx.points[name]
+				position, ok := p.position, true
+				if view != nil && !p.public {
+					position, ok = view(name, p.position)
+				}
+				if ok {
+					add(position, map[string]struct{}{name: {}})
+				}
+			}
+		}
+	} else {
+		for _, c := range idx.cellsFor(max(zoom, 0), region, view) {
+			n := float64(len(c.members))
+			add(geo.InverseMercator(c.sumX/n, c.sumY/n), c.members)
+		}
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Count != clusters[j].Count {
+			return clusters[i].Count > clusters[j].Count
+		}
+		return clusters[i].Sample[0] < clusters[j].Sample[0]
+	})
+	return clusters
+}
+
+// returns the cells of a zoom level covering the bounds as the viewer sees them
+// the cached cells are kept when the viewer sees all their members at the stored position, which public users
+// always are, otherwise a cell is rebuilt without the users hidden from the viewer or seen elsewhere and the
+// latter are added to the cells of the positions the viewer sees
+func (idx *Index) cellsFor(zoom int, bounds geo.Bounds, view View) map[[2]int]*cell {
+	cached := idx.levels[zoom]
+	cells := map[[2]int]*cell{}
+	var moved []movedPoint
+	visit := func(key [2]int, c *cell) {
+		if view == nil || c.public == len(c.members) {
+			cells[key] = c
+			return
+		}
+		kept, elsewhere := idx.viewCell(c, view)
+		if len(kept.members) > 0 {
+			cells[key] = kept
+		}
+		moved = append(moved, elsewhere...)
+	}
+
+	// few cells are looked up by key, large bounds walk the cached cells instead
+	columns, rows := cellRanges(bounds, zoom)
+	area := 0
+	for _, r := range columns {
+		area += (r[1] - r[0] + 1) * (rows[1] - rows[0] + 1)
+	}
+	if area <= len(cached) {
+		for _, r := range columns {
+			for x := r[0]; x <= r[1]; x++ {
+				for y := rows[0]; y <= rows[1]; y++ {
+					if c, ok := cached[[2]int{x, y}]; ok {
+						visit([2]int{x, y}, c)
+					}
+				}
+			}
+		}
+	} else {
+		for key, c := range cached {
+			if key[1] < rows[0] || key[1] > rows[1] {
+				continue
+			}
+			for _, r := range columns {
+				if key[0] >= r[0] && key[0] <= r[1] {
+					visit(key, c)
+					break
+				}
+			}
+		}
+	}
+
+	for _, p := range moved {
+		key := cellKey(p.x, p.y, zoom)
+		c, ok := cells[key]
+		switch {
+		case !ok:
+			c = &cell{members: map[string]struct{}{}}
+			cells[key] = c
+		case c == cached[key]:
+			c = c.clone(idx.points)
+			cells[key] = c
+		}
+		c.add(p.name, p.point)
+	}
+	return cells
+}
+
+// a user the viewer sees away from the stored position
+type movedPoint struct {
+	name string
+	point
+}
+
+// returns the cached cell as the viewer sees it, rebuilt from the members seen at their stored position
+// unless that is all of them, and the members the viewer sees elsewhere
+func (idx *Index) viewCell(c *cell, view View) (*cell, []movedPoint) {
+	var kept []string
+	var moved []movedPoint
+	for name := range c.members {
+		p := idx.points[name]
+		if p.public {
+			kept = append(kept, name)
+			continue
+		}
+		position, ok := view(name, p.position)
+		if ok && position == p.position {
+			kept = append(kept, name)
+		} else if ok {
+			x, y := geo.Mercator(position)
+			moved = append(moved, movedPoint{name: name, point: point{position: position, x: x, y: y}})
+		}
+	}
+	if len(kept) == len(c.members) {
+		return c, nil
+	}
+
+	rebuilt := &cell{members: make(map[string]struct{}, len(kept))}
+	for _, name := range kept {
+		rebuilt.add(name, idx.points[name])
+	}
+	return rebuilt, moved
+}
+
+// returns a copy of the cell that can be changed without touching the index, its sums recomputed from the members
+func (c *cell) clone(points map[string]point) *cell {
+	copied := &cell{members: make(map[string]struct{}, len(c.members))}
+	for name := range c.members {
+		copied.add(name, points[name])
+	}
+	return copied
+}
+
+// recomputes the sums of the projected positions from the members
+func (c *cell) recompute(points map[string]point) {
+	c.sumX, c.sumY, c.removed = 0, 0, 0
+	for name := range c.members {
+		c.sumX += points[name].x
+		c.sumY += points[name].y
+	}
+}
+
+func (c *cell) add(name string, p point) {
+	c.sumX += p.x
+	c.sumY += p.y
+	c.members[name] = struct{}{}
+	if p.public {
+		c.public++
+	}
+}
+
+func (c *cell) remove(name string, p point) {
+	delete(c.members, name)
+	c.sumX -= p.x
+	c.sumY -= p.y
+	if p.public {
+		c.public--
+	}
+}
+
+// returns up to SampleSize member names, alphabetically first so the sample is stable between requests
+func sample(members map[string]struct{}) []string {
+	names := make([]string, 0, SampleSize+1)
+	for name := range members {
+		i := sort.SearchStrings(names, name)
+		if i >= SampleSize {
+			continue
+		}
+		names = append(names, "")
+		copy(names[i+1:], names[i:])
+		names[i] = name
+		if len(names) > SampleSize {
+			names = names[:SampleSize]
+		}
+	}
+	return names
+}
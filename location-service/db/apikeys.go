@@ -0,0 +1,160 @@
+package DB
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"go-nauka/location-service/models"
+	"go-nauka/tracing"
+)
+
+// columns of an API key with one of its usernames per row
+const apiKeyColumns = "k.id, k.prefix, k.name, k.owner, k.scopes, k.created_at, k.last_used_at, k.revoked_at, u.username"
+
+// scans rows of apiKeyColumns ordered by key id, merging the usernames of a key
+func scanAPIKeys(rows *sql.Rows) ([]models.APIKey, error) {
+	keys := []models.APIKey{}
+	for rows.Next() {
+		var key models.APIKey
+		var scopes string
+		var lastUsedAt, revokedAt, username sql.NullString
+		if err := rows.Scan(&key.ID, &key.Prefix, &key.Name, &key.Owner, &scopes, &key.CreatedAt, &lastUsedAt, &revokedAt, &username); err != nil {
+			return nil, err
+		}
+		if n := len(keys); n > 0 && keys[n-1].ID == key.ID {
+			if username.Valid {
+				keys[n-1].Usernames = append(keys[n-1].Usernames, username.String)
+			}
+			continue
+		}
+		key.Scopes = strings.Split(scopes, ",")
+		key.Usernames = []string{}
+		if username.Valid {
+			key.Usernames = append(key.Usernames, username.String)
+		}
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.String
+		}
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.String
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// stores an API key under the sha256 hash of its plaintext and returns its id
+func AddAPIKey(ctx context.Context, key models.APIKey, hash string) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "AddAPIKey")
+	defer span.End()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("addAPIKey: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO api_keys (key_hash, prefix, name, owner, scopes) VALUES (?, ?, ?, ?, ?)",
+		hash, key.Prefix, key.Name, key.Owner, strings.Join(key.Scopes, ","))
+	if err != nil {
+		return 0, fmt.Errorf("addAPIKey: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("addAPIKey: %v", err)
+	}
+
+	for _, username := range key.Usernames {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO api_key_usernames (key_id, username) VALUES (?, ?)", id, username); err != nil {
+			return 0, fmt.Errorf("addAPIKey (usernames): %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("addAPIKey: %v", err)
+	}
+	return id, nil
+}
+
+// retrieves the API keys of an owner including revoked ones, every key when owner is empty
+func GetAPIKeys(ctx context.Context, owner string) ([]models.APIKey, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetAPIKeys")
+	defer span.End()
+
+	query := "SELECT " + apiKeyColumns + " FROM api_keys k LEFT JOIN api_key_usernames u ON u.key_id = k.id WHERE k.owner = ? ORDER BY k.id, u.username"
+	args := []interface{}{owner}
+	if owner == "" {
+		query = "SELECT " + apiKeyColumns + " FROM api_keys k LEFT JOIN api_key_usernames u ON u.key_id = k.id ORDER BY k.id, u.username"
+		args = nil
+	}
+
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("getAPIKeys: %v", err)
+	}
+	defer rows.Close()
+
+	keys, err := scanAPIKeys(rows)
+	if err != nil {
+		return nil, fmt.Errorf("getAPIKeys: %v", err)
+	}
+	return keys, nil
+}
+
+// returns the API key that is not revoked with the given hash, nil when there is none
+func GetActiveAPIKey(ctx context.Context, hash string) (*models.APIKey, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetActiveAPIKey")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys k LEFT JOIN api_key_usernames u ON u.key_id = k.id WHERE k.key_hash = ? AND k.revoked_at IS NULL ORDER BY u.username", hash)
+	if err != nil {
+		return nil, fmt.Errorf("getActiveAPIKey: %v", err)
+	}
+	defer rows.Close()
+
+	keys, err := scanAPIKeys(rows)
+	if err != nil {
+		return nil, fmt.Errorf("getActiveAPIKey: %v", err)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return &keys[0], nil
+}
+
+// records that an API key was used, at most once a minute so busy keys don't write on every request
+func TouchAPIKey(ctx context.Context, id int64) error {
+	ctx, span := tracing.StartQuery(ctx, "TouchAPIKey")
+	defer span.End()
+
+	_, err := DB.ExecContext(ctx, "UPDATE api_keys SET last_used_at = UTC_TIMESTAMP() WHERE id = ? AND (last_used_at IS NULL OR last_used_at < UTC_TIMESTAMP() - INTERVAL 1 MINUTE)", id)
+	if err != nil {
+		return fmt.Errorf("touchAPIKey: %v", err)
+	}
+	return nil
+}
+
+// revokes an API key of an owner, any owners key when owner is empty, reports whether an active key was revoked
+func RevokeAPIKey(ctx context.Context, owner string, id int64) (bool, error) {
+	ctx, span := tracing.StartQuery(ctx, "RevokeAPIKey")
+	defer span.End()
+
+	query := "UPDATE api_keys SET revoked_at = UTC_TIMESTAMP() WHERE id = ? AND owner = ? AND revoked_at IS NULL"
+	args := []interface{}{id, owner}
+	if owner == "" {
+		query = "UPDATE api_keys SET revoked_at = UTC_TIMESTAMP() WHERE id = ? AND revoked_at IS NULL"
+		args = args[:1]
+	}
+
+	result, err := DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, fmt.Errorf("revokeAPIKey: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("revokeAPIKey: %v", err)
+	}
+	return rowsAffected > 0, nil
+}
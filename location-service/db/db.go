@@ -2,58 +2,78 @@
 package DB
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"os"
+	"sort"
+	"time"
 
+	"go-nauka/config"
+	"go-nauka/geo"
 	"go-nauka/location-service/models"
+	"go-nauka/location-service/precision"
+	"go-nauka/logging"
+	"go-nauka/metrics"
+	"go-nauka/tracing"
 
 	"github.com/go-sql-driver/mysql"
 )
 
 var DB *sql.DB
 
+var logger = logging.For("db")
+
 // safely closes the database connection
 func CloseDB() {
 	if DB != nil {
 		err := DB.Close()
 		if err != nil {
-			log.Println("Error closing the database:", err)
+			logger.Error("Error closing the database", "error", err)
 		} else {
-			log.Println("Database connection closed.")
+			logger.Info("Database connection closed")
 		}
 	}
 }
 
-// initializes the database connection
-func InitDB() {
+// initializes the database connection with the database section of the config
+func InitDB(settings config.Database) {
 	cfg := mysql.Config{
-		User:   os.Getenv("DBUSER"),
-		Passwd: os.Getenv("DBPASS"),
+		User:   settings.User,
+		Passwd: settings.Password,
 		Net:    "tcp",
-		Addr:   "127.0.0.1:3306",
-		DBName: "users",
+		Addr:   settings.Addr,
+		DBName: settings.Name,
 	}
 
 	var err error
 	DB, err = sql.Open("mysql", cfg.FormatDSN())
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "Failed to open the database", "error", err)
 	}
 
 	pingErr := DB.Ping()
 	if pingErr != nil {
-		log.Fatal(pingErr)
+		logging.Fatal(logger, "Failed to connect to the database", "addr", settings.Addr, "error", pingErr)
 	}
-	fmt.Println("Connected to the database!")
+	logger.Info("Connected to the database", "addr", settings.Addr)
+}
+
+// pings the database for the readiness check
+func HealthCheck(ctx context.Context) (string, error) {
+	if err := DB.PingContext(ctx); err != nil {
+		return "", fmt.Errorf("healthCheck: %v", err)
+	}
+	return fmt.Sprintf("%d open connections", DB.Stats().OpenConnections), nil
 }
 
 // Gets all user location records from the database
-func DBGetLocations() ([]models.Location, error) {
+func DBGetLocations(ctx context.Context) ([]models.Location, error) {
+	ctx, span := tracing.StartQuery(ctx, "DBGetLocations")
+	defer span.End()
+
 	var locations []models.Location
 
-	rows, err := DB.Query("SELECT * FROM location")
+	rows, err := DB.QueryContext(ctx, "SELECT * FROM location")
 	if err != nil {
 		return nil, fmt.Errorf("locations: %v", err)
 	}
@@ -74,10 +94,13 @@ func DBGetLocations() ([]models.Location, error) {
 }
 
 // inserts a new location or updates one if it exists( name )
-func AddLocation(loc models.Location) (int64, error) {
+func AddLocation(ctx context.Context, loc models.Location) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "AddLocation")
+	defer span.End()
+	defer metrics.ObserveQuery("AddLocation", time.Now())
 
 	var existingName string
-	err := DB.QueryRow("SELECT name FROM location WHERE name = ?", loc.Name).Scan(&existingName)
+	err := DB.QueryRowContext(ctx, "SELECT name FROM location WHERE name = ?", loc.Name).Scan(&existingName)
 
 	if err != nil && err != sql.ErrNoRows {
 
@@ -86,15 +109,15 @@ func AddLocation(loc models.Location) (int64, error) {
 
 	if err == nil {
 
-		_, err := DB.Exec("UPDATE location SET latitude = ?, longitude = ?, updated_at = CURRENT_TIMESTAMP WHERE name = ?", loc.Latitude, loc.Longitude, loc.Name)
+		_, err := DB.ExecContext(ctx, "UPDATE location SET latitude = ?, longitude = ?, updated_at = CURRENT_TIMESTAMP WHERE name = ?", loc.Latitude, loc.Longitude, loc.Name)
 		if err != nil {
 			return 0, fmt.Errorf("addLocation (update): %v", err)
 		}
-		fmt.Printf("Updated location for '%s'\n", loc.Name)
+		logger.DebugContext(ctx, "Updated location", "username", loc.Name)
 		return 0, nil
 	}
 
-	result, err := DB.Exec("INSERT INTO location (name, latitude, longitude) VALUES (?, ?, ?)", loc.Name, loc.Latitude, loc.Longitude)
+	result, err := DB.ExecContext(ctx, "INSERT INTO location (name, latitude, longitude) VALUES (?, ?, ?)", loc.Name, loc.Latitude, loc.Longitude)
 	if err != nil {
 		return 0, fmt.Errorf("addLocation (insert): %v", err)
 	}
@@ -103,48 +126,177 @@ func AddLocation(loc models.Location) (int64, error) {
 	if err != nil {
 		return 0, fmt.Errorf("addLocation (insert): %v", err)
 	}
-	fmt.Printf("Inserted new location for '%s'\n", loc.Name)
+	logger.DebugContext(ctx, "Inserted new location", "username", loc.Name)
 	return rowsAffected, nil
 }
 
-// retrives locations within a specified radius of given coordinates(supports pagination)
-func SearchLocations(lat, lon, radius float64, page, pageSize int) ([]models.Location, error) {
-	var locations []models.Location
+// widens the bounding box prefilter in SQL so it never drops points an ellipsoidal distance func keeps
+const searchRadiusMargin = 1.01
+
+// rows fetched beyond the requested page for geodesic searches, the database orders them by haversine distance
+// which can differ in order from the geodesic one for points at almost the same distance
+const geodesicExtraRows = 50
+
+// great-circle distance in km between the location row l and a point, the latitude is passed twice, then the longitude
+const haversineSQL = `(6371 * 2 * ASIN(SQRT(
+		POW(SIN(RADIANS(l.latitude - ?) / 2), 2) +
+		COS(RADIANS(?)) * COS(RADIANS(l.latitude)) * POW(SIN(RADIANS(l.longitude - ?) / 2), 2))))`
+
+// returns the condition selecting the location rows l inside the bounds, followed by the args of the bounds
+func inBounds(bounds geo.Bounds) (string, []any) {
+	args := []any{bounds.SouthWest.Lat, bounds.NorthEast.Lat, bounds.SouthWest.Lng, bounds.NorthEast.Lng}
+	if bounds.CrossesAntimeridian() {
+		return "l.latitude BETWEEN ? AND ? AND (l.longitude >= ? OR l.longitude <= ?)", args
+	}
+	return "l.latitude BETWEEN ? AND ? AND l.longitude BETWEEN ? AND ?", args
+}
+
+// a location found by a search and its distance from the center
+type searchHit struct {
+	loc      models.Location
+	distance float64
+}
+
+// retrives locations the viewer may see within a specified radius of given coordinates(supports pagination)
+// method names the distance formula, haversine searches are filtered, ordered and paginated by the database
+// geodesic ones fetch a page and some extra rows ordered by haversine distance and calculate the exact distance here
+// users the viewer sees at reduced precision are searched by the position the viewer sees, so their stored one
+// never decides whether or where they are listed
+func SearchLocations(ctx context.Context, center geo.LatLng, radius float64, page, pageSize int, method string, viewer string) ([]models.Location, error) {
+	ctx, span := tracing.StartQuery(ctx, "SearchLocations")
+	defer span.End()
+	defer metrics.ObserveQuery("SearchLocations", time.Now())
+
+	distance, err := geo.DistanceFuncFor(method)
+	if err != nil {
+		return nil, fmt.Errorf("searchLocations: %v", err)
+	}
+	geodesic := method != "" && method != geo.MethodHaversine
 
 	offset := (page - 1) * pageSize
+	sqlRadius := radius
+	if geodesic {
+		sqlRadius = radius * searchRadiusMargin
+	}
+	bounds := geo.BoundsAround(center, sqlRadius)
+
+	hits, err := searchReduced(ctx, center, radius, bounds, distance, viewer)
+	if err != nil {
+		return nil, fmt.Errorf("searchLocations: %v", err)
+	}
+
+	// the page can only be left to the database when no reduced positions have to be merged into it
+	limit, sqlOffset := pageSize, offset
+	if geodesic || len(hits) > 0 {
+		limit, sqlOffset = offset+pageSize, 0
+	}
+	if geodesic {
+		limit += geodesicExtraRows
+	}
 
+	condition, boundsArgs := inBounds(bounds)
 	query := `
-	SELECT name, latitude, longitude, updated_at,
-		(6371 * ACOS(
-			COS(RADIANS(?)) * COS(RADIANS(latitude)) *
-			COS(RADIANS(longitude) - RADIANS(?)) +
-			SIN(RADIANS(?)) * SIN(RADIANS(latitude))
-		)) AS distance
-	FROM location
-	HAVING distance <= ?
+	SELECT ` + visibleColumns + `, ` + haversineSQL + ` AS distance
+	FROM location l
+	WHERE ` + condition + ` AND ` + visibleTo + `
+	HAVING precision_m = 0 AND distance <= ?
 	ORDER BY distance ASC
-	LIMIT ? OFFSET ?
-`
-
-	rows, err := DB.Query(query, lat, lon, lat, radius, pageSize, offset)
+	LIMIT ? OFFSET ?`
+	args := append([]any{viewer, viewer, viewer, center.Lat, center.Lat, center.Lng}, boundsArgs...)
+	args = append(args, viewer, viewer, viewer, sqlRadius, limit, sqlOffset)
 
+	rows, err := DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("searchLocations: %v", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var loc models.Location
-		var distance float64
-		if err := rows.Scan(&loc.Name, &loc.Latitude, &loc.Longitude, &loc.UpdatedAt, &distance); err != nil {
+		var d float64
+		loc, err := scanVisible(rows, &d)
+		if err != nil {
 			return nil, fmt.Errorf("searchLocations: %v", err)
 		}
-		locations = append(locations, loc)
+		if geodesic {
+			d = distance(center, loc.Position())
+		}
+		if !geodesic || d <= radius {
+			hits = append(hits, searchHit{loc: loc, distance: d})
+		}
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("searchLocations: %v", err)
 	}
 
+	if sqlOffset > 0 {
+		// the database already skipped the rows of the earlier pages
+		offset = 0
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].distance < hits[j].distance })
+
+	var locations []models.Location
+	for i := offset; i < len(hits) && i < offset+pageSize; i++ {
+		locations = append(locations, hits[i].loc)
+	}
+
+	return locations, nil
+}
+
+// returns the users the viewer sees at reduced precision whose reduced position is within the radius
+// the database only narrows them down to the bounds widened by the coarsest grid
+func searchReduced(ctx context.Context, center geo.LatLng, radius float64, bounds geo.Bounds, distance geo.DistanceFunc, viewer string) ([]searchHit, error) {
+	condition, boundsArgs := inBounds(bounds.Expand(precision.MaxMeters / 1000))
+	args := append([]any{viewer, viewer, viewer}, boundsArgs...)
+	args = append(args, viewer, viewer, viewer)
+
+	rows, err := DB.QueryContext(ctx, "SELECT "+visibleColumns+" FROM location l WHERE "+condition+" AND "+visibleTo+" HAVING precision_m > 0", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []searchHit
+	for rows.Next() {
+		loc, err := scanVisible(rows)
+		if err != nil {
+			return nil, err
+		}
+		if d := distance(center, loc.Position()); d <= radius {
+			hits = append(hits, searchHit{loc: loc, distance: d})
+		}
+	}
+	return hits, rows.Err()
+}
+
+// retrieves the locations the viewer may see inside a latitude/longitude rectangle, at the precision the viewer may see them
+// the database looks inside the bounds widened by the coarsest grid, reduced positions are checked against the bounds here
+func GetLocationsIn(ctx context.Context, bounds geo.Bounds, viewer string) ([]models.Location, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetLocationsIn")
+	defer span.End()
+
+	condition, boundsArgs := inBounds(bounds.Expand(precision.MaxMeters / 1000))
+	args := append([]any{viewer, viewer, viewer}, boundsArgs...)
+	args = append(args, viewer, viewer, viewer)
+
+	rows, err := DB.QueryContext(ctx, "SELECT "+visibleColumns+" FROM location l WHERE "+condition+" AND "+visibleTo, args...)
+	if err != nil {
+		return nil, fmt.Errorf("getLocationsIn: %v", err)
+	}
+	defer rows.Close()
+
+	var locations []models.Location
+	for rows.Next() {
+		loc, err := scanVisible(rows)
+		if err != nil {
+			return nil, fmt.Errorf("getLocationsIn: %v", err)
+		}
+		if bounds.Contains(loc.Position()) {
+			locations = append(locations, loc)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getLocationsIn: %v", err)
+	}
 	return locations, nil
 }
@@ -0,0 +1,100 @@
+package DB
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"go-nauka/tracing"
+)
+
+// removes a users current location together with their stored idempotency records, the API keys they own or may act as,
+// proximity rule memberships and events, the shares they own or receive and the groups they own or belong to
+// returns the number of location rows deleted
+func DeleteLocation(ctx context.Context, name string) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "DeleteLocation")
+	defer span.End()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("deleteLocation: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE name = ?", name); err != nil {
+		return 0, fmt.Errorf("deleteLocation (idempotency keys): %v", err)
+	}
+
+	// keys owned by the user go with their usernames, keys of others lose the user, so no key can write the location again
+	if _, err := tx.ExecContext(ctx, "DELETE FROM api_key_usernames WHERE username = ? OR key_id IN (SELECT id FROM api_keys WHERE owner = ?)", name, name); err != nil {
+		return 0, fmt.Errorf("deleteLocation (api key usernames): %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM api_keys WHERE owner = ?", name); err != nil {
+		return 0, fmt.Errorf("deleteLocation (api keys): %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM proximity_rule_members WHERE username = ?", name); err != nil {
+		return 0, fmt.Errorf("deleteLocation (proximity rules): %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM proximity_events WHERE user_a = ? OR user_b = ?", name, name); err != nil {
+		return 0, fmt.Errorf("deleteLocation (proximity events): %v", err)
+	}
+
+	// shares granted to the groups of the user go too, so a new group with the same name does not inherit them
+	if _, err := tx.ExecContext(ctx, `DELETE FROM location_shares WHERE owner = ? OR (grantee_type = 'user' AND grantee = ?)
+		OR (grantee_type = 'group' AND grantee IN (SELECT name FROM user_groups WHERE owner = ?))`, name, name, name); err != nil {
+		return 0, fmt.Errorf("deleteLocation (shares): %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM group_members WHERE username = ? OR group_name IN (SELECT name FROM user_groups WHERE owner = ?)", name, name); err != nil {
+		return 0, fmt.Errorf("deleteLocation (group members): %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_groups WHERE owner = ?", name); err != nil {
+		return 0, fmt.Errorf("deleteLocation (groups): %v", err)
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM location WHERE name = ?", name)
+	if err != nil {
+		return 0, fmt.Errorf("deleteLocation: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("deleteLocation: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("deleteLocation: %v", err)
+	}
+	return rowsAffected, nil
+}
+
+// key of the username hashes in the deletion audit, set from DELETION_AUDIT_SECRET so an erased user can't be found
+// by hashing candidate usernames
+var AuditSecret []byte
+
+// records that a user was erased and how many rows were removed in each service
+// the username itself is stored only as a keyed hash so the audit trail does not keep personal data
+func AddDeletionAudit(ctx context.Context, name string, locationRows, historyRows int64) error {
+	ctx, span := tracing.StartQuery(ctx, "AddDeletionAudit")
+	defer span.End()
+
+	_, err := DB.ExecContext(ctx, "INSERT INTO user_deletion_audit (subject_hash, location_rows, history_rows) VALUES (?, ?, ?)",
+		HashSubject(name), locationRows, historyRows)
+	if err != nil {
+		return fmt.Errorf("addDeletionAudit: %v", err)
+	}
+	return nil
+}
+
+// returns the hex encoded HMAC-SHA256 of a username keyed by AuditSecret as stored in the deletion audit
+func HashSubject(name string) string {
+	mac := hmac.New(sha256.New, AuditSecret)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
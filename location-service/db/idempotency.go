@@ -0,0 +1,116 @@
+package DB
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go-nauka/location-service/models"
+	"go-nauka/tracing"
+)
+
+// how long a stored idempotent response is replayed for retried requests
+var IdempotencyTTL = 24 * time.Hour
+
+// retrieves the stored response for a users idempotency key
+// returns nil if the key is unknown or older than IdempotencyTTL
+func GetIdempotencyRecord(ctx context.Context, name, key string) (*models.IdempotencyRecord, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetIdempotencyRecord")
+	defer span.End()
+
+	rec := models.IdempotencyRecord{Name: name, Key: key}
+
+	err := DB.QueryRowContext(ctx,
+		"SELECT status_code, response FROM idempotency_keys WHERE name = ? AND idempotency_key = ? AND created_at > NOW() - INTERVAL ? SECOND",
+		name, key, int64(IdempotencyTTL.Seconds()),
+	).Scan(&rec.StatusCode, &rec.Response)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getIdempotencyRecord: %v", err)
+	}
+	return &rec, nil
+}
+
+// claims a users idempotency key for a request before it is processed, so concurrent retries can't both write
+// returns nil once the key is reserved, otherwise the record of the key, still pending while its request is processed
+// an expired record with the same key is reset and reserved again
+func ReserveIdempotencyKey(ctx context.Context, name, key string) (*models.IdempotencyRecord, error) {
+	ctx, span := tracing.StartQuery(ctx, "ReserveIdempotencyKey")
+	defer span.End()
+
+	// the assignments are applied in order, so created_at is checked by all of them before it is reset
+	result, err := DB.ExecContext(ctx, `
+	INSERT INTO idempotency_keys (name, idempotency_key, status_code, response) VALUES (?, ?, 0, '')
+	ON DUPLICATE KEY UPDATE
+		status_code = IF(created_at <= NOW() - INTERVAL ? SECOND, 0, status_code),
+		response = IF(created_at <= NOW() - INTERVAL ? SECOND, '', response),
+		created_at = IF(created_at <= NOW() - INTERVAL ? SECOND, CURRENT_TIMESTAMP, created_at)
+`, name, key, int64(IdempotencyTTL.Seconds()), int64(IdempotencyTTL.Seconds()), int64(IdempotencyTTL.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("reserveIdempotencyKey: %v", err)
+	}
+	// 1 for a new row, 2 for a reset expired one, 0 when a live record was left as it is
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("reserveIdempotencyKey: %v", err)
+	}
+	if rowsAffected > 0 {
+		return nil, nil
+	}
+
+	rec, err := GetIdempotencyRecord(ctx, name, key)
+	if err != nil {
+		return nil, fmt.Errorf("reserveIdempotencyKey: %v", err)
+	}
+	if rec == nil {
+		// expired or purged since the insert, the caller retries
+		rec = &models.IdempotencyRecord{Name: name, Key: key}
+	}
+	return rec, nil
+}
+
+// stores the response for a users reserved idempotency key
+func SaveIdempotencyRecord(ctx context.Context, rec models.IdempotencyRecord) error {
+	ctx, span := tracing.StartQuery(ctx, "SaveIdempotencyRecord")
+	defer span.End()
+
+	_, err := DB.ExecContext(ctx, "UPDATE idempotency_keys SET status_code = ?, response = ? WHERE name = ? AND idempotency_key = ?",
+		rec.StatusCode, rec.Response, rec.Name, rec.Key)
+	if err != nil {
+		return fmt.Errorf("saveIdempotencyRecord: %v", err)
+	}
+	return nil
+}
+
+// removes the reservation of a users idempotency key whose request failed, so a retry is processed again
+func ReleaseIdempotencyKey(ctx context.Context, name, key string) error {
+	ctx, span := tracing.StartQuery(ctx, "ReleaseIdempotencyKey")
+	defer span.End()
+
+	_, err := DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE name = ? AND idempotency_key = ? AND status_code = 0", name, key)
+	if err != nil {
+		return fmt.Errorf("releaseIdempotencyKey: %v", err)
+	}
+	return nil
+}
+
+// removes idempotency records older than IdempotencyTTL and returns how many were removed
+func DeleteExpiredIdempotencyRecords(ctx context.Context) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "DeleteExpiredIdempotencyRecords")
+	defer span.End()
+
+	result, err := DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at <= NOW() - INTERVAL ? SECOND", int64(IdempotencyTTL.Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("deleteExpiredIdempotencyRecords: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("deleteExpiredIdempotencyRecords: %v", err)
+	}
+	return rowsAffected, nil
+}
@@ -0,0 +1,166 @@
+package DB
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"go-nauka/location-service/models"
+	"go-nauka/tracing"
+)
+
+// stores a proximity rule with its members, marking the ones that accepted it, and returns its id
+func AddProximityRule(ctx context.Context, rule models.ProximityRule) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "AddProximityRule")
+	defer span.End()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("addProximityRule: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO proximity_rules (name, threshold_km, exit_km) VALUES (?, ?, ?)", rule.Name, rule.ThresholdKm, rule.ExitKm)
+	if err != nil {
+		return 0, fmt.Errorf("addProximityRule: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("addProximityRule: %v", err)
+	}
+
+	for _, member := range rule.Members {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO proximity_rule_members (rule_id, username, accepted) VALUES (?, ?, ?)", id, member, slices.Contains(rule.Accepted, member)); err != nil {
+			return 0, fmt.Errorf("addProximityRule (members): %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("addProximityRule: %v", err)
+	}
+	return id, nil
+}
+
+// retrieves every proximity rule with its members and the members that accepted it
+func GetProximityRules(ctx context.Context) ([]models.ProximityRule, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetProximityRules")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, `
+		SELECT r.id, r.name, r.threshold_km, r.exit_km, m.username, m.accepted
+		FROM proximity_rules r
+		JOIN proximity_rule_members m ON m.rule_id = r.id
+		ORDER BY r.id, m.username
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("getProximityRules: %v", err)
+	}
+	defer rows.Close()
+
+	rules := []models.ProximityRule{}
+	for rows.Next() {
+		var rule models.ProximityRule
+		var member string
+		var accepted bool
+		if err := rows.Scan(&rule.ID, &rule.Name, &rule.ThresholdKm, &rule.ExitKm, &member, &accepted); err != nil {
+			return nil, fmt.Errorf("getProximityRules: %v", err)
+		}
+		if n := len(rules); n == 0 || rules[n-1].ID != rule.ID {
+			rule.Members, rule.Accepted = []string{}, []string{}
+			rules = append(rules, rule)
+		}
+		last := &rules[len(rules)-1]
+		last.Members = append(last.Members, member)
+		if accepted {
+			last.Accepted = append(last.Accepted, member)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getProximityRules: %v", err)
+	}
+	return rules, nil
+}
+
+// records that a member accepted a proximity rule, so it applies to them from now on
+func AcceptProximityRule(ctx context.Context, id int64, username string) error {
+	ctx, span := tracing.StartQuery(ctx, "AcceptProximityRule")
+	defer span.End()
+
+	if _, err := DB.ExecContext(ctx, "UPDATE proximity_rule_members SET accepted = TRUE WHERE rule_id = ? AND username = ?", id, username); err != nil {
+		return fmt.Errorf("acceptProximityRule: %v", err)
+	}
+	return nil
+}
+
+// removes a proximity rule, reports whether it existed
+func DeleteProximityRule(ctx context.Context, id int64) (bool, error) {
+	ctx, span := tracing.StartQuery(ctx, "DeleteProximityRule")
+	defer span.End()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("deleteProximityRule: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM proximity_rule_members WHERE rule_id = ?", id); err != nil {
+		return false, fmt.Errorf("deleteProximityRule (members): %v", err)
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM proximity_rules WHERE id = ?", id)
+	if err != nil {
+		return false, fmt.Errorf("deleteProximityRule: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("deleteProximityRule: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("deleteProximityRule: %v", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// stores a proximity event
+func AddProximityEvent(ctx context.Context, event models.ProximityEvent) error {
+	ctx, span := tracing.StartQuery(ctx, "AddProximityEvent")
+	defer span.End()
+
+	_, err := DB.ExecContext(ctx, "INSERT INTO proximity_events (rule_id, event_type, user_a, user_b, distance_km) VALUES (?, ?, ?, ?, ?)",
+		event.RuleID, event.Type, event.Users[0], event.Users[1], event.DistanceKm)
+	if err != nil {
+		return fmt.Errorf("addProximityEvent: %v", err)
+	}
+	return nil
+}
+
+// retrieves the latest proximity events of a user, newest first
+func GetProximityEvents(ctx context.Context, username string, limit int) ([]models.ProximityEvent, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetProximityEvents")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, `
+		SELECT id, rule_id, event_type, user_a, user_b, distance_km, created_at
+		FROM proximity_events
+		WHERE user_a = ? OR user_b = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, username, username, limit)
+	if err != nil {
+		return nil, fmt.Errorf("getProximityEvents: %v", err)
+	}
+	defer rows.Close()
+
+	events := []models.ProximityEvent{}
+	for rows.Next() {
+		var event models.ProximityEvent
+		if err := rows.Scan(&event.ID, &event.RuleID, &event.Type, &event.Users[0], &event.Users[1], &event.DistanceKm, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("getProximityEvents: %v", err)
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getProximityEvents: %v", err)
+	}
+	return events, nil
+}
@@ -0,0 +1,357 @@
+package DB
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"go-nauka/location-service/models"
+	"go-nauka/location-service/precision"
+	"go-nauka/tracing"
+)
+
+// condition selecting the shares (aliased s) that let the viewer see the location row l, the viewer is passed twice
+// a group share only counts while the sharer owns the group
+const shareGrants = `s.owner = l.name
+		AND (s.expires_at IS NULL OR s.expires_at > UTC_TIMESTAMP())
+		AND (s.grantee_type = 'everyone'
+			OR (s.grantee_type = 'user' AND s.grantee = ?)
+			OR (s.grantee_type = 'group' AND s.grantee IN (
+				SELECT m.group_name FROM group_members m JOIN user_groups g ON g.name = m.group_name
+				WHERE m.username = ? AND g.owner = s.owner)))`
+
+// condition selecting the rows of the location table (aliased l) the viewer may see
+// a user always sees themselves, others only through a share that has not expired, the viewer is passed three times
+const visibleTo = `(l.name = ? OR EXISTS (SELECT 1 FROM location_shares s WHERE ` + shareGrants + `))`
+
+// grid size in meters of the precision the viewer sees the location row l with, the finest of the shares
+// and 0 for the viewer themselves, the viewer is passed three times
+const precisionFor = `CASE WHEN l.name = ? THEN 0 ELSE (SELECT MIN(s.precision_m) FROM location_shares s WHERE ` + shareGrants + `) END`
+
+// columns of a location as the viewer may see it, the viewer is passed three times
+const visibleColumns = "l.name, l.latitude, l.longitude, l.updated_at, " + precisionFor + " AS precision_m"
+
+// scans a row of visibleColumns followed by the extra columns, reducing the precision of the location to what the viewer may see
+func scanVisible(rows *sql.Rows, extra ...any) (models.Location, error) {
+	var loc models.Location
+	var meters sql.NullInt64
+	if err := rows.Scan(append([]any{&loc.Name, &loc.Latitude, &loc.Longitude, &loc.UpdatedAt, &meters}, extra...)...); err != nil {
+		return loc, err
+	}
+	precision.Apply(&loc, int(meters.Int64))
+	return loc, nil
+}
+
+// retrieves the locations the viewer may see, an empty viewer only sees users sharing with everyone
+func GetLocationsVisibleTo(ctx context.Context, viewer string) ([]models.Location, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetLocationsVisibleTo")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, "SELECT "+visibleColumns+" FROM location l WHERE "+visibleTo, viewer, viewer, viewer, viewer, viewer, viewer)
+	if err != nil {
+		return nil, fmt.Errorf("getLocationsVisibleTo: %v", err)
+	}
+	defer rows.Close()
+
+	var locations []models.Location
+	for rows.Next() {
+		loc, err := scanVisible(rows)
+		if err != nil {
+			return nil, fmt.Errorf("getLocationsVisibleTo: %v", err)
+		}
+		locations = append(locations, loc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getLocationsVisibleTo: %v", err)
+	}
+	return locations, nil
+}
+
+// retrieves the locations of the named users the viewer may see, at the precision the viewer may see them
+func GetLocationsOf(ctx context.Context, names []string, viewer string) ([]models.Location, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetLocationsOf")
+	defer span.End()
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+	args := []any{viewer, viewer, viewer}
+	for _, name := range names {
+		args = append(args, name)
+	}
+	args = append(args, viewer, viewer, viewer)
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+	rows, err := DB.QueryContext(ctx, "SELECT "+visibleColumns+" FROM location l WHERE l.name IN ("+placeholders+") AND "+visibleTo, args...)
+	if err != nil {
+		return nil, fmt.Errorf("getLocationsOf: %v", err)
+	}
+	defer rows.Close()
+
+	var locations []models.Location
+	for rows.Next() {
+		loc, err := scanVisible(rows)
+		if err != nil {
+			return nil, fmt.Errorf("getLocationsOf: %v", err)
+		}
+		locations = append(locations, loc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getLocationsOf: %v", err)
+	}
+	return locations, nil
+}
+
+// returns the users the viewer may see with the grid size in meters of the precision they are shown with
+func GetVisiblePrecisions(ctx context.Context, viewer string) (map[string]int, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetVisiblePrecisions")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, "SELECT l.name, "+precisionFor+" FROM location l WHERE "+visibleTo, viewer, viewer, viewer, viewer, viewer, viewer)
+	if err != nil {
+		return nil, fmt.Errorf("getVisiblePrecisions: %v", err)
+	}
+	defer rows.Close()
+
+	precisions := map[string]int{}
+	for rows.Next() {
+		var name string
+		var meters sql.NullInt64
+		if err := rows.Scan(&name, &meters); err != nil {
+			return nil, fmt.Errorf("getVisiblePrecisions: %v", err)
+		}
+		precisions[name] = int(meters.Int64)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getVisiblePrecisions: %v", err)
+	}
+	return precisions, nil
+}
+
+// returns the grid size in meters of the precision the owner shares their location with the viewer,
+// reports false when the owner does not share with the viewer at all
+func SharePrecision(ctx context.Context, owner, viewer string) (int, bool, error) {
+	ctx, span := tracing.StartQuery(ctx, "SharePrecision")
+	defer span.End()
+
+	var meters sql.NullInt64
+	err := DB.QueryRowContext(ctx, "SELECT "+precisionFor+" FROM location l WHERE l.name = ? AND "+visibleTo,
+		viewer, viewer, viewer, owner, viewer, viewer, viewer).Scan(&meters)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("sharePrecision: %v", err)
+	}
+	return int(meters.Int64), true, nil
+}
+
+// condition selecting the shares that show their owner exactly to every viewer for good
+const publicShare = "grantee_type = 'everyone' AND precision_m = 0 AND expires_at IS NULL"
+
+// lists the users sharing their exact location with everyone without an expiry
+func GetPublicUsers(ctx context.Context) ([]string, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetPublicUsers")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, "SELECT DISTINCT owner FROM location_shares WHERE "+publicShare)
+	if err != nil {
+		return nil, fmt.Errorf("getPublicUsers: %v", err)
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var owner string
+		if err := rows.Scan(&owner); err != nil {
+			return nil, fmt.Errorf("getPublicUsers: %v", err)
+		}
+		users = append(users, owner)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getPublicUsers: %v", err)
+	}
+	return users, nil
+}
+
+// reports whether an owner shares their exact location with everyone without an expiry
+func IsPublic(ctx context.Context, owner string) (bool, error) {
+	ctx, span := tracing.StartQuery(ctx, "IsPublic")
+	defer span.End()
+
+	var public bool
+	if err := DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM location_shares WHERE owner = ? AND "+publicShare+")", owner).Scan(&public); err != nil {
+		return false, fmt.Errorf("isPublic: %v", err)
+	}
+	return public, nil
+}
+
+// stores a share and returns its id
+func AddShare(ctx context.Context, share models.Share) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "AddShare")
+	defer span.End()
+
+	var expiresAt sql.NullString
+	if share.ExpiresAt != nil {
+		expiresAt = sql.NullString{String: *share.ExpiresAt, Valid: true}
+	}
+
+	meters, err := precision.Meters(share.Precision)
+	if err != nil {
+		return 0, fmt.Errorf("addShare: %v", err)
+	}
+
+	result, err := DB.ExecContext(ctx, "INSERT INTO location_shares (owner, grantee_type, grantee, precision_m, expires_at) VALUES (?, ?, ?, ?, ?)",
+		share.Owner, share.GranteeType, share.Grantee, meters, expiresAt)
+	if err != nil {
+		return 0, fmt.Errorf("addShare: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("addShare: %v", err)
+	}
+	return id, nil
+}
+
+// retrieves the shares of an owner including expired ones
+func GetShares(ctx context.Context, owner string) ([]models.Share, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetShares")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, "SELECT id, owner, grantee_type, grantee, precision_m, expires_at, created_at FROM location_shares WHERE owner = ? ORDER BY id", owner)
+	if err != nil {
+		return nil, fmt.Errorf("getShares: %v", err)
+	}
+	defer rows.Close()
+
+	shares := []models.Share{}
+	for rows.Next() {
+		var share models.Share
+		var meters int
+		var expiresAt sql.NullString
+		if err := rows.Scan(&share.ID, &share.Owner, &share.GranteeType, &share.Grantee, &meters, &expiresAt, &share.CreatedAt); err != nil {
+			return nil, fmt.Errorf("getShares: %v", err)
+		}
+		share.Precision = precision.LevelFor(meters)
+		if expiresAt.Valid {
+			share.ExpiresAt = &expiresAt.String
+		}
+		shares = append(shares, share)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getShares: %v", err)
+	}
+	return shares, nil
+}
+
+// removes one share of an owner, reports whether it existed
+func DeleteShare(ctx context.Context, owner string, id int64) (bool, error) {
+	ctx, span := tracing.StartQuery(ctx, "DeleteShare")
+	defer span.End()
+
+	result, err := DB.ExecContext(ctx, "DELETE FROM location_shares WHERE owner = ? AND id = ?", owner, id)
+	if err != nil {
+		return false, fmt.Errorf("deleteShare: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("deleteShare: %v", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// removes every share of an owner so nobody else can see them, returns how many were removed
+func DeleteShares(ctx context.Context, owner string) (int64, error) {
+	ctx, span := tracing.StartQuery(ctx, "DeleteShares")
+	defer span.End()
+
+	result, err := DB.ExecContext(ctx, "DELETE FROM location_shares WHERE owner = ?", owner)
+	if err != nil {
+		return 0, fmt.Errorf("deleteShares: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("deleteShares: %v", err)
+	}
+	return rowsAffected, nil
+}
+
+// returns the owner of a group, empty when the group does not exist
+func GetGroupOwner(ctx context.Context, group string) (string, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetGroupOwner")
+	defer span.End()
+
+	var owner string
+	err := DB.QueryRowContext(ctx, "SELECT owner FROM user_groups WHERE name = ?", group).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("getGroupOwner: %v", err)
+	}
+	return owner, nil
+}
+
+// creates a group owned by a user
+func CreateGroup(ctx context.Context, group, owner string) error {
+	ctx, span := tracing.StartQuery(ctx, "CreateGroup")
+	defer span.End()
+
+	if _, err := DB.ExecContext(ctx, "INSERT INTO user_groups (name, owner) VALUES (?, ?)", group, owner); err != nil {
+		return fmt.Errorf("createGroup: %v", err)
+	}
+	return nil
+}
+
+// adds a user to a group
+func AddGroupMember(ctx context.Context, group, username string) error {
+	ctx, span := tracing.StartQuery(ctx, "AddGroupMember")
+	defer span.End()
+
+	if _, err := DB.ExecContext(ctx, "INSERT INTO group_members (group_name, username) VALUES (?, ?) ON DUPLICATE KEY UPDATE username = username", group, username); err != nil {
+		return fmt.Errorf("addGroupMember: %v", err)
+	}
+	return nil
+}
+
+// removes a user from a group, reports whether they were a member
+func RemoveGroupMember(ctx context.Context, group, username string) (bool, error) {
+	ctx, span := tracing.StartQuery(ctx, "RemoveGroupMember")
+	defer span.End()
+
+	result, err := DB.ExecContext(ctx, "DELETE FROM group_members WHERE group_name = ? AND username = ?", group, username)
+	if err != nil {
+		return false, fmt.Errorf("removeGroupMember: %v", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("removeGroupMember: %v", err)
+	}
+	return rowsAffected > 0, nil
+}
+
+// lists the members of a group
+func GetGroupMembers(ctx context.Context, group string) ([]string, error) {
+	ctx, span := tracing.StartQuery(ctx, "GetGroupMembers")
+	defer span.End()
+
+	rows, err := DB.QueryContext(ctx, "SELECT username FROM group_members WHERE group_name = ? ORDER BY username", group)
+	if err != nil {
+		return nil, fmt.Errorf("getGroupMembers: %v", err)
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var member string
+		if err := rows.Scan(&member); err != nil {
+			return nil, fmt.Errorf("getGroupMembers: %v", err)
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("getGroupMembers: %v", err)
+	}
+	return members, nil
+}
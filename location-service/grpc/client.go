@@ -3,57 +3,383 @@ package GRPC
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
 	"time"
 
+	"go-nauka/config"
+	"go-nauka/grpcauth"
 	pb "go-nauka/location-service/grpc/proto"
+	"go-nauka/logging"
+	"go-nauka/metrics"
+	"go-nauka/tracing"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
 )
 
+// returned when the history service can't be reached and the update could not be queued
+var ErrUnavailable = errors.New("location history service unavailable")
+
+// delays between attempts to reconnect to the history service
+var reconnectBackoff = backoff.Config{BaseDelay: time.Second, Multiplier: 1.6, Jitter: 0.2, MaxDelay: 30 * time.Second}
+
+var logger = logging.For("grpc")
+
+// how often Flush checks whether the outbox is empty
+const flushPollInterval = 50 * time.Millisecond
+
 // defines the interface for sending location updates over gRPC
 type GRPCClient interface {
-	SendLocationUpdate(username string, latitude, longitude float64) error
+	SendLocationUpdate(ctx context.Context, username string, latitude, longitude float64, fixID string) error
+	DeleteUserHistory(ctx context.Context, username string) (int64, error)
 }
 
 // implments the GRPCCLIENT interface using the grpc generated client
+// updates sent while the history service is unavailable wait in an in-memory outbox and are delivered in order once it is back
 type DefaultGRPCClient struct {
-	client pb.LocationHistoryServiceClient
+	conn    *grpc.ClientConn
+	client  pb.LocationHistoryServiceClient
+	timeout time.Duration
+
+	mu         sync.Mutex
+	outbox     []*queuedUpdate
+	outboxSize int
+	wake       chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	// the updates being sent directly or from the outbox, each with a channel closed once its call returned
+	sending map[*queuedUpdate]chan struct{}
 }
 
-// initializesz the GRPC client and connects to the
-func InitGRPCClient() *DefaultGRPCClient {
-	conn, err := grpc.Dial("localhost:50051", grpc.WithInsecure(), grpc.WithBlock())
+// an update waiting in the outbox with the span and request id of the request that sent it
+// ctx only carries the values of the request context, not its cancellation
+type queuedUpdate struct {
+	req *pb.LocationRequest
+	ctx context.Context
+}
+
+// creates the client for the target of the grpc config without waiting for the history service
+// the connection is made in the background and remade with backoff whenever it is lost
+// the channel is secured with the certificates or service token of the config
+func NewClient(settings config.GRPC) (*DefaultGRPCClient, error) {
+	options, err := grpcauth.DialOptions(settings.Auth())
+	if err != nil {
+		return nil, fmt.Errorf("newClient: %v", err)
+	}
+	options = append(options,
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: reconnectBackoff, MinConnectTimeout: time.Duration(settings.Timeout)}),
+		grpc.WithChainUnaryInterceptor(tracing.UnaryClientInterceptor, logging.UnaryClientInterceptor, metrics.UnaryClientInterceptor),
+	)
+
+	conn, err := grpc.NewClient(settings.Target, options...)
 	if err != nil {
-		log.Fatalf("Failed to connect to Location History Service: %v", err)
+		return nil, fmt.Errorf("newClient: %v", err)
 	}
-	client := pb.NewLocationHistoryServiceClient(conn)
-	log.Println("Connected to Location History Service (gRPC)")
+	conn.Connect()
 
-	return &DefaultGRPCClient{client: client}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &DefaultGRPCClient{
+		conn:       conn,
+		client:     pb.NewLocationHistoryServiceClient(conn),
+		timeout:    time.Duration(settings.Timeout),
+		outboxSize: settings.OutboxSize,
+		wake:       make(chan struct{}, 1),
+		sending:    map[*queuedUpdate]chan struct{}{},
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	go d.drain()
+	go d.logStateChanges()
+	return d, nil
 }
 
-// send a user location update to location-history-service over grpc
-func (d *DefaultGRPCClient) SendLocationUpdate(username string, latitude, longitude float64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
+// returns the state of the connection to the history service
+func (d *DefaultGRPCClient) State() connectivity.State {
+	return d.conn.GetState()
+}
+
+// returns the number of updates waiting for the history service
+func (d *DefaultGRPCClient) Queued() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.outbox)
+}
+
+// reports the connection state for the readiness check, failing while the history service can't be reached
+func (d *DefaultGRPCClient) CheckConnection(ctx context.Context) (string, error) {
+	state := d.conn.GetState()
+	if state == connectivity.TransientFailure || state == connectivity.Shutdown {
+		return state.String(), fmt.Errorf("history service connection %v", state)
+	}
+	return state.String(), nil
+}
 
-	req := &pb.LocationRequest{
+// reports the outbox backlog for the readiness check, failing once updates are rejected, an outbox of size 0 never queues
+func (d *DefaultGRPCClient) CheckOutbox(ctx context.Context) (string, error) {
+	queued := d.Queued()
+	detail := fmt.Sprintf("%d of %d updates queued", queued, d.outboxSize)
+	if d.outboxSize > 0 && queued >= d.outboxSize {
+		return detail, errors.New("outbox full")
+	}
+	return detail, nil
+}
+
+// waits until the outbox is delivered, giving up with the error of ctx, called on shutdown before Close
+func (d *DefaultGRPCClient) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	for d.Queued() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("flush: %v", ctx.Err())
+		}
+	}
+	return nil
+}
+
+// stops reconnecting and closes the connection, updates still in the outbox are lost
+func (d *DefaultGRPCClient) Close() error {
+	d.cancel()
+	if queued := d.Queued(); queued > 0 {
+		logger.Warn("Dropping location updates not delivered to the history service", "queued", queued)
+	}
+	return d.conn.Close()
+}
+
+// send a user location update to location-history-service over grpc
+// fixID is forwarded so the history service can ignore duplicated updates, the call continues the trace of ctx
+// while the service is unavailable the update is queued, ErrUnavailable is only returned when the outbox is full
+func (d *DefaultGRPCClient) SendLocationUpdate(ctx context.Context, username string, latitude, longitude float64, fixID string) error {
+	update := &queuedUpdate{ctx: context.WithoutCancel(ctx), req: &pb.LocationRequest{
 		Username:   username,
 		Latitude:   latitude,
 		Longitude:  longitude,
 		RecordedAt: time.Now().Format(time.RFC3339),
+		FixId:      fixID,
+	}}
+
+	// updates are not sent past queued ones or past an update of the same user still being sent,
+	// so the history service gets the updates of a user in order
+	d.mu.Lock()
+	if len(d.outbox) > 0 || len(d.sendingOf(username)) > 0 {
+		defer d.mu.Unlock()
+		return d.insert(update, len(d.outbox))
 	}
+	d.startSending(update)
+	d.mu.Unlock()
+
+	err := d.record(update)
 
-	_, err := d.client.RecordLocation(ctx, req)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.doneSending(update)
+	if status.Code(err) == codes.Unavailable {
+		logger.WarnContext(ctx, "History service unavailable, queueing location update", "username", username)
+		// updates of the user queued while this one was sent go after it
+		i := slices.IndexFunc(d.outbox, func(queued *queuedUpdate) bool { return queued.req.Username == username })
+		if i < 0 {
+			i = len(d.outbox)
+		}
+		return d.insert(update, i)
+	}
 	if err != nil {
-		log.Printf("Failed to send location update: %v", err)
+		logger.ErrorContext(ctx, "Failed to send location update", "username", username, "error", err)
 		return err
 	}
+	logger.DebugContext(ctx, "Sent location update", "username", username)
+	return nil
+}
+
+// returns the context of a call with the timeout, ended by Close, with the span and request id of parent
+// the call is not cancelled with the request that started it, queued updates outlive it anyway
+func (d *DefaultGRPCClient) callContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(parent), d.timeout)
+	stop := context.AfterFunc(d.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// sends a single update with the call timeout
+func (d *DefaultGRPCClient) record(update *queuedUpdate) error {
+	ctx, cancel := d.callContext(update.ctx)
+	defer cancel()
+	_, err := d.client.RecordLocation(ctx, update.req)
+	return err
+}
+
+// registers an update as being sent, the caller holds mu
+func (d *DefaultGRPCClient) startSending(update *queuedUpdate) {
+	d.sending[update] = make(chan struct{})
+}
+
+// unregisters an update once its call returned and releases those waiting for it, the caller holds mu
+func (d *DefaultGRPCClient) doneSending(update *queuedUpdate) {
+	close(d.sending[update])
+	delete(d.sending, update)
+}
+
+// returns the channels of the updates of a user being sent, the caller holds mu
+func (d *DefaultGRPCClient) sendingOf(username string) []chan struct{} {
+	var done []chan struct{}
+	for update, ch := range d.sending {
+		if update.req.Username == username {
+			done = append(done, ch)
+		}
+	}
+	return done
+}
 
-	log.Printf("Sent location update for user '%s'", username)
+// inserts an update into the outbox at i and wakes the goroutine delivering them, the caller holds mu
+func (d *DefaultGRPCClient) insert(update *queuedUpdate, i int) error {
+	if len(d.outbox) >= d.outboxSize {
+		logger.ErrorContext(update.ctx, "Outbox full, dropping location update", "username", update.req.Username)
+		return ErrUnavailable
+	}
+	d.outbox = slices.Insert(d.outbox, i, update)
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
-// global grpc client instance
-var Client GRPCClient = InitGRPCClient()
+// delivers the queued updates in order, waiting for the connection to recover whenever the service is unavailable
+func (d *DefaultGRPCClient) drain() {
+	for {
+		select {
+		case <-d.wake:
+		case <-d.ctx.Done():
+			return
+		}
+
+		for {
+			d.mu.Lock()
+			if len(d.outbox) == 0 {
+				d.mu.Unlock()
+				break
+			}
+			update := d.outbox[0]
+			// a direct update of the user still being sent goes first, it may be queued ahead of this one
+			if pending := d.sendingOf(update.req.Username); len(pending) > 0 {
+				d.mu.Unlock()
+				for _, done := range pending {
+					<-done
+				}
+				continue
+			}
+			d.startSending(update)
+			d.mu.Unlock()
+
+			err := d.record(update)
+
+			d.mu.Lock()
+			if status.Code(err) != codes.Unavailable {
+				// the update may already be gone when the users history was erased meanwhile
+				if i := slices.Index(d.outbox, update); i >= 0 {
+					d.outbox = slices.Delete(d.outbox, i, i+1)
+				}
+			}
+			d.doneSending(update)
+			d.mu.Unlock()
+
+			if status.Code(err) == codes.Unavailable {
+				if !d.waitUntilReady() {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				logger.ErrorContext(update.ctx, "Failed to send queued location update, dropping it", "username", update.req.Username, "error", err)
+			} else {
+				logger.DebugContext(update.ctx, "Sent queued location update", "username", update.req.Username)
+			}
+		}
+	}
+}
+
+// blocks until the connection is ready again, reports false once the client is closed
+func (d *DefaultGRPCClient) waitUntilReady() bool {
+	state := d.conn.GetState()
+	if state == connectivity.Ready {
+		// the connection has not noticed the failure yet, give it the call timeout to do so
+		select {
+		case <-time.After(d.timeout):
+		case <-d.ctx.Done():
+			return false
+		}
+		state = d.conn.GetState()
+	}
+	for state != connectivity.Ready {
+		if state == connectivity.Idle {
+			d.conn.Connect()
+		}
+		if !d.conn.WaitForStateChange(d.ctx, state) {
+			return false
+		}
+		state = d.conn.GetState()
+	}
+	return true
+}
+
+// logs every change of the connection state until the client is closed
+func (d *DefaultGRPCClient) logStateChanges() {
+	state := d.conn.GetState()
+	for d.conn.WaitForStateChange(d.ctx, state) {
+		state = d.conn.GetState()
+		logger.Info("Location History Service connection changed", "state", state.String())
+	}
+}
+
+// asks location-history-service to erase a users location history, returns the number of deleted records
+// updates of the user already being sent, directly or from the outbox, are waited for and the queued ones discarded,
+// so none can be recorded after the history is erased, fails fast with ErrUnavailable while the service is down
+func (d *DefaultGRPCClient) DeleteUserHistory(ctx context.Context, username string) (int64, error) {
+	for {
+		d.mu.Lock()
+		pending := d.sendingOf(username)
+		if len(pending) == 0 {
+			// a direct update failing meanwhile would have been queued, so the outbox is cleared last
+			d.outbox = slices.DeleteFunc(d.outbox, func(update *queuedUpdate) bool { return update.req.Username == username })
+			d.mu.Unlock()
+			break
+		}
+		d.mu.Unlock()
+
+		for _, done := range pending {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return 0, fmt.Errorf("deleteUserHistory: %v", ctx.Err())
+			}
+		}
+	}
+
+	callCtx, cancel := d.callContext(ctx)
+	defer cancel()
+
+	resp, err := d.client.DeleteUserHistory(callCtx, &pb.DeleteUserHistoryRequest{Username: username})
+	if status.Code(err) == codes.Unavailable {
+		logger.WarnContext(ctx, "Failed to delete user history", "username", username, "error", err)
+		return 0, ErrUnavailable
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "Failed to delete user history", "username", username, "error", err)
+		return 0, err
+	}
+
+	logger.InfoContext(ctx, "Deleted user history", "username", username, "records", resp.DeletedRows)
+	return resp.DeletedRows, nil
+}
+
+// global grpc client instance, created by main
+var Client GRPCClient
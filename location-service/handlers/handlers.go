@@ -2,23 +2,45 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-nauka/geo"
+	"go-nauka/jwtauth"
+	"go-nauka/location-service/auth"
+	"go-nauka/location-service/cluster"
 	DB "go-nauka/location-service/db"
 	GRPC "go-nauka/location-service/grpc"
 	"go-nauka/location-service/models"
-	"log"
+	"go-nauka/location-service/precision"
+	"go-nauka/location-service/proximity"
+	"go-nauka/location-service/ratelimit"
+	"go-nauka/location-service/tiles"
+	"go-nauka/logging"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 var locations []models.Location
 
-// handles GET request for retrievies all stored user locations
+var logger = logging.For("handlers")
+
+// handles GET request for retrievies the stored user locations the caller may see, callers with the admin scope see all of them
 // Responds with 500 erro if fetching for the datbase fails
 func GetLocations(c *gin.Context) {
 
-	locations, err := DB.DBGetLocations()
+	var locations []models.Location
+	var err error
+	if jwtauth.IsAdmin(c) {
+		locations, err = DB.DBGetLocations(c.Request.Context())
+	} else {
+		locations, err = DB.GetLocationsVisibleTo(c.Request.Context(), auth.Caller(c))
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch locations"})
 		return
@@ -26,8 +48,15 @@ func GetLocations(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, locations)
 }
 
+// maximum length of an Idempotency-Key header or fix_id
+const maxIdempotencyKeyLength = 64
+
 // handles POST requests for adding or updating user's current location
 // validates the input, updates the database and notifies the location-history-service over grpc
+// requests repeated with the same Idempotency-Key header (or fix_id) are answered with the original response,
+// or with 409 while the original is still processed
+// the name has to match the subject of the callers token
+// updates sooner than MIN_UPDATE_INTERVAL after the last written one get 202 and are coalesced
 func PostLocation(c *gin.Context) {
 	var newLocation models.Location
 
@@ -35,40 +64,192 @@ func PostLocation(c *gin.Context) {
 		return
 	}
 
-	if newLocation.Name == "" || newLocation.Latitude < -90 || newLocation.Latitude > 90 || newLocation.Longitude < -180 || newLocation.Longitude > 180 {
+	position, err := geo.NewLatLng(newLocation.Latitude, newLocation.Longitude)
+	if newLocation.Name == "" || err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input data"})
 		return
 	}
+	newLocation.Latitude, newLocation.Longitude = position.Lat, position.Lng
+
+	if !auth.RequireSelf(c, newLocation.Name) {
+		return
+	}
+
+	idempotencyKey := c.GetHeader("Idempotency-Key")
+	if idempotencyKey == "" {
+		idempotencyKey = newLocation.FixID
+	}
+	if newLocation.FixID == "" {
+		newLocation.FixID = idempotencyKey
+	}
+	if len(idempotencyKey) > maxIdempotencyKeyLength || len(newLocation.FixID) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency key too long"})
+		return
+	}
+
+	// the key is reserved before the location is written, so a retry arriving meanwhile can't write it again
+	written := false
+	if idempotencyKey != "" {
+		record, err := DB.ReserveIdempotencyKey(c.Request.Context(), newLocation.Name, idempotencyKey)
+		if err != nil {
+			logger.ErrorContext(c.Request.Context(), "Failed to reserve idempotency key", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update location"})
+			return
+		}
+		if record != nil && record.StatusCode == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "A request with this idempotency key is in progress"})
+			return
+		}
+		if record != nil {
+			c.Data(record.StatusCode, "application/json; charset=utf-8", []byte(record.Response))
+			return
+		}
+		// a request failing before the location was written gives the key back, so it can be retried
+		defer func() {
+			if written {
+				return
+			}
+			if err := DB.ReleaseIdempotencyKey(context.WithoutCancel(c.Request.Context()), newLocation.Name, idempotencyKey); err != nil {
+				logger.ErrorContext(c.Request.Context(), "Failed to release idempotency key", "error", err)
+			}
+		}()
+	}
+
+	// once the location is written every response is stored for the key, so a retry is answered the same way
+	// instead of writing the location again, the key stays reserved until it expires when storing fails
+	respond := func(status int, body any) {
+		response, err := json.MarshalIndent(body, "", "    ")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+			return
+		}
+		if idempotencyKey != "" {
+			err = DB.SaveIdempotencyRecord(context.WithoutCancel(c.Request.Context()), models.IdempotencyRecord{
+				Name:       newLocation.Name,
+				Key:        idempotencyKey,
+				StatusCode: status,
+				Response:   string(response),
+			})
+			if err != nil {
+				logger.ErrorContext(c.Request.Context(), "Failed to store idempotency key", "error", err)
+			}
+		}
+		c.Data(status, "application/json; charset=utf-8", response)
+	}
+
+	activeUsers.seen(newLocation.Name, time.Now())
+
+	// updates sooner than the minimum interval are accepted but only the latest of them is written once it has passed
+	if !ratelimit.Updates.Offer(newLocation, writeCoalescedLocation) {
+		written = true
+		locationUpdates.WithLabelValues("coalesced").Inc()
+		respond(http.StatusAccepted, newLocation)
+		return
+	}
 
-	_, err := DB.AddLocation(newLocation)
+	_, err = DB.AddLocation(c.Request.Context(), newLocation)
 	if err != nil {
-		log.Println("Failed to update location in DB:", err)
+		logger.ErrorContext(c.Request.Context(), "Failed to update location in DB", "username", newLocation.Name, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update location"})
 		return
 	}
+	written = true
+	locationUpdates.WithLabelValues("stored").Inc()
+	cluster.Default.Update(newLocation.Name, newLocation.Position())
 
-	err = GRPC.Client.SendLocationUpdate(newLocation.Name, newLocation.Latitude, newLocation.Longitude)
+	if _, err := proximity.Default.Check(c.Request.Context(), newLocation); err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to check proximity rules", "username", newLocation.Name, "error", err)
+	}
+
+	err = GRPC.Client.SendLocationUpdate(c.Request.Context(), newLocation.Name, newLocation.Latitude, newLocation.Longitude, newLocation.FixID)
+	if errors.Is(err, GRPC.ErrUnavailable) {
+		logger.WarnContext(c.Request.Context(), "History service unavailable and outbox full", "username", newLocation.Name, "error", err)
+		respond(http.StatusServiceUnavailable, gin.H{"error": "History service unavailable"})
+		return
+	}
 	if err != nil {
-		log.Println("Failed to send gRPC location update:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to notify history service"})
+		logger.ErrorContext(c.Request.Context(), "Failed to send gRPC location update", "username", newLocation.Name, "error", err)
+		respond(http.StatusInternalServerError, gin.H{"error": "Failed to notify history service"})
 		return
 	}
 
 	locations = append(locations, newLocation)
-	c.IndentedJSON(http.StatusCreated, newLocation)
+	respond(http.StatusCreated, newLocation)
+}
+
+// writes an update held back by the minimum update interval like PostLocation does, failures are only logged
+func writeCoalescedLocation(loc models.Location) {
+	// the request that sent the update has already been answered
+	ctx := context.Background()
+	if _, err := DB.AddLocation(ctx, loc); err != nil {
+		logger.ErrorContext(ctx, "Failed to update coalesced location in DB", "username", loc.Name, "error", err)
+		return
+	}
+	locationUpdates.WithLabelValues("stored").Inc()
+	cluster.Default.Update(loc.Name, loc.Position())
+
+	if _, err := proximity.Default.Check(ctx, loc); err != nil {
+		logger.ErrorContext(ctx, "Failed to check proximity rules", "username", loc.Name, "error", err)
+	}
+	if err := GRPC.Client.SendLocationUpdate(ctx, loc.Name, loc.Latitude, loc.Longitude, loc.FixID); err != nil {
+		logger.ErrorContext(ctx, "Failed to send gRPC location update", "username", loc.Name, "error", err)
+	}
+}
+
+// handles DELETE requests erasing a user from both services
+// removes the current location, purges the users history over grpc and records an audit entry
+// users can erase themselves, erasing anyone else needs the admin scope
+func DeleteLocation(c *gin.Context) {
+	name := c.Param("name")
+	if name != auth.Caller(c) && !jwtauth.IsAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to erase this user"})
+		return
+	}
+
+	// a held back update would write the location again after it is deleted
+	ratelimit.Updates.Forget(name)
+	locationRows, err := DB.DeleteLocation(c.Request.Context(), name)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to delete location from DB", "username", name, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete location"})
+		return
+	}
+	cluster.Default.Remove(name)
+	proximity.Default.RemoveUser(name)
+
+	historyRows, err := GRPC.Client.DeleteUserHistory(c.Request.Context(), name)
+	if errors.Is(err, GRPC.ErrUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "History service unavailable, try again later"})
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to delete user history over gRPC", "username", name, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to erase history"})
+		return
+	}
+
+	if err := DB.AddDeletionAudit(c.Request.Context(), name, locationRows, historyRows); err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to record deletion audit", "username", name, "error", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"name":                  name,
+		"location_rows_deleted": locationRows,
+		"history_rows_deleted":  historyRows,
+	})
 }
 
-// handles GET request for searching users within a given radius
-// validates query and supports pagination
+// handles GET request for searching users the caller may see within a given radius
+// validates query and supports pagination, method selects the distance formula (haversine or geodesic)
 func SearchLocationsHandler(c *gin.Context) {
 	lat, err := strconv.ParseFloat(c.Query("latitude"), 64)
-	if err != nil {
+	if err != nil || geo.Validate(lat, 0) != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid latitude"})
 		return
 	}
 
 	lon, err := strconv.ParseFloat(c.Query("longitude"), 64)
-	if err != nil {
+	if err != nil || geo.Validate(0, lon) != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid longitude"})
 		return
 	}
@@ -89,11 +270,599 @@ func SearchLocationsHandler(c *gin.Context) {
 		pageSize = 10
 	}
 
-	locations, err := DB.SearchLocations(lat, lon, radius, page, pageSize)
+	method := c.DefaultQuery("method", geo.MethodHaversine)
+	if _, err := geo.DistanceFuncFor(method); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid distance method"})
+		return
+	}
+
+	center := geo.Normalize(geo.LatLng{Lat: lat, Lng: lon})
+	locations, err := DB.SearchLocations(c.Request.Context(), center, radius, page, pageSize, method, auth.Caller(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	searchResults.Observe(float64(len(locations)))
 
 	c.JSON(http.StatusOK, locations)
 }
+
+// handles GET requests for a vector tile of the current positions at /tiles/{z}/{x}/{y}.mvt
+// only users the caller may see are drawn, at low zoom levels nearby users are merged into clusters, responds with an empty body for a tile without users
+func GetTile(c *gin.Context) {
+	y, isMVT := strings.CutSuffix(c.Param("y"), ".mvt")
+	z, errZ := strconv.Atoi(c.Param("z"))
+	x, errX := strconv.Atoi(c.Param("x"))
+	row, errY := strconv.Atoi(y)
+	if !isMVT || errZ != nil || errX != nil || errY != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tile"})
+		return
+	}
+	tile, err := geo.NewTile(z, x, row)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tile"})
+		return
+	}
+
+	data, err := tiles.Render(c.Request.Context(), tile, auth.Caller(c))
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Error rendering tile", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not render tile"})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/vnd.mapbox-vector-tile", data)
+}
+
+// handles GET requests for clustered markers of the current positions inside bbox ("west,south,east,north") at a zoom level
+// each cluster has the mean of the positions the caller sees, the number of visible users and a sample of their names
+func GetClusters(c *gin.Context) {
+	zoom, err := strconv.Atoi(c.Query("zoom"))
+	if err != nil || zoom < 0 || zoom > geo.MaxZoom {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid zoom"})
+		return
+	}
+
+	bounds := geo.World()
+	if bbox := c.Query("bbox"); bbox != "" {
+		bounds, err = geo.ParseBounds(bbox)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bbox"})
+			return
+		}
+	}
+
+	caller := auth.Caller(c)
+	precisions, err := DB.GetVisiblePrecisions(c.Request.Context(), caller)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Error fetching visible users", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch clusters"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"zoom": zoom,
+		"clusters": cluster.Default.Clusters(bounds, zoom, func(name string, position geo.LatLng) (geo.LatLng, bool) {
+			meters, ok := precisions[name]
+			return precision.Reduce(name, position, meters), ok
+		}),
+	})
+}
+
+// handles POST requests creating a proximity rule for a pair or group of users
+// exit_km defaults to 1.25 times threshold_km, the caller has to be one of the members
+// the rule only applies to the caller until the other members accept it
+func CreateProximityRule(c *gin.Context) {
+	caller, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+
+	var rule models.ProximityRule
+	if err := c.BindJSON(&rule); err != nil {
+		return
+	}
+	if err := proximity.Validate(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !slices.Contains(rule.Members, caller) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Caller is not a member of the rule"})
+		return
+	}
+	rule.Accepted = []string{caller}
+
+	id, err := DB.AddProximityRule(c.Request.Context(), rule)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to store proximity rule", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create proximity rule"})
+		return
+	}
+	rule.ID = id
+	proximity.Default.AddRule(rule)
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+// handles GET requests listing the proximity rules including the caller, callers with the admin scope see all of them
+func GetProximityRules(c *gin.Context) {
+	caller, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+	rules := proximity.Default.Rules()
+	if !jwtauth.IsAdmin(c) {
+		rules = slices.DeleteFunc(rules, func(rule models.ProximityRule) bool { return !slices.Contains(rule.Members, caller) })
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+// handles DELETE requests removing a proximity rule, responds 404 to callers that are not members unless they have the admin scope
+func DeleteProximityRule(c *gin.Context) {
+	caller, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule id"})
+		return
+	}
+	if rule, found := proximity.Default.Rule(id); !found || (!slices.Contains(rule.Members, caller) && !jwtauth.IsAdmin(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Proximity rule not found"})
+		return
+	}
+
+	found, err := DB.DeleteProximityRule(c.Request.Context(), id)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to delete proximity rule", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete proximity rule"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Proximity rule not found"})
+		return
+	}
+	proximity.Default.RemoveRule(id)
+
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+// handles POST requests of a member opting in to a proximity rule, responds 404 to callers that are not members
+func AcceptProximityRule(c *gin.Context) {
+	caller, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule id"})
+		return
+	}
+	rule, found := proximity.Default.Rule(id)
+	if !found || !slices.Contains(rule.Members, caller) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Proximity rule not found"})
+		return
+	}
+
+	if err := DB.AcceptProximityRule(c.Request.Context(), id, caller); err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to accept proximity rule", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept proximity rule"})
+		return
+	}
+	proximity.Default.Accept(id, caller)
+
+	rule, _ = proximity.Default.Rule(id)
+	c.JSON(http.StatusOK, rule)
+}
+
+// handles GET requests for the pairs including the caller that are currently close
+func GetProximityState(c *gin.Context) {
+	caller, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, proximity.Default.Active(caller))
+}
+
+// handles GET requests for the latest proximity events of the caller
+func GetProximityEvents(c *gin.Context) {
+	username, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	events, err := DB.GetProximityEvents(c.Request.Context(), username, limit)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to fetch proximity events", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch proximity events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, events)
+}
+
+// handles GET requests listing the shares of the caller, expired ones included
+func GetShares(c *gin.Context) {
+	owner, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+
+	shares, err := DB.GetShares(c.Request.Context(), owner)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to fetch shares", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch shares"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shares)
+}
+
+// body of a POST /sharing request, expires_in ("2h30m") or expires_at (RFC 3339) limit the share in time
+// precision is exact, 100m, 1km or city, exact by default
+type shareRequest struct {
+	Type      string     `json:"type"`
+	Grantee   string     `json:"grantee"`
+	Precision string     `json:"precision"`
+	ExpiresIn string     `json:"expires_in"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// handles POST requests letting a user, a group or everyone see the callers location, optionally only approximately
+// only groups the caller owns can be shared with
+func CreateShare(c *gin.Context) {
+	owner, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+
+	var request shareRequest
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+
+	switch request.Type {
+	case models.ShareEveryone:
+		request.Grantee = ""
+	case models.ShareUser, models.ShareGroup:
+		if request.Grantee == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing grantee"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid share type"})
+		return
+	}
+
+	if request.Precision == "" {
+		request.Precision = precision.Exact
+	}
+	if _, err := precision.Meters(request.Precision); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid precision"})
+		return
+	}
+
+	share := models.Share{Owner: owner, GranteeType: request.Type, Grantee: request.Grantee, Precision: request.Precision}
+	if request.ExpiresIn != "" || request.ExpiresAt != nil {
+		expiresAt := time.Now().UTC()
+		if request.ExpiresAt != nil {
+			expiresAt = request.ExpiresAt.UTC()
+		} else if d, err := time.ParseDuration(request.ExpiresIn); err == nil && d > 0 {
+			expiresAt = expiresAt.Add(d)
+		}
+		if !expiresAt.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry"})
+			return
+		}
+		formatted := expiresAt.Format(time.DateTime)
+		share.ExpiresAt = &formatted
+	}
+
+	// groups are named globally, sharing with one owned by someone else would let its owner pick who sees the location
+	if share.GranteeType == models.ShareGroup {
+		groupOwner, err := DB.GetGroupOwner(c.Request.Context(), share.Grantee)
+		if err != nil {
+			logger.ErrorContext(c.Request.Context(), "Failed to fetch group", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share"})
+			return
+		}
+		if groupOwner == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		if groupOwner != owner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only groups owned by the caller can be shared with"})
+			return
+		}
+	}
+
+	id, err := DB.AddShare(c.Request.Context(), share)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to store share", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share"})
+		return
+	}
+	share.ID = id
+	if share.GranteeType == models.ShareEveryone && share.Precision == precision.Exact && share.ExpiresAt == nil {
+		cluster.Default.SetPublic(owner, true)
+	}
+
+	c.JSON(http.StatusCreated, share)
+}
+
+// handles DELETE requests revoking one share of the caller
+func DeleteShare(c *gin.Context) {
+	owner, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid share id"})
+		return
+	}
+
+	found, err := DB.DeleteShare(c.Request.Context(), owner, id)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to delete share", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete share"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+
+	// the clusters only skip the views of users known to be public, a failed check merely loses that shortcut
+	public, err := DB.IsPublic(c.Request.Context(), owner)
+	if err != nil {
+		logger.WarnContext(c.Request.Context(), "Failed to check for public shares", "owner", owner, "error", err)
+	}
+	cluster.Default.SetPublic(owner, public)
+
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+// handles DELETE requests revoking every share of the caller, so nobody else can see them
+func DeleteShares(c *gin.Context) {
+	owner, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+
+	deleted, err := DB.DeleteShares(c.Request.Context(), owner)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to delete shares", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete shares"})
+		return
+	}
+	cluster.Default.SetPublic(owner, false)
+
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
+// checks that the caller owns a group, a missing group is created with the caller as owner when create is set
+// responds with 403 or 404 and returns false otherwise
+func requireGroupOwner(c *gin.Context, caller, group string, create bool) bool {
+	owner, err := DB.GetGroupOwner(c.Request.Context(), group)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to fetch group", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group"})
+		return false
+	}
+
+	switch {
+	case owner == "" && create:
+		if err := DB.CreateGroup(c.Request.Context(), group, caller); err != nil {
+			logger.ErrorContext(c.Request.Context(), "Failed to create group", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+			return false
+		}
+	case owner == "":
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return false
+	case owner != caller:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the group owner can change its members"})
+		return false
+	}
+	return true
+}
+
+// handles PUT requests adding a user to a group of the caller, the group is created on first use
+func AddGroupMember(c *gin.Context) {
+	caller, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+	group, name := c.Param("group"), c.Param("name")
+
+	if !requireGroupOwner(c, caller, group, true) {
+		return
+	}
+	if err := DB.AddGroupMember(c.Request.Context(), group, name); err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to add group member", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add group member"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": group, "name": name})
+}
+
+// handles DELETE requests removing a user from a group of the caller
+func RemoveGroupMember(c *gin.Context) {
+	caller, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+	group, name := c.Param("group"), c.Param("name")
+
+	if !requireGroupOwner(c, caller, group, false) {
+		return
+	}
+	found, err := DB.RemoveGroupMember(c.Request.Context(), group, name)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to remove group member", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove group member"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group member not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": group, "name": name})
+}
+
+// handles GET requests listing the members of a group of the caller
+func GetGroupMembers(c *gin.Context) {
+	caller, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+	group := c.Param("group")
+
+	if !requireGroupOwner(c, caller, group, false) {
+		return
+	}
+	members, err := DB.GetGroupMembers(c.Request.Context(), group)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to fetch group members", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group members"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": group, "owner": caller, "members": members})
+}
+
+// body of a POST /apikeys request, scopes are write and/or search
+// usernames default to the owner, only callers with the admin scope may name other users or create keys for another owner
+type apiKeyRequest struct {
+	Name      string   `json:"name"`
+	Owner     string   `json:"owner"`
+	Usernames []string `json:"usernames"`
+	Scopes    []string `json:"scopes"`
+}
+
+// handles POST requests creating an API key, the plaintext key is only part of this response
+func CreateAPIKey(c *gin.Context) {
+	caller, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+
+	var request apiKeyRequest
+	if err := c.BindJSON(&request); err != nil {
+		return
+	}
+
+	if len(request.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing scopes"})
+		return
+	}
+	for _, scope := range request.Scopes {
+		if scope != models.APIKeyWrite && scope != models.APIKeySearch {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scope " + scope})
+			return
+		}
+	}
+
+	if request.Owner == "" {
+		request.Owner = caller
+	}
+	if len(request.Usernames) == 0 {
+		request.Usernames = []string{request.Owner}
+	}
+	if !jwtauth.IsAdmin(c) && (request.Owner != caller || slices.ContainsFunc(request.Usernames, func(name string) bool { return name != caller })) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to create keys for other users"})
+		return
+	}
+	slices.Sort(request.Scopes)
+	slices.Sort(request.Usernames)
+
+	plaintext, prefix, err := auth.NewAPIKey()
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to generate API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	key := models.APIKey{
+		Prefix:    prefix,
+		Name:      request.Name,
+		Owner:     request.Owner,
+		Usernames: slices.Compact(request.Usernames),
+		Scopes:    slices.Compact(request.Scopes),
+	}
+	id, err := DB.AddAPIKey(c.Request.Context(), key, auth.HashAPIKey(plaintext))
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to store API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	key.ID = id
+	key.Key = plaintext
+
+	c.JSON(http.StatusCreated, key)
+}
+
+// handles GET requests listing the API keys of the caller without their plaintext, revoked ones included
+// callers with the admin scope list the keys of another owner with ?owner=
+func GetAPIKeys(c *gin.Context) {
+	owner, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+	if other := c.Query("owner"); other != "" && other != owner {
+		if !jwtauth.IsAdmin(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed to list keys of other users"})
+			return
+		}
+		owner = other
+	}
+
+	keys, err := DB.GetAPIKeys(c.Request.Context(), owner)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to fetch API keys", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// handles DELETE requests revoking an API key of the caller, callers with the admin scope revoke any key
+func RevokeAPIKey(c *gin.Context) {
+	owner, ok := auth.RequireCaller(c)
+	if !ok {
+		return
+	}
+	if jwtauth.IsAdmin(c) {
+		owner = ""
+	}
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key id"})
+		return
+	}
+
+	found, err := DB.RevokeAPIKey(c.Request.Context(), owner, id)
+	if err != nil {
+		logger.ErrorContext(c.Request.Context(), "Failed to revoke API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// how long a user counts as active after posting a location
+const activeWindow = 15 * time.Minute
+
+var (
+	locationUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "location_updates_total",
+		Help: "Location updates accepted, stored right away or held back by coalescing.",
+	}, []string{"result"})
+	searchResults = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "location_search_results",
+		Help:    "Number of users returned by a search.",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100},
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "location_active_users",
+		Help: "Users that posted a location in the last 15 minutes.",
+	}, func() float64 { return float64(activeUsers.count(time.Now())) })
+)
+
+// users that posted a location within the active window
+var activeUsers = &activity{lastSeen: map[string]time.Time{}}
+
+type activity struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+}
+
+func (a *activity) seen(username string, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastSeen[username] = now
+}
+
+// counts the active users, forgetting the others
+func (a *activity) count(now time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for username, seen := range a.lastSeen {
+		if now.Sub(seen) > activeWindow {
+			delete(a.lastSeen, username)
+		}
+	}
+	return len(a.lastSeen)
+}
@@ -3,72 +3,197 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"flag"
+	"go-nauka/config"
+	"go-nauka/health"
+	"go-nauka/jwtauth"
+	"go-nauka/location-service/cluster"
 	DB "go-nauka/location-service/db"
 	grpc "go-nauka/location-service/grpc"
 	"go-nauka/location-service/models"
+	"go-nauka/location-service/precision"
+	"go-nauka/location-service/proximity"
+	"go-nauka/location-service/ratelimit"
 	"go-nauka/location-service/routes"
-	"log"
+	"go-nauka/logging"
+	"go-nauka/tracing"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
-// initalizes the database, grpc client and starts the http server
+var logger = logging.For("main")
+
+// loads the config, initalizes the database, grpc client and starts the http server until SIGINT or SIGTERM
+// with --print-config it only prints the resolved config
 func main() {
-	DB.InitDB()
+	cfg, err := config.Load(config.LocationService, flag.CommandLine, os.Args[1:])
+	if err != nil {
+		logging.Fatal(logger, "Failed to load the config", "error", err)
+	}
+	if cfg.PrintOnly {
+		if err := cfg.Print(os.Stdout); err != nil {
+			logging.Fatal(logger, "Failed to print the config", "error", err)
+		}
+		return
+	}
+
+	if err := logging.Setup(config.LocationService, cfg.Logging, os.Stdout); err != nil {
+		logging.Fatal(logger, "Failed to set up logging", "error", err)
+	}
+	gin.SetMode(gin.ReleaseMode)
+
+	shutdownTracing, err := tracing.Setup(config.LocationService, cfg.Tracing)
+	if err != nil {
+		logging.Fatal(logger, "Failed to set up tracing", "error", err)
+	}
+
+	DB.InitDB(cfg.Database)
+
+	client, err := grpc.NewClient(cfg.GRPC)
+	if err != nil {
+		logging.Fatal(logger, "Failed to create the history service client", "error", err)
+	}
+	grpc.Client = client
+
+	// background jobs stop and shutdown starts with the first signal
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	DB.IdempotencyTTL = time.Duration(cfg.Location.IdempotencyTTL)
+	purgeJob := &health.Job{Interval: time.Hour}
+	go purgeIdempotencyRecords(ctx, purgeJob)
+
+	health.Default.Add("mysql", true, DB.HealthCheck)
+	health.Default.Add("history_grpc", false, client.CheckConnection)
+	health.Default.Add("outbox", true, client.CheckOutbox)
+	health.Default.Add("idempotency_purge", false, purgeJob.Check)
+
+	precision.Secret = []byte(cfg.Location.PrecisionSecret)
+	DB.AuditSecret = []byte(cfg.Location.AuditSecret)
 
-	go grpc.InitGRPCClient()
+	configureRateLimits(cfg.Location)
 
-	locID, err := DB.AddLocation(models.Location{
+	verifier, err := jwtauth.NewVerifier(cfg.JWT.Verifier())
+	if err != nil {
+		logging.Fatal(logger, "Failed to create the token verifier", "error", err)
+	}
+	jwtauth.Default = verifier
+
+	locID, err := DB.AddLocation(context.Background(), models.Location{
 		Name:      "antek",
 		Latitude:  80.112323,
 		Longitude: 120.123,
 	})
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "Failed to add the initial location", "error", err)
 	}
-	fmt.Printf("ID of added location: %v\n", locID)
+	logger.Debug("Added initial location", "rows", locID)
 
-	locations, err := DB.DBGetLocations()
+	locations, err := DB.DBGetLocations(context.Background())
+	if err != nil {
+		logging.Fatal(logger, "Failed to load locations", "error", err)
+	}
+	logger.Info("Loaded locations", "count", len(locations))
+	cluster.Default.Load(locations)
+	public, err := DB.GetPublicUsers(context.Background())
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(logger, "Failed to load public users", "error", err)
+	}
+	for _, name := range public {
+		cluster.Default.SetPublic(name, true)
+	}
+
+	if err := proximity.Default.Load(context.Background()); err != nil {
+		logging.Fatal(logger, "Failed to load proximity rules", "error", err)
 	}
-	fmt.Printf("Locations found %v\n", locations)
 
 	pingErr := DB.DB.Ping()
 	if pingErr != nil {
-		log.Fatal(pingErr)
+		logging.Fatal(logger, "Failed to connect to the database", "error", pingErr)
 	}
 
-	router := routes.SetupRouter()
-	go router.Run("localhost:8080")
-
 	server := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
+		Addr:    cfg.HTTP.Addr,
+		Handler: routes.SetupRouter(),
 	}
+	go func() {
+		logger.Info("REST server running", "addr", cfg.HTTP.Addr)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal(logger, "Failed to start REST server", "error", err)
+		}
+	}()
 
-	gracefulShutdown(server)
+	<-ctx.Done()
+	// a second signal kills the process right away
+	stop()
+	gracefulShutdown(cfg.Shutdown, server, client, shutdownTracing)
+}
+
+// removes idempotency records older than the configured ttl every interval of the job until ctx is done
+func purgeIdempotencyRecords(ctx context.Context, job *health.Job) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		removed, err := DB.DeleteExpiredIdempotencyRecords(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		job.Done(err)
+		if err != nil {
+			logger.Error("Failed to purge idempotency records", "error", err)
+			continue
+		}
+		logger.Info("Purged expired idempotency records", "records", removed)
+	}
+}
 
+// sets the write and search budgets (requests a second and at once) and enables coalescing of location updates
+// sent sooner than the minimum update interval after the last one
+func configureRateLimits(settings config.Location) {
+	ratelimit.Writes = ratelimit.NewLimiter(settings.WriteRate, settings.WriteBurst)
+	ratelimit.Searches = ratelimit.NewLimiter(settings.SearchRate, settings.SearchBurst)
+	ratelimit.Updates.Interval = time.Duration(settings.MinUpdateInterval)
 }
 
-// shuts down the http server and closes the database
-func gracefulShutdown(server *http.Server) {
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt, syscall.SIGINT)
-	<-quit
-	fmt.Println("Shutting down server...")
+// stops the service in order so no accepted location update is lost
+// readiness fails first and the servers keep accepting requests for the shutdown delay, so load balancers stop sending traffic,
+// then in-flight requests are drained, coalesced updates written, the outbox delivered to the history service,
+// the spans flushed and the database closed, all within the shutdown timeout
+func gracefulShutdown(settings config.Shutdown, server *http.Server, client *grpc.DefaultGRPCClient, shutdownTracing func(context.Context) error) {
+	logger.Info("Shutting down server", "delay", time.Duration(settings.Delay).String(), "timeout", time.Duration(settings.Timeout).String())
+	health.Default.Shutdown()
+	time.Sleep(time.Duration(settings.Delay))
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(settings.Timeout))
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		logger.Error("Failed to drain HTTP requests, closing their connections", "error", err)
+		server.Close()
+	}
+
+	ratelimit.Updates.Flush()
+	if err := client.Flush(ctx); err != nil {
+		logger.Error("Failed to deliver the outbox to the history service", "queued", client.Queued(), "error", err)
+	}
+	client.Close()
+
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("Failed to flush spans", "error", err)
 	}
 
 	DB.CloseDB()
-	fmt.Println("Server exited gracefully")
+	logger.Info("Server exited gracefully")
 }
@@ -1,13 +1,105 @@
 // package defines data structures used in the app
 package models
 
+import "go-nauka/geo"
+
 // Location represents the structure for storing user location data
 // Name - unique user identifier
 // Latitude and Longitude are used for defininf a users location
 // UpdatedAt is used to record the time of the last update
+// FixID is an optional client generated id of the gps fix, used to deduplicate retried updates
+// Precision names the reduced precision the location is shown with to the viewer, empty when it is exact
 type Location struct {
 	Name      string  `json:"name"`
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
 	UpdatedAt string  `json:"updated_at"`
+	FixID     string  `json:"fix_id,omitempty"`
+	Precision string  `json:"precision,omitempty"`
+}
+
+// returns the coordinates of the location
+func (l Location) Position() geo.LatLng {
+	return geo.LatLng{Lat: l.Latitude, Lng: l.Longitude}
+}
+
+// IdempotencyRecord stores the response sent for a request with an idempotency key
+// so that a retried request can be answered without writing the location again
+// StatusCode is 0 while the key is reserved by a request that is still processed
+type IdempotencyRecord struct {
+	Name       string
+	Key        string
+	StatusCode int
+	Response   string
+}
+
+// ProximityRule makes users of a group (two for a pair) notify each other when they come within ThresholdKm
+// a pair that came close is only considered apart again beyond ExitKm, which stops alerts flapping at the threshold
+// the rule only applies to the Accepted members, the creator accepts it by creating it and everyone else has to opt in
+type ProximityRule struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Members     []string `json:"members"`
+	Accepted    []string `json:"accepted"`
+	ThresholdKm float64  `json:"threshold_km"`
+	ExitKm      float64  `json:"exit_km"`
+}
+
+// ProximityPair is a pair of users of a rule that are currently close to each other
+type ProximityPair struct {
+	RuleID     int64     `json:"rule_id"`
+	Users      [2]string `json:"users"`
+	DistanceKm float64   `json:"distance_km"`
+	Since      string    `json:"since"`
+}
+
+// ProximityEvent records a pair of users entering or leaving the proximity of a rule
+type ProximityEvent struct {
+	ID         int64     `json:"id"`
+	RuleID     int64     `json:"rule_id"`
+	Type       string    `json:"type"`
+	Users      [2]string `json:"users"`
+	DistanceKm float64   `json:"distance_km"`
+	CreatedAt  string    `json:"created_at"`
+}
+
+// grantee types of a location share
+const (
+	ShareEveryone = "everyone"
+	ShareUser     = "user"
+	ShareGroup    = "group"
+)
+
+// Share lets a user, a group or everyone see the owners location, until ExpiresAt when it is set
+// a user without shares is visible to nobody but themselves, Precision limits how exactly the grantees see them
+type Share struct {
+	ID          int64   `json:"id"`
+	Owner       string  `json:"owner"`
+	GranteeType string  `json:"type"`
+	Grantee     string  `json:"grantee,omitempty"`
+	Precision   string  `json:"precision"`
+	ExpiresAt   *string `json:"expires_at,omitempty"`
+	CreatedAt   string  `json:"created_at,omitempty"`
+}
+
+// operations an API key may be scoped to
+const (
+	APIKeyWrite  = "write"
+	APIKeySearch = "search"
+)
+
+// APIKey is a long-lived credential of a device or partner system acting for its owner
+// Usernames are the users whose location it may post, Scopes the operations it may call
+// only a hash of the key is stored, Key holds the plaintext once in the response creating it
+type APIKey struct {
+	ID         int64    `json:"id"`
+	Prefix     string   `json:"prefix"`
+	Name       string   `json:"name"`
+	Owner      string   `json:"owner"`
+	Usernames  []string `json:"usernames"`
+	Scopes     []string `json:"scopes"`
+	Key        string   `json:"key,omitempty"`
+	CreatedAt  string   `json:"created_at,omitempty"`
+	LastUsedAt *string  `json:"last_used_at"`
+	RevokedAt  *string  `json:"revoked_at,omitempty"`
 }
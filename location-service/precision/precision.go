@@ -0,0 +1,108 @@
+// package reduces the precision of the locations shown to viewers a user only shares an approximate position with
+package precision
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"go-nauka/geo"
+	"go-nauka/location-service/models"
+)
+
+// precision levels of a share
+const (
+	Exact        = "exact"
+	Street       = "100m"
+	Neighborhood = "1km"
+	City         = "city"
+)
+
+// size of the coarsest grid in meters, a reduced position is never farther than that from the stored one
+const MaxMeters = 10000
+
+// size of the snapping grid of each level in meters, 0 keeps the exact position
+var gridMeters = map[string]int{
+	Exact:        0,
+	Street:       100,
+	Neighborhood: 1000,
+	City:         MaxMeters,
+}
+
+// key mixed into the per-user grid offsets, set from the required PRECISION_SECRET so the cell boundaries of a user
+// can't be derived from their name, it has to stay the same across restarts or the offsets move
+var Secret []byte
+
+const metersPerDegree = 111320.0
+
+// returns the grid size of a level, an empty level is exact
+func Meters(level string) (int, error) {
+	if level == "" {
+		return 0, nil
+	}
+	meters, ok := gridMeters[level]
+	if !ok {
+		return 0, fmt.Errorf("unknown precision %q", level)
+	}
+	return meters, nil
+}
+
+// returns the finest level whose grid is at least the given size
+func LevelFor(meters int) string {
+	for _, level := range []string{Exact, Street, Neighborhood} {
+		if gridMeters[level] >= meters {
+			return level
+		}
+	}
+	return City
+}
+
+// snaps a position to the center of its cell in a grid of the given size
+// the grid of every user is shifted by a stable offset derived from their name, so a position always maps to the
+// same point, repeated queries can't be averaged and the cell boundaries differ between users
+func Reduce(name string, p geo.LatLng, meters int) geo.LatLng {
+	if meters <= 0 {
+		return p
+	}
+	offsetLat, offsetLng := offsets(name)
+
+	latStep := float64(meters) / metersPerDegree
+	lat := snap(p.Lat, latStep, offsetLat)
+	lat = math.Max(-90, math.Min(90, lat))
+
+	// the longitude step follows the snapped latitude so the whole cell shares one step
+	lngStep := 360.0
+	if cos := math.Cos(geo.DegreesToRadians(lat)); cos > 0 {
+		lngStep = math.Min(latStep/cos, 360)
+	}
+	lng := geo.NormalizeLongitude(snap(p.Lng, lngStep, offsetLng))
+
+	return geo.LatLng{Lat: lat, Lng: lng}
+}
+
+// returns the center of the cell containing v in a grid of the given step shifted by offset steps
+func snap(v, step, offset float64) float64 {
+	origin := offset * step
+	return math.Floor((v-origin)/step)*step + origin + step/2
+}
+
+// returns the grid offsets of a user as fractions of a cell
+func offsets(name string) (float64, float64) {
+	mac := hmac.New(sha256.New, Secret)
+	mac.Write([]byte(name))
+	sum := mac.Sum(nil)
+	return float64(binary.BigEndian.Uint64(sum[:8])) / math.MaxUint64, float64(binary.BigEndian.Uint64(sum[8:16])) / math.MaxUint64
+}
+
+// reduces the precision of a location in place and names the level it is shown with
+func Apply(loc *models.Location, meters int) {
+	if meters <= 0 {
+		loc.Precision = ""
+		return
+	}
+	p := Reduce(loc.Name, loc.Position(), meters)
+	loc.Latitude, loc.Longitude = p.Lat, p.Lng
+	loc.Precision = LevelFor(meters)
+}
@@ -0,0 +1,348 @@
+// package detects users of a proximity rule coming close to or moving away from each other
+package proximity
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go-nauka/geo"
+	DB "go-nauka/location-service/db"
+	"go-nauka/location-service/models"
+	"go-nauka/location-service/precision"
+)
+
+// types of proximity events
+const (
+	Entered = "proximity_entered"
+	Left    = "proximity_left"
+)
+
+// exit distance of a rule created without one, relative to its threshold
+const DefaultExitRatio = 1.25
+
+// a pair of users of a rule, the names are ordered so both users map to the same pair
+type pairKey struct {
+	rule  int64
+	users [2]string
+}
+
+func newPairKey(rule int64, a, b string) pairKey {
+	if b < a {
+		a, b = b, a
+	}
+	return pairKey{rule: rule, users: [2]string{a, b}}
+}
+
+// Engine keeps the rules in memory together with the pairs that are currently close
+// the state is not persisted, after a restart pairs are detected again as their users move
+type Engine struct {
+	mu     sync.Mutex
+	rules  map[int64]models.ProximityRule
+	byUser map[string][]int64
+	active map[pairKey]*models.ProximityPair
+	now    func() time.Time
+}
+
+// engine used by the handlers
+var Default = NewEngine()
+
+// returns an engine without rules
+func NewEngine() *Engine {
+	return &Engine{
+		rules:  map[int64]models.ProximityRule{},
+		byUser: map[string][]int64{},
+		active: map[pairKey]*models.ProximityPair{},
+		now:    time.Now,
+	}
+}
+
+// checks a rule and fills in the default exit distance
+func Validate(rule *models.ProximityRule) error {
+	members := map[string]bool{}
+	for _, member := range rule.Members {
+		if member == "" || members[member] {
+			return fmt.Errorf("proximity: members must be distinct usernames")
+		}
+		members[member] = true
+	}
+	if len(members) < 2 {
+		return fmt.Errorf("proximity: a rule needs at least two members")
+	}
+	if !(rule.ThresholdKm > 0) || math.IsInf(rule.ThresholdKm, 0) {
+		return fmt.Errorf("proximity: threshold must be positive")
+	}
+	if rule.ExitKm == 0 {
+		rule.ExitKm = rule.ThresholdKm * DefaultExitRatio
+	}
+	if rule.ExitKm < rule.ThresholdKm || math.IsInf(rule.ExitKm, 0) {
+		return fmt.Errorf("proximity: exit distance must not be below the threshold")
+	}
+	return nil
+}
+
+// replaces the rules of the engine with the ones stored in the database
+func (e *Engine) Load(ctx context.Context) error {
+	rules, err := DB.GetProximityRules(ctx)
+	if err != nil {
+		return fmt.Errorf("proximity: %v", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rules = map[int64]models.ProximityRule{}
+	e.byUser = map[string][]int64{}
+	e.active = map[pairKey]*models.ProximityPair{}
+	for _, rule := range rules {
+		e.addRule(rule)
+	}
+	return nil
+}
+
+// adds a stored rule to the engine
+func (e *Engine) AddRule(rule models.ProximityRule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.addRule(rule)
+}
+
+func (e *Engine) addRule(rule models.ProximityRule) {
+	e.rules[rule.ID] = rule
+	for _, member := range rule.Members {
+		e.byUser[member] = append(e.byUser[member], rule.ID)
+	}
+}
+
+// removes a rule together with its active pairs
+func (e *Engine) RemoveRule(id int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rule, ok := e.rules[id]
+	if !ok {
+		return
+	}
+	delete(e.rules, id)
+	for _, member := range rule.Members {
+		e.byUser[member] = without(e.byUser[member], id)
+	}
+	for key := range e.active {
+		if key.rule == id {
+			delete(e.active, key)
+		}
+	}
+}
+
+// removes an erased user from every rule and pair
+func (e *Engine) RemoveUser(name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, id := range e.byUser[name] {
+		rule := e.rules[id]
+		rule.Members = withoutName(rule.Members, name)
+		rule.Accepted = withoutName(rule.Accepted, name)
+		e.rules[id] = rule
+	}
+	delete(e.byUser, name)
+	for key := range e.active {
+		if key.users[0] == name || key.users[1] == name {
+			delete(e.active, key)
+		}
+	}
+}
+
+// records that a member accepted a rule, reports false when the rule does not exist or the user is not a member
+func (e *Engine) Accept(id int64, username string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rule, ok := e.rules[id]
+	if !ok || !slices.Contains(rule.Members, username) {
+		return false
+	}
+	if !slices.Contains(rule.Accepted, username) {
+		rule.Accepted = append(slices.Clip(rule.Accepted), username)
+		e.rules[id] = rule
+	}
+	return true
+}
+
+// returns a rule of the engine by id
+func (e *Engine) Rule(id int64) (models.ProximityRule, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rule, ok := e.rules[id]
+	return rule, ok
+}
+
+// returns the rules of the engine ordered by id
+func (e *Engine) Rules() []models.ProximityRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rules := make([]models.ProximityRule, 0, len(e.rules))
+	for _, rule := range e.rules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules
+}
+
+// returns the pairs that are currently close, limited to pairs with the given user unless username is empty
+func (e *Engine) Active(username string) []models.ProximityPair {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	pairs := []models.ProximityPair{}
+	for key, pair := range e.active {
+		if username == "" || key.users[0] == username || key.users[1] == username {
+			pairs = append(pairs, *pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].RuleID != pairs[j].RuleID {
+			return pairs[i].RuleID < pairs[j].RuleID
+		}
+		if pairs[i].Users[0] != pairs[j].Users[0] {
+			return pairs[i].Users[0] < pairs[j].Users[0]
+		}
+		return pairs[i].Users[1] < pairs[j].Users[1]
+	})
+	return pairs
+}
+
+// checks a user that just moved against the other members of their rules and stores the resulting events
+// only rules the mover accepted are checked, against the other members that accepted them
+// members that don't share their location with the mover or the mover doesn't share with count as apart,
+// a pair is only close while both of them see each other
+// the database is queried without holding the lock, which only guards the transitions of the pairs
+func (e *Engine) Check(ctx context.Context, mover models.Location) ([]models.ProximityEvent, error) {
+	e.mu.Lock()
+	var rules []models.ProximityRule
+	var members []string
+	for _, id := range e.byUser[mover.Name] {
+		rule := e.rules[id]
+		if !slices.Contains(rule.Accepted, mover.Name) {
+			continue
+		}
+		rules = append(rules, rule)
+		for _, member := range rule.Accepted {
+			if member != mover.Name && !slices.Contains(members, member) {
+				members = append(members, member)
+			}
+		}
+	}
+	e.mu.Unlock()
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	distances, err := memberDistances(ctx, mover, members)
+	if err != nil {
+		return nil, err
+	}
+
+	now := e.now().UTC().Format("2006-01-02 15:04:05")
+	var events []models.ProximityEvent
+	e.mu.Lock()
+	for _, rule := range rules {
+		// the rule may have been removed or changed while the members were looked up
+		current, ok := e.rules[rule.ID]
+		if !ok || !slices.Contains(current.Accepted, mover.Name) {
+			continue
+		}
+		for _, member := range current.Accepted {
+			if member == mover.Name {
+				continue
+			}
+			key := newPairKey(current.ID, mover.Name, member)
+			distance, found := distances[member]
+			pair, active := e.active[key]
+
+			switch {
+			case !active && found && distance <= current.ThresholdKm:
+				e.active[key] = &models.ProximityPair{RuleID: current.ID, Users: key.users, DistanceKm: distance, Since: now}
+				events = append(events, models.ProximityEvent{RuleID: current.ID, Type: Entered, Users: key.users, DistanceKm: distance, CreatedAt: now})
+			case active && (!found || distance > current.ExitKm):
+				delete(e.active, key)
+				if !found {
+					// the distance to a member that can't be seen is unknown, it is only known to be beyond the exit
+					distance = current.ExitKm
+				}
+				events = append(events, models.ProximityEvent{RuleID: current.ID, Type: Left, Users: key.users, DistanceKm: distance, CreatedAt: now})
+			case active:
+				pair.DistanceKm = distance
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	for _, event := range events {
+		if err := DB.AddProximityEvent(ctx, event); err != nil {
+			return events, fmt.Errorf("proximity: %v", err)
+		}
+	}
+	return events, nil
+}
+
+// returns the distances from the mover to the members both sharing with the mover and seen by them
+// the members are loaded reduced to the precision they share with, the distance is taken between the reduced
+// positions and rounded to the coarser grid of the pair
+func memberDistances(ctx context.Context, mover models.Location, members []string) (map[string]float64, error) {
+	located, err := DB.GetLocationsOf(ctx, members, mover.Name)
+	if err != nil {
+		return nil, fmt.Errorf("proximity: %v", err)
+	}
+
+	distances := map[string]float64{}
+	for _, loc := range located {
+		moverMeters, shared, err := DB.SharePrecision(ctx, mover.Name, loc.Name)
+		if err != nil {
+			return nil, fmt.Errorf("proximity: %v", err)
+		}
+		if !shared {
+			continue
+		}
+		memberMeters, _ := precision.Meters(loc.Precision)
+		distance := geo.Haversine(precision.Reduce(mover.Name, mover.Position(), moverMeters), loc.Position())
+		distances[loc.Name] = coarsen(distance, max(moverMeters, memberMeters))
+	}
+	return distances, nil
+}
+
+// rounds a distance to the grid of the coarser precision of a pair, so it doesn't reveal more than the grid
+func coarsen(km float64, meters int) float64 {
+	if meters <= 0 {
+		return km
+	}
+	step := float64(meters) / 1000
+	return math.Round(km/step) * step
+}
+
+func without(ids []int64, id int64) []int64 {
+	kept := ids[:0]
+	for _, v := range ids {
+		if v != id {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+func withoutName(names []string, name string) []string {
+	kept := make([]string, 0, len(names))
+	for _, v := range names {
+		if v != name {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
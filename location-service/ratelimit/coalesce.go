@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"go-nauka/location-service/models"
+)
+
+// Coalescer writes the location of a user at most once per Interval
+// updates arriving sooner replace each other and only the latest is written once the interval has passed
+type Coalescer struct {
+	Interval time.Duration
+
+	mu    sync.Mutex
+	users map[string]*user
+}
+
+// the update of a user waiting for the interval since their last write to pass
+// the timer either writes the pending update or forgets the user once the interval passed without one
+type user struct {
+	pending *models.Location
+	write   func(models.Location)
+	timer   *time.Timer
+	// flushes still writing, awaited by Forget
+	writes sync.WaitGroup
+}
+
+// coalesces the location updates, disabled until main sets MIN_UPDATE_INTERVAL
+var Updates = &Coalescer{}
+
+// reports whether the update should be written right away, otherwise it is kept and written by write
+// when the interval since the last write of the user has passed, unless a newer update replaces it first
+func (c *Coalescer) Offer(loc models.Location, write func(models.Location)) bool {
+	if c.Interval <= 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.users == nil {
+		c.users = map[string]*user{}
+	}
+
+	u, ok := c.users[loc.Name]
+	if !ok {
+		c.users[loc.Name] = &user{timer: time.AfterFunc(c.Interval, func() { c.flush(loc.Name) })}
+		return true
+	}
+
+	u.pending, u.write = &loc, write
+	return false
+}
+
+// writes the pending update of a user, the user is forgotten once an interval passes without updates
+func (c *Coalescer) flush(name string) {
+	c.mu.Lock()
+	u, ok := c.users[name]
+	if !ok {
+		// forgotten by Flush or Forget while the timer fired
+		c.mu.Unlock()
+		return
+	}
+	if u.pending == nil {
+		delete(c.users, name)
+		c.mu.Unlock()
+		return
+	}
+	loc, write := *u.pending, u.write
+	u.pending, u.write = nil, nil
+	u.timer = time.AfterFunc(c.Interval, func() { c.flush(name) })
+	u.writes.Add(1)
+	c.mu.Unlock()
+
+	defer u.writes.Done()
+	write(loc)
+}
+
+// writes every pending update right away, waits for the writes already running and forgets all users,
+// called on shutdown once no more updates arrive
+func (c *Coalescer) Flush() {
+	c.mu.Lock()
+	users := c.users
+	for _, u := range users {
+		u.timer.Stop()
+	}
+	c.users = nil
+	c.mu.Unlock()
+
+	for _, u := range users {
+		if u.pending != nil {
+			u.write(*u.pending)
+		}
+		u.writes.Wait()
+	}
+}
+
+// drops the pending update of a user without writing it and waits for a write already running,
+// called before the user is erased so no write of theirs lands after it
+func (c *Coalescer) Forget(name string) {
+	c.mu.Lock()
+	u, ok := c.users[name]
+	if ok {
+		u.timer.Stop()
+		delete(c.users, name)
+	}
+	c.mu.Unlock()
+
+	if ok {
+		u.writes.Wait()
+	}
+}
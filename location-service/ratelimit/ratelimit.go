@@ -0,0 +1,114 @@
+// package limits how often callers may write and search locations
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go-nauka/location-service/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// number of Allow calls between sweeps of idle buckets
+const sweepEvery = 1024
+
+// Limiter is a token bucket per caller, refilled with Rate tokens a second up to Burst
+type Limiter struct {
+	Rate  float64
+	Burst float64
+	// clock of the limiter, replaced in tests
+	Now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+// tokens left in a bucket when it was last used
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// budgets of the location writes and the searches, replaced by main from the environment
+var (
+	Writes   = NewLimiter(1, 30)
+	Searches = NewLimiter(2, 20)
+)
+
+// returns a limiter allowing burst calls at once and rate calls a second after that
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{Rate: rate, Burst: float64(burst), Now: time.Now, buckets: map[string]*bucket{}}
+}
+
+// takes a token from the bucket of key, reports whether there was one and otherwise how long until there is
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Now()
+	if l.calls++; l.calls%sweepEvery == 0 {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.Burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.Burst, b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// drops the buckets that have refilled, they behave like new ones
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= l.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// returns the key a request is limited by, read from the request before any credential is checked:
+// the hash of its API key, the authenticated user, the hash of its bearer token or the client IP in that order
+// limiting by hash keeps the credentials themselves out of the buckets
+func KeyOf(c *gin.Context) string {
+	if key := c.GetHeader(auth.APIKeyHeader); key != "" {
+		return "key:" + auth.HashAPIKey(key)
+	}
+	if caller := auth.Caller(c); caller != "" {
+		return "user:" + caller
+	}
+	if token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); found && token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:])
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// rejects requests over the budget of the limiter with 429 and a Retry-After header in whole seconds
+// it runs before authentication, so callers over budget never cost an API key lookup
+func Middleware(limiter *Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, retryAfter := limiter.Allow(KeyOf(c))
+		if !allowed {
+			c.Header("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
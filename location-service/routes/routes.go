@@ -2,21 +2,66 @@
 package routes
 
 import (
+	"go-nauka/health"
+	"go-nauka/jwtauth"
+	"go-nauka/location-service/auth"
 	"go-nauka/location-service/handlers"
+	"go-nauka/location-service/models"
+	"go-nauka/location-service/ratelimit"
+	"go-nauka/logging"
+	"go-nauka/metrics"
+	"go-nauka/tracing"
 
 	"github.com/gin-gonic/gin"
 )
 
 // SetupRouter configures and returns the main Gin router with defined routes
-// GET  /locations - Retrieves all stored user locations
-// POST /locations - Adds or updates a users location and notifies the history service
+// GET  /healthz, /readyz, /metrics - Liveness and readiness probes and prometheus metrics, the only routes without authentication
+// GET  /locations - Retrieves the user locations visible to the caller, all of them with the admin scope
+// POST /locations - Adds or updates the callers location and notifies the history service
+// DELETE /locations/:name - Erases a user from both services
 // GET  /search    - Searches for users within a specified radius with pagination support
+// GET  /tiles/:z/:x/:y.mvt - Serves a vector tile of the current positions, clustered at low zoom
+// GET  /clusters  - Returns clustered markers of the current positions inside a bounding box
+// POST/GET /proximity/rules, DELETE /proximity/rules/:id, POST /proximity/rules/:id/accept - Manages proximity alerts between users
+// GET  /proximity/state, /proximity/events - Lists the users currently close to the caller and past alerts
+// GET/POST/DELETE /sharing, DELETE /sharing/:id - Manages who may see the callers location
+// GET /groups/:group, PUT/DELETE /groups/:group/members/:name - Manages the groups of the caller
+// POST/GET /apikeys, DELETE /apikeys/:id - Manages the API keys of the caller
+// every route needs a bearer token (HS256 or RS256), its sub claim names the caller and a user is only visible to callers it shares with
+// POST /locations and GET /search also accept an X-API-Key with the write or search scope, acting as the keys owner
+// they are rate limited per key, token or client IP with separate budgets before the credentials are checked, over budget callers get 429 with Retry-After
 func SetupRouter() *gin.Engine {
-	router := gin.Default()
+	router := gin.New()
+	router.Use(logging.Middleware(), gin.Recovery(), tracing.Middleware(), metrics.Middleware())
+	router.GET("/healthz", health.Default.Liveness)
+	router.GET("/readyz", health.Default.Readiness)
+	router.GET("/metrics", metrics.Handler())
+	router.POST("/locations", ratelimit.Middleware(ratelimit.Writes), auth.Authenticate(models.APIKeyWrite), handlers.PostLocation)
+	router.GET("/search", ratelimit.Middleware(ratelimit.Searches), auth.Authenticate(models.APIKeySearch), handlers.SearchLocationsHandler)
 
+	// routes registered from here on only take bearer tokens
+	router.Use(jwtauth.Middleware())
 	router.GET("/locations", handlers.GetLocations)
-	router.POST("/locations", handlers.PostLocation)
-	router.GET("/search", handlers.SearchLocationsHandler)
+	router.DELETE("/locations/:name", handlers.DeleteLocation)
+	router.GET("/tiles/:z/:x/:y", handlers.GetTile)
+	router.GET("/clusters", handlers.GetClusters)
+	router.POST("/proximity/rules", handlers.CreateProximityRule)
+	router.GET("/proximity/rules", handlers.GetProximityRules)
+	router.DELETE("/proximity/rules/:id", handlers.DeleteProximityRule)
+	router.POST("/proximity/rules/:id/accept", handlers.AcceptProximityRule)
+	router.GET("/proximity/state", handlers.GetProximityState)
+	router.GET("/proximity/events", handlers.GetProximityEvents)
+	router.GET("/sharing", handlers.GetShares)
+	router.POST("/sharing", handlers.CreateShare)
+	router.DELETE("/sharing", handlers.DeleteShares)
+	router.DELETE("/sharing/:id", handlers.DeleteShare)
+	router.GET("/groups/:group", handlers.GetGroupMembers)
+	router.PUT("/groups/:group/members/:name", handlers.AddGroupMember)
+	router.DELETE("/groups/:group/members/:name", handlers.RemoveGroupMember)
+	router.POST("/apikeys", handlers.CreateAPIKey)
+	router.GET("/apikeys", handlers.GetAPIKeys)
+	router.DELETE("/apikeys/:id", handlers.RevokeAPIKey)
 
 	return router
 }
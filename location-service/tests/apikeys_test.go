@@ -0,0 +1,249 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-nauka/jwtauth"
+	"go-nauka/location-service/auth"
+	GRPC "go-nauka/location-service/grpc"
+	"go-nauka/location-service/models"
+	"go-nauka/location-service/routes"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+// sqlmock argument remembering the value it was matched against
+type capturedArg struct {
+	value driver.Value
+}
+
+func (a *capturedArg) Match(v driver.Value) bool {
+	a.value = v
+	return true
+}
+
+// columns returned by the API key queries
+var apiKeyColumns = []string{"id", "prefix", "name", "owner", "scopes", "created_at", "last_used_at", "revoked_at", "username"}
+
+// tests the POST /apikeys endpoint, keys are stored as a hash and only returned in plaintext once
+func TestCreateAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	router := routes.SetupRouter()
+
+	tests := []struct {
+		name              string
+		scope             string
+		body              map[string]interface{}
+		expectedOwner     string
+		expectedScopes    string
+		expectedUsernames []string
+		expectedStatus    int
+	}{
+		{
+			name:              "Device Key",
+			body:              map[string]interface{}{"name": "tracker", "scopes": []string{"write"}},
+			expectedOwner:     "tomek_prus",
+			expectedScopes:    "write",
+			expectedUsernames: []string{"tomek_prus"},
+			expectedStatus:    http.StatusCreated,
+		},
+		{
+			name:              "Partner Key",
+			scope:             jwtauth.ScopeAdmin,
+			body:              map[string]interface{}{"name": "fleet", "owner": "partner", "usernames": []string{"van_2", "van_1", "van_2"}, "scopes": []string{"write", "search"}},
+			expectedOwner:     "partner",
+			expectedScopes:    "search,write",
+			expectedUsernames: []string{"van_1", "van_2"},
+			expectedStatus:    http.StatusCreated,
+		},
+		{
+			name:           "Other Users",
+			body:           map[string]interface{}{"usernames": []string{"jane_doe"}, "scopes": []string{"write"}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Other Owner",
+			body:           map[string]interface{}{"owner": "jane_doe", "scopes": []string{"search"}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Invalid Scope",
+			body:           map[string]interface{}{"scopes": []string{"admin"}},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "No Scopes",
+			body:           map[string]interface{}{"name": "tracker"},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := &capturedArg{}
+			if tt.expectedStatus == http.StatusCreated {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO api_keys").
+					WithArgs(hash, sqlmock.AnyArg(), tt.body["name"], tt.expectedOwner, tt.expectedScopes).
+					WillReturnResult(sqlmock.NewResult(7, 1))
+				for _, username := range tt.expectedUsernames {
+					mock.ExpectExec("INSERT INTO api_key_usernames").
+						WithArgs(7, username).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				mock.ExpectCommit()
+			}
+
+			var buf bytes.Buffer
+			json.NewEncoder(&buf).Encode(tt.body)
+			req, _ := http.NewRequest("POST", "/apikeys", &buf)
+			authorize(req, "tomek_prus", tt.scope)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d but got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if tt.expectedStatus == http.StatusCreated {
+				var key models.APIKey
+				json.Unmarshal(w.Body.Bytes(), &key)
+				if !strings.HasPrefix(key.Key, key.Prefix) || key.ID != 7 {
+					t.Errorf("Expected the plaintext key in the response, got %+v", key)
+				}
+				if hash.value != auth.HashAPIKey(key.Key) || strings.Contains(hash.value.(string), key.Key) {
+					t.Errorf("Expected only the hash of the key to be stored, got %v", hash.value)
+				}
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled DB expectations: %v", err)
+			}
+		})
+	}
+}
+
+// tests authenticating POST /locations and GET /search with an X-API-Key scoped to users and operations
+func TestAPIKeyAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	router := routes.SetupRouter()
+	GRPC.Client = &MockGRPCClient{}
+
+	plaintext, prefix, err := auth.NewAPIKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		scopes         string
+		found          bool
+		touched        bool
+		expectedStatus int
+	}{
+		{name: "Write Own User", method: "POST", path: "/locations", body: `{"name":"van_1","latitude":40.7128,"longitude":-74.0060}`, scopes: "write", found: true, touched: true, expectedStatus: http.StatusCreated},
+		{name: "Write Other User", method: "POST", path: "/locations", body: `{"name":"tomek_prus","latitude":40.7128,"longitude":-74.0060}`, scopes: "write", found: true, touched: true, expectedStatus: http.StatusForbidden},
+		{name: "Write With Search Key", method: "POST", path: "/locations", body: `{"name":"van_1","latitude":40.7128,"longitude":-74.0060}`, scopes: "search", found: true, expectedStatus: http.StatusForbidden},
+		{name: "Search", method: "GET", path: "/search?latitude=52.2&longitude=21.0&radius=10", scopes: "search", found: true, touched: true, expectedStatus: http.StatusOK},
+		{name: "Unknown Or Revoked Key", method: "GET", path: "/search?latitude=52.2&longitude=21.0&radius=10", expectedStatus: http.StatusUnauthorized},
+		{name: "Key On Other Route", method: "GET", path: "/locations", expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// GET /locations only takes bearer tokens, so the key is never looked up
+			if tt.path != "/locations" || tt.method == "POST" {
+				rows := sqlmock.NewRows(apiKeyColumns)
+				if tt.found {
+					rows.AddRow(3, prefix, "fleet", "partner", tt.scopes, "2024-01-16 10:00:00", nil, nil, "van_1").
+						AddRow(3, prefix, "fleet", "partner", tt.scopes, "2024-01-16 10:00:00", nil, nil, "van_2")
+				}
+				mock.ExpectQuery("FROM api_keys k").WithArgs(auth.HashAPIKey(plaintext)).WillReturnRows(rows)
+			}
+			if tt.touched {
+				mock.ExpectExec("UPDATE api_keys SET last_used_at").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			switch tt.name {
+			case "Write Own User":
+				mock.ExpectQuery("SELECT name FROM location WHERE name = ?").WithArgs("van_1").WillReturnError(sql.ErrNoRows)
+				mock.ExpectExec("INSERT INTO location").WithArgs("van_1", 40.7128, -74.0060).WillReturnResult(sqlmock.NewResult(1, 1))
+			case "Search":
+				expectReducedSearch(mock, nil)
+				// the key searches as its owner
+				mock.ExpectQuery("FROM location l").
+					WithArgs("partner", "partner", "partner", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+						sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "partner", "partner", "partner",
+						10.0, 10, 0).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m", "distance"}))
+			}
+
+			req, _ := http.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+			req.Header.Set(auth.APIKeyHeader, plaintext)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d but got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled DB expectations: %v", err)
+			}
+		})
+	}
+}
+
+// tests listing and revoking keys, only the owner or an admin may revoke a key
+func TestRevokeAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	router := routes.SetupRouter()
+
+	mock.ExpectQuery("FROM api_keys k LEFT JOIN api_key_usernames u ON u.key_id = k.id WHERE k.owner = ?").
+		WithArgs("tomek_prus").
+		WillReturnRows(sqlmock.NewRows(apiKeyColumns).
+			AddRow(3, "lsk_abcdefgh", "tracker", "tomek_prus", "write", "2024-01-16 10:00:00", "2024-01-17 08:00:00", nil, "tomek_prus"))
+	w := sendAs(router, "tomek_prus", "GET", "/apikeys", nil)
+	var keys []models.APIKey
+	json.Unmarshal(w.Body.Bytes(), &keys)
+	if w.Code != http.StatusOK || len(keys) != 1 || keys[0].Key != "" || keys[0].LastUsedAt == nil || keys[0].Usernames[0] != "tomek_prus" {
+		t.Errorf("Expected the key without its plaintext, got %d %s", w.Code, w.Body.String())
+	}
+
+	if w := sendAs(router, "tomek_prus", "GET", "/apikeys?owner=jane_doe", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 listing another users keys but got %d", w.Code)
+	}
+
+	mock.ExpectExec("UPDATE api_keys SET revoked_at").WithArgs(4, "jane_doe").WillReturnResult(sqlmock.NewResult(0, 0))
+	if w := sendAs(router, "jane_doe", "DELETE", "/apikeys/4", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a key of another owner but got %d", w.Code)
+	}
+
+	mock.ExpectExec("UPDATE api_keys SET revoked_at").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+	req, _ := http.NewRequest("DELETE", "/apikeys/4", nil)
+	authorize(req, "operator", jwtauth.ScopeAdmin)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for an admin but got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-nauka/jwtauth"
+	"go-nauka/location-service/handlers"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// secret of the locally minted test tokens
+var testSecret = []byte("test-secret")
+
+// makes the middleware accept tokens signed with testSecret
+func useTestVerifier() {
+	if jwtauth.Default == nil {
+		jwtauth.Default, _ = jwtauth.NewVerifier(jwtauth.Config{HMACSecret: testSecret})
+	}
+}
+
+// returns an HS256 token for a subject with the given space separated scopes, valid for an hour
+func mintToken(subject, scope string) string {
+	useTestVerifier()
+	claims := jwtauth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: subject, ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		Scope:            scope,
+	}
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testSecret)
+	return token
+}
+
+// adds a bearer token for the subject to a request
+func authorize(req *http.Request, subject string, scope string) {
+	req.Header.Set("Authorization", "Bearer "+mintToken(subject, scope))
+}
+
+// returns middleware making every request come from the subject without a token
+func asCaller(subject string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(jwtauth.ClaimsKey, &jwtauth.Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: subject}})
+	}
+}
+
+// tests that requests without a valid token are rejected before reaching a handler
+func TestAuthenticationRequired(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useTestVerifier()
+
+	router := gin.Default()
+	router.Use(jwtauth.Middleware())
+	router.GET("/locations", handlers.GetLocations)
+
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "tomek_prus",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+	}).SignedString(testSecret)
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "tomek_prus",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString([]byte("other-secret"))
+
+	for name, header := range map[string]string{
+		"Missing": "",
+		"Basic":   "Basic dG9tZWs6cHJ1cw==",
+		"Expired": "Bearer " + expired,
+		"Forged":  "Bearer " + forged,
+	} {
+		req, _ := http.NewRequest("GET", "/locations", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected status 401 with a challenge but got %d", name, w.Code)
+		}
+	}
+}
+
+// tests that a device can only update and erase its own location
+func TestSubjectBinding(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	_, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	router := gin.Default()
+	router.Use(jwtauth.Middleware())
+	router.POST("/locations", handlers.PostLocation)
+	router.DELETE("/locations/:name", handlers.DeleteLocation)
+
+	req, _ := http.NewRequest("POST", "/locations", bytes.NewBufferString(`{"name":"tomek_prus","latitude":40.7128,"longitude":-74.0060}`))
+	authorize(req, "jane_doe", "")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for another users location but got %d", w.Code)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/locations/tomek_prus", nil)
+	authorize(req, "jane_doe", "")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for erasing another user but got %d", w.Code)
+	}
+}
+
+// tests that the admin scope reads every location without the sharing rules
+func TestAdminReadsAllLocations(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	router := gin.Default()
+	router.Use(jwtauth.Middleware())
+	router.GET("/locations", handlers.GetLocations)
+
+	mock.ExpectQuery("SELECT \\* FROM location").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at"}).
+			AddRow("tomek_prus", 40.7128, -74.0060, "2024-01-16 10:00:00"))
+
+	req, _ := http.NewRequest("GET", "/locations", nil)
+	authorize(req, "operator", "read "+jwtauth.ScopeAdmin)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 but got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"go-nauka/geo"
+	"go-nauka/location-service/cluster"
+	"go-nauka/location-service/handlers"
+	"go-nauka/location-service/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+var clusterLocations = []models.Location{
+	{Name: "john_doe", Latitude: 52.2297, Longitude: 21.0122},
+	{Name: "jane_doe", Latitude: 52.2300, Longitude: 21.0130},
+	{Name: "anna", Latitude: 52.2310, Longitude: 21.0100},
+	{Name: "tomek_prus", Latitude: 50.0647, Longitude: 19.9450},
+}
+
+// tests that nearby users share a cluster at low zoom and split at high zoom
+func TestClusters(t *testing.T) {
+	idx := cluster.NewIndex()
+	idx.Load(clusterLocations)
+
+	clusters := idx.Clusters(geo.World(), 5, nil)
+	if len(clusters) != 2 {
+		t.Fatalf("Expected 2 clusters, got %+v", clusters)
+	}
+	if clusters[0].Count != 3 || !reflect.DeepEqual(clusters[0].Sample, []string{"anna", "jane_doe", "john_doe"}) {
+		t.Errorf("Unexpected cluster %+v", clusters[0])
+	}
+	if d := geo.Haversine(clusters[0].Center, geo.LatLng{Lat: 52.2302, Lng: 21.0117}); d > 0.01 {
+		t.Errorf("Expected the cluster at the mean position, got %v", clusters[0].Center)
+	}
+
+	krakow, _ := geo.ParseBounds("19,49,21,51")
+	if clusters := idx.Clusters(krakow, 5, nil); len(clusters) != 1 || clusters[0].Sample[0] != "tomek_prus" {
+		t.Errorf("Expected only the cluster inside the bbox, got %+v", clusters)
+	}
+
+	if clusters := idx.Clusters(geo.World(), cluster.MaxZoom+1, nil); len(clusters) != 4 {
+		t.Errorf("Expected every user on its own above the max zoom, got %+v", clusters)
+	}
+}
+
+// tests that moving and removing users gives the same clusters as rebuilding the index
+func TestClustersIncremental(t *testing.T) {
+	idx := cluster.NewIndex()
+	idx.Load(clusterLocations)
+
+	idx.Update("tomek_prus", geo.LatLng{Lat: 52.2305, Lng: 21.0125})
+	idx.Update("new_user", geo.LatLng{Lat: 50.0647, Lng: 19.9450})
+	idx.Remove("anna")
+	idx.Remove("unknown")
+
+	moved := []models.Location{
+		{Name: "john_doe", Latitude: 52.2297, Longitude: 21.0122},
+		{Name: "jane_doe", Latitude: 52.2300, Longitude: 21.0130},
+		{Name: "tomek_prus", Latitude: 52.2305, Longitude: 21.0125},
+		{Name: "new_user", Latitude: 50.0647, Longitude: 19.9450},
+	}
+	rebuilt := cluster.NewIndex()
+	rebuilt.Load(moved)
+
+	if idx.Len() != 4 {
+		t.Errorf("Expected 4 indexed users, got %d", idx.Len())
+	}
+	for zoom := 0; zoom <= cluster.MaxZoom+1; zoom++ {
+		got, expected := idx.Clusters(geo.World(), zoom, nil), rebuilt.Clusters(geo.World(), zoom, nil)
+		if len(got) != len(expected) {
+			t.Fatalf("Zoom %d: expected %+v, got %+v", zoom, expected, got)
+		}
+		for i := range got {
+			if got[i].Count != expected[i].Count || !reflect.DeepEqual(got[i].Sample, expected[i].Sample) || geo.Haversine(got[i].Center, expected[i].Center) > 1e-6 {
+				t.Errorf("Zoom %d: expected %+v, got %+v", zoom, expected[i], got[i])
+			}
+		}
+	}
+}
+
+// tests that hidden users are left out of the counts, samples and centroids
+func TestClustersVisible(t *testing.T) {
+	idx := cluster.NewIndex()
+	idx.Load(clusterLocations)
+
+	visible := func(name string, position geo.LatLng) (geo.LatLng, bool) {
+		return position, name != "anna" && name != "tomek_prus"
+	}
+	clusters := idx.Clusters(geo.World(), 5, visible)
+	if len(clusters) != 1 || clusters[0].Count != 2 || !reflect.DeepEqual(clusters[0].Sample, []string{"jane_doe", "john_doe"}) {
+		t.Fatalf("Unexpected clusters %+v", clusters)
+	}
+	if d := geo.Haversine(clusters[0].Center, geo.LatLng{Lat: 52.22985, Lng: 21.0126}); d > 0.01 {
+		t.Errorf("Expected the cluster at the mean of the visible positions, got %v", clusters[0].Center)
+	}
+
+	if clusters := idx.Clusters(geo.World(), cluster.MaxZoom+1, visible); len(clusters) != 2 {
+		t.Errorf("Expected only the visible users above the max zoom, got %+v", clusters)
+	}
+}
+
+// tests that users seen elsewhere are moved into the cells of the positions the viewer sees without changing the index
+func TestClustersMovedView(t *testing.T) {
+	idx := cluster.NewIndex()
+	idx.Load(clusterLocations)
+
+	shown := geo.LatLng{Lat: 52.2305, Lng: 21.0125}
+	view := func(name string, position geo.LatLng) (geo.LatLng, bool) {
+		if name == "tomek_prus" {
+			return shown, true
+		}
+		return position, name != "anna"
+	}
+	seen := cluster.NewIndex()
+	seen.Load([]models.Location{
+		{Name: "john_doe", Latitude: 52.2297, Longitude: 21.0122},
+		{Name: "jane_doe", Latitude: 52.2300, Longitude: 21.0130},
+		{Name: "tomek_prus", Latitude: shown.Lat, Longitude: shown.Lng},
+	})
+
+	for zoom := 0; zoom <= cluster.MaxZoom+1; zoom++ {
+		got, expected := idx.Clusters(geo.World(), zoom, view), seen.Clusters(geo.World(), zoom, nil)
+		if len(got) != len(expected) {
+			t.Fatalf("Zoom %d: expected %+v, got %+v", zoom, expected, got)
+		}
+		for i := range got {
+			if got[i].Count != expected[i].Count || !reflect.DeepEqual(got[i].Sample, expected[i].Sample) || geo.Haversine(got[i].Center, expected[i].Center) > 1e-6 {
+				t.Errorf("Zoom %d: expected %+v, got %+v", zoom, expected[i], got[i])
+			}
+		}
+	}
+
+	if clusters := idx.Clusters(geo.World(), 5, nil); len(clusters) != 2 || clusters[0].Count != 3 {
+		t.Errorf("Expected the index to keep the stored positions, got %+v", clusters)
+	}
+}
+
+// tests that views are only asked about users near the bounds who are not public
+func TestClustersViewedUsers(t *testing.T) {
+	idx := cluster.NewIndex()
+	idx.Load(clusterLocations)
+	idx.SetPublic("john_doe", true)
+
+	var viewed []string
+	view := func(name string, position geo.LatLng) (geo.LatLng, bool) {
+		viewed = append(viewed, name)
+		return position, true
+	}
+
+	warsaw, _ := geo.ParseBounds("20.5,52,21.5,52.5")
+	for _, zoom := range []int{5, cluster.MaxZoom + 1} {
+		viewed = nil
+		if clusters := idx.Clusters(warsaw, zoom, view); len(clusters) == 0 {
+			t.Fatalf("Zoom %d: expected the users in Warsaw, got %+v", zoom, clusters)
+		}
+		sort.Strings(viewed)
+		if !reflect.DeepEqual(viewed, []string{"anna", "jane_doe"}) {
+			t.Errorf("Zoom %d: expected only the users in Warsaw who are not public to be viewed, got %v", zoom, viewed)
+		}
+	}
+
+	// a public user is shown as stored, a cell of only public users is used without asking the view
+	idx.SetPublic("anna", true)
+	idx.SetPublic("jane_doe", true)
+	viewed = nil
+	hidden := func(name string, position geo.LatLng) (geo.LatLng, bool) {
+		viewed = append(viewed, name)
+		return position, false
+	}
+	if clusters := idx.Clusters(warsaw, 5, hidden); len(clusters) != 1 || clusters[0].Count != 3 || len(viewed) != 0 {
+		t.Errorf("Expected the public users without viewing them, got %+v and viewed %v", clusters, viewed)
+	}
+
+	idx.SetPublic("anna", false)
+	if clusters := idx.Clusters(warsaw, 5, hidden); len(clusters) != 1 || clusters[0].Count != 2 {
+		t.Errorf("Expected the user no longer public to be hidden, got %+v", clusters)
+	}
+}
+
+// tests that users the viewer sees moved into the bounds are found from the cells just outside them
+func TestClustersMovedIntoBounds(t *testing.T) {
+	idx := cluster.NewIndex()
+	idx.Load([]models.Location{{Name: "tomek_prus", Latitude: 40.7128, Longitude: -74.0060}})
+
+	shown := geo.LatLng{Lat: 40.7128, Lng: -73.98}
+	view := func(name string, position geo.LatLng) (geo.LatLng, bool) {
+		return shown, true
+	}
+	bounds, _ := geo.ParseBounds("-73.99,40.6,-73.9,40.8")
+	if clusters := idx.Clusters(bounds, cluster.MaxZoom, view); len(clusters) != 1 || clusters[0].Center != shown {
+		t.Errorf("Expected the user at the position the viewer sees, got %+v", clusters)
+	}
+	if clusters := idx.Clusters(bounds, cluster.MaxZoom, nil); len(clusters) != 0 {
+		t.Errorf("Expected nothing at the stored position outside the bounds, got %+v", clusters)
+	}
+}
+
+// tests that many moves of the users of one cell keep its centroid at the mean of the current positions
+func TestClustersCentroidAfterMoves(t *testing.T) {
+	idx := cluster.NewIndex()
+	idx.Load(clusterLocations)
+	for i := 0; i < 1000; i++ {
+		idx.Update("tomek_prus", geo.LatLng{Lat: 52.2305, Lng: 21.0125})
+		idx.Update("tomek_prus", geo.LatLng{Lat: 50.0647, Lng: 19.9450})
+	}
+
+	rebuilt := cluster.NewIndex()
+	rebuilt.Load(clusterLocations)
+	for zoom := 0; zoom <= cluster.MaxZoom; zoom++ {
+		got, expected := idx.Clusters(geo.World(), zoom, nil), rebuilt.Clusters(geo.World(), zoom, nil)
+		if len(got) != len(expected) {
+			t.Fatalf("Zoom %d: expected %+v, got %+v", zoom, expected, got)
+		}
+		for i := range got {
+			if got[i].Count != expected[i].Count || geo.Haversine(got[i].Center, expected[i].Center) > 1e-9 {
+				t.Errorf("Zoom %d: expected %+v, got %+v", zoom, expected[i], got[i])
+			}
+		}
+	}
+}
+
+// tests that the sample is limited to the first names
+func TestClusterSample(t *testing.T) {
+	idx := cluster.NewIndex()
+	for _, name := range []string{"g", "c", "a", "f", "b", "e", "d"} {
+		idx.Update(name, geo.LatLng{Lat: 10, Lng: 10})
+	}
+
+	clusters := idx.Clusters(geo.World(), 0, nil)
+	if len(clusters) != 1 || clusters[0].Count != 7 || !reflect.DeepEqual(clusters[0].Sample, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("Unexpected clusters %+v", clusters)
+	}
+}
+
+// tests the GET /clusters endpoint
+func TestGetClusters(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	cluster.Default.Load(clusterLocations)
+	defer cluster.Default.Load(nil)
+
+	router := gin.Default()
+	router.GET("/clusters", handlers.GetClusters)
+
+	// anna does not share with the caller
+	mock.ExpectQuery("SELECT l.name, CASE (.+) FROM location l WHERE").
+		WithArgs("", "", "", "", "", "").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "precision_m"}).AddRow("john_doe", 0).AddRow("jane_doe", 0).AddRow("tomek_prus", 0))
+
+	req, _ := http.NewRequest("GET", "/clusters?zoom=5&bbox=20,51,22,53", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", w.Code)
+	}
+
+	var response struct {
+		Zoom     int               `json:"zoom"`
+		Clusters []cluster.Cluster `json:"clusters"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.Zoom != 5 || len(response.Clusters) != 1 || !reflect.DeepEqual(response.Clusters[0].Sample, []string{"jane_doe", "john_doe"}) {
+		t.Errorf("Unexpected response %+v", response)
+	}
+
+	for _, query := range []string{"", "zoom=23", "zoom=3&bbox=1,2"} {
+		req, _ := http.NewRequest("GET", "/clusters?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %q but got %d", query, w.Code)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
@@ -2,10 +2,16 @@
 package tests
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
+	"go-nauka/geo"
 	db "go-nauka/location-service/db"
 	"go-nauka/location-service/models"
+	"go-nauka/location-service/precision"
+	"reflect"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
@@ -70,7 +76,7 @@ func TestAddLocation(t *testing.T) {
 				WillReturnResult(sqlmock.NewResult(1, 1)).
 				WillReturnError(tt.mockError)
 
-			_, err := db.AddLocation(tt.location)
+			_, err := db.AddLocation(context.Background(), tt.location)
 
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Expected error: %v, got: %v", tt.wantErr, err)
@@ -95,7 +101,7 @@ func TestDBGetLocations(t *testing.T) {
 	mock.ExpectQuery("SELECT \\* FROM location").
 		WillReturnRows(rows)
 
-	locations, err := db.DBGetLocations()
+	locations, err := db.DBGetLocations(context.Background())
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -109,29 +115,179 @@ func TestDBGetLocations(t *testing.T) {
 	}
 }
 
+// expects the query of a search for the users the viewer sees at reduced precision, returning the given rows or none
+func expectReducedSearch(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	if rows == nil {
+		rows = sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m"})
+	}
+	mock.ExpectQuery("HAVING precision_m > 0").WillReturnRows(rows)
+}
+
 // tests the SearchLocations function for finding users within a specified radius
+// haversine searches are paginated by the database, geodesic ones and ones merging reduced positions fetch extra rows
+// and paginate here
 func TestSearchLocations(t *testing.T) {
 	mock, cleanup := setupMockDB(t)
 	defer cleanup()
 
-	lat, lon, radius := 40.7128, -74.0060, 10.0
-	page, pageSize := 1, 5
-	offset := (page - 1) * pageSize
+	center, radius := geo.LatLng{Lat: 40.7128, Lng: -74.0060}, 10.0
+	// shared at 1 km precision 3 km east of the center, listed by the position the viewer sees
+	approximate := geo.Destination(center, 90, 3)
+	approximateShown := precision.Reduce("anna", approximate, 1000)
 
-	rows := sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "distance"}).
-		AddRow("john_doe", 40.7128, -74.0060, "2024-01-16 10:00:00", 5.0).
-		AddRow("jane_doe", 40.7306, -73.9352, "2024-01-16 11:00:00", 8.0)
+	tests := []struct {
+		name      string
+		page      int
+		pageSize  int
+		method    string
+		reduced   bool
+		sqlRadius float64
+		limit     int
+		offset    int
+		expected  []string
+	}{
+		{
+			name:      "Haversine",
+			page:      2,
+			pageSize:  5,
+			method:    geo.MethodHaversine,
+			sqlRadius: radius,
+			limit:     5,
+			offset:    5,
+			expected:  []string{"john_doe", "jane_doe"},
+		},
+		{
+			name:      "Geodesic Second Page",
+			page:      2,
+			pageSize:  1,
+			method:    geo.MethodGeodesic,
+			sqlRadius: radius * 1.01,
+			limit:     52,
+			offset:    0,
+			expected:  []string{"jane_doe"},
+		},
+		{
+			name:      "Reduced Position Merged",
+			page:      1,
+			pageSize:  5,
+			method:    geo.MethodHaversine,
+			reduced:   true,
+			sqlRadius: radius,
+			limit:     5,
+			offset:    0,
+			expected:  []string{"john_doe", "anna", "jane_doe"},
+		},
+	}
 
-	mock.ExpectQuery("SELECT name, latitude, longitude, updated_at,").
-		WithArgs(lat, lon, lat, radius, pageSize, offset).
-		WillReturnRows(rows)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bounds := geo.BoundsAround(center, tt.sqlRadius)
+			wide := bounds.Expand(precision.MaxMeters / 1000)
+			reduced := sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m"})
+			if tt.reduced {
+				reduced.AddRow("anna", approximate.Lat, approximate.Lng, "2024-01-16 11:00:00", 1000)
+			}
+			mock.ExpectQuery("WHERE l.latitude BETWEEN \\? AND \\? AND l.longitude BETWEEN \\? AND \\? AND \\(l.name = \\? OR EXISTS(.|\\n)*HAVING precision_m > 0").
+				WithArgs("viewer", "viewer", "viewer", wide.SouthWest.Lat, wide.NorthEast.Lat, wide.SouthWest.Lng, wide.NorthEast.Lng, "viewer", "viewer", "viewer").
+				WillReturnRows(reduced)
 
-	locations, err := db.SearchLocations(lat, lon, radius, page, pageSize)
-	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+			// rows as the database orders them, far_user stands for a row the geodesic distance drops
+			rows := sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m", "distance"}).
+				AddRow("john_doe", 40.7128, -74.0060, "2024-01-16 10:00:00", 0, 0.0).
+				AddRow("jane_doe", 40.7306, -73.9352, "2024-01-16 11:00:00", 0, 6.2)
+			if tt.method == geo.MethodGeodesic {
+				rows.AddRow("far_user", 40.7306, -73.8000, "2024-01-16 11:00:00", 0, 17.4)
+			}
+
+			mock.ExpectQuery("WHERE l.latitude BETWEEN \\? AND \\? AND l.longitude BETWEEN \\? AND \\? AND \\(l.name = \\? OR EXISTS(.|\\n)*HAVING precision_m = 0 AND distance <= \\?\\s+ORDER BY distance ASC\\s+LIMIT \\? OFFSET \\?").
+				WithArgs("viewer", "viewer", "viewer", center.Lat, center.Lat, center.Lng,
+					bounds.SouthWest.Lat, bounds.NorthEast.Lat, bounds.SouthWest.Lng, bounds.NorthEast.Lng, "viewer", "viewer", "viewer",
+					tt.sqlRadius, tt.limit, tt.offset).
+				WillReturnRows(rows)
+
+			locations, err := db.SearchLocations(context.Background(), center, radius, tt.page, tt.pageSize, tt.method, "viewer")
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+
+			var names []string
+			for _, loc := range locations {
+				names = append(names, loc.Name)
+				if loc.Name == "anna" && loc.Position() != approximateShown {
+					t.Errorf("Expected anna at %v, got %v", approximateShown, loc.Position())
+				}
+			}
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, names)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled DB expectations: %v", err)
+			}
+		})
 	}
+}
 
-	if len(locations) != 2 {
-		t.Errorf("Expected 2 search results, got %d", len(locations))
+// tests that GetLocationsIn decides by the reduced position whether a user is inside the bounds, never by the stored one
+func TestGetLocationsInReducedPosition(t *testing.T) {
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	stored := geo.LatLng{Lat: 40.7128, Lng: -74.0060}
+	shown := precision.Reduce("anna", stored, precision.MaxMeters)
+	around := func(p geo.LatLng) geo.Bounds {
+		return geo.Bounds{SouthWest: geo.LatLng{Lat: p.Lat - 0.001, Lng: p.Lng - 0.001}, NorthEast: geo.LatLng{Lat: p.Lat + 0.001, Lng: p.Lng + 0.001}}
+	}
+	if around(stored).Contains(shown) {
+		t.Fatalf("Expected the reduced position %v to be away from the stored one", shown)
+	}
+
+	tests := []struct {
+		name     string
+		bounds   geo.Bounds
+		expected int
+	}{
+		{name: "Around the Stored Position", bounds: around(stored), expected: 0},
+		{name: "Around the Reduced Position", bounds: around(shown), expected: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the database looks far enough around the bounds to find every reduced position inside them
+			wide := tt.bounds.Expand(precision.MaxMeters / 1000)
+			mock.ExpectQuery("FROM location l WHERE l.latitude BETWEEN").
+				WithArgs("viewer", "viewer", "viewer", wide.SouthWest.Lat, wide.NorthEast.Lat, wide.SouthWest.Lng, wide.NorthEast.Lng, "viewer", "viewer", "viewer").
+				WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m"}).
+					AddRow("anna", stored.Lat, stored.Lng, "2024-01-16 10:00:00", precision.MaxMeters))
+
+			locations, err := db.GetLocationsIn(context.Background(), tt.bounds, "viewer")
+			if err != nil || len(locations) != tt.expected {
+				t.Fatalf("Expected %d locations, got %+v %v", tt.expected, locations, err)
+			}
+			if len(locations) == 1 && locations[0].Position() != shown {
+				t.Errorf("Expected the reduced position %v, got %v", shown, locations[0].Position())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled DB expectations: %v", err)
+			}
+		})
+	}
+}
+
+// tests that the username hashes of the deletion audit are keyed by the audit secret and fit its 64 character column
+func TestHashSubject(t *testing.T) {
+	defer func(secret []byte) { db.AuditSecret = secret }(db.AuditSecret)
+
+	db.AuditSecret = []byte("first-secret")
+	first := db.HashSubject("tomek_prus")
+	if len(first) != 64 || first != db.HashSubject("tomek_prus") {
+		t.Errorf("Expected a stable 64 character hash, got %q", first)
+	}
+	if unkeyed := sha256.Sum256([]byte("tomek_prus")); first == hex.EncodeToString(unkeyed[:]) {
+		t.Errorf("Expected the hash to depend on the audit secret")
+	}
+
+	db.AuditSecret = []byte("other-secret")
+	if other := db.HashSubject("tomek_prus"); other == first {
+		t.Errorf("Expected another hash with another secret, got %s for both", first)
 	}
 }
@@ -0,0 +1,263 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"go-nauka/config"
+	"go-nauka/grpcauth"
+	GRPC "go-nauka/location-service/grpc"
+	pb "go-nauka/location-service/grpc/proto"
+
+	"google.golang.org/grpc"
+)
+
+// history service stub passing the username of every recorded location to a channel
+type recordingHistoryServer struct {
+	pb.UnimplementedLocationHistoryServiceServer
+	recorded chan string
+}
+
+func (s *recordingHistoryServer) RecordLocation(ctx context.Context, req *pb.LocationRequest) (*pb.LocationResponse, error) {
+	s.recorded <- req.Username
+	return &pb.LocationResponse{}, nil
+}
+
+// tests that the client starts without the history service, queues updates while it is down and delivers them in order once it is up
+func TestGRPCClientOutbox(t *testing.T) {
+	// reserve a free port for the history service started later
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	settings := config.GRPC{Target: address, Timeout: config.Duration(500 * time.Millisecond), Token: "service-token", OutboxSize: 2}
+	started := time.Now()
+	client, err := GRPC.NewClient(settings)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	if time.Since(started) > 100*time.Millisecond {
+		t.Errorf("Expected the client to be created without waiting for the history service")
+	}
+
+	for _, username := range []string{"tomek_prus", "jane_doe"} {
+		if err := client.SendLocationUpdate(context.Background(), username, 40.7128, -74.0060, ""); err != nil {
+			t.Fatalf("Expected the update of %s to be queued, got %v", username, err)
+		}
+	}
+	if err := client.SendLocationUpdate(context.Background(), "tomek_prus", 41.5, -73.5, ""); !errors.Is(err, GRPC.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable with a full outbox, got %v", err)
+	}
+	if _, err := client.CheckOutbox(context.Background()); err == nil {
+		t.Errorf("Expected the outbox check to fail with a full outbox")
+	}
+	if _, err := client.DeleteUserHistory(context.Background(), "jane_doe"); !errors.Is(err, GRPC.ErrUnavailable) {
+		t.Errorf("Expected deleting history to fail fast with ErrUnavailable, got %v", err)
+	}
+	if queued := client.Queued(); queued != 1 {
+		t.Fatalf("Expected the queued update of the erased user to be dropped, %d queued", queued)
+	}
+	if detail, err := client.CheckOutbox(context.Background()); err != nil || detail != "1 of 2 updates queued" {
+		t.Errorf("Expected a passing outbox check, got %q %v", detail, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := client.Flush(ctx); err == nil {
+		t.Errorf("Expected Flush to give up while the history service is down")
+	}
+
+	options, err := grpcauth.ServerOptions(grpcauth.Config{Token: "service-token"})
+	if err != nil {
+		t.Fatalf("Failed to configure server: %v", err)
+	}
+	server := grpc.NewServer(options...)
+	history := &recordingHistoryServer{recorded: make(chan string, 2)}
+	pb.RegisterLocationHistoryServiceServer(server, history)
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", address, err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	select {
+	case username := <-history.recorded:
+		if username != "tomek_prus" {
+			t.Errorf("Expected the queued update of tomek_prus, got %s", username)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the queued update to be delivered after the history service came up")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Flush(ctx); err != nil {
+		t.Errorf("Expected Flush to return once the outbox is delivered, got %v", err)
+	}
+	if queued := client.Queued(); queued != 0 {
+		t.Errorf("Expected an empty outbox, %d queued", queued)
+	}
+
+	if err := client.SendLocationUpdate(context.Background(), "tomek_prus", 41.5, -73.5, ""); err != nil {
+		t.Errorf("Expected a direct update once connected, got %v", err)
+	}
+	if username := <-history.recorded; username != "tomek_prus" {
+		t.Errorf("Expected the direct update of tomek_prus, got %s", username)
+	}
+}
+
+// history service stub whose RecordLocation blocks until released, it reports every call as it starts
+type blockingHistoryServer struct {
+	pb.UnimplementedLocationHistoryServiceServer
+	calls   chan string
+	release chan struct{}
+}
+
+func (s *blockingHistoryServer) RecordLocation(ctx context.Context, req *pb.LocationRequest) (*pb.LocationResponse, error) {
+	s.calls <- "record " + req.Username
+	<-s.release
+	return &pb.LocationResponse{}, nil
+}
+
+func (s *blockingHistoryServer) DeleteUserHistory(ctx context.Context, req *pb.DeleteUserHistoryRequest) (*pb.DeleteUserHistoryResponse, error) {
+	s.calls <- "delete " + req.Username
+	return &pb.DeleteUserHistoryResponse{DeletedRows: 1}, nil
+}
+
+// tests that erasing a user waits for a queued update of the user that is already being sent,
+// so the update can't be recorded after the history is erased
+func TestGRPCClientDeleteWaitsForQueuedSend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	client, err := GRPC.NewClient(config.GRPC{Target: address, Timeout: config.Duration(2 * time.Second), Token: "service-token", OutboxSize: 2})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	if err := client.SendLocationUpdate(context.Background(), "tomek_prus", 40.7128, -74.0060, ""); err != nil {
+		t.Fatalf("Expected the update to be queued, got %v", err)
+	}
+
+	options, err := grpcauth.ServerOptions(grpcauth.Config{Token: "service-token"})
+	if err != nil {
+		t.Fatalf("Failed to configure server: %v", err)
+	}
+	server := grpc.NewServer(options...)
+	history := &blockingHistoryServer{calls: make(chan string, 2), release: make(chan struct{})}
+	pb.RegisterLocationHistoryServiceServer(server, history)
+	listener, err = net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", address, err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	select {
+	case call := <-history.calls:
+		if call != "record tomek_prus" {
+			t.Fatalf("Expected the queued update to be sent first, got %s", call)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the queued update to be sent after the history service came up")
+	}
+
+	deleted := make(chan error, 1)
+	go func() {
+		_, err := client.DeleteUserHistory(context.Background(), "tomek_prus")
+		deleted <- err
+	}()
+	select {
+	case call := <-history.calls:
+		t.Fatalf("Expected the deletion to wait for the update being sent, got %s", call)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(history.release)
+	if call := <-history.calls; call != "delete tomek_prus" {
+		t.Errorf("Expected the history to be deleted after the update, got %s", call)
+	}
+	if err := <-deleted; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// tests that an update sent directly holds back later updates of the user and is waited for
+// before the users history is erased
+func TestGRPCClientDeleteWaitsForDirectSend(t *testing.T) {
+	options, err := grpcauth.ServerOptions(grpcauth.Config{Token: "service-token"})
+	if err != nil {
+		t.Fatalf("Failed to configure server: %v", err)
+	}
+	server := grpc.NewServer(options...)
+	history := &blockingHistoryServer{calls: make(chan string, 4), release: make(chan struct{})}
+	pb.RegisterLocationHistoryServiceServer(server, history)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	client, err := GRPC.NewClient(config.GRPC{Target: listener.Addr().String(), Timeout: config.Duration(2 * time.Second), Token: "service-token", OutboxSize: 2})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	sent := make(chan error, 1)
+	go func() { sent <- client.SendLocationUpdate(context.Background(), "tomek_prus", 40.7128, -74.0060, "") }()
+	select {
+	case call := <-history.calls:
+		if call != "record tomek_prus" {
+			t.Fatalf("Expected the direct update to be sent, got %s", call)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the direct update to reach the history service")
+	}
+
+	if err := client.SendLocationUpdate(context.Background(), "tomek_prus", 41.5, -73.5, ""); err != nil {
+		t.Fatalf("Expected the next update to be queued, got %v", err)
+	}
+	deleted := make(chan error, 1)
+	go func() {
+		_, err := client.DeleteUserHistory(context.Background(), "tomek_prus")
+		deleted <- err
+	}()
+	select {
+	case call := <-history.calls:
+		t.Fatalf("Expected nothing to pass the update being sent, got %s", call)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(history.release)
+	if err := <-sent; err != nil {
+		t.Errorf("Unexpected error sending the direct update: %v", err)
+	}
+	// the queued update is either delivered before the erase or dropped by it
+	for call := <-history.calls; call != "delete tomek_prus"; call = <-history.calls {
+		if call != "record tomek_prus" {
+			t.Fatalf("Unexpected call %s", call)
+		}
+	}
+	if err := <-deleted; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	select {
+	case call := <-history.calls:
+		t.Errorf("Expected nothing after the history was erased, got %s", call)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
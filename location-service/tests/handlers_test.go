@@ -3,15 +3,21 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"go-nauka/geo"
+	"go-nauka/jwtauth"
+	DB "go-nauka/location-service/db"
 	GRPC "go-nauka/location-service/grpc"
 	"go-nauka/location-service/handlers"
 	"go-nauka/location-service/models"
+	"go-nauka/location-service/ratelimit"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
@@ -20,16 +26,29 @@ import (
 // simulates grpcs client behavior for testing
 type MockGRPCClient struct {
 	ShouldFail bool
+	Calls      int
+	LastFixID  string
 }
 
 // mocks the behavior of sending a location update over grpc
-func (m *MockGRPCClient) SendLocationUpdate(username string, latitude, longitude float64) error {
+func (m *MockGRPCClient) SendLocationUpdate(ctx context.Context, username string, latitude, longitude float64, fixID string) error {
+	m.Calls++
+	m.LastFixID = fixID
 	if m.ShouldFail {
 		return errors.New("mocked gRPC failure")
 	}
 	return nil
 }
 
+// mocks the behavior of erasing a users history over grpc
+func (m *MockGRPCClient) DeleteUserHistory(ctx context.Context, username string) (int64, error) {
+	m.Calls++
+	if m.ShouldFail {
+		return 0, errors.New("mocked gRPC failure")
+	}
+	return 3, nil
+}
+
 // tests the POST /locations endpoint for adding new locations
 func TestPostLocation(t *testing.T) {
 	gin.SetMode(gin.TestMode)
@@ -37,6 +56,7 @@ func TestPostLocation(t *testing.T) {
 	defer cleanup()
 
 	router := gin.Default()
+	router.Use(asCaller("tomek_prus"))
 	router.POST("/locations", handlers.PostLocation)
 
 	tests := []struct {
@@ -105,23 +125,342 @@ func TestPostLocation(t *testing.T) {
 	}
 }
 
-// tests the GET /locations endpoint for retrieving all stored locations
+// tests that POST /locations with an Idempotency-Key reserves the key, stores the response and replays it for retries
+// a retry while the first request is processed conflicts, a request failing before the write gives the key back
+// and one failing after it stores its response like a coalesced update does
+func TestPostLocationIdempotency(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	router := gin.Default()
+	router.Use(asCaller("tomek_prus"))
+	router.POST("/locations", handlers.PostLocation)
+
+	payload := `{"name":"tomek_prus","latitude":40.7128,"longitude":-74.0060}`
+	stored := "{\n    \"name\": \"tomek_prus\",\n    \"latitude\": 40.7128,\n    \"longitude\": -74.006,\n    \"updated_at\": \"\",\n    \"fix_id\": \"retry-1\"\n}"
+
+	t.Run("First Request Is Stored", func(t *testing.T) {
+		client := &MockGRPCClient{}
+		GRPC.Client = client
+
+		mock.ExpectExec("INSERT INTO idempotency_keys").
+			WithArgs("tomek_prus", "retry-1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT name FROM location WHERE name = ?").
+			WithArgs("tomek_prus").
+			WillReturnError(sql.ErrNoRows)
+		mock.ExpectExec("INSERT INTO location").
+			WithArgs("tomek_prus", 40.7128, -74.0060).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("UPDATE idempotency_keys SET status_code = \\?, response = \\?").
+			WithArgs(http.StatusCreated, stored, "tomek_prus", "retry-1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		req, _ := http.NewRequest("POST", "/locations", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "retry-1")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d but got %d", http.StatusCreated, w.Code)
+		}
+		if client.LastFixID != "retry-1" {
+			t.Errorf("Expected fix id retry-1 to be sent to history service, got %q", client.LastFixID)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Unfulfilled DB expectations: %v", err)
+		}
+	})
+
+	t.Run("Retry Is Replayed", func(t *testing.T) {
+		client := &MockGRPCClient{}
+		GRPC.Client = client
+
+		mock.ExpectExec("INSERT INTO idempotency_keys").
+			WithArgs("tomek_prus", "retry-1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT status_code, response FROM idempotency_keys").
+			WithArgs("tomek_prus", "retry-1", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"status_code", "response"}).AddRow(http.StatusCreated, stored))
+
+		req, _ := http.NewRequest("POST", "/locations", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "retry-1")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status %d but got %d", http.StatusCreated, w.Code)
+		}
+		if w.Body.String() != stored {
+			t.Errorf("Expected the stored response to be replayed, got %s", w.Body.String())
+		}
+		if client.Calls != 0 {
+			t.Errorf("Expected no gRPC calls for a replayed request, got %d", client.Calls)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Unfulfilled DB expectations: %v", err)
+		}
+	})
+
+	t.Run("Retry During The First Request Conflicts", func(t *testing.T) {
+		client := &MockGRPCClient{}
+		GRPC.Client = client
+
+		mock.ExpectExec("INSERT INTO idempotency_keys").
+			WithArgs("tomek_prus", "retry-2", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT status_code, response FROM idempotency_keys").
+			WithArgs("tomek_prus", "retry-2", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"status_code", "response"}).AddRow(0, ""))
+
+		req, _ := http.NewRequest("POST", "/locations", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "retry-2")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected status %d but got %d", http.StatusConflict, w.Code)
+		}
+		if client.Calls != 0 {
+			t.Errorf("Expected no gRPC calls while the first request is processed, got %d", client.Calls)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Unfulfilled DB expectations: %v", err)
+		}
+	})
+
+	t.Run("Failed Request Releases The Key", func(t *testing.T) {
+		GRPC.Client = &MockGRPCClient{}
+
+		mock.ExpectExec("INSERT INTO idempotency_keys").
+			WithArgs("tomek_prus", "retry-3", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT name FROM location WHERE name = ?").
+			WithArgs("tomek_prus").
+			WillReturnError(errors.New("database down"))
+		mock.ExpectExec("DELETE FROM idempotency_keys WHERE name = \\? AND idempotency_key = \\? AND status_code = 0").
+			WithArgs("tomek_prus", "retry-3").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		req, _ := http.NewRequest("POST", "/locations", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "retry-3")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status %d but got %d", http.StatusInternalServerError, w.Code)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Unfulfilled DB expectations: %v", err)
+		}
+	})
+
+	t.Run("Failure After The Write Is Stored", func(t *testing.T) {
+		GRPC.Client = &MockGRPCClient{ShouldFail: true}
+
+		mock.ExpectExec("INSERT INTO idempotency_keys").
+			WithArgs("tomek_prus", "retry-4", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("SELECT name FROM location WHERE name = ?").
+			WithArgs("tomek_prus").
+			WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("tomek_prus"))
+		mock.ExpectExec("UPDATE location SET").
+			WithArgs(40.7128, -74.0060, "tomek_prus").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE idempotency_keys SET status_code = \\?, response = \\?").
+			WithArgs(http.StatusInternalServerError, "{\n    \"error\": \"Failed to notify history service\"\n}", "tomek_prus", "retry-4").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		req, _ := http.NewRequest("POST", "/locations", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "retry-4")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status %d but got %d", http.StatusInternalServerError, w.Code)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Unfulfilled DB expectations: %v", err)
+		}
+	})
+
+	t.Run("Coalesced Update Is Stored", func(t *testing.T) {
+		updates := ratelimit.Updates
+		ratelimit.Updates = &ratelimit.Coalescer{Interval: time.Hour}
+		defer func() { ratelimit.Updates.Forget("tomek_prus"); ratelimit.Updates = updates }()
+		// the first update of the interval is written right away, the one under test is held back
+		ratelimit.Updates.Offer(models.Location{Name: "tomek_prus", Latitude: 41.5, Longitude: -73.5}, func(models.Location) {})
+		GRPC.Client = &MockGRPCClient{}
+
+		mock.ExpectExec("INSERT INTO idempotency_keys").
+			WithArgs("tomek_prus", "retry-5", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE idempotency_keys SET status_code = \\?, response = \\?").
+			WithArgs(http.StatusAccepted, sqlmock.AnyArg(), "tomek_prus", "retry-5").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		req, _ := http.NewRequest("POST", "/locations", bytes.NewBufferString(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "retry-5")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusAccepted {
+			t.Errorf("Expected status %d but got %d", http.StatusAccepted, w.Code)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Unfulfilled DB expectations: %v", err)
+		}
+	})
+}
+
+// tests the DELETE /locations/:name endpoint for erasing a user from both services
+func TestDeleteLocation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	router := gin.Default()
+	router.Use(asCaller("tomek_prus"))
+	router.DELETE("/locations/:name", handlers.DeleteLocation)
+
+	// an update held back by the coalescer must not write the location again after the deletion
+	updates := ratelimit.Updates
+	ratelimit.Updates = &ratelimit.Coalescer{Interval: 20 * time.Millisecond}
+	defer func() { ratelimit.Updates = updates }()
+	written := make(chan models.Location, 1)
+	ratelimit.Updates.Offer(models.Location{Name: "tomek_prus", Latitude: 40.7128, Longitude: -74.0060}, func(loc models.Location) { written <- loc })
+	ratelimit.Updates.Offer(models.Location{Name: "tomek_prus", Latitude: 41.5, Longitude: -73.5}, func(loc models.Location) { written <- loc })
+
+	tests := []struct {
+		name           string
+		grpcShouldFail bool
+		expectedStatus int
+		expectedBody   map[string]interface{}
+	}{
+		{
+			name:           "Successful Deletion",
+			grpcShouldFail: false,
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]interface{}{
+				"name":                  "tomek_prus",
+				"location_rows_deleted": float64(1),
+				"history_rows_deleted":  float64(3),
+			},
+		},
+		{
+			name:           "gRPC Failure",
+			grpcShouldFail: true,
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody: map[string]interface{}{
+				"error": "Failed to erase history",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			GRPC.Client = &MockGRPCClient{ShouldFail: tt.grpcShouldFail}
+
+			mock.ExpectBegin()
+			mock.ExpectExec("DELETE FROM idempotency_keys WHERE name = ?").
+				WithArgs("tomek_prus").
+				WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectExec("DELETE FROM api_key_usernames WHERE username = \\? OR key_id IN \\(SELECT id FROM api_keys WHERE owner = \\?\\)").
+				WithArgs("tomek_prus", "tomek_prus").
+				WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectExec("DELETE FROM api_keys WHERE owner = ?").
+				WithArgs("tomek_prus").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("DELETE FROM proximity_rule_members WHERE username = ?").
+				WithArgs("tomek_prus").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("DELETE FROM proximity_events WHERE user_a = \\? OR user_b = \\?").
+				WithArgs("tomek_prus", "tomek_prus").
+				WillReturnResult(sqlmock.NewResult(0, 4))
+			mock.ExpectExec("DELETE FROM location_shares WHERE owner = \\?").
+				WithArgs("tomek_prus", "tomek_prus", "tomek_prus").
+				WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectExec("DELETE FROM group_members WHERE username = \\?").
+				WithArgs("tomek_prus", "tomek_prus").
+				WillReturnResult(sqlmock.NewResult(0, 3))
+			mock.ExpectExec("DELETE FROM user_groups WHERE owner = ?").
+				WithArgs("tomek_prus").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("DELETE FROM location WHERE name = ?").
+				WithArgs("tomek_prus").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			if !tt.grpcShouldFail {
+				mock.ExpectExec("INSERT INTO user_deletion_audit").
+					WithArgs(DB.HashSubject("tomek_prus"), int64(1), int64(3)).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			req, _ := http.NewRequest("DELETE", "/locations/tomek_prus", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d but got %d", tt.expectedStatus, w.Code)
+			}
+
+			var response map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			for key, expected := range tt.expectedBody {
+				if response[key] != expected {
+					t.Errorf("Expected %s to be %v, got %v", key, expected, response[key])
+				}
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled DB expectations: %v", err)
+			}
+		})
+	}
+
+	select {
+	case loc := <-written:
+		t.Errorf("Expected the held back update to be dropped, got %v", loc)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// tests the GET /locations endpoint for retrieving the locations visible to the caller
 func TestGetLocations(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	mock, cleanup := setupMockDB(t)
 	defer cleanup()
 
 	router := gin.Default()
+	router.Use(jwtauth.Middleware())
 	router.GET("/locations", handlers.GetLocations)
 
-	rows := sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at"}).
-		AddRow("tomek_prus", 40.7128, -74.0060, "2024-01-16 10:00:00").
-		AddRow("jane_doe", 34.0522, -118.2437, "2024-01-16 11:00:00")
+	rows := sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m"}).
+		AddRow("tomek_prus", 40.7128, -74.0060, "2024-01-16 10:00:00", 0).
+		AddRow("jane_doe", 34.0522, -118.2437, "2024-01-16 11:00:00", 0)
 
-	mock.ExpectQuery("SELECT \\* FROM location").
+	mock.ExpectQuery("FROM location l WHERE \\(l.name = \\? OR EXISTS").
+		WithArgs("tomek_prus", "tomek_prus", "tomek_prus", "tomek_prus", "tomek_prus", "tomek_prus").
 		WillReturnRows(rows)
 
 	req, _ := http.NewRequest("GET", "/locations", nil)
+	authorize(req, "tomek_prus", "")
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
@@ -143,18 +482,21 @@ func TestSearchLocationsHandler(t *testing.T) {
 	router := gin.Default()
 	router.GET("/search", handlers.SearchLocationsHandler)
 
-	lat, lon, radius, page, pageSize := 40.7128, -74.0060, 10.0, 1, 5
-	offset := (page - 1) * pageSize
+	bounds := geo.BoundsAround(geo.LatLng{Lat: 40.7128, Lng: -74.0060}, 10.0*1.01)
 
-	rows := sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "distance"}).
-		AddRow("tomek_prus", 40.7128, -74.0060, "2024-01-16 10:00:00", 5.0).
-		AddRow("jane_doe", 40.7306, -73.9352, "2024-01-16 11:00:00", 8.0)
+	rows := sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m", "distance"}).
+		AddRow("tomek_prus", 40.7128, -74.0060, "2024-01-16 10:00:00", 0, 0.0).
+		AddRow("jane_doe", 40.7306, -73.9352, "2024-01-16 11:00:00", 0, 6.2)
 
-	mock.ExpectQuery("SELECT name, latitude, longitude, updated_at,").
-		WithArgs(lat, lon, lat, radius, pageSize, offset).
+	expectReducedSearch(mock, nil)
+	// a geodesic search fetches the first page and the extra rows
+	mock.ExpectQuery("SELECT l.name, l.latitude, l.longitude, l.updated_at").
+		WithArgs("", "", "", 40.7128, 40.7128, -74.0060,
+			bounds.SouthWest.Lat, bounds.NorthEast.Lat, bounds.SouthWest.Lng, bounds.NorthEast.Lng, "", "", "",
+			10.0*1.01, 55, 0).
 		WillReturnRows(rows)
 
-	req, _ := http.NewRequest("GET", "/search?latitude=40.7128&longitude=-74.0060&radius=10&page=1&page_size=5", nil)
+	req, _ := http.NewRequest("GET", "/search?latitude=40.7128&longitude=-74.0060&radius=10&page=1&page_size=5&method=geodesic", nil)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
@@ -162,6 +504,14 @@ func TestSearchLocationsHandler(t *testing.T) {
 		t.Errorf("Expected status 200 but got %d", w.Code)
 	}
 
+	req, _ = http.NewRequest("GET", "/search?latitude=40.7128&longitude=-74.0060&radius=10&method=flat", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown method but got %d", w.Code)
+	}
+
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("Unfulfilled DB expectations: %v", err)
 	}
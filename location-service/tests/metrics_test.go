@@ -0,0 +1,70 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-nauka/geo"
+	GRPC "go-nauka/location-service/grpc"
+	"go-nauka/location-service/handlers"
+	"go-nauka/metrics"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+// tests that ingest, active users, search result sizes and query latencies are exported
+func TestLocationMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	GRPC.Client = &MockGRPCClient{}
+
+	router := gin.Default()
+	router.POST("/locations", asCaller("tomek_prus"), handlers.PostLocation)
+	router.GET("/search", handlers.SearchLocationsHandler)
+	router.GET("/metrics", metrics.Handler())
+
+	mock.ExpectQuery("SELECT name FROM location WHERE name = ?").WithArgs("tomek_prus").WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO location").WithArgs("tomek_prus", 40.7128, -74.0060).WillReturnResult(sqlmock.NewResult(1, 1))
+	bounds := geo.BoundsAround(geo.LatLng{Lat: 40.7128, Lng: -74.0060}, 10.0)
+	expectReducedSearch(mock, nil)
+	mock.ExpectQuery("SELECT l.name, l.latitude, l.longitude, l.updated_at").
+		WithArgs("", "", "", 40.7128, 40.7128, -74.0060,
+			bounds.SouthWest.Lat, bounds.NorthEast.Lat, bounds.SouthWest.Lng, bounds.NorthEast.Lng, "", "", "",
+			10.0, 10, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m", "distance"}).
+			AddRow("tomek_prus", 40.7128, -74.0060, "2024-01-16 10:00:00", 0, 0.0))
+
+	req, _ := http.NewRequest("POST", "/locations", bytes.NewBufferString(`{"name":"tomek_prus","latitude":40.7128,"longitude":-74.0060}`))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	req, _ = http.NewRequest("GET", "/search?latitude=40.7128&longitude=-74.0060&radius=10", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	scraped := w.Body.String()
+	for _, expected := range []string{
+		`location_updates_total{result="stored"}`,
+		`location_search_results_bucket{le="1"}`,
+		`db_query_duration_seconds_count{function="AddLocation"}`,
+		`db_query_duration_seconds_count{function="SearchLocations"}`,
+	} {
+		if !strings.Contains(scraped, expected) {
+			t.Errorf("Expected %s in the metrics", expected)
+		}
+	}
+	if strings.Contains(scraped, "location_active_users 0\n") || !strings.Contains(scraped, "location_active_users ") {
+		t.Errorf("Expected tomek_prus to count as an active user")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-nauka/geo"
+	"go-nauka/jwtauth"
+	"go-nauka/location-service/cluster"
+	"go-nauka/location-service/handlers"
+	"go-nauka/location-service/models"
+	"go-nauka/location-service/precision"
+	"go-nauka/location-service/proximity"
+	"go-nauka/location-service/tiles"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+// tests that reduced positions stay within their grid cell and never change between calls
+func TestReduce(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	for _, level := range []string{precision.Street, precision.Neighborhood, precision.City} {
+		meters, err := precision.Meters(level)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", level, err)
+		}
+		// half the diagonal of a cell
+		maxKm := float64(meters) * 0.75 / 1000
+
+		for i := 0; i < 1000; i++ {
+			p := geo.LatLng{Lat: random.Float64()*160 - 80, Lng: random.Float64()*360 - 180}
+			reduced := precision.Reduce("john_doe", p, meters)
+
+			if d := geo.Haversine(p, reduced); d > maxKm {
+				t.Fatalf("%s: %v reduced to %v is %.3f km away", level, p, reduced, d)
+			}
+			if again := precision.Reduce("john_doe", p, meters); again != reduced {
+				t.Fatalf("%s: expected the same position on every call, got %v and %v", level, reduced, again)
+			}
+			if nearby := precision.Reduce("john_doe", reduced, meters); nearby != reduced {
+				t.Fatalf("%s: expected every point of a cell to snap to its center, got %v and %v", level, reduced, nearby)
+			}
+		}
+	}
+
+	p := geo.LatLng{Lat: 52.2297, Lng: 21.0122}
+	if reduced := precision.Reduce("john_doe", p, 0); reduced != p {
+		t.Errorf("Expected the exact position, got %v", reduced)
+	}
+	if precision.Reduce("john_doe", p, 1000) == precision.Reduce("jane_doe", p, 1000) {
+		t.Errorf("Expected the grids of different users to be offset")
+	}
+}
+
+// tests the conversions between levels and grid sizes
+func TestPrecisionLevels(t *testing.T) {
+	for level, meters := range map[string]int{"": 0, "exact": 0, "100m": 100, "1km": 1000, "city": 10000} {
+		got, err := precision.Meters(level)
+		if err != nil || got != meters {
+			t.Errorf("Expected %d meters for %q, got %d %v", meters, level, got, err)
+		}
+	}
+	if _, err := precision.Meters("10m"); err == nil {
+		t.Errorf("Expected an error for an unknown level")
+	}
+
+	for meters, level := range map[int]string{0: "exact", 100: "100m", 500: "1km", 1000: "1km", 10000: "city", 50000: "city"} {
+		if got := precision.LevelFor(meters); got != level {
+			t.Errorf("Expected %s for %d meters, got %s", level, meters, got)
+		}
+	}
+}
+
+// a user shared with the caller at 1 km precision and the position the caller should see
+var (
+	approximate        = models.Location{Name: "jane_doe", Latitude: 52.2297, Longitude: 21.0122, UpdatedAt: "2024-01-16 10:00:00"}
+	approximatePrecise = approximate.Position()
+	approximateShown   = precision.Reduce(approximate.Name, approximate.Position(), 1000)
+)
+
+// returns rows of visibleColumns holding the approximate user
+func approximateRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m"}).
+		AddRow(approximate.Name, approximate.Latitude, approximate.Longitude, approximate.UpdatedAt, 1000)
+}
+
+// expects a search finding the approximate user among the reduced positions and no exact ones
+func expectApproximateSearch(mock sqlmock.Sqlmock) {
+	expectReducedSearch(mock, approximateRows())
+	mock.ExpectQuery("HAVING precision_m = 0").WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m", "distance"}))
+}
+
+// checks that a location is shown at the reduced position
+func checkApproximate(t *testing.T, path string, loc models.Location) {
+	t.Helper()
+	if loc.Position() != approximateShown || loc.Precision != precision.Neighborhood {
+		t.Errorf("%s: expected %v at 1km precision, got %+v", path, approximateShown, loc)
+	}
+	if loc.Position() == approximatePrecise {
+		t.Errorf("%s: exact position leaked", path)
+	}
+}
+
+// tests that every read path shows a location shared at 1 km precision at the reduced position
+func TestReducedPrecisionReadPaths(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	cluster.Default.Load([]models.Location{approximate})
+	defer cluster.Default.Load(nil)
+
+	router := gin.Default()
+	router.Use(jwtauth.Middleware())
+	router.GET("/locations", handlers.GetLocations)
+	router.GET("/search", handlers.SearchLocationsHandler)
+	router.GET("/clusters", handlers.GetClusters)
+
+	get := func(path string) []byte {
+		req, _ := http.NewRequest("GET", path, nil)
+		authorize(req, "john_doe", "")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200 but got %d", path, w.Code)
+		}
+		return w.Body.Bytes()
+	}
+
+	// repeated requests return the same point, so averaging them does not get closer to the true one
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("SELECT l.name, l.latitude, l.longitude, l.updated_at, CASE").WillReturnRows(approximateRows())
+		var locations []models.Location
+		if err := json.Unmarshal(get("/locations"), &locations); err != nil || len(locations) != 1 {
+			t.Fatalf("Unexpected locations %+v %v", locations, err)
+		}
+		checkApproximate(t, "/locations", locations[0])
+	}
+
+	expectApproximateSearch(mock)
+	var found []models.Location
+	if err := json.Unmarshal(get("/search?latitude=52.23&longitude=21.01&radius=5"), &found); err != nil || len(found) != 1 {
+		t.Fatalf("Unexpected search result %+v %v", found, err)
+	}
+	checkApproximate(t, "/search", found[0])
+
+	mock.ExpectQuery("SELECT l.name, CASE").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "precision_m"}).AddRow(approximate.Name, 1000))
+	var response struct {
+		Clusters []cluster.Cluster `json:"clusters"`
+	}
+	if err := json.Unmarshal(get("/clusters?zoom=20"), &response); err != nil || len(response.Clusters) != 1 {
+		t.Fatalf("Unexpected clusters %+v %v", response, err)
+	}
+	if center := response.Clusters[0].Center; center != approximateShown {
+		t.Errorf("/clusters: expected %v, got %v", approximateShown, center)
+	}
+
+	tile := geo.TileFor(approximateShown, 16)
+	mock.ExpectQuery("SELECT l.name, l.latitude, l.longitude, l.updated_at, CASE").WillReturnRows(approximateRows())
+	data, err := tiles.Render(context.Background(), tile, "john_doe")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	shown := approximate
+	shown.Latitude, shown.Longitude = approximateShown.Lat, approximateShown.Lng
+	expected, _ := tiles.Build(tile, []models.Location{shown})
+	exact, _ := tiles.Build(tile, []models.Location{approximate})
+	if string(data) != string(expected) || string(data) == string(exact) {
+		t.Errorf("tiles: expected the feature at the reduced position")
+	}
+
+	// john_doe shares with jane_doe at 100 m, the distance is taken between both reduced positions on the 1 km grid
+	engine := proximity.NewEngine()
+	engine.AddRule(models.ProximityRule{ID: 4, Members: []string{"john_doe", "jane_doe"}, Accepted: []string{"john_doe", "jane_doe"}, ThresholdKm: 2, ExitKm: 2.5})
+	john := models.Location{Name: "john_doe", Latitude: 52.2324, Longitude: 21.0122}
+	distance := math.Round(geo.Haversine(precision.Reduce(john.Name, john.Position(), 100), approximateShown))
+	mock.ExpectQuery("FROM location l WHERE l.name IN").WithArgs("john_doe", "john_doe", "john_doe", "jane_doe", "john_doe", "john_doe", "john_doe").
+		WillReturnRows(approximateRows())
+	mock.ExpectQuery("SELECT CASE WHEN l.name").WillReturnRows(sqlmock.NewRows([]string{"precision_m"}).AddRow(100))
+	mock.ExpectExec("INSERT INTO proximity_events").
+		WithArgs(int64(4), proximity.Entered, "jane_doe", "john_doe", distance).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	events, err := engine.Check(context.Background(), john)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("Unexpected proximity events %+v %v", events, err)
+	}
+	if exact := geo.Haversine(john.Position(), approximatePrecise); events[0].DistanceKm == exact {
+		t.Errorf("proximity: exact distance %v leaked", exact)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-nauka/geo"
+	"go-nauka/jwtauth"
+	"go-nauka/location-service/handlers"
+	"go-nauka/location-service/models"
+	"go-nauka/location-service/proximity"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+// expects the lookup of the rule members of a proximity check returning the given locations
+func expectMembers(mock sqlmock.Sqlmock, locations ...models.Location) {
+	rows := sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m"})
+	for _, loc := range locations {
+		rows.AddRow(loc.Name, loc.Latitude, loc.Longitude, "2024-01-16 10:00:00", 0)
+	}
+	mock.ExpectQuery("FROM location l WHERE l.name IN").WillReturnRows(rows)
+}
+
+// expects the check whether the mover shares their location with a member found
+func expectShared(mock sqlmock.Sqlmock, owner, viewer string, shared bool) {
+	rows := sqlmock.NewRows([]string{"precision_m"})
+	if shared {
+		rows.AddRow(0)
+	}
+	mock.ExpectQuery("SELECT CASE WHEN l.name").WithArgs(viewer, viewer, viewer, owner, viewer, viewer, viewer).WillReturnRows(rows)
+}
+
+// tests that a pair enters at the threshold and only leaves beyond the exit distance
+func TestProximityHysteresis(t *testing.T) {
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	engine := proximity.NewEngine()
+	engine.AddRule(models.ProximityRule{ID: 7, Name: "friends", Members: []string{"john_doe", "jane_doe"}, Accepted: []string{"john_doe", "jane_doe"}, ThresholdKm: 1, ExitKm: 1.5})
+
+	jane := models.Location{Name: "jane_doe", Latitude: 52.2297, Longitude: 21.0122}
+	johnAt := func(km float64) models.Location {
+		p := geo.Destination(jane.Position(), 90, km)
+		return models.Location{Name: "john_doe", Latitude: p.Lat, Longitude: p.Lng}
+	}
+
+	steps := []struct {
+		name     string
+		distance float64
+		visible  bool
+		expected string
+		active   int
+	}{
+		{name: "Far Away", distance: 3, visible: true, expected: "", active: 0},
+		{name: "Within Threshold", distance: 0.8, visible: true, expected: proximity.Entered, active: 1},
+		{name: "Between Threshold and Exit", distance: 1.2, visible: true, expected: "", active: 1},
+		{name: "Back Inside", distance: 0.9, visible: true, expected: "", active: 1},
+		{name: "Beyond Exit", distance: 1.6, visible: true, expected: proximity.Left, active: 0},
+		{name: "Between Threshold and Exit Again", distance: 1.2, visible: true, expected: "", active: 0},
+		{name: "Within Threshold Again", distance: 0.5, visible: true, expected: proximity.Entered, active: 1},
+		{name: "No Longer Visible", distance: 0.5, visible: false, expected: proximity.Left, active: 0},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if step.visible {
+				expectMembers(mock, jane)
+				expectShared(mock, "john_doe", "jane_doe", true)
+			} else {
+				expectMembers(mock)
+			}
+			if step.expected != "" {
+				mock.ExpectExec("INSERT INTO proximity_events").
+					WithArgs(int64(7), step.expected, "jane_doe", "john_doe", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			}
+
+			events, err := engine.Check(context.Background(), johnAt(step.distance))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if step.expected == "" && len(events) != 0 {
+				t.Errorf("Expected no events, got %+v", events)
+			}
+			if step.expected != "" && (len(events) != 1 || events[0].Type != step.expected) {
+				t.Errorf("Expected a %s event, got %+v", step.expected, events)
+			}
+			if active := engine.Active("john_doe"); len(active) != step.active {
+				t.Errorf("Expected %d active pairs, got %+v", step.active, active)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled DB expectations: %v", err)
+			}
+		})
+	}
+}
+
+// tests that every other member of a group rule is checked and unrelated users are skipped
+func TestProximityGroup(t *testing.T) {
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	engine := proximity.NewEngine()
+	engine.AddRule(models.ProximityRule{ID: 1, Members: []string{"a", "b", "c"}, Accepted: []string{"a", "b", "c"}, ThresholdKm: 2, ExitKm: 2.5})
+
+	if events, err := engine.Check(context.Background(), models.Location{Name: "stranger", Latitude: 10, Longitude: 10}); err != nil || events != nil {
+		t.Errorf("Expected users without rules to be skipped, got %v %v", events, err)
+	}
+
+	expectMembers(mock,
+		models.Location{Name: "b", Latitude: 50.001, Longitude: 20},
+		models.Location{Name: "c", Latitude: 50.002, Longitude: 20})
+	expectShared(mock, "a", "b", true)
+	expectShared(mock, "a", "c", true)
+	mock.ExpectExec("INSERT INTO proximity_events").WithArgs(int64(1), proximity.Entered, "a", "b", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO proximity_events").WithArgs(int64(1), proximity.Entered, "a", "c", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(2, 1))
+
+	events, err := engine.Check(context.Background(), models.Location{Name: "a", Latitude: 50, Longitude: 20})
+	if err != nil || len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %+v %v", events, err)
+	}
+
+	engine.RemoveUser("c")
+	if active := engine.Active(""); len(active) != 1 || active[0].Users != [2]string{"a", "b"} {
+		t.Errorf("Expected only the pair a-b to stay active, got %+v", active)
+	}
+	engine.RemoveRule(1)
+	if active := engine.Active(""); len(active) != 0 {
+		t.Errorf("Expected no active pairs after removing the rule, got %+v", active)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests validation of proximity rules
+func TestValidateProximityRule(t *testing.T) {
+	rule := models.ProximityRule{Members: []string{"a", "b"}, ThresholdKm: 2}
+	if err := proximity.Validate(&rule); err != nil || rule.ExitKm != 2.5 {
+		t.Errorf("Expected a valid rule with the default exit distance, got %+v %v", rule, err)
+	}
+
+	invalid := []models.ProximityRule{
+		{Members: []string{"a"}, ThresholdKm: 1},
+		{Members: []string{"a", "a"}, ThresholdKm: 1},
+		{Members: []string{"a", "b"}, ThresholdKm: 0},
+		{Members: []string{"a", "b"}, ThresholdKm: 2, ExitKm: 1},
+	}
+	for _, rule := range invalid {
+		if err := proximity.Validate(&rule); err == nil {
+			t.Errorf("Expected an error for %+v", rule)
+		}
+	}
+}
+
+// tests creating a rule over HTTP and reading it back
+func TestProximityRuleHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	defer func() { proximity.Default = proximity.NewEngine() }()
+
+	router := gin.Default()
+	router.Use(asCaller("john_doe"))
+	router.POST("/proximity/rules", handlers.CreateProximityRule)
+	router.GET("/proximity/rules", handlers.GetProximityRules)
+	router.DELETE("/proximity/rules/:id", handlers.DeleteProximityRule)
+	router.GET("/proximity/state", handlers.GetProximityState)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO proximity_rules").WithArgs("friends", 1.0, 1.25).WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectExec("INSERT INTO proximity_rule_members").WithArgs(int64(3), "john_doe", true).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO proximity_rule_members").WithArgs(int64(3), "jane_doe", false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	body, _ := json.Marshal(map[string]interface{}{"name": "friends", "members": []string{"john_doe", "jane_doe"}, "accepted": []string{"john_doe", "jane_doe"}, "threshold_km": 1})
+	req, _ := http.NewRequest("POST", "/proximity/rules", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201 but got %d: %s", w.Code, w.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/proximity/rules", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var rules []models.ProximityRule
+	if err := json.Unmarshal(w.Body.Bytes(), &rules); err != nil || len(rules) != 1 || rules[0].ID != 3 || rules[0].ExitKm != 1.25 {
+		t.Errorf("Unexpected rules %+v %v", rules, err)
+	}
+	if len(rules) == 1 && (len(rules[0].Accepted) != 1 || rules[0].Accepted[0] != "john_doe") {
+		t.Errorf("Expected only the creator to have accepted the rule, got %+v", rules[0].Accepted)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"members": []string{"john_doe"}, "threshold_km": 1})
+	req, _ = http.NewRequest("POST", "/proximity/rules", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a single member but got %d", w.Code)
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{"members": []string{"jane_doe", "anna"}, "threshold_km": 1})
+	req, _ = http.NewRequest("POST", "/proximity/rules", bytes.NewBuffer(body))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a rule without the caller but got %d", w.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/proximity/state", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Errorf("Expected an empty state, got %d %s", w.Code, w.Body.String())
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM proximity_rule_members WHERE rule_id = ?").WithArgs(int64(3)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM proximity_rules WHERE id = ?").WithArgs(int64(3)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req, _ = http.NewRequest("DELETE", "/proximity/rules/3", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || len(proximity.Default.Rules()) != 0 {
+		t.Errorf("Expected the rule to be deleted, got %d %+v", w.Code, proximity.Default.Rules())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests that a rule only applies to members that accepted it and to pairs sharing their locations with each other
+func TestProximityConsent(t *testing.T) {
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	engine := proximity.NewEngine()
+	engine.AddRule(models.ProximityRule{ID: 2, Members: []string{"anna", "jane_doe"}, Accepted: []string{"anna"}, ThresholdKm: 1, ExitKm: 1.25})
+	jane := models.Location{Name: "jane_doe", Latitude: 40.7128, Longitude: -74.0060}
+	anna := models.Location{Name: "anna", Latitude: 40.7128, Longitude: -74.0060}
+
+	if events, err := engine.Check(context.Background(), jane); err != nil || events != nil {
+		t.Errorf("Expected a rule jane_doe did not accept to be skipped, got %v %v", events, err)
+	}
+
+	// anna moving next to jane_doe looks nobody up while jane_doe has not accepted
+	if events, err := engine.Check(context.Background(), anna); err != nil || len(events) != 0 {
+		t.Errorf("Expected no events before jane_doe accepts, got %v %v", events, err)
+	}
+
+	if engine.Accept(2, "stranger") {
+		t.Errorf("Expected users outside the rule not to be able to accept it")
+	}
+	if !engine.Accept(2, "jane_doe") {
+		t.Fatalf("Expected jane_doe to accept the rule")
+	}
+
+	// jane_doe shares with anna but anna does not share back
+	expectMembers(mock, anna)
+	expectShared(mock, "jane_doe", "anna", false)
+	if events, err := engine.Check(context.Background(), jane); err != nil || len(events) != 0 {
+		t.Errorf("Expected no events while jane_doe does not share with anna, got %v %v", events, err)
+	}
+	if active := engine.Active("anna"); len(active) != 0 {
+		t.Errorf("Expected no active pairs, got %+v", active)
+	}
+
+	expectMembers(mock, anna)
+	expectShared(mock, "jane_doe", "anna", true)
+	mock.ExpectExec("INSERT INTO proximity_events").WithArgs(int64(2), proximity.Entered, "anna", "jane_doe", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	if events, err := engine.Check(context.Background(), jane); err != nil || len(events) != 1 {
+		t.Errorf("Expected the pair to enter once both share, got %v %v", events, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests that callers outside a rule neither see nor delete it unless they have the admin scope
+func TestProximityRuleAccess(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	defer func() { proximity.Default = proximity.NewEngine() }()
+
+	proximity.Default = proximity.NewEngine()
+	proximity.Default.AddRule(models.ProximityRule{ID: 5, Members: []string{"john_doe", "jane_doe"}, Accepted: []string{"john_doe"}, ThresholdKm: 1, ExitKm: 1.25})
+	proximity.Default.AddRule(models.ProximityRule{ID: 6, Members: []string{"anna", "jane_doe"}, Accepted: []string{"anna"}, ThresholdKm: 1, ExitKm: 1.25})
+
+	router := gin.Default()
+	router.Use(jwtauth.Middleware())
+	router.GET("/proximity/rules", handlers.GetProximityRules)
+	router.DELETE("/proximity/rules/:id", handlers.DeleteProximityRule)
+
+	send := func(method, path, subject, scope string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		authorize(req, subject, scope)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		subject  string
+		scope    string
+		expected []int64
+	}{
+		{name: "Member", subject: "john_doe", expected: []int64{5}},
+		{name: "Member of Both", subject: "jane_doe", expected: []int64{5, 6}},
+		{name: "Stranger", subject: "stranger", expected: []int64{}},
+		{name: "Admin", subject: "stranger", scope: jwtauth.ScopeAdmin, expected: []int64{5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules []models.ProximityRule
+			w := send("GET", "/proximity/rules", tt.subject, tt.scope)
+			if err := json.Unmarshal(w.Body.Bytes(), &rules); err != nil || len(rules) != len(tt.expected) {
+				t.Fatalf("Expected rules %v, got %s %v", tt.expected, w.Body.String(), err)
+			}
+			for i, rule := range rules {
+				if rule.ID != tt.expected[i] {
+					t.Errorf("Expected rules %v, got %+v", tt.expected, rules)
+				}
+			}
+		})
+	}
+
+	if w := send("DELETE", "/proximity/rules/6", "john_doe", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a rule without the caller but got %d", w.Code)
+	}
+	if w := send("DELETE", "/proximity/rules/9", "john_doe", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing rule but got %d", w.Code)
+	}
+	if _, found := proximity.Default.Rule(6); !found {
+		t.Errorf("Expected the rule to be kept")
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM proximity_rule_members WHERE rule_id = ?").WithArgs(int64(6)).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM proximity_rules WHERE id = ?").WithArgs(int64(6)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if w := send("DELETE", "/proximity/rules/6", "stranger", jwtauth.ScopeAdmin); w.Code != http.StatusOK {
+		t.Errorf("Expected admins to delete any rule, got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests that the engine is not locked while a check waits for the database, so checks of other users aren't held up
+func TestProximityCheckUnlocked(t *testing.T) {
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	engine := proximity.NewEngine()
+	engine.AddRule(models.ProximityRule{ID: 8, Members: []string{"john_doe", "jane_doe"}, Accepted: []string{"john_doe", "jane_doe"}, ThresholdKm: 1, ExitKm: 1.25})
+	mock.ExpectQuery("FROM location l WHERE l.name IN").
+		WillDelayFor(300 * time.Millisecond).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m"}))
+
+	checked := make(chan error, 1)
+	go func() {
+		_, err := engine.Check(context.Background(), models.Location{Name: "john_doe", Latitude: 40.7128, Longitude: -74.0060})
+		checked <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	started := time.Now()
+	engine.Accept(8, "jane_doe")
+	if waited := time.Since(started); waited > 100*time.Millisecond {
+		t.Errorf("Expected the engine to stay unlocked during the lookup, waited %v", waited)
+	}
+	if err := <-checked; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
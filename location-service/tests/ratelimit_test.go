@@ -0,0 +1,290 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-nauka/location-service/auth"
+	GRPC "go-nauka/location-service/grpc"
+	"go-nauka/location-service/handlers"
+	"go-nauka/location-service/models"
+	"go-nauka/location-service/ratelimit"
+	"go-nauka/location-service/routes"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+// tests that a bucket allows a burst, then refills at the configured rate per key
+func TestLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 16, 10, 0, 0, 0, time.UTC)
+	limiter := ratelimit.NewLimiter(2, 3)
+	limiter.Now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("user:tomek_prus"); !ok {
+			t.Fatalf("Expected call %d of the burst to be allowed", i+1)
+		}
+	}
+	ok, retryAfter := limiter.Allow("user:tomek_prus")
+	if ok || retryAfter != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms after the burst, got %v %v", ok, retryAfter)
+	}
+	if ok, _ := limiter.Allow("user:jane_doe"); !ok {
+		t.Errorf("Expected another user to have their own budget")
+	}
+
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("user:tomek_prus"); !ok {
+			t.Errorf("Expected refilled call %d to be allowed", i+1)
+		}
+	}
+	if ok, _ := limiter.Allow("user:tomek_prus"); ok {
+		t.Errorf("Expected the refilled tokens to be used up")
+	}
+}
+
+// tests the 429 response with Retry-After and the separate budgets of writes and searches
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	writes, searches := ratelimit.NewLimiter(0.1, 1), ratelimit.NewLimiter(0.1, 2)
+
+	router := gin.Default()
+	router.Use(asCaller("tomek_prus"))
+	router.POST("/locations", ratelimit.Middleware(writes), func(c *gin.Context) { c.Status(http.StatusCreated) })
+	router.GET("/search", ratelimit.Middleware(searches), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{method: "POST", path: "/locations", expectedStatus: http.StatusCreated},
+		{method: "POST", path: "/locations", expectedStatus: http.StatusTooManyRequests},
+		{method: "GET", path: "/search", expectedStatus: http.StatusOK},
+		{method: "GET", path: "/search", expectedStatus: http.StatusOK},
+		{method: "GET", path: "/search", expectedStatus: http.StatusTooManyRequests},
+	}
+
+	for i, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.expectedStatus {
+			t.Errorf("Request %d: expected status %d but got %d", i+1, tt.expectedStatus, w.Code)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "10" {
+			t.Errorf("Request %d: expected Retry-After 10 but got %q", i+1, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+// tests that callers over budget are rejected before their API key is looked up, anonymous ones by client IP
+func TestRateLimitBeforeAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	writes := ratelimit.Writes
+	ratelimit.Writes = ratelimit.NewLimiter(0.1, 1)
+	defer func() { ratelimit.Writes = writes }()
+	router := routes.SetupRouter()
+
+	tests := []struct {
+		name           string
+		apiKey         string
+		lookedUp       bool
+		expectedStatus int
+	}{
+		{name: "Unknown Key", apiKey: "lsk_unknown", lookedUp: true, expectedStatus: http.StatusUnauthorized},
+		{name: "Same Key Over Budget", apiKey: "lsk_unknown", expectedStatus: http.StatusTooManyRequests},
+		{name: "Other Key", apiKey: "lsk_other", lookedUp: true, expectedStatus: http.StatusUnauthorized},
+		{name: "Anonymous", expectedStatus: http.StatusUnauthorized},
+		{name: "Anonymous Over Budget", expectedStatus: http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.lookedUp {
+				mock.ExpectQuery("FROM api_keys k").WithArgs(auth.HashAPIKey(tt.apiKey)).WillReturnRows(sqlmock.NewRows(apiKeyColumns))
+			}
+
+			req, _ := http.NewRequest("POST", "/locations", bytes.NewBufferString(`{"name":"van_1","latitude":40.7128,"longitude":-74.0060}`))
+			if tt.apiKey != "" {
+				req.Header.Set(auth.APIKeyHeader, tt.apiKey)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d but got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled DB expectations: %v", err)
+			}
+		})
+	}
+}
+
+// tests that updates within the minimum interval are accepted and only the latest of them is written afterwards
+func TestCoalescedUpdates(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	updates := ratelimit.Updates
+	ratelimit.Updates = &ratelimit.Coalescer{Interval: 100 * time.Millisecond}
+	defer func() { ratelimit.Updates = updates }()
+	client := &notifyingGRPCClient{sent: make(chan float64, 3)}
+	GRPC.Client = client
+
+	router := gin.Default()
+	router.Use(asCaller("tomek_prus"))
+	router.POST("/locations", handlers.PostLocation)
+
+	mock.ExpectQuery("SELECT name FROM location WHERE name = ?").WithArgs("tomek_prus").WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO location").WithArgs("tomek_prus", 40.7128, -74.0060).WillReturnResult(sqlmock.NewResult(1, 1))
+	// only the last of the held back updates reaches the database
+	mock.ExpectQuery("SELECT name FROM location WHERE name = ?").WithArgs("tomek_prus").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("tomek_prus"))
+	mock.ExpectExec("UPDATE location SET").WithArgs(41.5, -73.5, "tomek_prus").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	for i, payload := range []string{
+		`{"name":"tomek_prus","latitude":40.7128,"longitude":-74.0060}`,
+		`{"name":"tomek_prus","latitude":41.0,"longitude":-74.0}`,
+		`{"name":"tomek_prus","latitude":41.5,"longitude":-73.5}`,
+	} {
+		req, _ := http.NewRequest("POST", "/locations", bytes.NewBufferString(payload))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		expectedStatus := http.StatusAccepted
+		if i == 0 {
+			expectedStatus = http.StatusCreated
+		}
+		if w.Code != expectedStatus {
+			t.Errorf("Update %d: expected status %d but got %d", i+1, expectedStatus, w.Code)
+		}
+	}
+
+	for _, expected := range []float64{40.7128, 41.5} {
+		select {
+		case latitude := <-client.sent:
+			if latitude != expected {
+				t.Errorf("Expected the history service to get latitude %v, got %v", expected, latitude)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected an update with latitude %v to be sent", expected)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests that Flush writes the held back updates right away on shutdown and that their timers write nothing after it
+func TestCoalescerFlush(t *testing.T) {
+	updates := &ratelimit.Coalescer{Interval: time.Hour}
+	var written []models.Location
+	write := func(loc models.Location) { written = append(written, loc) }
+
+	for _, loc := range []models.Location{
+		{Name: "tomek_prus", Latitude: 40.7128, Longitude: -74.0060},
+		{Name: "tomek_prus", Latitude: 41.5, Longitude: -73.5},
+		{Name: "jane_doe", Latitude: 40.7128, Longitude: -74.0060},
+	} {
+		if updates.Offer(loc, write) {
+			written = append(written, loc)
+		}
+	}
+	if len(written) != 2 {
+		t.Fatalf("Expected the first update of each user to be written right away, got %v", written)
+	}
+
+	updates.Flush()
+	if len(written) != 3 || written[2].Name != "tomek_prus" || written[2].Latitude != 41.5 {
+		t.Fatalf("Expected the held back update of tomek_prus to be written by Flush, got %v", written)
+	}
+	if !updates.Offer(models.Location{Name: "tomek_prus", Latitude: 40.7128, Longitude: -74.0060}, write) {
+		t.Errorf("Expected users to be forgotten after Flush")
+	}
+}
+
+// tests that Forget drops the held back update of an erased user so its timer writes nothing
+func TestCoalescerForget(t *testing.T) {
+	updates := &ratelimit.Coalescer{Interval: 20 * time.Millisecond}
+	written := make(chan models.Location, 2)
+	write := func(loc models.Location) { written <- loc }
+
+	if !updates.Offer(models.Location{Name: "tomek_prus", Latitude: 40.7128, Longitude: -74.0060}, write) {
+		t.Fatalf("Expected the first update to be written right away")
+	}
+	if updates.Offer(models.Location{Name: "tomek_prus", Latitude: 41.5, Longitude: -73.5}, write) {
+		t.Fatalf("Expected the second update to be held back")
+	}
+
+	updates.Forget("tomek_prus")
+	select {
+	case loc := <-written:
+		t.Errorf("Expected the held back update to be dropped, got %v", loc)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !updates.Offer(models.Location{Name: "tomek_prus", Latitude: 40.7128, Longitude: -74.0060}, write) {
+		t.Errorf("Expected the user to be forgotten")
+	}
+}
+
+// tests that Forget waits for a held back update that is already being written
+func TestCoalescerForgetWaitsForWrite(t *testing.T) {
+	updates := &ratelimit.Coalescer{Interval: 20 * time.Millisecond}
+	started, release := make(chan struct{}), make(chan struct{})
+	write := func(loc models.Location) {
+		close(started)
+		<-release
+	}
+
+	updates.Offer(models.Location{Name: "tomek_prus", Latitude: 40.7128, Longitude: -74.0060}, write)
+	updates.Offer(models.Location{Name: "tomek_prus", Latitude: 41.5, Longitude: -73.5}, write)
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the held back update to be written")
+	}
+
+	forgotten := make(chan struct{})
+	go func() {
+		updates.Forget("tomek_prus")
+		close(forgotten)
+	}()
+	select {
+	case <-forgotten:
+		t.Fatalf("Expected Forget to wait for the running write")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-forgotten:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected Forget to return once the write finished")
+	}
+}
+
+// grpc client passing the latitude of every update to a channel, for updates written in the background
+type notifyingGRPCClient struct {
+	sent chan float64
+}
+
+func (n *notifyingGRPCClient) SendLocationUpdate(ctx context.Context, username string, latitude, longitude float64, fixID string) error {
+	n.sent <- latitude
+	return nil
+}
+
+func (n *notifyingGRPCClient) DeleteUserHistory(ctx context.Context, username string) (int64, error) {
+	return 0, nil
+}
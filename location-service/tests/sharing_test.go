@@ -0,0 +1,268 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-nauka/jwtauth"
+	"go-nauka/location-service/handlers"
+	"go-nauka/location-service/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+// returns a router with the sharing and group routes behind the caller middleware
+func sharingRouter() *gin.Engine {
+	router := gin.Default()
+	router.Use(jwtauth.Middleware())
+	router.GET("/sharing", handlers.GetShares)
+	router.POST("/sharing", handlers.CreateShare)
+	router.DELETE("/sharing", handlers.DeleteShares)
+	router.DELETE("/sharing/:id", handlers.DeleteShare)
+	router.GET("/groups/:group", handlers.GetGroupMembers)
+	router.PUT("/groups/:group/members/:name", handlers.AddGroupMember)
+	router.DELETE("/groups/:group/members/:name", handlers.RemoveGroupMember)
+	return router
+}
+
+// sends a request as the given caller, an empty caller is anonymous
+func sendAs(router *gin.Engine, caller, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, path, &buf)
+	if caller != "" {
+		authorize(req, caller, "")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// tests the POST /sharing endpoint for the different grantee types and expiries
+func TestCreateShare(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	router := sharingRouter()
+
+	tests := []struct {
+		name           string
+		caller         string
+		body           map[string]interface{}
+		groupOwner     string
+		expectedArgs   []driver.Value
+		expectedStatus int
+	}{
+		{
+			name:           "Everyone",
+			caller:         "tomek_prus",
+			body:           map[string]interface{}{"type": "everyone", "grantee": "ignored"},
+			expectedArgs:   []driver.Value{"tomek_prus", models.ShareEveryone, "", 0, nil},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "User With Expiry",
+			caller:         "tomek_prus",
+			body:           map[string]interface{}{"type": "user", "grantee": "jane_doe", "expires_in": "2h", "precision": "1km"},
+			expectedArgs:   []driver.Value{"tomek_prus", models.ShareUser, "jane_doe", 1000, sqlmock.AnyArg()},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Group",
+			caller:         "tomek_prus",
+			body:           map[string]interface{}{"type": "group", "grantee": "family", "precision": "city"},
+			groupOwner:     "tomek_prus",
+			expectedArgs:   []driver.Value{"tomek_prus", models.ShareGroup, "family", 10000, nil},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Group Of Another User",
+			caller:         "tomek_prus",
+			body:           map[string]interface{}{"type": "group", "grantee": "family"},
+			groupOwner:     "jane_doe",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Unknown Group",
+			caller:         "tomek_prus",
+			body:           map[string]interface{}{"type": "group", "grantee": "family"},
+			groupOwner:     "",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Anonymous",
+			body:           map[string]interface{}{"type": "everyone"},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Missing Grantee",
+			caller:         "tomek_prus",
+			body:           map[string]interface{}{"type": "user"},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown Type",
+			caller:         "tomek_prus",
+			body:           map[string]interface{}{"type": "friends"},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown Precision",
+			caller:         "tomek_prus",
+			body:           map[string]interface{}{"type": "everyone", "precision": "10m"},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Expiry In The Past",
+			caller:         "tomek_prus",
+			body:           map[string]interface{}{"type": "everyone", "expires_at": "2020-01-01T00:00:00Z"},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Invalid Duration",
+			caller:         "tomek_prus",
+			body:           map[string]interface{}{"type": "everyone", "expires_in": "soon"},
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.body["type"] == "group" {
+				owner := sqlmock.NewRows([]string{"owner"})
+				if tt.groupOwner != "" {
+					owner.AddRow(tt.groupOwner)
+				}
+				mock.ExpectQuery("SELECT owner FROM user_groups WHERE name = ?").WithArgs("family").WillReturnRows(owner)
+			}
+			if tt.expectedArgs != nil {
+				mock.ExpectExec("INSERT INTO location_shares").WithArgs(tt.expectedArgs...).WillReturnResult(sqlmock.NewResult(5, 1))
+			}
+
+			w := sendAs(router, tt.caller, "POST", "/sharing", tt.body)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d but got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("Unfulfilled DB expectations: %v", err)
+			}
+		})
+	}
+}
+
+// tests listing and revoking shares
+func TestShareRevocation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	router := sharingRouter()
+
+	mock.ExpectQuery("SELECT id, owner, grantee_type, grantee, precision_m, expires_at, created_at FROM location_shares WHERE owner = ?").
+		WithArgs("tomek_prus").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "owner", "grantee_type", "grantee", "precision_m", "expires_at", "created_at"}).
+			AddRow(1, "tomek_prus", "user", "jane_doe", 0, "2024-01-16 12:00:00", "2024-01-16 10:00:00").
+			AddRow(2, "tomek_prus", "everyone", "", 10000, nil, "2024-01-16 11:00:00"))
+
+	w := sendAs(router, "tomek_prus", "GET", "/sharing", nil)
+	var shares []models.Share
+	if err := json.Unmarshal(w.Body.Bytes(), &shares); err != nil || len(shares) != 2 {
+		t.Fatalf("Unexpected shares %s %v", w.Body.String(), err)
+	}
+	if shares[0].ExpiresAt == nil || shares[1].ExpiresAt != nil {
+		t.Errorf("Expected only the first share to expire, got %+v", shares)
+	}
+	if shares[0].Precision != "exact" || shares[1].Precision != "city" {
+		t.Errorf("Unexpected precisions %+v", shares)
+	}
+
+	mock.ExpectExec("DELETE FROM location_shares WHERE owner = \\? AND id = \\?").
+		WithArgs("tomek_prus", int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT EXISTS \\(SELECT 1 FROM location_shares WHERE owner = \\? AND grantee_type = 'everyone'").
+		WithArgs("tomek_prus").
+		WillReturnRows(sqlmock.NewRows([]string{"public"}).AddRow(false))
+	if w := sendAs(router, "tomek_prus", "DELETE", "/sharing/1", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 but got %d", w.Code)
+	}
+
+	// somebody else's share is not found
+	mock.ExpectExec("DELETE FROM location_shares WHERE owner = \\? AND id = \\?").
+		WithArgs("jane_doe", int64(2)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if w := sendAs(router, "jane_doe", "DELETE", "/sharing/2", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 but got %d", w.Code)
+	}
+
+	mock.ExpectExec("DELETE FROM location_shares WHERE owner = ?").
+		WithArgs("tomek_prus").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if w := sendAs(router, "tomek_prus", "DELETE", "/sharing", nil); w.Code != http.StatusOK || w.Body.String() != `{"deleted":1}` {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
+
+// tests that groups are created on first use and only their owner can change them
+func TestGroupMembers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+	router := sharingRouter()
+
+	noOwner := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"owner"}) }
+	owner := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"owner"}).AddRow("tomek_prus") }
+
+	mock.ExpectQuery("SELECT owner FROM user_groups WHERE name = ?").WithArgs("family").WillReturnRows(noOwner())
+	mock.ExpectExec("INSERT INTO user_groups").WithArgs("family", "tomek_prus").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO group_members").WithArgs("family", "jane_doe").WillReturnResult(sqlmock.NewResult(0, 1))
+	if w := sendAs(router, "tomek_prus", "PUT", "/groups/family/members/jane_doe", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 but got %d", w.Code)
+	}
+
+	mock.ExpectQuery("SELECT owner FROM user_groups WHERE name = ?").WithArgs("family").WillReturnRows(owner())
+	if w := sendAs(router, "jane_doe", "PUT", "/groups/family/members/stranger", nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a member changing the group but got %d", w.Code)
+	}
+
+	mock.ExpectQuery("SELECT owner FROM user_groups WHERE name = ?").WithArgs("family").WillReturnRows(owner())
+	mock.ExpectQuery("SELECT username FROM group_members WHERE group_name = ?").
+		WithArgs("family").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("jane_doe"))
+	if w := sendAs(router, "tomek_prus", "GET", "/groups/family", nil); w.Code != http.StatusOK ||
+		w.Body.String() != `{"group":"family","members":["jane_doe"],"owner":"tomek_prus"}` {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	mock.ExpectQuery("SELECT owner FROM user_groups WHERE name = ?").WithArgs("friends").WillReturnRows(noOwner())
+	if w := sendAs(router, "tomek_prus", "DELETE", "/groups/friends/members/jane_doe", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a missing group but got %d", w.Code)
+	}
+
+	mock.ExpectQuery("SELECT owner FROM user_groups WHERE name = ?").WithArgs("family").WillReturnRows(owner())
+	mock.ExpectExec("DELETE FROM group_members WHERE group_name = \\? AND username = \\?").
+		WithArgs("family", "jane_doe").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if w := sendAs(router, "tomek_prus", "DELETE", "/groups/family/members/jane_doe", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 but got %d", w.Code)
+	}
+
+	if w := sendAs(router, "", "GET", "/groups/family", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for an anonymous caller but got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+// package contains unit tests and integration tests for the app
+package tests
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-nauka/geo"
+	"go-nauka/location-service/handlers"
+	"go-nauka/location-service/models"
+	"go-nauka/location-service/tiles"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// point feature decoded from a vector tile
+type decodedFeature struct {
+	X, Y       int64
+	Properties map[string]interface{}
+}
+
+// decoded vector tile layer
+type decodedLayer struct {
+	Name     string
+	Version  uint64
+	Extent   uint64
+	Features []decodedFeature
+}
+
+// walks the fields of a protobuf message
+func forEachField(t *testing.T, b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte, varint uint64)) {
+	t.Helper()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("Invalid tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			fn(num, typ, nil, v)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			fn(num, typ, nil, v)
+			b = b[n:]
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				t.Fatalf("Invalid bytes: %v", protowire.ParseError(n))
+			}
+			fn(num, typ, v, 0)
+			b = b[n:]
+		default:
+			t.Fatalf("Unexpected wire type %v", typ)
+		}
+	}
+}
+
+// reads packed varints
+func unpack(b []byte) []uint64 {
+	var values []uint64
+	for len(b) > 0 {
+		v, n := protowire.ConsumeVarint(b)
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values
+}
+
+// decodes the point layers of a vector tile
+func decodeTile(t *testing.T, data []byte) []decodedLayer {
+	var layers []decodedLayer
+	forEachField(t, data, func(num protowire.Number, _ protowire.Type, layerBytes []byte, _ uint64) {
+		if num != 3 {
+			t.Fatalf("Unexpected tile field %d", num)
+		}
+		var layer decodedLayer
+		var keys []string
+		var values []interface{}
+		var rawFeatures [][]byte
+
+		forEachField(t, layerBytes, func(num protowire.Number, _ protowire.Type, b []byte, v uint64) {
+			switch num {
+			case 15:
+				layer.Version = v
+			case 1:
+				layer.Name = string(b)
+			case 2:
+				rawFeatures = append(rawFeatures, b)
+			case 3:
+				keys = append(keys, string(b))
+			case 4:
+				forEachField(t, b, func(num protowire.Number, _ protowire.Type, s []byte, v uint64) {
+					switch num {
+					case 1:
+						values = append(values, string(s))
+					case 3:
+						values = append(values, math.Float64frombits(v))
+					case 4:
+						values = append(values, int64(v))
+					case 7:
+						values = append(values, v != 0)
+					}
+				})
+			case 5:
+				layer.Extent = v
+			}
+		})
+
+		for _, raw := range rawFeatures {
+			feature := decodedFeature{Properties: map[string]interface{}{}}
+			forEachField(t, raw, func(num protowire.Number, _ protowire.Type, b []byte, v uint64) {
+				switch num {
+				case 2:
+					tags := unpack(b)
+					for i := 0; i+1 < len(tags); i += 2 {
+						feature.Properties[keys[tags[i]]] = values[tags[i+1]]
+					}
+				case 3:
+					if v != 1 {
+						t.Errorf("Expected a point feature, got type %d", v)
+					}
+				case 4:
+					geometry := unpack(b)
+					if len(geometry) != 3 || geometry[0] != 9 {
+						t.Fatalf("Expected a single MoveTo, got %v", geometry)
+					}
+					feature.X = protowire.DecodeZigZag(geometry[1])
+					feature.Y = protowire.DecodeZigZag(geometry[2])
+				}
+			})
+			layer.Features = append(layer.Features, feature)
+		}
+		layers = append(layers, layer)
+	})
+	return layers
+}
+
+// tests that nearby users are clustered at low zoom and drawn as separate points at high zoom
+func TestBuildTile(t *testing.T) {
+	locations := []models.Location{
+		{Name: "john_doe", Latitude: 52.2297, Longitude: 21.0122, UpdatedAt: "2024-01-16 10:00:00"},
+		{Name: "jane_doe", Latitude: 52.2300, Longitude: 21.0130, UpdatedAt: "2024-01-16 11:00:00"},
+		{Name: "tomek_prus", Latitude: 50.0647, Longitude: 19.9450, UpdatedAt: "2024-01-16 12:00:00"},
+	}
+
+	low := geo.TileFor(locations[0].Position(), 6)
+	data, err := tiles.Build(low, locations)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	layers := decodeTile(t, data)
+	if len(layers) != 1 || layers[0].Name != tiles.LayerName || layers[0].Version != 2 || layers[0].Extent != tiles.Extent {
+		t.Fatalf("Unexpected layers %+v", layers)
+	}
+	if len(layers[0].Features) != 2 {
+		t.Fatalf("Expected a cluster and a single point, got %+v", layers[0].Features)
+	}
+
+	cluster := layers[0].Features[0]
+	if cluster.Properties["cluster"] != true || cluster.Properties["point_count"] != int64(2) || cluster.Properties["point_count_abbreviated"] != "2" {
+		t.Errorf("Unexpected cluster properties %v", cluster.Properties)
+	}
+	x, y := low.Pixel(locations[0].Position(), tiles.Extent)
+	if math.Abs(float64(cluster.X)-x) > 1 || math.Abs(float64(cluster.Y)-y) > 1 {
+		t.Errorf("Expected the cluster near (%v, %v), got (%d, %d)", x, y, cluster.X, cluster.Y)
+	}
+	if single := layers[0].Features[1]; single.Properties["name"] != "tomek_prus" || single.Properties["updated_at"] != "2024-01-16 12:00:00" {
+		t.Errorf("Unexpected point properties %v", single.Properties)
+	}
+
+	high := geo.TileFor(locations[0].Position(), tiles.ClusterMaxZoom)
+	data, err = tiles.Build(high, locations[:2])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if features := decodeTile(t, data)[0].Features; len(features) != 2 || features[0].Properties["name"] != "john_doe" {
+		t.Errorf("Expected two separate points at zoom %d, got %+v", tiles.ClusterMaxZoom, features)
+	}
+
+	if data, _ := tiles.Build(high, nil); len(data) != 0 {
+		t.Errorf("Expected an empty tile, got %d bytes", len(data))
+	}
+}
+
+// tests abbreviation of cluster counts
+func TestAbbreviate(t *testing.T) {
+	for count, expected := range map[int]string{7: "7", 999: "999", 1234: "1.2k", 15678: "15k", 2500000: "2.5M"} {
+		if result := tiles.Abbreviate(count); result != expected {
+			t.Errorf("Expected %q for %d, got %q", expected, count, result)
+		}
+	}
+}
+
+// tests the GET /tiles/{z}/{x}/{y}.mvt endpoint
+func TestGetTile(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mock, cleanup := setupMockDB(t)
+	defer cleanup()
+
+	router := gin.Default()
+	router.GET("/tiles/:z/:x/:y", handlers.GetTile)
+
+	tile := geo.Tile{Z: 0, X: 0, Y: 0}
+	mock.ExpectQuery("SELECT l.name, l.latitude, l.longitude, l.updated_at, CASE (.+) FROM location l WHERE l.latitude BETWEEN").
+		WithArgs("", "", "", -90.0, 90.0, -180.0, 180.0, "", "", "").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude", "updated_at", "precision_m"}).
+			AddRow("john_doe", 52.2297, 21.0122, "2024-01-16 10:00:00", 0))
+
+	req, _ := http.NewRequest("GET", "/tiles/0/0/0.mvt", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 but got %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/vnd.mapbox-vector-tile" {
+		t.Errorf("Unexpected content type %q", contentType)
+	}
+	if features := decodeTile(t, w.Body.Bytes())[0].Features; len(features) != 1 || features[0].Properties["name"] != "john_doe" {
+		t.Errorf("Unexpected features %+v in tile %v", features, tile)
+	}
+
+	for _, path := range []string{"/tiles/0/0/0", "/tiles/1/2/0.mvt", "/tiles/x/0/0.mvt"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s but got %d", path, w.Code)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unfulfilled DB expectations: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+// package builds Mapbox Vector Tiles of the current user positions
+package tiles
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field numbers and constants of the vector tile specification (vector_tile.proto, version 2)
+const (
+	tileLayers = 3
+
+	layerVersion  = 15
+	layerName     = 1
+	layerFeatures = 2
+	layerKeys     = 3
+	layerValues   = 4
+	layerExtent   = 5
+
+	featureTags     = 2
+	featureType     = 3
+	featureGeometry = 4
+
+	valueString = 1
+	valueDouble = 3
+	valueInt    = 4
+	valueBool   = 7
+
+	geomPoint = 1
+	cmdMoveTo = 1
+)
+
+// Feature is a point in tile coordinates, x and y run from 0 to the layer extent
+// property values may be strings, ints, int64s, float64s or bools
+type Feature struct {
+	X          int
+	Y          int
+	Properties map[string]interface{}
+}
+
+// Layer is a named set of point features
+type Layer struct {
+	Name     string
+	Extent   int
+	Features []Feature
+}
+
+// encodes the layers as a vector tile
+func Encode(layers ...Layer) ([]byte, error) {
+	var tile []byte
+	for _, layer := range layers {
+		encoded, err := encodeLayer(layer)
+		if err != nil {
+			return nil, err
+		}
+		tile = protowire.AppendTag(tile, tileLayers, protowire.BytesType)
+		tile = protowire.AppendBytes(tile, encoded)
+	}
+	return tile, nil
+}
+
+// encodes a layer, keys and values shared by several features are stored once
+func encodeLayer(layer Layer) ([]byte, error) {
+	var keys []string
+	var values [][]byte
+	keyIndex := map[string]uint64{}
+	valueIndex := map[string]uint64{}
+
+	var features []byte
+	for _, feature := range layer.Features {
+		names := make([]string, 0, len(feature.Properties))
+		for name := range feature.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var tags []byte
+		for _, name := range names {
+			value, err := encodeValue(feature.Properties[name])
+			if err != nil {
+				return nil, fmt.Errorf("tiles: property %q: %v", name, err)
+			}
+
+			k, ok := keyIndex[name]
+			if !ok {
+				k = uint64(len(keys))
+				keyIndex[name] = k
+				keys = append(keys, name)
+			}
+			v, ok := valueIndex[string(value)]
+			if !ok {
+				v = uint64(len(values))
+				valueIndex[string(value)] = v
+				values = append(values, value)
+			}
+			tags = protowire.AppendVarint(tags, k)
+			tags = protowire.AppendVarint(tags, v)
+		}
+
+		// a single MoveTo command followed by the zigzag encoded offset from the origin
+		var geometry []byte
+		geometry = protowire.AppendVarint(geometry, cmdMoveTo|1<<3)
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(int64(feature.X)))
+		geometry = protowire.AppendVarint(geometry, protowire.EncodeZigZag(int64(feature.Y)))
+
+		var encoded []byte
+		if len(tags) > 0 {
+			encoded = protowire.AppendTag(encoded, featureTags, protowire.BytesType)
+			encoded = protowire.AppendBytes(encoded, tags)
+		}
+		encoded = protowire.AppendTag(encoded, featureType, protowire.VarintType)
+		encoded = protowire.AppendVarint(encoded, geomPoint)
+		encoded = protowire.AppendTag(encoded, featureGeometry, protowire.BytesType)
+		encoded = protowire.AppendBytes(encoded, geometry)
+
+		features = protowire.AppendTag(features, layerFeatures, protowire.BytesType)
+		features = protowire.AppendBytes(features, encoded)
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, layerVersion, protowire.VarintType)
+	b = protowire.AppendVarint(b, 2)
+	b = protowire.AppendTag(b, layerName, protowire.BytesType)
+	b = protowire.AppendString(b, layer.Name)
+	b = append(b, features...)
+	for _, key := range keys {
+		b = protowire.AppendTag(b, layerKeys, protowire.BytesType)
+		b = protowire.AppendString(b, key)
+	}
+	for _, value := range values {
+		b = protowire.AppendTag(b, layerValues, protowire.BytesType)
+		b = protowire.AppendBytes(b, value)
+	}
+	b = protowire.AppendTag(b, layerExtent, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(layer.Extent))
+	return b, nil
+}
+
+// encodes a property value as a vector tile Value message
+func encodeValue(value interface{}) ([]byte, error) {
+	var b []byte
+	switch v := value.(type) {
+	case string:
+		b = protowire.AppendTag(b, valueString, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	case int:
+		b = protowire.AppendTag(b, valueInt, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case int64:
+		b = protowire.AppendTag(b, valueInt, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case float64:
+		b = protowire.AppendTag(b, valueDouble, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		b = protowire.AppendTag(b, valueBool, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", value)
+	}
+	return b, nil
+}
@@ -0,0 +1,120 @@
+package tiles
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+
+	"go-nauka/geo"
+	DB "go-nauka/location-service/db"
+	"go-nauka/location-service/models"
+)
+
+const (
+	// name of the layer holding the user positions
+	LayerName = "locations"
+	// resolution of the tile coordinates
+	Extent = 4096
+	// points are clustered at zoom levels below this one
+	ClusterMaxZoom = 14
+	// size of a clustering cell in pixels of a 256 pixel tile, a power of two so cells never straddle tiles
+	ClusterCellPixels = 64
+)
+
+// returns the area whose locations are drawn on the tile
+// the edge rows also cover the poles since the projection clamps points beyond it onto them
+func Bounds(tile geo.Tile) geo.Bounds {
+	bounds := tile.Bounds()
+	if tile.Y == 0 {
+		bounds.NorthEast.Lat = 90
+	}
+	if tile.Y == 1<<tile.Z-1 {
+		bounds.SouthWest.Lat = -90
+	}
+	return bounds
+}
+
+// builds the vector tile of the given locations
+// below ClusterMaxZoom locations sharing a clustering cell are merged into a cluster feature at their mean position
+func Build(tile geo.Tile, locations []models.Location) ([]byte, error) {
+	layer := Layer{Name: LayerName, Extent: Extent}
+
+	type cluster struct {
+		members []models.Location
+		sumX    float64
+		sumY    float64
+	}
+	cells := map[[2]int]*cluster{}
+	var order [][2]int
+
+	cellSize := float64(ClusterCellPixels * Extent / geo.TileSize)
+	for i, loc := range locations {
+		x, y := tile.Pixel(loc.Position(), Extent)
+
+		key := [2]int{i, 0}
+		if tile.Z < ClusterMaxZoom {
+			key = [2]int{int(math.Floor(x / cellSize)), int(math.Floor(y / cellSize))}
+		}
+		c, ok := cells[key]
+		if !ok {
+			c = &cluster{}
+			cells[key] = c
+			order = append(order, key)
+		}
+		c.members = append(c.members, loc)
+		c.sumX += x
+		c.sumY += y
+	}
+
+	for _, key := range order {
+		c := cells[key]
+		n := float64(len(c.members))
+		feature := Feature{X: clampExtent(c.sumX / n), Y: clampExtent(c.sumY / n)}
+
+		if len(c.members) == 1 {
+			feature.Properties = map[string]interface{}{
+				"name":       c.members[0].Name,
+				"updated_at": c.members[0].UpdatedAt,
+			}
+		} else {
+			feature.Properties = map[string]interface{}{
+				"cluster":                 true,
+				"point_count":             len(c.members),
+				"point_count_abbreviated": Abbreviate(len(c.members)),
+			}
+		}
+		layer.Features = append(layer.Features, feature)
+	}
+
+	if len(layer.Features) == 0 {
+		return []byte{}, nil
+	}
+	return Encode(layer)
+}
+
+func clampExtent(v float64) int {
+	return int(math.Max(0, math.Min(math.Round(v), Extent-1)))
+}
+
+// shortens large counts for cluster labels, e.g. 1234 to "1.2k"
+func Abbreviate(count int) string {
+	switch {
+	case count >= 1000000:
+		return strconv.FormatFloat(math.Floor(float64(count)/100000)/10, 'f', -1, 64) + "M"
+	case count >= 10000:
+		return strconv.Itoa(count/1000) + "k"
+	case count >= 1000:
+		return strconv.FormatFloat(math.Floor(float64(count)/100)/10, 'f', -1, 64) + "k"
+	}
+	return strconv.Itoa(count)
+}
+
+// fetches the locations on a tile the viewer may see and builds its vector tile
+func Render(ctx context.Context, tile geo.Tile, viewer string) ([]byte, error) {
+	locations, err := DB.GetLocationsIn(ctx, Bounds(tile), viewer)
+	if err != nil {
+		return nil, fmt.Errorf("tiles: %v", err)
+	}
+	return Build(tile, locations)
+}
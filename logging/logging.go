@@ -0,0 +1,288 @@
+// package writes the structured logs of both services with log/slog, with per package levels,
+// request ids passed from the REST apis through gRPC metadata and redaction of usernames and coordinates
+package logging
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go-nauka/config"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// header carrying the request id of a REST request, taken from the caller when valid and always returned
+	RequestIDHeader = "X-Request-ID"
+	// grpc metadata key carrying the request id to the history service
+	requestIDMetadata = "x-request-id"
+	// longest request id accepted from a caller
+	maxRequestIDLength = 64
+
+	// values of the redact setting
+	RedactUsernames   = "usernames"
+	RedactCoordinates = "coordinates"
+)
+
+// routes polled by probes and scrapers, their requests are logged at debug level
+var quietRoutes = []string{"/healthz", "/readyz", "/metrics"}
+
+// attribute keys holding usernames and coordinates, redacted when configured
+var (
+	usernameKeys   = []string{"username", "owner", "member", "grantee", "caller"}
+	coordinateKeys = []string{"latitude", "longitude", "lat", "lng"}
+)
+
+// output, levels and redaction of every logger, replaced by Setup
+type state struct {
+	out      slog.Handler
+	level    slog.Level
+	packages map[string]slog.Level
+	// key of the username pseudonyms
+	usernameKey []byte
+}
+
+var current atomic.Pointer[state]
+
+func init() {
+	current.Store(&state{out: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}), level: slog.LevelInfo, usernameKey: randomKey()})
+}
+
+// configures the loggers of the service from the logging config, JSON or text lines are written to w
+// every record names the service, records of a package below its level are dropped
+// usernames are hashed with the redact secret, or with a random key when it is unset
+func Setup(service string, settings config.Logging, w io.Writer) error {
+	level, packages, err := parseLevels(settings)
+	if err != nil {
+		return fmt.Errorf("setup: %v", err)
+	}
+
+	options := &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: redactor(settings.Redact)}
+	var out slog.Handler = slog.NewJSONHandler(w, options)
+	if settings.Format == "text" {
+		out = slog.NewTextHandler(w, options)
+	}
+	key := []byte(settings.RedactSecret)
+	if len(key) == 0 {
+		key = randomKey()
+	}
+	current.Store(&state{out: out.WithAttrs([]slog.Attr{slog.String("service", service)}), level: level, packages: packages, usernameKey: key})
+	slog.SetDefault(For("main"))
+	return nil
+}
+
+// parses the level and the package=level overrides
+func parseLevels(settings config.Logging) (slog.Level, map[string]slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(settings.Level)); err != nil {
+		return 0, nil, err
+	}
+	packages := map[string]slog.Level{}
+	for _, override := range settings.Packages {
+		pkg, text, found := strings.Cut(override, "=")
+		var packageLevel slog.Level
+		if !found || packageLevel.UnmarshalText([]byte(text)) != nil {
+			return 0, nil, fmt.Errorf("invalid package level %q", override)
+		}
+		packages[strings.TrimSpace(pkg)] = packageLevel
+	}
+	return level, packages, nil
+}
+
+// returns a func replacing the usernames and coordinates of records as configured
+// usernames become a short hash so the records of a user can still be followed, coordinates are dropped
+func redactor(redact []string) func(groups []string, a slog.Attr) slog.Attr {
+	usernames, coordinates := slices.Contains(redact, RedactUsernames), slices.Contains(redact, RedactCoordinates)
+	return func(groups []string, a slog.Attr) slog.Attr {
+		switch {
+		case usernames && slices.Contains(usernameKeys, a.Key):
+			return slog.String(a.Key, HashUsername(a.Value.String()))
+		case coordinates && slices.Contains(coordinateKeys, a.Key):
+			return slog.String(a.Key, "<redacted>")
+		}
+		return a
+	}
+}
+
+// returns the pseudonym of a username used in redacted logs, a HMAC keyed by the redact secret
+// so pseudonyms can't be reversed by hashing candidate usernames
+func HashUsername(username string) string {
+	mac := hmac.New(sha256.New, current.Load().usernameKey)
+	mac.Write([]byte(username))
+	return "user-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// returns a random key for the username pseudonyms, they then only match within one run of the service
+func randomKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// returns the logger of a package, its records are dropped below the level configured for the package
+func For(pkg string) *slog.Logger {
+	return slog.New(&handler{pkg: pkg, attrs: []slog.Attr{slog.String("package", pkg)}})
+}
+
+// reads the current state on every record, so package loggers created before Setup follow it
+type handler struct {
+	pkg   string
+	attrs []slog.Attr
+	group string
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	s := current.Load()
+	if packageLevel, ok := s.packages[h.pkg]; ok {
+		return level >= packageLevel
+	}
+	return level >= s.level
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	out := current.Load().out.WithAttrs(h.attrs)
+	if id := RequestID(ctx); id != "" {
+		out = out.WithAttrs([]slog.Attr{slog.String("request_id", id)})
+	}
+	if h.group != "" {
+		out = out.WithGroup(h.group)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if h.group != "" {
+		attrs = []slog.Attr{slog.Attr{Key: h.group, Value: slog.GroupValue(attrs...)}}
+	}
+	return &handler{pkg: h.pkg, attrs: append(slices.Clip(h.attrs), attrs...), group: h.group}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	if h.group != "" {
+		name = h.group + "." + name
+	}
+	return &handler{pkg: h.pkg, attrs: h.attrs, group: name}
+}
+
+// logs at error level and exits, for failures main can't recover from
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// key of the request id in a context
+type requestIDKey struct{}
+
+// returns a context carrying the request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// returns the request id of the context, empty outside of a request
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// returns a new random request id
+func NewRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// reports whether an id sent by a caller can be used, it must be short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// gives every request an id, taken from the X-Request-ID header when valid, returns it in the response
+// and logs the request by its route template when it is done, failed requests at error level
+func Middleware() gin.HandlerFunc {
+	logger := For("http")
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = NewRequestID()
+		}
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), id))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case slices.Contains(quietRoutes, c.FullPath()):
+			level = slog.LevelDebug
+		}
+		logger.Log(c.Request.Context(), level, "request",
+			"method", c.Request.Method,
+			"route", c.FullPath(),
+			"status", status,
+			"duration_ms", time.Since(start).Milliseconds())
+	}
+}
+
+// sends the request id of the context in the metadata of every unary call
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if id := RequestID(ctx); id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadata, id)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// puts the request id of the metadata in the context of every unary call, calls without one get a new id
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(incomingRequestID(ctx), req)
+}
+
+// puts the request id of the metadata in the context of every streaming call, calls without one get a new id
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &requestStream{ServerStream: ss, ctx: incomingRequestID(ss.Context())})
+}
+
+func incomingRequestID(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ids := md.Get(requestIDMetadata); len(ids) > 0 && validRequestID(ids[0]) {
+		return WithRequestID(ctx, ids[0])
+	}
+	return WithRequestID(ctx, NewRequestID())
+}
+
+// server stream whose context carries the request id
+type requestStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *requestStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,103 @@
+// package parses the retention policies of location history, shared so the config can validate them without importing the history service
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tier keeps at most one point per Interval for records older than After
+type Tier struct {
+	After    time.Duration
+	Interval time.Duration
+}
+
+// Policy describes how location history ages
+// records younger than the first tier are kept at full resolution, records older than DeleteAfter are removed
+// ToleranceKm is the maximum distance a single compacted segment may lose compared to the raw track
+// BatchSize limits how many rows are read and deleted at once
+type Policy struct {
+	Tiers       []Tier
+	DeleteAfter time.Duration
+	ToleranceKm float64
+	BatchSize   int
+}
+
+const (
+	DefaultToleranceKm = 0.05
+	DefaultBatchSize   = 1000
+)
+
+// reports whether the policy changes anything, an empty policy keeps history forever
+func (p Policy) Enabled() bool {
+	return len(p.Tiers) > 0 || p.DeleteAfter > 0
+}
+
+// parses a policy in the form "30d=5m,365d=delete"
+// each entry maps an age to the interval of points kept after it, or to "delete"
+func Parse(spec string) (Policy, error) {
+	policy := Policy{ToleranceKm: DefaultToleranceKm, BatchSize: DefaultBatchSize}
+
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return policy, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		age, action, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found {
+			return Policy{}, fmt.Errorf("parse: entry %q must look like age=interval", entry)
+		}
+
+		after, err := ParseDuration(age)
+		if err != nil || after <= 0 {
+			return Policy{}, fmt.Errorf("parse: invalid age %q", age)
+		}
+
+		if action == "delete" {
+			if policy.DeleteAfter > 0 {
+				return Policy{}, fmt.Errorf("parse: delete given more than once")
+			}
+			policy.DeleteAfter = after
+			continue
+		}
+
+		interval, err := ParseDuration(action)
+		if err != nil || interval <= 0 {
+			return Policy{}, fmt.Errorf("parse: invalid interval %q", action)
+		}
+		policy.Tiers = append(policy.Tiers, Tier{After: after, Interval: interval})
+	}
+
+	sort.Slice(policy.Tiers, func(i, j int) bool { return policy.Tiers[i].After < policy.Tiers[j].After })
+
+	for i, tier := range policy.Tiers {
+		if i > 0 && tier.After == policy.Tiers[i-1].After {
+			return Policy{}, fmt.Errorf("parse: age %v given more than once", tier.After)
+		}
+		if i > 0 && tier.Interval < policy.Tiers[i-1].Interval {
+			return Policy{}, fmt.Errorf("parse: interval for age %v is finer than for a younger tier", tier.After)
+		}
+		if policy.DeleteAfter > 0 && tier.After >= policy.DeleteAfter {
+			return Policy{}, fmt.Errorf("parse: tier at age %v starts after records are deleted", tier.After)
+		}
+	}
+
+	return policy, nil
+}
+
+// parses a duration like time.ParseDuration that also accepts whole days such as "30d"
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("parseDuration: %v", err)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,180 @@
+// package contains unit tests for the packages shared by both services
+package tests
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-nauka/config"
+)
+
+// writes a config file into a temporary directory and returns its path
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+// sets the secrets location-service requires for the test
+func setSecrets(t *testing.T) {
+	t.Setenv("DELETION_AUDIT_SECRET", "audit-secret")
+	t.Setenv("PRECISION_SECRET", "precision-secret")
+}
+
+// loads the config of a service from the arguments with a fresh flag set
+func load(service string, args ...string) (*config.Config, error) {
+	return config.Load(service, flag.NewFlagSet(service, flag.ContinueOnError), args)
+}
+
+// tests that flags override variables, which override the file, which overrides the defaults
+func TestConfigPrecedence(t *testing.T) {
+	file := writeConfig(t, "config.yaml", `
+http:
+  addr: "0.0.0.0:9000"
+grpc:
+  target: "history:50051"
+  timeout: 2s
+database:
+  addr: "db:3306"
+  name: "locations"
+location:
+  write_rate: 5
+  min_update_interval: 10s
+`)
+	setSecrets(t)
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("DB_NAME", "from_env")
+	t.Setenv("GRPC_TIMEOUT", "3s")
+
+	cfg, err := load(config.LocationService, "-grpc-timeout=4s", "-grpc-allowed-clients", "a, b")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{name: "File", got: cfg.HTTP.Addr, expected: "0.0.0.0:9000"},
+		{name: "File Duration", got: cfg.Location.MinUpdateInterval, expected: config.Duration(10 * time.Second)},
+		{name: "File Float", got: cfg.Location.WriteRate, expected: 5.0},
+		{name: "Env Over File", got: cfg.Database.Name, expected: "from_env"},
+		{name: "Flag Over Env", got: cfg.GRPC.Timeout, expected: config.Duration(4 * time.Second)},
+		{name: "Flag List", got: strings.Join(cfg.GRPC.AllowedClients, "|"), expected: "a|b"},
+		{name: "Default", got: cfg.Location.SearchBurst, expected: 20},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, tt.got)
+		}
+	}
+}
+
+// tests loading a TOML file and the defaults that differ per service
+func TestConfigTOML(t *testing.T) {
+	file := writeConfig(t, "config.toml", `
+[grpc]
+addr = ":6000"
+
+[history]
+retention_policy = "30d=5m"
+retention_tolerance_km = 0.1
+`)
+
+	cfg, err := load(config.HistoryService, "--config", file)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.GRPC.Addr != ":6000" || cfg.History.RetentionPolicy != "30d=5m" || cfg.History.RetentionToleranceKm != 0.1 {
+		t.Errorf("Expected the TOML settings, got %+v %+v", cfg.GRPC, cfg.History)
+	}
+	if tiers := cfg.History.Policy.Tiers; len(tiers) != 1 || tiers[0].After != 30*24*time.Hour || cfg.History.Policy.ToleranceKm != 0.1 {
+		t.Errorf("Expected the retention policy to be parsed with the tolerance, got %+v", cfg.History.Policy)
+	}
+	if cfg.History.RetentionInterval != config.Duration(time.Hour) {
+		t.Errorf("Expected the default retention interval, got %v", cfg.History.RetentionInterval)
+	}
+	if cfg.HTTP.Addr != "localhost:8081" || cfg.Database.Addr != "127.0.0.1:3306" {
+		t.Errorf("Expected the history service defaults, got %+v %+v", cfg.HTTP, cfg.Database)
+	}
+}
+
+// tests that invalid settings, unknown keys and malformed values are rejected
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		service string
+		file    string
+		args    []string
+	}{
+		{name: "Unknown YAML Key", service: config.LocationService, file: writeConfig(t, "typo.yaml", "http:\n  adr: \":80\"\n")},
+		{name: "Unknown TOML Key", service: config.LocationService, file: writeConfig(t, "typo.toml", "[database]\nhost = \"db\"\n")},
+		{name: "Unsupported File", service: config.LocationService, file: writeConfig(t, "config.json", "{}")},
+		{name: "Invalid Duration", service: config.LocationService, args: []string{"-grpc-timeout=soon"}},
+		{name: "Invalid Address", service: config.HistoryService, args: []string{"-grpc-addr=50051"}},
+		{name: "Zero Rate", service: config.LocationService, args: []string{"-write-rate=0"}},
+		{name: "Partial TLS", service: config.LocationService, args: []string{"-grpc-tls-cert=cert.pem"}},
+		{name: "Unknown Flag", service: config.LocationService, args: []string{"-port=80"}},
+		{name: "Unknown Exporter", service: config.HistoryService, args: []string{"-tracing-exporter=jaeger"}},
+		{name: "Missing Trace File", service: config.LocationService, args: []string{"-tracing-exporter=file"}},
+		{name: "Unknown Log Level", service: config.HistoryService, args: []string{"-log-level=verbose"}},
+		{name: "Invalid Package Level", service: config.LocationService, args: []string{"-log-package-levels=grpc"}},
+		{name: "Unknown Redaction", service: config.LocationService, args: []string{"-log-redact=emails"}},
+		{name: "Invalid Retention Policy", service: config.HistoryService, args: []string{"-retention-policy=30d"}},
+		{name: "Invalid Retention Interval", service: config.HistoryService, args: []string{"-retention-interval=1d"}},
+		{name: "Zero Retention Interval", service: config.HistoryService, args: []string{"-retention-policy=30d=5m", "-retention-interval=0s"}},
+		{name: "Missing Audit Secret", service: config.LocationService, args: []string{"-precision-secret=precision-secret"}},
+		{name: "Missing Precision Secret", service: config.LocationService, args: []string{"-audit-secret=audit-secret"}},
+		{name: "Zero Shutdown Timeout", service: config.HistoryService, args: []string{"-shutdown-timeout=0s"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append(args, "-config", tt.file)
+			}
+			if _, err := load(tt.service, args...); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
+
+// tests that --print-config prints the resolved settings without the secrets
+func TestPrintConfig(t *testing.T) {
+	setSecrets(t)
+	t.Setenv("DBPASS", "hunter2")
+	cfg, err := load(config.LocationService, "--print-config", "-jwt-hs256-secret=topsecret", "-log-redact-secret=pepper", "-audit-secret=salt", "-db-user=root")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if !cfg.PrintOnly {
+		t.Errorf("Expected print mode")
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatalf("Failed to print config: %v", err)
+	}
+	printed := buf.String()
+	for _, expected := range []string{"user: root", "password: <redacted>", "hs256_secret: <redacted>", "redact_secret: <redacted>", "audit_secret: <redacted>", "precision_secret: <redacted>", "timeout: 5s"} {
+		if !strings.Contains(printed, expected) {
+			t.Errorf("Expected %q in the printed config:\n%s", expected, printed)
+		}
+	}
+	if strings.Contains(printed, "hunter2") || strings.Contains(printed, "topsecret") || strings.Contains(printed, "pepper") || strings.Contains(printed, "salt") {
+		t.Errorf("Expected the secrets to be redacted:\n%s", printed)
+	}
+	if cfg.Database.Password != "hunter2" {
+		t.Errorf("Expected printing to leave the config unchanged")
+	}
+}
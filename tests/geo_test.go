@@ -0,0 +1,368 @@
+// package contains unit tests for the packages shared by both services
+package tests
+
+import (
+	"go-nauka/geo"
+	"math"
+	"testing"
+)
+
+// checks whether a and b are almost equal within the provided tolerance
+func almostEqual(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+// tests the Geodesic func against reference values from GeographicLib
+func TestGeodesicDistance(t *testing.T) {
+	tests := []struct {
+		name      string
+		lat1      float64
+		lon1      float64
+		lat2      float64
+		lon2      float64
+		expected  float64
+		tolerance float64
+	}{
+		{
+			name:      "Flinders Peak to Buninyong",
+			lat1:      -37.95103341666667,
+			lon1:      144.42486788888888,
+			lat2:      -37.65282113888889,
+			lon2:      143.92649552777778,
+			expected:  54.972271,
+			tolerance: 0.000001,
+		},
+		{
+			name:      "JFK to CDG",
+			lat1:      40.6,
+			lon1:      -73.8,
+			lat2:      49.01666666666667,
+			lon2:      2.55,
+			expected:  5853.226,
+			tolerance: 0.001,
+		},
+		{
+			name:      "Quarter of the Equator",
+			lat1:      0,
+			lon1:      0,
+			lat2:      0,
+			lon2:      90,
+			expected:  10018.754171394,
+			tolerance: 0.000001,
+		},
+		{
+			name:      "Pole to Pole",
+			lat1:      90,
+			lon1:      0,
+			lat2:      -90,
+			lon2:      0,
+			expected:  20003.931458,
+			tolerance: 0.000001,
+		},
+		{
+			name:      "Near Antipodal (Vincenty does not converge)",
+			lat1:      -30,
+			lon1:      0,
+			lat2:      29.9,
+			lon2:      179.8,
+			expected:  19989.832827610,
+			tolerance: 0.000001,
+		},
+		{
+			name:      "Antipodal on the Equator",
+			lat1:      0,
+			lon1:      0,
+			lat2:      0,
+			lon2:      180,
+			expected:  20003.931458,
+			tolerance: 0.000001,
+		},
+		{
+			name:      "Near Antipodal off the Equator",
+			lat1:      0,
+			lon1:      0,
+			lat2:      0.5,
+			lon2:      179.7,
+			expected:  19944.127421,
+			tolerance: 0.000001,
+		},
+		{
+			name:      "Same Location",
+			lat1:      34.0522,
+			lon1:      -118.2437,
+			lat2:      34.0522,
+			lon2:      -118.2437,
+			expected:  0,
+			tolerance: 0.000001,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := geo.Geodesic(geo.LatLng{Lat: tt.lat1, Lng: tt.lon1}, geo.LatLng{Lat: tt.lat2, Lng: tt.lon2})
+			if !almostEqual(result, tt.expected, tt.tolerance) {
+				t.Errorf("Expected %.6f km, but got %.6f km", tt.expected, result)
+			}
+		})
+	}
+}
+
+// tests selecting a distance func by name
+func TestDistanceFuncFor(t *testing.T) {
+	for _, method := range []string{"", "haversine", "geodesic", "vincenty", "wgs84"} {
+		if _, err := geo.DistanceFuncFor(method); err != nil {
+			t.Errorf("Expected method %q to be supported, got %v", method, err)
+		}
+	}
+
+	if _, err := geo.DistanceFuncFor("flat"); err == nil {
+		t.Errorf("Expected an error for an unknown method")
+	}
+}
+
+// tests coordinate validation
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		lat   float64
+		lng   float64
+		valid bool
+	}{
+		{name: "Valid", lat: 52.2297, lng: 21.0122, valid: true},
+		{name: "Poles and Antimeridian", lat: -90, lng: 180, valid: true},
+		{name: "Latitude Too High", lat: 90.1, lng: 0, valid: false},
+		{name: "Longitude Too Low", lat: 0, lng: -180.5, valid: false},
+		{name: "NaN", lat: math.NaN(), lng: 0, valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := geo.Validate(tt.lat, tt.lng)
+			if (err == nil) != tt.valid {
+				t.Errorf("Expected valid=%v, got error %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+// tests longitude wrapping and -0 handling
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		point    geo.LatLng
+		expected geo.LatLng
+	}{
+		{name: "Unchanged", point: geo.LatLng{Lat: 10, Lng: 20}, expected: geo.LatLng{Lat: 10, Lng: 20}},
+		{name: "Antimeridian", point: geo.LatLng{Lat: 0, Lng: 180}, expected: geo.LatLng{Lat: 0, Lng: -180}},
+		{name: "Wrap East", point: geo.LatLng{Lat: 0, Lng: 190}, expected: geo.LatLng{Lat: 0, Lng: -170}},
+		{name: "Wrap West", point: geo.LatLng{Lat: 0, Lng: -540}, expected: geo.LatLng{Lat: 0, Lng: -180}},
+		{name: "Clamp Latitude", point: geo.LatLng{Lat: 91, Lng: 0}, expected: geo.LatLng{Lat: 90, Lng: 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := geo.Normalize(tt.point)
+			if !almostEqual(result.Lat, tt.expected.Lat, 1e-9) || !almostEqual(result.Lng, tt.expected.Lng, 1e-9) {
+				t.Errorf("Expected %v, got %v", tt.expected, result)
+			}
+		})
+	}
+
+	zero := geo.Normalize(geo.LatLng{Lat: math.Copysign(0, -1), Lng: math.Copysign(0, -1)})
+	if math.Signbit(zero.Lat) || math.Signbit(zero.Lng) {
+		t.Errorf("Expected -0 to be normalized to 0, got %v", zero)
+	}
+}
+
+// tests the bearing and destination point functions
+func TestBearingAndDestination(t *testing.T) {
+	start := geo.LatLng{Lat: 0, Lng: 0}
+
+	if bearing := geo.Bearing(start, geo.LatLng{Lat: 0, Lng: 10}); !almostEqual(bearing, 90, 1e-9) {
+		t.Errorf("Expected bearing 90, got %v", bearing)
+	}
+	if bearing := geo.Bearing(start, geo.LatLng{Lat: -10, Lng: 0}); !almostEqual(bearing, 180, 1e-9) {
+		t.Errorf("Expected bearing 180, got %v", bearing)
+	}
+
+	from := geo.LatLng{Lat: 52.2297, Lng: 21.0122}
+	to := geo.Destination(from, 45, 100)
+	if d := geo.Haversine(from, to); !almostEqual(d, 100, 1e-6) {
+		t.Errorf("Expected destination 100 km away, got %v", d)
+	}
+	if bearing := geo.Bearing(from, to); !almostEqual(bearing, 45, 1e-6) {
+		t.Errorf("Expected bearing 45 to the destination, got %v", bearing)
+	}
+
+	wrapped := geo.Destination(geo.LatLng{Lat: 0, Lng: 179.9}, 90, 50)
+	if wrapped.Lng > -179 || wrapped.Lng < -180 {
+		t.Errorf("Expected destination to wrap across the antimeridian, got %v", wrapped)
+	}
+}
+
+// tests the bounding box around a point
+func TestBoundsAround(t *testing.T) {
+	tests := []struct {
+		name    string
+		center  geo.LatLng
+		radius  float64
+		crosses bool
+		allLng  bool
+		inside  []geo.LatLng
+		outside []geo.LatLng
+	}{
+		{
+			name:    "Warsaw",
+			center:  geo.LatLng{Lat: 52.2297, Lng: 21.0122},
+			radius:  10,
+			inside:  []geo.LatLng{{Lat: 52.2297, Lng: 21.15}, {Lat: 52.3, Lng: 21.0122}},
+			outside: []geo.LatLng{{Lat: 52.2297, Lng: 21.2}, {Lat: 52.4, Lng: 21.0122}},
+		},
+		{
+			name:    "Antimeridian",
+			center:  geo.LatLng{Lat: -17.7, Lng: 179.9},
+			radius:  50,
+			crosses: true,
+			inside:  []geo.LatLng{{Lat: -17.7, Lng: -179.8}, {Lat: -17.7, Lng: 179.6}},
+			outside: []geo.LatLng{{Lat: -17.7, Lng: 0}, {Lat: -17.7, Lng: -179}},
+		},
+		{
+			name:    "North Pole",
+			center:  geo.LatLng{Lat: 89.9, Lng: 0},
+			radius:  50,
+			allLng:  true,
+			inside:  []geo.LatLng{{Lat: 89.8, Lng: 180}, {Lat: 90, Lng: -90}},
+			outside: []geo.LatLng{{Lat: 89, Lng: 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bounds := geo.BoundsAround(tt.center, tt.radius)
+			if bounds.CrossesAntimeridian() != tt.crosses {
+				t.Errorf("Expected crosses=%v, got %v", tt.crosses, bounds)
+			}
+			if tt.allLng && (bounds.SouthWest.Lng != -180 || bounds.NorthEast.Lng != 180) {
+				t.Errorf("Expected bounds to cover all longitudes, got %v", bounds)
+			}
+			for _, p := range tt.inside {
+				if !bounds.Contains(p) {
+					t.Errorf("Expected %v inside %v", p, bounds)
+				}
+			}
+			for _, p := range tt.outside {
+				if bounds.Contains(p) {
+					t.Errorf("Expected %v outside %v", p, bounds)
+				}
+			}
+		})
+	}
+}
+
+// tests widening a bounding box by a distance on every side
+func TestBoundsExpand(t *testing.T) {
+	tests := []struct {
+		name    string
+		bounds  geo.Bounds
+		km      float64
+		crosses bool
+		allLng  bool
+		inside  []geo.LatLng
+		outside []geo.LatLng
+	}{
+		{
+			name:    "New York",
+			bounds:  geo.Bounds{SouthWest: geo.LatLng{Lat: 40.7, Lng: -74.1}, NorthEast: geo.LatLng{Lat: 40.8, Lng: -74}},
+			km:      10,
+			inside:  []geo.LatLng{{Lat: 40.7, Lng: -74.2}, {Lat: 40.88, Lng: -74}, {Lat: 40.62, Lng: -73.9}},
+			outside: []geo.LatLng{{Lat: 40.7, Lng: -74.3}, {Lat: 40.95, Lng: -74}},
+		},
+		{
+			name:    "Across the Antimeridian",
+			bounds:  geo.Bounds{SouthWest: geo.LatLng{Lat: -17.8, Lng: 179.95}, NorthEast: geo.LatLng{Lat: -17.6, Lng: 180}},
+			km:      10,
+			crosses: true,
+			inside:  []geo.LatLng{{Lat: -17.7, Lng: -179.95}, {Lat: -17.7, Lng: 179.9}},
+			outside: []geo.LatLng{{Lat: -17.7, Lng: -179.5}, {Lat: -17.7, Lng: 179.5}},
+		},
+		{
+			name:    "Past the Pole",
+			bounds:  geo.Bounds{SouthWest: geo.LatLng{Lat: 89.9, Lng: 10}, NorthEast: geo.LatLng{Lat: 89.95, Lng: 20}},
+			km:      10,
+			allLng:  true,
+			inside:  []geo.LatLng{{Lat: 90, Lng: -170}, {Lat: 89.85, Lng: 15}},
+			outside: []geo.LatLng{{Lat: 89.7, Lng: 15}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bounds := tt.bounds.Expand(tt.km)
+			if bounds.CrossesAntimeridian() != tt.crosses {
+				t.Errorf("Expected crosses=%v, got %v", tt.crosses, bounds)
+			}
+			if tt.allLng && (bounds.SouthWest.Lng != -180 || bounds.NorthEast.Lng != 180) {
+				t.Errorf("Expected bounds to cover all longitudes, got %v", bounds)
+			}
+			for _, p := range tt.inside {
+				if !bounds.Contains(p) {
+					t.Errorf("Expected %v inside %v", p, bounds)
+				}
+			}
+			for _, p := range tt.outside {
+				if bounds.Contains(p) {
+					t.Errorf("Expected %v outside %v", p, bounds)
+				}
+			}
+		})
+	}
+}
+
+// tests Web-Mercator tile math against known tiles
+func TestTiles(t *testing.T) {
+	warsaw := geo.LatLng{Lat: 52.2297, Lng: 21.0122}
+
+	assert := func(cond bool, format string, args ...interface{}) {
+		t.Helper()
+		if !cond {
+			t.Errorf(format, args...)
+		}
+	}
+
+	assert(geo.TileFor(warsaw, 0) == geo.Tile{Z: 0, X: 0, Y: 0}, "Expected the only tile at zoom 0")
+	tile := geo.TileFor(warsaw, 10)
+	assert(tile == geo.Tile{Z: 10, X: 571, Y: 337}, "Expected tile 10/571/337, got %v", tile)
+	assert(tile.Bounds().Contains(warsaw), "Expected %v to contain %v", tile.Bounds(), warsaw)
+
+	north := geo.TileFor(geo.LatLng{Lat: 89.9, Lng: 180}, 3)
+	assert(north == geo.Tile{Z: 3, X: 0, Y: 0}, "Expected points beyond the projection on the edge tile, got %v", north)
+
+	world := geo.Tile{}.Bounds()
+	assert(almostEqual(world.NorthEast.Lat, geo.MaxMercatorLat, 1e-9) && world.SouthWest.Lng == -180 && world.NorthEast.Lng == 180,
+		"Expected the zoom 0 tile to cover the world, got %v", world)
+
+	if _, err := geo.NewTile(2, 4, 0); err == nil {
+		t.Errorf("Expected an error for a tile outside the map")
+	}
+
+	west := geo.Tile{Z: 2, X: 0, Y: 1}
+	px, _ := west.Pixel(geo.LatLng{Lat: 40, Lng: 179.9}, geo.TileSize)
+	assert(px < 0 && px > -1, "Expected a point across the antimeridian just west of the tile, got %v", px)
+}
+
+// tests parsing of west,south,east,north bounding boxes
+func TestParseBounds(t *testing.T) {
+	bounds, err := geo.ParseBounds("170, -20, -170, -10")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bounds.CrossesAntimeridian() || !bounds.Contains(geo.LatLng{Lat: -15, Lng: 179}) {
+		t.Errorf("Expected bounds crossing the antimeridian, got %v", bounds)
+	}
+
+	for _, bbox := range []string{"", "1,2,3", "a,0,1,1", "0,10,1,5", "0,-91,1,1"} {
+		if _, err := geo.ParseBounds(bbox); err == nil {
+			t.Errorf("Expected an error for %q", bbox)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// package contains unit tests for the packages shared by both services
+package tests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-nauka/grpcauth"
+	pb "go-nauka/location-history-service/grpc/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// a certificate authority issuing test certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+// writes a PEM block to a file in dir and returns its path
+func writePEM(t *testing.T, dir, name, blockType string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// creates a self signed CA and writes its certificate to dir
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, file: writePEM(t, dir, name+".pem", "CERTIFICATE", der)}
+}
+
+// issues a certificate for a common name and DNS names and returns the paths of the certificate and key
+func (ca *testCA) issue(t *testing.T, dir, commonName string, usage x509.ExtKeyUsage, dnsNames ...string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return writePEM(t, dir, commonName+".pem", "CERTIFICATE", der), writePEM(t, dir, commonName+"-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+// a streaming service standing for the calls that need authorization, it answers a stream with one message
+var testStreamService = grpc.ServiceDesc{
+	ServiceName: "tests.Stream",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Watch",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return stream.SendMsg(&healthpb.HealthCheckResponse{})
+		},
+	}},
+}
+
+// starts a history server with the health service on a loopback port and returns its address
+func startTestServer(t *testing.T, config grpcauth.Config) string {
+	options, err := grpcauth.ServerOptions(config)
+	if err != nil {
+		t.Fatalf("Failed to configure server: %v", err)
+	}
+	server := grpc.NewServer(options...)
+	pb.RegisterLocationHistoryServiceServer(server, pb.UnimplementedLocationHistoryServiceServer{})
+	server.RegisterService(&testStreamService, struct{}{})
+	healthpb.RegisterHealthServer(server, health.NewServer())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+// makes a unary call, a streaming call and a health check and returns their status codes
+func callTestServer(t *testing.T, address string, config grpcauth.Config) (codes.Code, codes.Code, codes.Code) {
+	options, err := grpcauth.DialOptions(config)
+	if err != nil {
+		t.Fatalf("Failed to configure client: %v", err)
+	}
+	conn, err := grpc.NewClient(address, options...)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = pb.NewLocationHistoryServiceClient(conn).RecordLocation(ctx, &pb.LocationRequest{Username: "tomek_prus"})
+	unary := status.Code(err)
+
+	stream, err := conn.NewStream(ctx, &testStreamService.Streams[0], "/tests.Stream/Watch")
+	if err == nil {
+		err = stream.SendMsg(&healthpb.HealthCheckRequest{})
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err == nil {
+		err = stream.RecvMsg(&healthpb.HealthCheckResponse{})
+	}
+	streaming := status.Code(err)
+
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return unary, streaming, status.Code(err)
+}
+
+// tests that only clients with an allowed certificate signed by the CA reach the handlers
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "internal-ca")
+	rogueCA := newTestCA(t, dir, "rogue-ca")
+
+	serverCert, serverKey := ca.issue(t, dir, "location-history-service", x509.ExtKeyUsageServerAuth, "localhost")
+	clientCert, clientKey := ca.issue(t, dir, "location-service", x509.ExtKeyUsageClientAuth)
+	otherCert, otherKey := ca.issue(t, dir, "intruder", x509.ExtKeyUsageClientAuth)
+	rogueCert, rogueKey := rogueCA.issue(t, dir, "location-service-rogue", x509.ExtKeyUsageClientAuth, "location-service")
+
+	address := startTestServer(t, grpcauth.Config{
+		CertFile:       serverCert,
+		KeyFile:        serverKey,
+		CAFile:         ca.file,
+		AllowedClients: []string{"location-service"},
+	})
+
+	// health checks pass every client that gets through the TLS handshake
+	tests := []struct {
+		name     string
+		config   grpcauth.Config
+		expected codes.Code
+		health   codes.Code
+	}{
+		{name: "Allowed Client", config: grpcauth.Config{CertFile: clientCert, KeyFile: clientKey, CAFile: ca.file, ServerName: "localhost"}, expected: codes.Unimplemented, health: codes.OK},
+		{name: "Unknown Client", config: grpcauth.Config{CertFile: otherCert, KeyFile: otherKey, CAFile: ca.file, ServerName: "localhost"}, expected: codes.PermissionDenied, health: codes.OK},
+		{name: "Other CA", config: grpcauth.Config{CertFile: rogueCert, KeyFile: rogueKey, CAFile: ca.file, ServerName: "localhost"}, expected: codes.Unavailable, health: codes.Unavailable},
+		{name: "Plaintext", config: grpcauth.Config{Token: "secret"}, expected: codes.Unavailable, health: codes.Unavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unary, stream, check := callTestServer(t, address, tt.config)
+			if unary != tt.expected {
+				t.Errorf("Expected unary call to end with %v, got %v", tt.expected, unary)
+			}
+			// the test stream service answers authorized streams
+			expectedStream := tt.expected
+			if expectedStream == codes.Unimplemented {
+				expectedStream = codes.OK
+			}
+			if stream != expectedStream {
+				t.Errorf("Expected stream to end with %v, got %v", expectedStream, stream)
+			}
+			if check != tt.health {
+				t.Errorf("Expected health check to end with %v, got %v", tt.health, check)
+			}
+		})
+	}
+}
+
+// tests authenticating with the service token on a plaintext channel
+func TestServiceToken(t *testing.T) {
+	address := startTestServer(t, grpcauth.Config{Token: "secret"})
+
+	tests := []struct {
+		name     string
+		token    string
+		expected codes.Code
+	}{
+		{name: "Valid Token", token: "secret", expected: codes.Unimplemented},
+		{name: "Wrong Token", token: "secreT", expected: codes.Unauthenticated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unary, stream, check := callTestServer(t, address, grpcauth.Config{Token: tt.token})
+			if unary != tt.expected {
+				t.Errorf("Expected unary call to end with %v, got %v", tt.expected, unary)
+			}
+			if tt.expected == codes.Unauthenticated && stream != codes.Unauthenticated {
+				t.Errorf("Expected stream to be rejected, got %v", stream)
+			}
+			if check != codes.OK {
+				t.Errorf("Expected health checks to pass without the token, got %v", check)
+			}
+		})
+	}
+
+	if _, err := grpcauth.ServerOptions(grpcauth.Config{}); err == nil {
+		t.Errorf("Expected an error without certificates or token")
+	}
+	if _, err := grpcauth.DialOptions(grpcauth.Config{CertFile: "client.pem"}); err == nil {
+		t.Errorf("Expected an error with an incomplete TLS config")
+	}
+}
@@ -0,0 +1,124 @@
+// package contains unit tests for the packages shared by both services
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-nauka/health"
+
+	"github.com/gin-gonic/gin"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// check with a fixed outcome
+func fixedCheck(detail string, err error) health.CheckFunc {
+	return func(ctx context.Context) (string, error) {
+		return detail, err
+	}
+}
+
+// requests a probe of the checker and returns the status code and the decoded report
+func probe(t *testing.T, checker *health.Checker, path string) (int, health.Report) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/healthz", checker.Liveness)
+	router.GET("/readyz", checker.Readiness)
+
+	req, _ := http.NewRequest("GET", path, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var report health.Report
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode %s: %v", path, err)
+	}
+	return w.Code, report
+}
+
+// tests that critical checks decide readiness, others only degrade it, and that liveness ignores them
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name           string
+		critical       error
+		optional       error
+		expectedStatus string
+		expectedCode   int
+	}{
+		{name: "All Passing", expectedStatus: health.StatusOK, expectedCode: http.StatusOK},
+		{name: "Optional Failing", optional: errors.New("connection TRANSIENT_FAILURE"), expectedStatus: health.StatusDegraded, expectedCode: http.StatusOK},
+		{name: "Critical Failing", critical: errors.New("connection refused"), expectedStatus: health.StatusFailing, expectedCode: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := &health.Checker{Timeout: time.Second}
+			checker.Add("mysql", true, fixedCheck("1 open connections", tt.critical))
+			checker.Add("history_grpc", false, fixedCheck("READY", tt.optional))
+
+			code, report := probe(t, checker, "/readyz")
+			if code != tt.expectedCode || report.Status != tt.expectedStatus {
+				t.Errorf("Expected %d %s, got %d %s", tt.expectedCode, tt.expectedStatus, code, report.Status)
+			}
+			if mysql := report.Checks["mysql"]; !mysql.Critical || mysql.Detail != "1 open connections" {
+				t.Errorf("Expected the mysql result in the report, got %+v", mysql)
+			}
+			if code, _ := probe(t, checker, "/healthz"); code != http.StatusOK {
+				t.Errorf("Expected liveness to pass, got %d", code)
+			}
+		})
+	}
+}
+
+// tests that shutting down fails readiness and stops the grpc health service from serving
+func TestShutdown(t *testing.T) {
+	checker := &health.Checker{Timeout: time.Second}
+	checker.Add("mysql", true, fixedCheck("", nil))
+	server := grpchealth.NewServer()
+	checker.Serve(server, time.Hour, "location.LocationHistoryService")
+
+	ctx := context.Background()
+	for _, service := range []string{"", "location.LocationHistoryService"} {
+		resp, err := server.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("Expected %q to be serving, got %v %v", service, resp, err)
+		}
+	}
+
+	checker.Shutdown()
+	if code, report := probe(t, checker, "/readyz"); code != http.StatusServiceUnavailable || !report.ShuttingDown {
+		t.Errorf("Expected readiness to fail while shutting down, got %d %+v", code, report)
+	}
+	resp, err := server.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil || resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected the grpc health service to stop serving, got %v %v", resp, err)
+	}
+}
+
+// tests that a job check fails after a failed run and when no run finished for two intervals
+func TestJobCheck(t *testing.T) {
+	now := time.Date(2024, 1, 16, 10, 0, 0, 0, time.UTC)
+	job := &health.Job{Interval: time.Hour, Now: func() time.Time { return now }}
+
+	if _, err := job.Check(context.Background()); err != nil {
+		t.Errorf("Expected a job that has not run yet to pass, got %v", err)
+	}
+	job.Done(errors.New("deadlock"))
+	if _, err := job.Check(context.Background()); err == nil {
+		t.Errorf("Expected a failed run to fail the check")
+	}
+	job.Done(nil)
+	if detail, err := job.Check(context.Background()); err != nil || detail != "last run 2024-01-16T10:00:00Z" {
+		t.Errorf("Expected a passing check, got %q %v", detail, err)
+	}
+	now = now.Add(3 * time.Hour)
+	if _, err := job.Check(context.Background()); err == nil {
+		t.Errorf("Expected a stale job to fail the check")
+	}
+}
@@ -0,0 +1,157 @@
+// package contains unit tests for the packages shared by both services
+package tests
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-nauka/jwtauth"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// returns a JWKS document holding the public key under the given key id
+func jwksFor(key *rsa.PublicKey, kid string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "EC", "kid": "ignored", "crv": "P-256"},
+			{
+				"kty": "RSA",
+				"kid": kid,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			},
+		},
+	})
+	return data
+}
+
+// signs claims with a method and key, setting the key id when it is not empty
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+// tests validating HS256 and RS256 tokens minted locally
+func TestVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, jwksFor(&rsaKey.PublicKey, "key-1"), 0o600); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+
+	secret := []byte("hs256-secret")
+	verifier, err := jwtauth.NewVerifier(jwtauth.Config{HMACSecret: secret, JWKSFile: jwksFile, Issuer: "auth.example", Audience: "locations"})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+
+	claims := func(subject string, expiresIn time.Duration, scope string) jwtauth.Claims {
+		return jwtauth.Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   subject,
+				Issuer:    "auth.example",
+				Audience:  jwt.ClaimStrings{"locations"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+			},
+			Scope: scope,
+		}
+	}
+	noExpiry := claims("john_doe", time.Hour, "")
+	noExpiry.ExpiresAt = nil
+	wrongAudience := claims("john_doe", time.Hour, "")
+	wrongAudience.Audience = jwt.ClaimStrings{"billing"}
+
+	tests := []struct {
+		name        string
+		token       string
+		expectedSub string
+	}{
+		{name: "HS256", token: sign(t, jwt.SigningMethodHS256, secret, "", claims("john_doe", time.Hour, "")), expectedSub: "john_doe"},
+		{name: "RS256", token: sign(t, jwt.SigningMethodRS256, rsaKey, "key-1", claims("jane_doe", time.Hour, "")), expectedSub: "jane_doe"},
+		{name: "Within Leeway", token: sign(t, jwt.SigningMethodHS256, secret, "", claims("john_doe", -10*time.Second, "")), expectedSub: "john_doe"},
+		{name: "Expired", token: sign(t, jwt.SigningMethodHS256, secret, "", claims("john_doe", -time.Hour, ""))},
+		{name: "No Expiry", token: sign(t, jwt.SigningMethodHS256, secret, "", noExpiry)},
+		{name: "No Subject", token: sign(t, jwt.SigningMethodHS256, secret, "", claims("", time.Hour, ""))},
+		{name: "Wrong Secret", token: sign(t, jwt.SigningMethodHS256, []byte("other"), "", claims("john_doe", time.Hour, ""))},
+		{name: "Wrong Audience", token: sign(t, jwt.SigningMethodHS256, secret, "", wrongAudience)},
+		{name: "Unknown Key Id", token: sign(t, jwt.SigningMethodRS256, rsaKey, "key-2", claims("jane_doe", time.Hour, ""))},
+		{name: "Wrong RSA Key", token: sign(t, jwt.SigningMethodRS256, otherKey, "key-1", claims("jane_doe", time.Hour, ""))},
+		{name: "Unsigned", token: sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", claims("john_doe", time.Hour, ""))},
+		{name: "HS384", token: sign(t, jwt.SigningMethodHS384, secret, "", claims("john_doe", time.Hour, ""))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifier.Verify(tt.token)
+			if tt.expectedSub == "" {
+				if err == nil {
+					t.Errorf("Expected the token to be rejected, got %+v", got)
+				}
+				return
+			}
+			if err != nil || got.Subject != tt.expectedSub {
+				t.Errorf("Expected subject %s, got %+v %v", tt.expectedSub, got, err)
+			}
+		})
+	}
+}
+
+// tests that a verifier with only RSA keys rejects HS256 tokens signed with the public key
+func TestVerifierAlgorithmConfusion(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys, err := jwtauth.ParseJWKS(jwksFor(&rsaKey.PublicKey, "key-1"))
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Expected one RSA key, got %v %v", keys, err)
+	}
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(jwksFile, jwksFor(&rsaKey.PublicKey, "key-1"), 0o600)
+	verifier, err := jwtauth.NewVerifier(jwtauth.Config{JWKSFile: jwksFile})
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+
+	claims := jwt.RegisteredClaims{Subject: "john_doe", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	if _, err := verifier.Verify(sign(t, jwt.SigningMethodHS256, rsaKey.PublicKey.N.Bytes(), "key-1", claims)); err == nil {
+		t.Errorf("Expected an HS256 token to be rejected")
+	}
+	// a set with a single key does not need the key id
+	if got, err := verifier.Verify(sign(t, jwt.SigningMethodRS256, rsaKey, "", claims)); err != nil || got.Subject != "john_doe" {
+		t.Errorf("Expected the token to be accepted, got %+v %v", got, err)
+	}
+
+	if _, err := jwtauth.NewVerifier(jwtauth.Config{}); err == nil {
+		t.Errorf("Expected an error without any keys")
+	}
+}
+
+// tests parsing the space separated scopes of a token
+func TestScopes(t *testing.T) {
+	claims := jwtauth.Claims{Scope: "read admin  write"}
+	for scope, expected := range map[string]bool{"admin": true, "read": true, "write": true, "adm": false, "": false} {
+		if got := claims.HasScope(scope); got != expected {
+			t.Errorf("Expected HasScope(%q) to be %v", scope, expected)
+		}
+	}
+}
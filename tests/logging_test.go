@@ -0,0 +1,203 @@
+// package contains unit tests for the packages shared by both services
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"go-nauka/config"
+	"go-nauka/logging"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// sets up logging into a buffer for the test, restoring the default output afterwards
+func captureLogs(t *testing.T, settings config.Logging) *bytes.Buffer {
+	var buf bytes.Buffer
+	if err := logging.Setup("test-service", settings, &buf); err != nil {
+		t.Fatalf("Failed to set up logging: %v", err)
+	}
+	t.Cleanup(func() {
+		logging.Setup("test-service", config.Logging{Level: "info", Format: "text"}, os.Stderr)
+	})
+	return &buf
+}
+
+// returns the JSON records written to the buffer
+func records(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var found []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected a JSON record, got %q", line)
+		}
+		found = append(found, record)
+	}
+	return found
+}
+
+// tests that package levels override the service level and that usernames and coordinates are redacted
+func TestLoggingLevelsAndRedaction(t *testing.T) {
+	buf := captureLogs(t, config.Logging{
+		Level:    "warn",
+		Format:   "json",
+		Packages: []string{"grpc=debug"},
+		Redact:   []string{logging.RedactUsernames, logging.RedactCoordinates},
+	})
+
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	logging.For("grpc").DebugContext(ctx, "Recorded location", "username", "tomek_prus", "latitude", 40.7128, "longitude", -74.0060)
+	logging.For("handlers").Info("Dropped below the service level")
+	logging.For("handlers").Warn("Kept at the service level", "records", 3)
+
+	found := records(t, buf)
+	if len(found) != 2 {
+		t.Fatalf("Expected 2 records, got %d: %s", len(found), buf.String())
+	}
+
+	tests := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{name: "Package", got: found[0]["package"], expected: "grpc"},
+		{name: "Service", got: found[0]["service"], expected: "test-service"},
+		{name: "Request ID", got: found[0]["request_id"], expected: "req-1"},
+		{name: "Username", got: found[0]["username"], expected: logging.HashUsername("tomek_prus")},
+		{name: "Latitude", got: found[0]["latitude"], expected: "<redacted>"},
+		{name: "Longitude", got: found[0]["longitude"], expected: "<redacted>"},
+		{name: "Level", got: found[1]["level"], expected: "WARN"},
+		{name: "Other Attributes", got: found[1]["records"], expected: 3.0},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, tt.got)
+		}
+	}
+	if strings.Contains(buf.String(), "tomek_prus") {
+		t.Errorf("Expected the username to be redacted, got %s", buf.String())
+	}
+}
+
+// tests that username pseudonyms depend on the redact secret, so they can't be matched by hashing candidate usernames
+func TestLoggingUsernameKey(t *testing.T) {
+	pseudonym := func(secret string) string {
+		captureLogs(t, config.Logging{Level: "info", Format: "json", Redact: []string{logging.RedactUsernames}, RedactSecret: secret})
+		return logging.HashUsername("tomek_prus")
+	}
+
+	first := pseudonym("first-secret")
+	if again := pseudonym("first-secret"); again != first {
+		t.Errorf("Expected the same pseudonym with the same secret, got %s and %s", first, again)
+	}
+	if other := pseudonym("other-secret"); other == first {
+		t.Errorf("Expected another pseudonym with another secret, got %s for both", first)
+	}
+	if random := pseudonym(""); random == first || random == pseudonym("") {
+		t.Errorf("Expected a random key without a secret, got %s", random)
+	}
+}
+
+// tests that values are logged as they are without redaction
+func TestLoggingWithoutRedaction(t *testing.T) {
+	buf := captureLogs(t, config.Logging{Level: "info", Format: "json"})
+
+	logging.For("db").Info("Updated location", "username", "tomek_prus", "latitude", 40.7128)
+
+	found := records(t, buf)
+	if len(found) != 1 || found[0]["username"] != "tomek_prus" || found[0]["latitude"] != 40.7128 {
+		t.Errorf("Expected the username and coordinates to be logged, got %s", buf.String())
+	}
+}
+
+// tests that the request id of a REST request is returned, logged and sent to the grpc server in the metadata
+func TestRequestIDPropagation(t *testing.T) {
+	buf := captureLogs(t, config.Logging{Level: "info", Format: "json"})
+
+	var received string
+	capture := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		received = logging.RequestID(ctx)
+		return handler(ctx, req)
+	}
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(logging.UnaryServerInterceptor, capture))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(logging.UnaryClientInterceptor))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(logging.Middleware())
+	router.POST("/locations", func(c *gin.Context) {
+		if _, err := healthpb.NewHealthClient(conn).Check(c.Request.Context(), &healthpb.HealthCheckRequest{}); err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusCreated)
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "Caller ID", header: "3f2b9c1e-7a4d-4e8b-9c21-5d6e7f8a9b0c", keep: true},
+		{name: "Missing ID", header: ""},
+		{name: "Invalid ID", header: "has spaces in it"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			req, _ := http.NewRequest("POST", "/locations", nil)
+			if tt.header != "" {
+				req.Header.Set(logging.RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Expected 201, got %d", w.Code)
+			}
+
+			id := w.Header().Get(logging.RequestIDHeader)
+			if tt.keep && id != tt.header {
+				t.Errorf("Expected the callers id %q, got %q", tt.header, id)
+			}
+			if !tt.keep && (len(id) != 32 || id == tt.header) {
+				t.Errorf("Expected a new id, got %q", id)
+			}
+			if received != id {
+				t.Errorf("Expected the grpc server to receive %q, got %q", id, received)
+			}
+
+			found := records(t, buf)
+			if len(found) != 1 || found[0]["request_id"] != id || found[0]["route"] != "/locations" || found[0]["status"] != 201.0 {
+				t.Errorf("Expected the request to be logged with its id, got %s", buf.String())
+			}
+		})
+	}
+}
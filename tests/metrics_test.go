@@ -0,0 +1,63 @@
+// package contains unit tests for the packages shared by both services
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-nauka/metrics"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// returns the metrics served by the handler in the prometheus text format
+func scrape(t *testing.T, router *gin.Engine) string {
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected metrics to be served, got %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+// tests that requests are counted by route template, and that queries and grpc calls are recorded
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(metrics.Middleware())
+	router.GET("/metrics", metrics.Handler())
+	router.GET("/history/heatmap/:z/:x/:y", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	for _, path := range []string{"/history/heatmap/1/0/0", "/history/heatmap/2/1/1", "/unknown"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	metrics.ObserveQuery("GetUserLocations", time.Now().Add(-20*time.Millisecond))
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/location.LocationHistoryService/RecordLocation"}
+	metrics.UnaryServerInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Unauthenticated, "missing client certificate or service token")
+	})
+
+	scraped := scrape(t, router)
+	for _, expected := range []string{
+		`http_requests_total{code="204",method="GET",route="/history/heatmap/:z/:x/:y"} 2`,
+		`http_requests_total{code="404",method="GET",route="unmatched"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/history/heatmap/:z/:x/:y"} 2`,
+		`db_query_duration_seconds_bucket{function="GetUserLocations",le="0.025"} 1`,
+		`grpc_server_handled_total{code="Unauthenticated",method="/location.LocationHistoryService/RecordLocation"} 1`,
+	} {
+		if !strings.Contains(scraped, expected) {
+			t.Errorf("Expected %s in the metrics", expected)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// package contains unit tests for the packages shared by both services
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"go-nauka/retention/policy"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tests the policy.Parse func
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        string
+		tiers       []policy.Tier
+		deleteAfter time.Duration
+		wantErr     bool
+	}{
+		{
+			name:        "Tiers And Delete",
+			spec:        "365d=delete, 30d=5m, 90d=1h",
+			tiers:       []policy.Tier{{After: 30 * 24 * time.Hour, Interval: 5 * time.Minute}, {After: 90 * 24 * time.Hour, Interval: time.Hour}},
+			deleteAfter: 365 * 24 * time.Hour,
+		},
+		{
+			name: "Empty Policy",
+			spec: "",
+		},
+		{
+			name:    "Missing Interval",
+			spec:    "30d",
+			wantErr: true,
+		},
+		{
+			name:    "Tier After Delete",
+			spec:    "30d=delete,60d=5m",
+			wantErr: true,
+		},
+		{
+			name:    "Coarser Tier Before Finer",
+			spec:    "30d=1h,60d=5m",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := policy.Parse(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			assert.Equal(t, tt.tiers, parsed.Tiers)
+			assert.Equal(t, tt.deleteAfter, parsed.DeleteAfter)
+		})
+	}
+}
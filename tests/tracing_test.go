@@ -0,0 +1,128 @@
+// package contains unit tests for the packages shared by both services
+package tests
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-nauka/tracing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// records the spans of the test in memory, restoring the global provider afterwards
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	return recorder
+}
+
+// returns the ended span with the name, failing the test when there is none
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+	t.Fatalf("Expected a %q span", name)
+	return nil
+}
+
+// tests that a request continues the trace of its traceparent header and database spans are its children
+func TestTracingMiddleware(t *testing.T) {
+	recorder := recordSpans(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(tracing.Middleware())
+	router.GET("/history/stats", func(c *gin.Context) {
+		_, span := tracing.StartQuery(c.Request.Context(), "GetDailyStatsRange")
+		span.End()
+		c.Status(http.StatusInternalServerError)
+	})
+
+	req, _ := http.NewRequest("GET", "/history/stats", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	server := endedSpan(t, recorder, "GET /history/stats")
+	if server.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Expected the request span to continue the callers trace, got %v parent %v", server.SpanContext(), server.Parent())
+	}
+	if server.Status().Code != codes.Error {
+		t.Errorf("Expected a 500 to mark the span failed, got %v", server.Status())
+	}
+	query := endedSpan(t, recorder, "GetDailyStatsRange")
+	if query.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("Expected the query span to be a child of the request span")
+	}
+}
+
+// tests that the trace context travels from a client call to the server in the grpc metadata
+func TestTracingGRPC(t *testing.T) {
+	recorder := recordSpans(t)
+
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(tracing.UnaryServerInterceptor))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient(listener.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithChainUnaryInterceptor(tracing.UnaryClientInterceptor))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "POST /locations")
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Failed to call the server: %v", err)
+	}
+	parent.End()
+	server.GracefulStop()
+
+	var client, handled sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() != "grpc.health.v1.Health/Check" {
+			continue
+		}
+		switch span.SpanKind() {
+		case trace.SpanKindClient:
+			client = span
+		case trace.SpanKindServer:
+			handled = span
+		}
+	}
+	if client == nil || handled == nil {
+		t.Fatalf("Expected a client and a server span")
+	}
+	if client.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Expected the client span to be a child of the request span")
+	}
+	if handled.SpanContext().TraceID() != parent.SpanContext().TraceID() || handled.Parent().SpanID() != client.SpanContext().SpanID() {
+		t.Errorf("Expected the server span to continue the trace of the client span")
+	}
+}